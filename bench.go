@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+// benchMaxSamples bounds how many latencies are kept to compute the percentiles.
+const benchMaxSamples = 1_000_000
+
+// benchMinLineSize fits the time a line was sent, in nanoseconds, a space and the
+// newline.
+const benchMinLineSize = 21
+
+// benchClient is a synthetic client of the benchmark.
+type benchClient struct {
+	received atomic.Uint64
+	// done is set once the client stopped receiving.
+	done atomic.Bool
+	// samples are the latencies of every sampleEvery-th message.
+	samples []time.Duration
+	err     error
+}
+
+// bench runs an in-process server broadcasting synthetic lines to synthetic
+// clients over loopback TCP, and reports throughput, latency and drops.
+func bench(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	clients := flags.Int("clients", 100, "How many clients receive the stream")
+	var rate float64 = 10_000
+	flags.Func("rate", "How many lines are broadcast per second, e.g. 50k or 50k-lines/s (default 10k)", func(s string) error {
+		var err error
+		rate, err = parseRate(s)
+		return err
+	})
+	duration := flags.Duration("duration", 10*time.Second, "How long lines are broadcast")
+	lineSize := flags.Int("line-size", 100, "How many bytes a line has, newline included")
+	codec := flags.String("codec", string(teecp.FeatureFramed), "The codec clients negotiate: codec/framed, codec/json or plain")
+	via := flags.String("via", "", "Have the clients connect through a proxy, relaying with \"proxy\" or forwarding bytes with \"passthrough\"")
+	coalesceDelay := flags.Duration("coalesce-delay", teecp.DefaultCoalesceDelay, "How long lines wait for the following ones to share a write, 0 writing every line right away")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *clients < 1 || rate <= 0 {
+		return errors.New("clients and rate must be positive")
+	}
+	if *lineSize < benchMinLineSize {
+		return fmt.Errorf("lines must have at least %d bytes to carry when they were sent", benchMinLineSize)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	server := &teecp.Server{CoalesceDelay: *coalesceDelay}
+	if *coalesceDelay == 0 {
+		server.CoalesceDelay = -1
+	}
+	connected := make(chan struct{}, *clients+1)
+	notify := func(*teecp.Handle) { connected <- struct{}{} }
+	server.OnClientConnect(notify)
+	waitFor := *clients
+	go server.Serve(ctx, ln)
+
+	addr := ln.Addr().String()
+	if *via != "" {
+		proxyLn, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return err
+		}
+		upstream := addr
+		proxy := &teecp.Proxy{
+			Dial: func(ctx context.Context) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "tcp", upstream)
+			},
+			Client: teecp.Client{Features: []teecp.Feature{teecp.FeatureFramed}},
+		}
+		switch *via {
+		case "proxy":
+			// The proxy connects to the server as well.
+			proxy.Server.CoalesceDelay = server.CoalesceDelay
+			proxy.Server.OnClientConnect(notify)
+			waitFor++
+		case "passthrough":
+			proxy.Passthrough = true
+		default:
+			return fmt.Errorf("invalid via %q", *via)
+		}
+		go proxy.Run(ctx, proxyLn)
+		addr = proxyLn.Addr().String()
+	}
+
+	expected := uint64(rate * duration.Seconds())
+	sampleEvery := max(1, expected*uint64(*clients)/benchMaxSamples)
+
+	var features []teecp.Feature
+	if *codec != "plain" {
+		features = []teecp.Feature{teecp.Feature(*codec)}
+	}
+	results := make([]*benchClient, *clients)
+	var wg sync.WaitGroup
+	for i := range results {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return err
+		}
+		c := &benchClient{}
+		results[i] = c
+		client := teecp.Client{Features: features}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer c.done.Store(true)
+			c.err = client.ReceiveMessages(ctx, conn, func(m teecp.Message) error {
+				if c.received.Add(1)%sampleEvery == 0 {
+					stamp, _, _ := bytes.Cut(m.Data, []byte(" "))
+					nanos, _ := strconv.ParseInt(string(stamp), 10, 64)
+					c.samples = append(c.samples, time.Since(time.Unix(0, nanos)))
+				}
+				return nil
+			})
+		}()
+	}
+	for range waitFor {
+		select {
+		case <-connected:
+		case <-time.After(10 * time.Second):
+			return errors.New("clients did not connect in time")
+		}
+	}
+	fmt.Fprintf(os.Stderr, "broadcasting %.0f lines/s of %d bytes to %d clients for %s\n", rate, *lineSize, *clients, *duration)
+
+	start := time.Now()
+	sent := benchBroadcast(server, rate, *duration, *lineSize)
+	elapsed := time.Since(start)
+
+	// Give the clients a moment to catch up before counting the drops.
+	drain := time.Now().Add(5 * time.Second)
+	for time.Now().Before(drain) && !benchDrained(results, sent) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	received := uint64(0)
+	for _, c := range results {
+		received += c.received.Load()
+	}
+	cancel()
+	wg.Wait()
+
+	var samples []time.Duration
+	disconnected := 0
+	for _, c := range results {
+		samples = append(samples, c.samples...)
+		if c.err != nil && !errors.Is(c.err, context.Canceled) {
+			disconnected++
+		}
+	}
+	slices.Sort(samples)
+
+	fmt.Printf("sent:         %d lines in %s (%.0f lines/s)\n", sent, elapsed.Round(time.Millisecond), float64(sent)/elapsed.Seconds())
+	fmt.Printf("delivered:    %d lines (%.0f lines/s, %.1f MB/s)\n", received, float64(received)/elapsed.Seconds(), float64(received)*float64(*lineSize)/elapsed.Seconds()/1e6)
+	fmt.Printf("dropped:      %d lines, %d clients disconnected\n", sent*uint64(*clients)-received, disconnected)
+	if len(samples) > 0 {
+		fmt.Printf("latency:      p50 %s, p90 %s, p99 %s, max %s\n", percentile(samples, 50), percentile(samples, 90), percentile(samples, 99), samples[len(samples)-1])
+	}
+	return nil
+}
+
+// benchBroadcast writes lines to the server at rate for duration, in chunks like
+// those read from stdin, and returns how many were written. Every line starts with
+// the Unix time it was sent at, in nanoseconds, and is padded to size.
+func benchBroadcast(server *teecp.Server, rate float64, duration time.Duration, size int) uint64 {
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+
+	var sent uint64
+	var line, chunk []byte
+	start := time.Now()
+	for now := range ticker.C {
+		elapsed := min(now.Sub(start), duration)
+		due := uint64(rate * elapsed.Seconds())
+
+		line = strconv.AppendInt(line[:0], time.Now().UnixNano(), 10)
+		line = append(line, ' ')
+		for len(line) < size-1 {
+			line = append(line, 'x')
+		}
+		line = append(line, '\n')
+
+		chunk = chunk[:0]
+		for ; sent < due; sent++ {
+			chunk = append(chunk, line...)
+		}
+		if len(chunk) > 0 {
+			server.Write(chunk)
+		}
+		if elapsed >= duration {
+			return sent
+		}
+	}
+	return sent
+}
+
+func benchDrained(clients []*benchClient, sent uint64) bool {
+	for _, c := range clients {
+		if !c.done.Load() && c.received.Load() < sent {
+			return false
+		}
+	}
+	return true
+}
+
+// percentile returns the p-th percentile of the sorted durations.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+// parseRate reads a rate of lines per second such as 50000, 50k, 1.5M or
+// 50k-lines/s.
+func parseRate(s string) (float64, error) {
+	number := strings.TrimSuffix(strings.TrimSuffix(s, "/s"), "-lines")
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(number, "k"):
+		multiplier, number = 1e3, strings.TrimSuffix(number, "k")
+	case strings.HasSuffix(number, "M"):
+		multiplier, number = 1e6, strings.TrimSuffix(number, "M")
+	}
+	rate, err := strconv.ParseFloat(number, 64)
+	if err != nil || rate <= 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return rate * multiplier, nil
+}
@@ -0,0 +1,11 @@
+//go:build !unix && !windows
+
+package main
+
+// failOnBrokenPipe does nothing: there is no SIGPIPE on this platform.
+func failOnBrokenPipe() {}
+
+// isBrokenPipe cannot tell a closed pipe on this platform.
+func isBrokenPipe(error) bool {
+	return false
+}
@@ -0,0 +1,20 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os/signal"
+	"syscall"
+)
+
+// failOnBrokenPipe makes writes to a closed stdout fail with EPIPE instead of
+// killing the process.
+func failOnBrokenPipe() {
+	signal.Ignore(syscall.SIGPIPE)
+}
+
+// isBrokenPipe tells if err comes from writing to a pipe whose reader is gone.
+func isBrokenPipe(err error) bool {
+	return errors.Is(err, syscall.EPIPE)
+}
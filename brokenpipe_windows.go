@@ -0,0 +1,17 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// errorNoData is what writing to a pipe being closed fails with.
+const errorNoData = syscall.Errno(232)
+
+// failOnBrokenPipe does nothing: writes to a closed pipe just fail on Windows.
+func failOnBrokenPipe() {}
+
+// isBrokenPipe tells if err comes from writing to a pipe whose reader is gone.
+func isBrokenPipe(err error) bool {
+	return errors.Is(err, syscall.ERROR_BROKEN_PIPE) || errors.Is(err, errorNoData)
+}
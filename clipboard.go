@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// clipboardCommands are the tools copying their input to the clipboard, by
+// platform, the first one found being used.
+var clipboardCommands = map[string][][]string{
+	"darwin":  {{"pbcopy"}},
+	"windows": {{"clip"}},
+	"":        {{"wl-copy"}, {"xclip", "-selection", "clipboard"}, {"xsel", "--clipboard", "--input"}},
+}
+
+// copyToClipboard puts text in the system clipboard. Without a clipboard tool, the
+// OSC 52 escape sequence asks the terminal on stderr to do it, which also works
+// through SSH.
+func copyToClipboard(text []byte) error {
+	commands, ok := clipboardCommands[runtime.GOOS]
+	if !ok {
+		commands = clipboardCommands[""]
+	}
+	for _, args := range commands {
+		if runtime.GOOS != "darwin" && args[0] == "wl-copy" && os.Getenv("WAYLAND_DISPLAY") == "" {
+			continue
+		}
+		if _, err := exec.LookPath(args[0]); err != nil {
+			continue
+		}
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.Stdin = bytes.NewReader(text)
+		return cmd.Run()
+	}
+
+	if info, err := os.Stderr.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return errors.New("no clipboard tool found and stderr is not a terminal")
+	}
+	_, err := fmt.Fprintf(os.Stderr, "\x1b]52;c;%s\a", base64.StdEncoding.EncodeToString(text))
+	return err
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffque/teecp/sink"
+	"github.com/jeffque/teecp/teecp"
+)
+
+// streamFlags are the flags shaping the broadcast: its filters and transforms,
+// in the order given, and its sinks. A --config file holds them as well.
+type streamFlags struct {
+	middlewares []teecp.Middleware
+	// tag is the last --tag, describing the stream to OTLP collectors and
+	// templates.
+	tag   string
+	sinks []string
+	// bind hands the server to the middlewares needing it, once it is set up,
+	// along with the index of the first of middlewares in its chain: the
+	// --plugin modules report their failures to its logger and --dedup-window
+	// broadcasts the counts of the repeats with it, through what follows it.
+	bind []func(server *teecp.Server, first int)
+	// closers release what the middlewares hold once they are replaced: the
+	// runtimes of the --plugin modules and the timers of --dedup-window.
+	closers []func() error
+}
+
+// close releases the middlewares, no longer in use.
+func (f *streamFlags) close() error {
+	var errs []error
+	for _, c := range f.closers {
+		errs = append(errs, c())
+	}
+	return errors.Join(errs...)
+}
+
+// define declares the stream flags on fs.
+func (f *streamFlags) define(fs *flag.FlagSet) {
+	fs.Func("filter", "Only broadcast lines matching the regex, may be repeated (requires --server)", middlewareFlag(&f.middlewares, regexpMiddleware(teecp.Filter)))
+	fs.Func("exclude", "Do not broadcast lines matching the regex, may be repeated (requires --server)", middlewareFlag(&f.middlewares, regexpMiddleware(teecp.Exclude)))
+	fs.Func("redact", "Replace matches of the regex with [REDACTED], may be repeated (requires --server)", middlewareFlag(&f.middlewares, regexpMiddleware(redactMiddleware)))
+	fs.Func("sub", "Substitute like sed with s/regex/replacement/[gi], may be repeated (requires --server)", middlewareFlag(&f.middlewares, subMiddleware))
+	fs.Func("json-select", "Only keep the comma separated fields of JSON lines, e.g. time,level,msg (requires --server)", middlewareFlag(&f.middlewares, func(s string) (teecp.Middleware, error) {
+		return teecp.JSONSelect(strings.Split(s, ",")...), nil
+	}))
+	fs.Func("json-where", "Only broadcast the JSON lines for which the condition holds, e.g. 'level==\"error\"' or 'status>=500', may be repeated (requires --server)", middlewareFlag(&f.middlewares, teecp.JSONWhere))
+	fs.Func("filter-expr", "Only broadcast lines for which the expression of line and json holds, e.g. 'line contains \"ERROR\" && !(line matches \"retryable\")', may be repeated (requires --server)", middlewareFlag(&f.middlewares, teecp.FilterExpr))
+	fs.Func("plugin", "Filter and transform lines with a WebAssembly module exporting memory, alloc and filter, may be repeated (requires --server)", middlewareFlag(&f.middlewares, func(s string) (teecp.Middleware, error) {
+		plugin, err := teecp.LoadPlugin(context.Background(), s, os.Stderr, os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		f.bind = append(f.bind, func(server *teecp.Server, _ int) { plugin.Logger = server.Logger })
+		f.closers = append(f.closers, plugin.Close)
+		return plugin.Middleware(), nil
+	}))
+	fs.Func("dedup-window", "Collapse the identical lines coming within the duration, e.g. 10s, the next one after it, or the first one again once it is over, telling how many were dropped; before --timestamp, which makes every line different (requires --server)", middlewareFlag(&f.middlewares, func(s string) (teecp.Middleware, error) {
+		window, err := time.ParseDuration(s)
+		if err != nil {
+			return nil, err
+		}
+		if window <= 0 {
+			return nil, errors.New("the window must be positive")
+		}
+		// The counts go through the middlewares after this one only, having
+		// been through those before it already.
+		var emit func(line []byte)
+		var closed atomic.Bool
+		index := len(f.middlewares)
+		f.bind = append(f.bind, func(server *teecp.Server, first int) {
+			emit = func(line []byte) { server.Emit(first+index, append(line, '\n')) }
+		})
+		f.closers = append(f.closers, func() error {
+			closed.Store(true)
+			return nil
+		})
+		return teecp.Dedup(window, func(line []byte) {
+			if emit != nil && !closed.Load() {
+				emit(line)
+			}
+		}), nil
+	}))
+	fs.Func("adaptive-sample", "Keep about the rate of lines at most, e.g. target=5k-lines/s, only one line in a few being broadcast while the input comes faster, and every line again once the load drops (requires --server)", middlewareFlag(&f.middlewares, func(s string) (teecp.Middleware, error) {
+		target, err := parseRate(strings.TrimPrefix(s, "target="))
+		if err != nil {
+			return nil, err
+		}
+		return teecp.AdaptiveSample(target), nil
+	}))
+	fs.BoolFunc("timestamp", "Prefix lines with the time they were read, optionally with a Go time layout (requires --server)", middlewareFlag(&f.middlewares, timestampMiddleware))
+	fs.Func("tag", "Prefix lines with [tag] (requires --server)", middlewareFlag(&f.middlewares, func(s string) (teecp.Middleware, error) {
+		f.tag = s
+		return tagMiddleware(s)
+	}))
+	fs.Func("sink", fmt.Sprintf("Also forward the broadcast to the sink URL, may be repeated; schemes are %v (requires --server)", sink.Schemes()), func(s string) error {
+		f.sinks = append(f.sinks, s)
+		return nil
+	})
+}
+
+// loadConfig reads the stream flags of a --config file, one per line: the name
+// of the flag without dashes, then its value after a space or =, e.g.
+// "filter ERROR" or "sink=file:///var/log/build.log". Blank lines and lines
+// starting with # are skipped. Every invalid line is reported.
+func loadConfig(path string) (*streamFlags, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &streamFlags{}
+	fs := flag.NewFlagSet(path, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	config.define(fs)
+
+	var errs []error
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value := line, ""
+		if end := strings.IndexAny(line, " \t="); end >= 0 {
+			name, value = line[:end], strings.TrimSpace(line[end+1:])
+		}
+
+		f := fs.Lookup(name)
+		if f == nil {
+			errs = append(errs, fmt.Errorf("%s:%d: unknown setting %q", path, i+1, name))
+			continue
+		}
+		// Like on the command line, a boolean flag alone is set.
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() && value == "" {
+			value = "true"
+		}
+		if err := fs.Set(name, value); err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %s: %w", path, i+1, name, err))
+		}
+	}
+	return config, errors.Join(errs...)
+}
+
+// check validates a --config file for deployment pipelines: every line is
+// parsed, its regexes and expressions compiled and the hosts of its sinks
+// resolved, without opening anything. Every problem is reported.
+func check(args []string) error {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	path := flags.String("config", "", "The config file to check")
+	templateText := flags.String("template", "", "Also check the --template the config goes with")
+	timeout := flags.Duration("timeout", 5*time.Second, "How long to wait for the hosts of the sinks to resolve")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *path == "" {
+		return errors.New("usage: teecp check --config FILE")
+	}
+
+	config, err := loadConfig(*path)
+	if config == nil {
+		return err
+	}
+	defer config.close()
+	errs := []error{err}
+	if *templateText != "" {
+		if _, err := teecp.NewTemplate(*templateText, config.tag); err != nil {
+			errs = append(errs, fmt.Errorf("invalid template: %w", err))
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	for _, rawURL := range config.sinks {
+		errs = append(errs, sink.Check(ctx, rawURL))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: %d filters and transforms, %d sinks\n", *path, len(config.middlewares), len(config.sinks))
+	return nil
+}
+
+// configuration is what a server runs of its --config file, which a reload
+// signal applies again without disconnecting the clients.
+type configuration struct {
+	path   string
+	server *teecp.Server
+	// base are the middlewares of the command line, which come first.
+	base []teecp.Middleware
+	// output formats what is written to the sinks.
+	output func(s sink.Sink) teecp.MessageReceiver
+	logger *slog.Logger
+
+	mu sync.Mutex
+	// current is the configuration applied, closed once replaced.
+	current *streamFlags
+	sinks   map[string]openSink
+	// archiver, if set, archives the rotated segments of the file sinks.
+	archiver *sink.Archiver
+}
+
+// openSink is a sink of the configuration, attached to the server.
+type openSink struct {
+	sink   sink.Sink
+	handle *teecp.Handle
+}
+
+// apply runs config: its middlewares after the base ones, and its sinks. The
+// sinks already open are kept, the new ones opened and those no longer there
+// closed, as are the middlewares replaced. When a sink does not open, nothing is
+// applied and config is closed.
+func (c *configuration) apply(config *streamFlags) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sinks := make(map[string]openSink, len(config.sinks))
+	for _, rawURL := range config.sinks {
+		if s, ok := c.sinks[rawURL]; ok {
+			sinks[rawURL] = s
+			continue
+		}
+		if _, ok := sinks[rawURL]; ok {
+			continue
+		}
+		s, err := sink.Open(rawURL, c.logger)
+		if err != nil {
+			for _, s := range sinks {
+				if s.handle == nil {
+					s.sink.Close()
+				}
+			}
+			c.closeMiddlewares(config)
+			return err
+		}
+		sinks[rawURL] = openSink{sink: s}
+	}
+
+	for rawURL, s := range sinks {
+		if s.handle != nil {
+			continue
+		}
+		if f, ok := s.sink.(*sink.File); ok && f.Rotates() && c.archiver != nil {
+			f.OnRotate(c.archiver.Archive)
+		}
+		s.handle = c.server.AttachMessages(c.output(s.sink))
+		sinks[rawURL] = s
+	}
+	for rawURL, s := range c.sinks {
+		if _, ok := sinks[rawURL]; !ok {
+			s.close(c.logger)
+		}
+	}
+	c.sinks = sinks
+
+	for _, bind := range config.bind {
+		bind(c.server, len(c.base))
+	}
+	c.server.SetMiddlewares(slices.Concat(c.base, config.middlewares)...)
+	if c.current != nil {
+		c.closeMiddlewares(c.current)
+	}
+	c.current = config
+	return nil
+}
+
+// closeMiddlewares releases the middlewares of config, no longer in use.
+func (c *configuration) closeMiddlewares(config *streamFlags) {
+	if err := config.close(); err != nil {
+		c.logger.Warn("could not release the filters and transforms", "path", c.path, "err", err)
+	}
+}
+
+// archive returns the sinks of the configuration, for their rotated segments to
+// be archived, and has the archiver take the segments of later reloads.
+func (c *configuration) archive(archiver *sink.Archiver) []sink.Sink {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.archiver = archiver
+	sinks := make([]sink.Sink, 0, len(c.sinks))
+	for _, s := range c.sinks {
+		sinks = append(sinks, s.sink)
+	}
+	return sinks
+}
+
+// close closes the sinks of the configuration and releases its middlewares.
+func (c *configuration) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, s := range c.sinks {
+		s.close(c.logger)
+	}
+	c.sinks = nil
+	if c.current != nil {
+		c.closeMiddlewares(c.current)
+		c.current = nil
+	}
+}
+
+func (s openSink) close(logger *slog.Logger) {
+	s.handle.Detach()
+	closeSinks([]sink.Sink{s.sink}, logger)
+}
+
+// reloadOnSignal applies the config file again at a reload signal, until ctx is
+// done. A file that no longer loads is reported and the current configuration
+// kept.
+func (c *configuration) reloadOnSignal(ctx context.Context) {
+	if len(reloadSignals) == 0 {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, reloadSignals...)
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-signals:
+			case <-ctx.Done():
+				return
+			}
+			config, err := loadConfig(c.path)
+			if err != nil && config != nil {
+				c.closeMiddlewares(config)
+			}
+			if err == nil {
+				err = c.apply(config)
+			}
+			if err != nil {
+				c.logger.Error("could not reload the config", "path", c.path, "err", err)
+				continue
+			}
+			c.logger.Info("config reloaded", "path", c.path, "middlewares", len(config.middlewares), "sinks", len(config.sinks))
+		}
+	}()
+}
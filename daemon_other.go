@@ -0,0 +1,22 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// shutdownSignals end teecp gracefully.
+var shutdownSignals = []os.Signal{os.Interrupt}
+
+// pauseSignals pause the broadcast, or resume it. There are none but on Unix.
+var pauseSignals []os.Signal
+
+// reloadSignals apply the --config file again. There are none but on Unix.
+var reloadSignals []os.Signal
+
+// daemonize is only supported on Unix systems.
+func daemonize() (*os.Process, error) {
+	return nil, errors.New("--daemon is not supported on this platform")
+}
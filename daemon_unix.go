@@ -0,0 +1,45 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// shutdownSignals end teecp gracefully.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// pauseSignals pause the broadcast, or resume it.
+var pauseSignals = []os.Signal{syscall.SIGUSR2}
+
+// reloadSignals apply the --config file again.
+var reloadSignals = []os.Signal{syscall.SIGHUP}
+
+// daemonize starts teecp again with the same arguments, in a session of its own
+// detached from the terminal. It keeps the standard input, which is then a file
+// or a FIFO, and drops the output. daemonEnv tells the new process not to start
+// yet another one.
+func daemonize() (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer null.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = null
+	cmd.Stderr = null
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd.Process, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+)
+
+// windowsToast shows the TEECP_NOTIFICATION variable as a toast, on behalf of
+// PowerShell as unpackaged programs cannot raise toasts of their own.
+const windowsToast = `[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$toast = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$text = $toast.GetElementsByTagName('text')
+$text.Item(0).AppendChild($toast.CreateTextNode('teecp')) > $null
+$text.Item(1).AppendChild($toast.CreateTextNode($env:TEECP_NOTIFICATION)) > $null
+$app = '{1AC14E77-02E7-4E5D-B744-2EB1AE5198B7}\WindowsPowerShell\v1.0\powershell.exe'
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier($app).Show([Windows.UI.Notifications.ToastNotification]::new($toast))`
+
+// desktopNotifier raises a desktop notification for the lines matching re. The
+// notifications are raised one at a time on the side; lines matching while too many
+// are pending are dropped.
+type desktopNotifier struct {
+	re      *regexp.Regexp
+	logger  *slog.Logger
+	pending chan string
+	done    chan struct{}
+}
+
+func newDesktopNotifier(re *regexp.Regexp, logger *slog.Logger) *desktopNotifier {
+	d := &desktopNotifier{re: re, logger: logger, pending: make(chan string, 8), done: make(chan struct{})}
+	go d.run()
+	return d
+}
+
+// notify raises a notification if the line matches.
+func (d *desktopNotifier) notify(line []byte) {
+	if !d.re.Match(line) {
+		return
+	}
+	select {
+	case d.pending <- string(line):
+	default:
+	}
+}
+
+// close waits for the pending notifications.
+func (d *desktopNotifier) close() {
+	close(d.pending)
+	<-d.done
+}
+
+func (d *desktopNotifier) run() {
+	defer close(d.done)
+
+	for line := range d.pending {
+		if err := notificationCommand(line).Run(); err != nil {
+			d.logger.Warn("could not raise desktop notification", "err", err)
+		}
+	}
+}
+
+// notificationCommand returns the command raising a notification with the platform
+// tool: osascript, PowerShell or notify-send.
+func notificationCommand(text string) *exec.Cmd {
+	switch runtime.GOOS {
+	case "darwin":
+		// The text is an argument rather than part of the script to need no quoting.
+		return exec.Command("osascript", "-e", "on run argv", "-e", `display notification (item 1 of argv) with title "teecp"`, "-e", "end run", text)
+	case "windows":
+		cmd := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", windowsToast)
+		cmd.Env = append(os.Environ(), "TEECP_NOTIFICATION="+text)
+		return cmd
+	default:
+		return exec.Command("notify-send", "--app-name=teecp", "teecp", text)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+// command is the --exec command, whose output is broadcast instead of stdin:
+// what it writes to stdout and stderr, or to its terminal with --pty.
+type command struct {
+	line   string
+	cmd    *exec.Cmd
+	output *os.File
+	pty    bool
+}
+
+// startCommand runs the command line with the shell, in a terminal of its own
+// if withPTY, for it to write colors and progress bars as it would for a user.
+// It gets the input of teecp.
+func startCommand(line string, withPTY bool) (*command, error) {
+	c := &command{line: line, cmd: shellCommand(line), pty: withPTY}
+	if withPTY {
+		terminal, err := startPTY(c.cmd)
+		if err != nil {
+			return nil, err
+		}
+		c.output = terminal
+		// What is typed goes to the command, echoed by its terminal.
+		go io.Copy(terminal, os.Stdin)
+		return c, nil
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	c.cmd.Stdin, c.cmd.Stdout, c.cmd.Stderr = os.Stdin, w, w
+	err = c.cmd.Start()
+	// The output ends once the command, and whatever it started, closed it.
+	w.Close()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	c.output = r
+	return c, nil
+}
+
+func (c *command) Read(p []byte) (int, error) {
+	n, err := c.output.Read(p)
+	if c.pty && ptyClosed(err) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// resize sets the size of the terminal of the command.
+func (c *command) resize(size teecp.TerminalSize) error {
+	if !c.pty {
+		return errors.New("the command runs in no terminal")
+	}
+	return resizePTY(c.output, size)
+}
+
+// wait waits for the command to exit, killing it first if kill, as when teecp is
+// interrupted before the end of its output.
+func (c *command) wait(kill bool) error {
+	if kill {
+		c.cmd.Process.Kill()
+	}
+	err := c.cmd.Wait()
+	c.output.Close()
+	if err != nil && !kill {
+		return fmt.Errorf("%s: %w", c.line, err)
+	}
+	return nil
+}
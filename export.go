@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jeffque/teecp/sink"
+	"github.com/jeffque/teecp/teecp"
+)
+
+// exportHeader comes before the lines of every session in an export.
+type exportHeader struct {
+	Session sink.SpoolSession `json:"session"`
+}
+
+// export turns the sessions recorded by a spool sink into a portable archive,
+// to be attached to an incident ticket: JSON lines, gzipped when the file ends
+// with .gz, where every session starts with a {"session":{...}} header followed
+// by the codec/json envelopes of its lines.
+func export(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	dir := flags.String("spool", "", "The directory of the spool sink, e.g. /var/spool/teecp for --sink spool:/var/spool/teecp")
+	out := flags.String("out", "-", "The archive to write, gzipped when ending with .gz, - for stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return errors.New("usage: teecp export --spool DIR [--out session.jsonl.gz]")
+	}
+
+	sessions, err := sink.SpoolSessions(*dir)
+	if err != nil {
+		return err
+	}
+	if len(sessions) == 0 {
+		return errors.New("no session recorded in " + *dir)
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	buffered := bufio.NewWriter(w)
+	w = buffered
+	var gz *gzip.Writer
+	if strings.HasSuffix(*out, ".gz") {
+		gz = gzip.NewWriter(buffered)
+		w = gz
+	}
+
+	headers := json.NewEncoder(w)
+	lines := teecp.JSONCodec{}.NewEncoder(w)
+	for _, session := range sessions {
+		if err := headers.Encode(exportHeader{session}); err != nil {
+			return err
+		}
+		if err := session.Messages(lines.Encode); err != nil {
+			return err
+		}
+	}
+
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	}
+	return buffered.Flush()
+}
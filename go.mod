@@ -1,3 +1,18 @@
 module github.com/jeffque/teecp
 
 go 1.22.1
+
+require (
+	github.com/expr-lang/expr v1.17.8
+	github.com/segmentio/kafka-go v0.4.47
+	github.com/tetratelabs/wazero v1.8.2
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0
+	golang.org/x/sys v0.28.0
+	golang.org/x/text v0.21.0
+)
+
+require (
+	github.com/klauspost/compress v1.15.9 // indirect
+	github.com/pierrec/lz4/v4 v4.1.15 // indirect
+)
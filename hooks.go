@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+// clientHooks run the --on-connect and --on-disconnect commands, with what is
+// known of the client in the environment. They run one at a time on the side, in
+// the order of the events; events coming while too many are pending are dropped.
+type clientHooks struct {
+	onConnect    string
+	onDisconnect string
+	logger       *slog.Logger
+	pending      chan hookRun
+	done         chan struct{}
+
+	// clients is how many clients are connected, for the hooks to tell the first
+	// and the last.
+	mu      sync.Mutex
+	clients int
+}
+
+func startClientHooks(server *teecp.Server, onConnect, onDisconnect string, logger *slog.Logger) *clientHooks {
+	k := &clientHooks{
+		onConnect:    onConnect,
+		onDisconnect: onDisconnect,
+		logger:       logger,
+		pending:      make(chan hookRun, 64),
+		done:         make(chan struct{}),
+	}
+	server.OnClientConnect(func(h *teecp.Handle) {
+		k.event(k.onConnect, h, "connect", 1, nil)
+	})
+	server.OnClientDisconnect(func(h *teecp.Handle, err error) {
+		k.event(k.onDisconnect, h, "disconnect", -1, err)
+	})
+	go k.run()
+	return k
+}
+
+// event counts the client in or out and queues the hook, if any.
+func (k *clientHooks) event(command string, h *teecp.Handle, event string, delta int, err error) {
+	k.mu.Lock()
+	k.clients += delta
+	clients := k.clients
+	k.mu.Unlock()
+	if command == "" {
+		return
+	}
+
+	meta := h.Metadata()
+	env := []string{
+		"TEECP_EVENT=" + event,
+		"TEECP_CLIENTS=" + strconv.Itoa(clients),
+		"TEECP_CLIENT_ID=" + strconv.FormatUint(h.ID(), 10),
+		"TEECP_CLIENT_NAME=" + meta.Name,
+	}
+	if meta.RemoteAddr != nil {
+		env = append(env, "TEECP_CLIENT_ADDR="+meta.RemoteAddr.String())
+	}
+	for key, value := range meta.Labels {
+		env = append(env, "TEECP_CLIENT_LABEL_"+key+"="+value)
+	}
+	if err != nil {
+		env = append(env, "TEECP_DISCONNECT_ERROR="+err.Error())
+	}
+
+	select {
+	case k.pending <- hookRun{command, env}:
+	default:
+		k.logger.Warn("too many hooks pending, dropping one", "event", event, "id", h.ID())
+	}
+}
+
+// hookRun is a command to run and the variables added to its environment.
+type hookRun struct {
+	command string
+	env     []string
+}
+
+// close waits for the pending hooks.
+func (k *clientHooks) close() {
+	close(k.pending)
+	<-k.done
+}
+
+func (k *clientHooks) run() {
+	defer close(k.done)
+
+	for run := range k.pending {
+		cmd := shellCommand(run.command)
+		cmd.Env = append(os.Environ(), run.env...)
+		// Stdout carries the stream of the server: the output of the hooks goes
+		// along with the logs.
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		if err := cmd.Run(); err != nil {
+			k.logger.Warn("hook failed", "command", run.command, "err", err)
+		}
+	}
+}
+
+// stallPoll is how often a stalled input is checked for lines again.
+const stallPoll = time.Second
+
+// watchStall warns when the server broadcast nothing for after, which is often
+// the sign that the producer died, running command if any, once per stall. It
+// returns once ctx is done.
+func watchStall(ctx context.Context, server *teecp.Server, after time.Duration, command string, logger *slog.Logger) {
+	// Before the first line, the input is as old as the server.
+	last := time.Now()
+	stalled := false
+	for {
+		switch t := server.LastBroadcast(); {
+		case server.Paused():
+			// The lines are held rather than broadcast: the input is not to blame.
+			last = time.Now()
+		case t.After(last):
+			last = t
+			if stalled {
+				logger.Info("input resumed")
+				stalled = false
+			}
+		}
+
+		wait := time.Until(last.Add(after))
+		if !stalled && wait <= 0 {
+			stalled = true
+			logger.Warn("input stalled", "for", after)
+			if command != "" {
+				go runStallCommand(command, server.LastBroadcast(), logger)
+			}
+		}
+		if stalled {
+			wait = stallPoll
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// runStallCommand runs the --stall-cmd command, with the time of the last line
+// in its environment, empty when none came.
+func runStallCommand(command string, last time.Time, logger *slog.Logger) {
+	cmd := shellCommand(command)
+	lastInput := ""
+	if !last.IsZero() {
+		lastInput = last.Format(time.RFC3339)
+	}
+	cmd.Env = append(os.Environ(), "TEECP_EVENT=stall", "TEECP_LAST_INPUT="+lastInput)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		logger.Warn("stall command failed", "command", command, "err", err)
+	}
+}
+
+// shellCommand runs the command line with the shell of the platform.
+func shellCommand(line string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", line)
+	}
+	return exec.Command("sh", "-c", line)
+}
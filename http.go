@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+// pprofHandler serves the profiles of net/http/pprof under /debug/pprof/.
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// serveHTTP serves handler on addr until ctx is done. It returns once the listener
+// is open, serving in the background.
+func serveHTTP(ctx context.Context, addr string, handler http.Handler, logger *slog.Logger) error {
+	return serveHTTPTLS(ctx, addr, handler, nil, logger)
+}
+
+// serveHTTPTLS is serveHTTP over TLS with config, or in the clear without it.
+func serveHTTPTLS(ctx context.Context, addr string, handler http.Handler, config *tls.Config, logger *slog.Logger) error {
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("could not open socket on %s: %w", addr, err)
+	}
+	if config != nil {
+		ln = tls.NewListener(ln, config)
+	}
+
+	srv := &http.Server{Handler: handler}
+	context.AfterFunc(ctx, func() { srv.Close() })
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("http server failed", "addr", addr, "err", err)
+		}
+	}()
+	return nil
+}
+
+// clientView is how /clients lists a client.
+type clientView struct {
+	ID          uint64            `json:"id"`
+	Remote      string            `json:"remote"`
+	Name        string            `json:"name,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	ConnectedAt time.Time         `json:"connected_at"`
+	Codec       string            `json:"codec"`
+	Messages    uint64            `json:"messages"`
+	Bytes       uint64            `json:"bytes"`
+	Queued      int               `json:"queued_bytes"`
+	LastSeq     uint64            `json:"last_seq"`
+	Behind      uint64            `json:"behind"`
+	Lag         float64           `json:"lag_seconds"`
+}
+
+// healthView is what the health check answers. The age of the last input is
+// null until a line comes.
+type healthView struct {
+	Status       string   `json:"status"`
+	Uptime       float64  `json:"uptime_seconds"`
+	Clients      int      `json:"clients"`
+	LastInputAge *float64 `json:"last_input_age_seconds"`
+}
+
+// healthHandler answers the health checks of load balancers and probes on path,
+// with the uptime of the server since started, its clients and how long ago its
+// input last broadcast a line, for them to tell a server that is up from one
+// that is also fed.
+func healthHandler(server *teecp.Server, path string, started time.Time) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, _ *http.Request) {
+		v := healthView{
+			Status:  "ok",
+			Uptime:  time.Since(started).Seconds(),
+			Clients: len(server.ClientStats()),
+		}
+		if last := server.LastBroadcast(); !last.IsZero() {
+			age := time.Since(last).Seconds()
+			v.LastInputAge = &age
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	})
+	return mux
+}
+
+// adminHandler serves the metrics of the server under /metrics, followed by those
+// of every client, lists the clients as JSON under /clients and pauses or resumes
+// the broadcast on POST /pause and /resume.
+func adminHandler(server *teecp.Server, metrics *teecp.PrometheusMetrics) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		metrics.ServeHTTP(w, r)
+		teecp.WriteClientStats(w, server.ClientStats())
+	})
+	mux.HandleFunc("/clients", func(w http.ResponseWriter, _ *http.Request) {
+		stats := server.ClientStats()
+		views := make([]clientView, 0, len(stats))
+		for _, st := range stats {
+			v := clientView{
+				ID:          st.ID,
+				Name:        st.Name,
+				Labels:      st.Labels,
+				ConnectedAt: st.ConnectedAt,
+				Codec:       string(st.Codec),
+				Messages:    st.Messages,
+				Bytes:       st.Bytes,
+				Queued:      st.Queued,
+				LastSeq:     st.LastSeq,
+				Behind:      st.Behind,
+				Lag:         st.Lag.Seconds(),
+			}
+			if st.RemoteAddr != nil {
+				v.Remote = st.RemoteAddr.String()
+			}
+			if v.Codec == "" {
+				v.Codec = "plain"
+			}
+			views = append(views, v)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(views)
+	})
+	mux.HandleFunc("POST /pause", func(w http.ResponseWriter, _ *http.Request) {
+		server.Pause()
+		io.WriteString(w, "paused\n")
+	})
+	mux.HandleFunc("POST /resume", func(w http.ResponseWriter, _ *http.Request) {
+		// Resuming returns once what was held is broadcast, which the caller may
+		// want to wait for.
+		server.Resume()
+		io.WriteString(w, "resumed\n")
+	})
+	return mux
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// preparedListener readies the connections it accepts before handing them out,
+// e.g. reading a header, away from the accept loop. The connections that fail to
+// get ready are refused.
+type preparedListener struct {
+	net.Listener
+	logger   *slog.Logger
+	prepare  []func(conn net.Conn) (net.Conn, error)
+	start    sync.Once
+	accepted chan acceptResult
+	closing  sync.Once
+	done     chan struct{}
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newPreparedListener(ln net.Listener, logger *slog.Logger, prepare ...func(conn net.Conn) (net.Conn, error)) *preparedListener {
+	return &preparedListener{Listener: ln, logger: logger, prepare: prepare, accepted: make(chan acceptResult), done: make(chan struct{})}
+}
+
+func (l *preparedListener) Accept() (net.Conn, error) {
+	l.start.Do(func() { go l.acceptLoop() })
+	select {
+	case a := <-l.accepted:
+		return a.conn, a.err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *preparedListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.accepted <- acceptResult{err: err}:
+			case <-l.done:
+			}
+			return
+		}
+		go func() {
+			raw := conn
+			for _, prepare := range l.prepare {
+				var err error
+				if conn, err = prepare(conn); err != nil {
+					l.logger.Warn("connection refused", "remote", raw.RemoteAddr(), "err", err)
+					raw.Close()
+					return
+				}
+			}
+			select {
+			case l.accepted <- acceptResult{conn: conn}:
+			case <-l.done:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+func (l *preparedListener) Close() error {
+	l.closing.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
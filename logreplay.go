@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+// logLayouts are the layouts the timestamps of a replayed log are tried with,
+// when --layout is not given.
+var logLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02 15:04:05,999999999",
+	"2006/01/02 15:04:05.999999999",
+	"02/Jan/2006:15:04:05 -0700",
+	time.Stamp,
+	time.StampNano,
+	"15:04:05.999999999",
+}
+
+// replay serves a log file as a stream, pacing its lines as they were written
+// according to the timestamps the regex finds in them, to test the consumers of a
+// stream with a realistic one.
+func replay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	port := flags.Int("port", 6667, "A listener port")
+	from := flags.String("from", "", "The log file to replay")
+	var pattern *regexp.Regexp
+	flags.Func("timestamps", "A regex matching the timestamp of the lines, its first group if it has one, e.g. '^\\S+ \\S+'", func(s string) error {
+		var err error
+		pattern, err = regexp.Compile(s)
+		return err
+	})
+	layout := flags.String("layout", "", "The Go layout of the timestamps, e.g. '2006-01-02 15:04:05.000', or unix, unixms; the usual layouts are tried otherwise")
+	speed := flags.Float64("speed", 1, "How many times faster than they were written the lines are replayed")
+	maxGap := flags.Duration("max-gap", 0, "The longest the replay waits between two lines, 0 for no limit")
+	waitClients := flags.Int("wait-clients", 1, "How many clients to wait for before replaying, 0 replaying right away")
+	verbose := flags.Bool("verbose", false, "Log connections and protocol details to stderr")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" || pattern == nil {
+		return errors.New("usage: teecp replay --from app.log --timestamps REGEX [--speed 10] [--port 6667]")
+	}
+	if *speed <= 0 || *waitClients < 0 {
+		return errors.New("--speed must be positive and --wait-clients not negative")
+	}
+
+	f, err := os.Open(*from)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelInfo
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
+	if err != nil {
+		return err
+	}
+	server := teecp.Server{Logger: logger}
+	connected := make(chan struct{}, *waitClients)
+	server.OnClientConnect(func(*teecp.Handle) {
+		select {
+		case connected <- struct{}{}:
+		default:
+		}
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := server.Serve(ctx, ln); err != nil && ctx.Err() == nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for range *waitClients {
+		<-connected
+	}
+
+	paced := &pacedLog{
+		ctx:     ctx,
+		r:       bufio.NewReader(f),
+		pattern: pattern,
+		layout:  *layout,
+		speed:   *speed,
+		maxGap:  *maxGap,
+	}
+	return server.BroadcastFrom(ctx, paced)
+}
+
+// pacedLog reads the lines of a log, each once the time between its timestamp
+// and the previous one, divided by speed and bounded by maxGap if set, passed.
+// The lines without timestamp, such as the rest of a stack trace, follow the
+// previous one right away, and so do those earlier than it.
+type pacedLog struct {
+	ctx     context.Context
+	r       *bufio.Reader
+	pattern *regexp.Regexp
+	layout  string
+	speed   float64
+	maxGap  time.Duration
+
+	last    time.Time
+	pending []byte
+}
+
+func (p *pacedLog) Read(b []byte) (int, error) {
+	if len(p.pending) == 0 {
+		line, err := p.r.ReadBytes('\n')
+		if len(line) == 0 {
+			return 0, err
+		}
+		if err := p.wait(line); err != nil {
+			return 0, err
+		}
+		p.pending = line
+	}
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
+
+// wait sleeps for the time between the timestamp of line and the previous one.
+func (p *pacedLog) wait(line []byte) error {
+	t, ok := p.timestamp(line)
+	if !ok {
+		return nil
+	}
+	last := p.last
+	p.last = t
+	if last.IsZero() || !t.After(last) {
+		return nil
+	}
+	gap := time.Duration(float64(t.Sub(last)) / p.speed)
+	if p.maxGap > 0 {
+		gap = min(gap, p.maxGap)
+	}
+	timer := time.NewTimer(gap)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+}
+
+// timestamp parses the timestamp of line, if it has one.
+func (p *pacedLog) timestamp(line []byte) (time.Time, bool) {
+	match := p.pattern.FindSubmatch(line)
+	if match == nil {
+		return time.Time{}, false
+	}
+	s := string(match[0])
+	if len(match) > 1 {
+		s = string(match[1])
+	}
+	s = strings.TrimSpace(s)
+
+	switch p.layout {
+	case "unix", "unixms":
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		if p.layout == "unixms" {
+			n /= 1e3
+		}
+		return time.Unix(0, int64(n*1e9)), true
+	case "":
+		for _, layout := range logLayouts {
+			if t, err := time.Parse(layout, s); err == nil {
+				// The next lines are likely in the same layout.
+				p.layout = layout
+				return t, true
+			}
+		}
+		return time.Time{}, false
+	}
+	t, err := time.Parse(p.layout, s)
+	return t, err == nil
+}
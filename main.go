@@ -1,17 +1,32 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"log/slog"
+	"math"
 	"net"
+	"net/http"
 	"os"
 	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/jeffque/teecp/sink"
 	"github.com/jeffque/teecp/teecp"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
 )
 
 type appState = int32
@@ -20,22 +35,39 @@ type appStateDescription struct {
 	description    string
 	waitConnection time.Duration
 	retryInterval  time.Duration
+	upstream       string
 }
 
 var appTypeStates = struct {
 	undefined appStateDescription
 	server    appStateDescription
 	client    appStateDescription
+	proxy     appStateDescription
 }{
-	appStateDescription{0, "undefined", 0, 0},
-	appStateDescription{1, "server", 0, 0},
-	appStateDescription{2, "client", 0, time.Duration(1000000000)},
+	appStateDescription{0, "undefined", 0, 0, ""},
+	appStateDescription{1, "server", 0, 0, ""},
+	appStateDescription{2, "client", 0, time.Duration(1000000000), ""},
+	appStateDescription{3, "proxy", 0, time.Duration(1000000000), ""},
 }
 
 func (s appStateDescription) isServer() bool {
 	return s.state != appTypeStates.client.state
 }
 
+func (s appStateDescription) isProxy() bool {
+	return s.state == appTypeStates.proxy.state
+}
+
+func defineProxyState(currAppState *appStateDescription) func(s string) error {
+	return func(s string) error {
+		if err := defineState(appTypeStates.proxy, currAppState)(s); err != nil {
+			return err
+		}
+		currAppState.upstream = s
+		return nil
+	}
+}
+
 func defineState(desiredVal appStateDescription, currAppState *appStateDescription) func(s string) error {
 	return func(s string) error {
 		if currAppState.state != appTypeStates.undefined.state {
@@ -97,34 +129,732 @@ func setRetryIntervalState(appState *appStateDescription) func(s string) error {
 	}
 }
 
+// middlewareFlag appends the middleware built from the flag value, so the chain
+// follows the order of the command line.
+func middlewareFlag(middlewares *[]teecp.Middleware, build func(s string) (teecp.Middleware, error)) func(s string) error {
+	return func(s string) error {
+		m, err := build(s)
+		if err != nil {
+			return err
+		}
+		*middlewares = append(*middlewares, m)
+		return nil
+	}
+}
+
+func regexpMiddleware(build func(re *regexp.Regexp) teecp.Middleware) func(s string) (teecp.Middleware, error) {
+	return func(s string) (teecp.Middleware, error) {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, err
+		}
+		return build(re), nil
+	}
+}
+
+func redactMiddleware(re *regexp.Regexp) teecp.Middleware {
+	return teecp.Redact(re, "[REDACTED]")
+}
+
+func timestampMiddleware(s string) (teecp.Middleware, error) {
+	if s == "true" {
+		s = time.RFC3339
+	}
+	return teecp.Timestamp(s), nil
+}
+
+func tagMiddleware(s string) (teecp.Middleware, error) {
+	return teecp.Tag(s), nil
+}
+
+// sedBackreference is a \1 style backreference of sed.
+var sedBackreference = regexp.MustCompile(`\\(\d)`)
+
+// subMiddleware parses a sed substitution, s/regex/replacement/flags, where any
+// character may delimit the parts. The flags are g, to replace every match, and i,
+// to ignore case. The replacement may refer to submatches as \1 or $1.
+func subMiddleware(s string) (teecp.Middleware, error) {
+	if len(s) < 2 || s[0] != 's' {
+		return nil, errors.New("expected s/regex/replacement/")
+	}
+	parts := strings.Split(s[2:], s[1:2])
+	if len(parts) != 3 {
+		return nil, errors.New("expected s/regex/replacement/")
+	}
+
+	pattern, replacement, flags := parts[0], parts[1], parts[2]
+	if strings.Trim(flags, "gi") != "" {
+		return nil, fmt.Errorf("unknown flags %q, expected g or i", flags)
+	}
+	if strings.Contains(flags, "i") {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	replacement = sedBackreference.ReplaceAllString(replacement, "$${$1}")
+	return teecp.Substitute(re, replacement, strings.Contains(flags, "g")), nil
+}
+
+// notification posts the lines matching re to a chat webhook.
+type notification struct {
+	re  *regexp.Regexp
+	url string
+}
+
+// notifyFlag parses regex=URL. The regex may hold an equal sign, so the URL starts
+// at the last =http.
+func notifyFlag(notifications *[]notification) func(s string) error {
+	return func(s string) error {
+		i := strings.LastIndex(s, "=http")
+		if i < 0 {
+			return errors.New("expected regex=URL")
+		}
+		re, err := regexp.Compile(s[:i])
+		if err != nil {
+			return err
+		}
+		*notifications = append(*notifications, notification{re, s[i+1:]})
+		return nil
+	}
+}
+
+// openNotifiers opens a sink for every notification.
+func openNotifiers(notifications []notification, logger *slog.Logger) ([]sink.Sink, error) {
+	var notifiers []sink.Sink
+	for _, n := range notifications {
+		notifier, err := sink.Notify(n.re, n.url, logger)
+		if err != nil {
+			closeSinks(notifiers, logger)
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	return notifiers, nil
+}
+
+func closeSinks(sinks []sink.Sink, logger *slog.Logger) {
+	for _, s := range sinks {
+		if err := s.Close(); err != nil {
+			logger.Error("could not close sink", "err", err)
+		}
+	}
+}
+
+// labelFlag parses key=value.
+func labelFlag(labels *map[string]string) func(s string) error {
+	return func(s string) error {
+		k, v, ok := strings.Cut(s, "=")
+		if !ok || !teecp.ValidLabelName(k) {
+			return errors.New("expected key=value, the key made of letters, digits and underscores")
+		}
+		if *labels == nil {
+			*labels = make(map[string]string)
+		}
+		(*labels)[k] = v
+		return nil
+	}
+}
+
+// topicBacklogFlag parses topic=N, comma-separated.
+func topicBacklogFlag(backlogs *map[string]int) func(s string) error {
+	return func(s string) error {
+		for _, item := range strings.Split(s, ",") {
+			topic, size, ok := strings.Cut(item, "=")
+			n, err := strconv.Atoi(size)
+			if !ok || topic == "" || err != nil || n <= 0 {
+				return errors.New("expected topic=N, e.g. build=10000,deploy=1000")
+			}
+			if *backlogs == nil {
+				*backlogs = make(map[string]int)
+			}
+			(*backlogs)[topic] = n
+		}
+		return nil
+	}
+}
+
+// parseSince reads the time --since replays from: RFC 3339, a date and time
+// without zone, a time of day, the last one before now, or a duration back from
+// now.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil && d > 0 {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02 15:04"} {
+		if t, err := time.ParseInLocation(layout, s, now.Location()); err == nil {
+			return t, nil
+		}
+	}
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		clock, err := time.ParseInLocation(layout, s, now.Location())
+		if err != nil {
+			continue
+		}
+		t := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), clock.Second(), 0, now.Location())
+		if t.After(now) {
+			t = t.AddDate(0, 0, -1)
+		}
+		return t, nil
+	}
+	return time.Time{}, errors.New("expected a time such as 10:42, 2024-05-01T10:42:00Z or 15m")
+}
+
+// metricFlag parses name=regex.
+func metricFlag(metrics *[]sink.Metric) func(s string) error {
+	return func(s string) error {
+		name, pattern, ok := strings.Cut(s, "=")
+		if !ok || name == "" {
+			return errors.New("expected name=regex")
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		*metrics = append(*metrics, sink.Metric{Name: name, Pattern: re})
+		return nil
+	}
+}
+
+// clientOptions are the flags only meaningful to a client.
+type clientOptions struct {
+	notifications  []notification
+	toClipboard    bool
+	clipboardMatch *regexp.Regexp
+	notifyDesktop  *regexp.Regexp
+	template       *teecp.Template
+	newline        string
+	readBuffer     int
+	// flushInterval is how long the output may be held, zero writing every line
+	// right away.
+	flushInterval time.Duration
+	// ignoreSIGPIPE keeps receiving once stdout is closed.
+	ignoreSIGPIPE bool
+	// pipe, if set, is the named pipe connected to instead of the port.
+	pipe string
+	// connect, if set, is the server connected to instead of the local one.
+	connect string
+	// ssh, if set, is the jump host the server is connected to through.
+	ssh string
+	// egressProxy, if set, is the proxy servers are connected to through.
+	egressProxy string
+	// psk, if set, encrypts the connection to the server.
+	psk *psk
+	// tls, if set, is the TLS configuration of the connection to the server.
+	tls *tls.Config
+	// verify checks the stream against the checksum the server sends at its end.
+	verify bool
+	// progress reports the throughput of the stream to stderr.
+	progress bool
+	// name and labels describe the client to the server.
+	name   string
+	labels map[string]string
+	// subscribe are the topics received instead of the default one.
+	subscribe []string
+	// consumerGroup, if set, is the group whose members share the lines.
+	consumerGroup string
+	// ack acknowledges the lines once written to stdout.
+	ack bool
+	// window, if set, is how many lines the server may send ahead.
+	window int
+	// showLatency prefixes the lines with their age.
+	showLatency bool
+	// since, if set, is the time from which the backlog is replayed.
+	since time.Time
+	// raw writes the bytes received to stdout as they are, right away.
+	raw bool
+	// sendSize sends the size of the terminal to the server, as it changes.
+	sendSize bool
+}
+
+// serverOptions are the flags only meaningful to a server, but for notifications
+// which a client also sends.
+type serverOptions struct {
+	middlewares []teecp.Middleware
+	bind        []func(server *teecp.Server, first int)
+	// config, if set, holds more middlewares and sinks, read from configPath
+	// and applied again on SIGHUP.
+	config        *streamFlags
+	configPath    string
+	metricsAddr   string
+	backlog       int
+	sinks         []string
+	notifications []notification
+	statsdAddr    string
+	metrics       []sink.Metric
+	otlpEndpoint  string
+	archive       string
+	// tag is the last --tag, describing the stream to OTLP collectors and
+	// templates.
+	tag       string
+	template  *teecp.Template
+	newline   string
+	multiline teecp.Multiline
+	// coalesceDelay is how long lines wait to share a write to a client.
+	coalesceDelay time.Duration
+	// readBuffer is how many bytes of the input, stdin or upstream, are read at
+	// once.
+	readBuffer int
+	// pauseBuffer is how many bytes are held while the broadcast is paused.
+	pauseBuffer int
+	// mirrors are the servers the broadcast is pushed to.
+	mirrors []string
+	// topic, if set, is the topic the input is broadcast as.
+	topic string
+	// topicBacklogs are the sizes of the backlogs of the topics with their own.
+	topicBacklogs map[string]int
+	// acked retains the lines for the clients with --ack until they acknowledge
+	// them, spilling them to ackSpool.
+	acked    bool
+	ackSpool string
+	// windowQueue is how many lines wait for a client out of credit, dropped
+	// beyond with dropSlowClients.
+	windowQueue     int
+	dropSlowClients bool
+	// maxClients, if set, is how many connections are accepted at once, and
+	// maxConnsPerIP how many of them from the same address.
+	maxClients    int
+	maxConnsPerIP int
+	// acceptMirror broadcasts what other servers mirror, instead of stdin.
+	acceptMirror bool
+	// clusterPeers are the other nodes of the cluster the input is shared with,
+	// and clusterNode the name of this one.
+	clusterPeers []string
+	clusterNode  string
+	// onConnect and onDisconnect, if set, are the commands run as clients come
+	// and go.
+	onConnect    string
+	onDisconnect string
+	// stallAlert, if set, is how long the input may go without a line before
+	// stallCmd runs.
+	stallAlert time.Duration
+	stallCmd   string
+	// passthrough makes a proxy forward the bytes as they are.
+	passthrough bool
+	// user and group are switched to once listening.
+	user  string
+	group string
+	// pipe, if set, is the named pipe listened on instead of the port.
+	pipe string
+	// advertise, if set, is the name the server is advertised as over mDNS.
+	advertise string
+	// register, if set, is the registry the server is registered to.
+	register *registry
+	// follow, if set, is the file read as it grows instead of stdin.
+	follow string
+	// exec, if set, is the command whose output is broadcast instead of stdin,
+	// run in a terminal of its own with pty.
+	exec string
+	pty  bool
+	// ptyController, if set, is the name of the client sizing the terminal of
+	// the command.
+	ptyController string
+	// probes, if set, is the address of the liveness and readiness probes.
+	probes string
+	// draining is closed once a shutdown signal arrived.
+	draining <-chan struct{}
+	// httpAddr, if set, is where clients may long-poll the stream over HTTP.
+	httpAddr string
+	// webAddr, if set, is where the viewer of the stream is served.
+	webAddr string
+	// health, if set, is the address and path of the health check.
+	health string
+	// egressProxy, if set, is the proxy a relay connects to its upstream through.
+	egressProxy string
+	// proxyProtocol expects the PROXY header of a load balancer on connections.
+	proxyProtocol bool
+	// progress reports the throughput of the broadcast to stderr.
+	progress bool
+	// psk, if set, encrypts the connections, those of clients and the one of a
+	// relay to its upstream.
+	psk *psk
+	// tls, if set, is the TLS configuration the clients, and the viewers of
+	// --web, connect with.
+	tls *tls.Config
+	// peerTLS, if set, is the TLS configuration the server connects with to the
+	// servers it mirrors to, its cluster peers and its upstream.
+	peerTLS *tls.Config
+	// acme, if set, gets the certificates of tls, answering the HTTP-01
+	// challenges on acmeHTTP if set.
+	acme     *autocert.Manager
+	acmeHTTP string
+	// inputEncoding, if set, is decoded to UTF-8 before anything else.
+	inputEncoding encoding.Encoding
+}
+
+// daemonEnv is set in the environment of a daemonized teecp.
+const daemonEnv = "TEECP_DAEMON"
+
+// subcommands are run by their name, given as the first argument, with the
+// following arguments.
+var subcommands = map[string]func(args []string) error{
+	"bench":   bench,
+	"check":   check,
+	"export":  export,
+	"replay":  replay,
+	"ls":      ls,
+	"service": service,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				if errors.Is(err, flag.ErrHelp) {
+					os.Exit(2)
+				}
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	var port int
+	var verbose bool
+	var templateText string
+	var newline string
+	var pprofAddr string
+	var daemon bool
+	var pidfile string
+	var grace time.Duration
+	var sidecar bool
+	var stream streamFlags
+	var configPath string
+	var useTLS bool
+	var tlsCert, tlsKey string
+	var pins [][]byte
+	var acmeDomains []string
+	var acmeCache string
+	var serverOpts serverOptions
+	var clientOpts clientOptions
 
 	serverClientSetted := appTypeStates.undefined
 
 	flag.IntVar(&port, "port", 6667, "A listener port")
+	flag.BoolVar(&verbose, "verbose", false, "Log connections and protocol details to stderr")
 	flag.BoolFunc("server", "Define a server teecp instance (conflict with --client)", defineState(appTypeStates.server, &serverClientSetted))
 	flag.BoolFunc("wait-connection", "Makes the client wait for a connection retrying until specified (requires --client)", setWaitConnectionState(&serverClientSetted))
 	flag.BoolFunc("retry-interval", "Sets the retry time interval for waiting a connection (requires --client and --wait-connection)", setRetryIntervalState(&serverClientSetted))
 	flag.BoolFunc("client", "Define a client teecp instance (conflicts with --server)", defineState(appTypeStates.client, &serverClientSetted))
+	flag.Func("proxy", "Define a proxy teecp instance relaying the server at host:port, reconnecting to it (conflicts with --server and --client)", defineProxyState(&serverClientSetted))
+	stream.define(flag.CommandLine)
+	flag.Func("notify", "Post the lines matching the regex, with the lines before them, to a Slack or Discord webhook given as regex=URL, may be repeated", notifyFlag(&serverOpts.notifications))
+	flag.StringVar(&serverOpts.statsdAddr, "statsd", "", "Send the counters of --metric to the StatsD server at host:port (requires --server)")
+	flag.Func("metric", "Count the lines matching the regex as the StatsD counter given as name=regex, may be repeated (requires --statsd)", metricFlag(&serverOpts.metrics))
+	flag.StringVar(&serverOpts.otlpEndpoint, "otlp-endpoint", "", "Export lines as OpenTelemetry logs to the OTLP endpoint, with gRPC to host:4317 or a grpc:// URL, with HTTP to host:4318 or a URL otherwise (requires --server)")
+	flag.StringVar(&serverOpts.archive, "archive", "", "Upload the rotated segments of file sinks to s3://bucket/prefix or gs://bucket/prefix, removing them locally (requires a rotated file sink)")
+	flag.BoolVar(&clientOpts.toClipboard, "to-clipboard", false, "Copy the received stream to the clipboard once it is over (requires --client)")
+	flag.Func("clipboard-match", "Copy the last line matching the regex to the clipboard as it is received (requires --client)", func(s string) error {
+		re, err := regexp.Compile(s)
+		clientOpts.clipboardMatch = re
+		return err
+	})
+	flag.Func("notify-desktop", "Raise a desktop notification for the lines matching the regex (requires --client)", func(s string) error {
+		re, err := regexp.Compile(s)
+		clientOpts.notifyDesktop = re
+		return err
+	})
+	flag.StringVar(&templateText, "template", "", "Format the lines written to sinks, or by a client to stdout, with a Go template of .Seq, .Time, .Timestamp, .Tag, .Topic and .Line, e.g. '{{.Timestamp}} [{{.Tag}}] {{.Line}}'")
+	flag.Func("multiline-start", "Group lines into records starting with the lines matching the regex, e.g. stack traces, before anything else (requires --server)", func(s string) error {
+		re, err := regexp.Compile(s)
+		serverOpts.multiline.Start = re
+		return err
+	})
+	flag.DurationVar(&serverOpts.multiline.Timeout, "multiline-timeout", teecp.DefaultMultilineTimeout, "How long a record waits for more lines (requires --multiline-start)")
+	flag.Func("input-encoding", "Convert the input from the encoding to UTF-8, e.g. latin1, windows-1252, shift_jis or utf-16le (requires --server)", func(s string) error {
+		enc, err := htmlindex.Get(s)
+		serverOpts.inputEncoding = enc
+		return err
+	})
+	flag.Func("newline", "End the lines written to sinks, or by a client to stdout, with lf, crlf or native", func(s string) error {
+		endings := map[string]string{"lf": "\n", "crlf": "\r\n", "native": "\n"}
+		if runtime.GOOS == "windows" {
+			endings["native"] = "\r\n"
+		}
+		var ok bool
+		if newline, ok = endings[s]; !ok {
+			return errors.New("expected lf, crlf or native")
+		}
+		return nil
+	})
+	flag.DurationVar(&serverOpts.coalesceDelay, "coalesce-delay", teecp.DefaultCoalesceDelay, "How long lines wait for the following ones to share a write to a client, 0 writing every line right away (requires --server)")
+	flag.Func("read-buffer", "How many bytes of stdin, or of the connection of a client, are read at once, e.g. 1M", func(s string) error {
+		size, err := sink.ParseSize(s)
+		if err != nil {
+			return err
+		}
+		if size > math.MaxInt32 {
+			return errors.New("read buffer too large")
+		}
+		serverOpts.readBuffer, clientOpts.readBuffer = int(size), int(size)
+		return nil
+	})
+	flag.Func("pause-buffer", "How many bytes of lines are held while the broadcast is paused, before the input waits, e.g. 256M (requires --server, default 64M)", func(s string) error {
+		size, err := sink.ParseSize(s)
+		if err != nil {
+			return err
+		}
+		if size > math.MaxInt {
+			return errors.New("pause buffer too large")
+		}
+		serverOpts.pauseBuffer = int(size)
+		return nil
+	})
+	flag.StringVar(&serverOpts.onConnect, "on-connect", "", "Run the shell command when a client connects, with TEECP_CLIENTS, TEECP_CLIENT_ID, TEECP_CLIENT_ADDR, TEECP_CLIENT_NAME and TEECP_CLIENT_LABEL_* in its environment (requires --server or --proxy)")
+	flag.StringVar(&serverOpts.onDisconnect, "on-disconnect", "", "Run the shell command when a client disconnects, with the variables of --on-connect and TEECP_DISCONNECT_ERROR (requires --server or --proxy)")
+	flag.DurationVar(&serverOpts.stallAlert, "stall-alert", 0, "Warn when the input goes without a line for the duration, e.g. 5m, often the sign that the producer died, running --stall-cmd if any (requires --server or --proxy)")
+	flag.StringVar(&serverOpts.stallCmd, "stall-cmd", "", "Run the shell command when the input stalls for --stall-alert, with TEECP_EVENT=stall and TEECP_LAST_INPUT, the time of the last line, in its environment (requires --server or --proxy)")
+	flag.DurationVar(&clientOpts.flushInterval, "flush-interval", 100*time.Millisecond, "How long received lines may be held before writing them to stdout, 0 writing every line right away (requires --client)")
+	flag.BoolVar(&clientOpts.ignoreSIGPIPE, "ignore-sigpipe", false, "Keep receiving once stdout is closed, e.g. for the notifications, instead of exiting (requires --client)")
+	flag.BoolVar(&serverOpts.passthrough, "passthrough", false, "Forward the bytes as they are, each client getting its own upstream connection, without filters, transforms, backlog nor sinks (requires --proxy)")
+	flag.StringVar(&serverOpts.user, "user", "", "Switch to the user, by name or ID, once listening, e.g. to bind a low port as root (requires --server)")
+	flag.StringVar(&serverOpts.group, "group", "", "Switch to the group, by name or ID, once listening, the primary group of --user by default (requires --server)")
+	flag.StringVar(&clientOpts.connect, "connect", "", "Connect to the server at host:port, srv://name for the DNS SRV records of name, consul://host:8500?service=name or etcd://host:2379?service=name for a registered server, or mdns://name for a server advertised on the local network, or http://host:port/stream to long-poll a server serving --http, instead of the local one (requires --client)")
+	flag.Func("register", "Register the server, while it runs, to consul://host:8500?service=name or etcd://host:2379?service=name (requires --server)", func(s string) error {
+		var err error
+		serverOpts.register, err = parseRegistry(s)
+		return err
+	})
+	flag.StringVar(&serverOpts.advertise, "advertise", "", "Advertise the server on the local network over mDNS under the name, listed by teecp ls (requires --server)")
+	flag.Func("pipe", `Listen on, or connect to, the Windows named pipe instead of the port, e.g. \\.\pipe\teecp`, func(s string) error {
+		serverOpts.pipe, clientOpts.pipe = s, s
+		return nil
+	})
+	flag.StringVar(&clientOpts.ssh, "ssh", "", "Connect through the SSH jump host, e.g. user@bastion, to the port or --connect host:port as reached from it (requires --client)")
+	flag.Func("egress-proxy", "Connect to the --connect or --proxy server through the proxy, socks5://host:1080 or http://host:3128 for HTTP CONNECT, instead of the one of ALL_PROXY", func(s string) error {
+		if _, err := egressDialer(s); err != nil {
+			return err
+		}
+		serverOpts.egressProxy, clientOpts.egressProxy = s, s
+		return nil
+	})
+	flag.BoolVar(&serverOpts.proxyProtocol, "proxy-protocol", false, "Expect the PROXY protocol header, version 1 or 2, of a load balancer on every connection, refusing those without it (requires --server or --proxy)")
+	flag.Func("psk", "Encrypt the connections with the pre-shared key, which clients and servers must share, also read from TEECP_PSK to keep it out of the process list", func(s string) error {
+		serverOpts.psk = newPSK(s)
+		clientOpts.psk = serverOpts.psk
+		return nil
+	})
+	flag.BoolVar(&useTLS, "tls", false, "Serve TLS, with a self-signed certificate made up for the run without --tls-cert, and connect to the other servers with TLS, or connect to the server with TLS")
+	flag.StringVar(&tlsCert, "tls-cert", "", "Serve TLS with the certificate of the PEM file, along with --tls-key (requires --server or --proxy)")
+	flag.StringVar(&tlsKey, "tls-key", "", "The PEM file of the private key of --tls-cert")
+	flag.Func("acme-domain", "Serve TLS with a certificate of Let's Encrypt for the domain, renewed automatically, the challenges being answered on the port 443 of --port or --web, or on --acme-http, may be repeated (requires --server or --proxy)", func(s string) error {
+		acmeDomains = append(acmeDomains, s)
+		return nil
+	})
+	flag.StringVar(&acmeCache, "acme-cache", "", "Keep the account and certificates of --acme-domain in the directory (default teecp/acme in the user cache directory)")
+	flag.StringVar(&serverOpts.acmeHTTP, "acme-http", "", "Answer the HTTP-01 challenges of --acme-domain on the address, e.g. :80")
+	flag.Func("pin-sha256", "Connect with TLS, only accepting the certificate of the server with the SHA-256 fingerprint, whoever signed it, may be repeated; with --server or --proxy, of the servers of --mirror, --cluster-peer and the upstream", pinFlag(&pins))
+	flag.StringVar(&clientOpts.consumerGroup, "consumer-group", "", "Join the group of clients of the name, which receive the lines in turn, a share each, rather than all of them, e.g. to distribute jobs among workers (requires --client)")
+	flag.BoolVar(&clientOpts.ack, "ack", false, "Acknowledge the lines once written to stdout, for a server with --acked to send them again when the client, known by its --name, connects again after losing the connection (requires --client)")
+	flag.BoolVar(&serverOpts.acked, "acked", false, "Retain the lines for the clients with --ack until they acknowledge them, sending them again as they reconnect, for consumers that must not lose a line (requires --server or --proxy)")
+	flag.StringVar(&serverOpts.ackSpool, "ack-spool", "", "Spill the lines retained by --acked beyond what memory keeps to files in the directory (default the temporary directory)")
+	flag.IntVar(&clientOpts.window, "window", 0, "Take up to N lines at once, granting the server credit again as they are written, for it to queue the rest rather than fill the TCP buffers (requires --client)")
+	flag.IntVar(&serverOpts.windowQueue, "window-queue", teecp.DefaultWindowQueue, "How many lines wait for a client of --window out of credit, before the broadcast waits for it (requires --server or --proxy)")
+	flag.BoolVar(&serverOpts.dropSlowClients, "drop-slow-clients", false, "Drop the lines of the clients of --window whose queue is full, rather than have the broadcast wait for them (requires --server or --proxy)")
+	flag.IntVar(&serverOpts.maxClients, "max-clients", 0, "Accept up to N connections at once, refusing those beyond, with an error for the clients aware of teecp (requires --server or --proxy)")
+	flag.IntVar(&serverOpts.maxConnsPerIP, "max-conns-per-ip", 0, "Accept up to N connections at once from the same IP address, refusing those beyond like --max-clients (requires --server or --proxy)")
+	flag.StringVar(&clientOpts.name, "name", "", "Name the client to the server, which shows it in its logs, /clients and metrics instead of the address alone (requires --client)")
+	flag.Func("label", "Label the client to the server as key=value, shown along with --name, may be repeated (requires --client)", labelFlag(&clientOpts.labels))
+	flag.Func("subscribe", "Receive the topics, comma-separated, broadcast by producers with --topic, instead of the lines without topic; a topic may be a pattern such as 'build/*', matching the topics that appear later as well (requires --client)", func(s string) error {
+		for _, topic := range strings.Split(s, ",") {
+			if !teecp.ValidTopicPattern(topic) {
+				return fmt.Errorf("invalid topic %q", topic)
+			}
+			clientOpts.subscribe = append(clientOpts.subscribe, topic)
+		}
+		return nil
+	})
+	flag.BoolVar(&clientOpts.showLatency, "show-latency", false, "Prefix the lines written to stdout with how long ago the server broadcast them, e.g. [+1.2s], telling the live stream from the backlog (requires --client)")
+	flag.BoolVar(&clientOpts.sendSize, "send-size", false, "Send the size of the terminal to the server as it is resized, for the command of --pty to render at its width when the server names this client its --pty-controller; Linux and macOS only (requires --client and --name)")
+	flag.BoolVar(&clientOpts.raw, "raw", false, "Write the bytes received to stdout as they are, right away, with no newline conversion, for progress bars, carriage returns and terminal control sequences to render as on the server (requires --client)")
+	flag.Func("since", "Only replay the backlog of the server from the time on, e.g. 10:42, 10:42:00, 2024-05-01T10:42:00Z or 15m for the last 15 minutes, refused by a server without --backlog (requires --client)", func(s string) error {
+		since, err := parseSince(s, time.Now())
+		clientOpts.since = since
+		return err
+	})
+	flag.BoolVar(&clientOpts.verify, "verify", false, "Check the stream against the SHA-256 the server sends once its input is over, exiting with an error when they differ or when lines were missed (requires --client)")
+	flag.BoolFunc("progress", "Report the bytes and lines broadcast, or received, with their rates, to stderr like pv", func(s string) error {
+		on, err := strconv.ParseBool(s)
+		serverOpts.progress, clientOpts.progress = on, on
+		return err
+	})
+	flag.Func("mirror", "Push the broadcast to the server at host:port, started with --accept-mirror, which broadcasts it to its own clients, may be repeated (requires --server or --proxy)", func(s string) error {
+		serverOpts.mirrors = append(serverOpts.mirrors, s)
+		return nil
+	})
+	flag.StringVar(&serverOpts.topic, "topic", "", "Broadcast the input as the topic, for the clients subscribing to it with --subscribe, e.g. along with --mirror to a server carrying several topics (requires --server or --proxy)")
+	flag.Func("cluster-peer", "Experimental: share the input with the server at host:port, another node of the cluster, and broadcast the union of the inputs of the nodes, may be repeated (requires --server)", func(s string) error {
+		serverOpts.clusterPeers = append(serverOpts.clusterPeers, s)
+		return nil
+	})
+	flag.StringVar(&serverOpts.clusterNode, "cluster-node", "", "Name of the node in the cluster, unique within it (default hostname:port)")
+	flag.BoolVar(&serverOpts.acceptMirror, "accept-mirror", false, "Broadcast what other servers push with --mirror, instead of stdin (requires --server)")
+	flag.StringVar(&serverOpts.follow, "follow", "", "Broadcast the lines written to the file, following it as it grows and once rotated, instead of stdin (requires --server)")
+	flag.StringVar(&serverOpts.exec, "exec", "", "Broadcast the output of the command, run by the shell, instead of stdin, exiting with an error when it fails (requires --server)")
+	flag.StringVar(&serverOpts.ptyController, "pty-controller", "", "Let the client of the --name, connecting with --send-size, size the terminal of --pty as its own, as it is resized (requires --pty)")
+	flag.BoolVar(&serverOpts.pty, "pty", false, "Run the command of --exec in a terminal of its own, for it to write colors and progress bars, broadcast as they come for clients with --raw; Linux and macOS only (requires --exec)")
+	flag.StringVar(&serverOpts.probes, "probes", "", "Serve Kubernetes probes on the address, /livez while running and /readyz until shutting down (requires --server)")
+	flag.DurationVar(&grace, "grace", 0, "On SIGTERM, keep broadcasting for up to the duration, until the input is over, before exiting")
+	flag.BoolVar(&sidecar, "sidecar", false, fmt.Sprintf("Run as a Kubernetes sidecar: tag lines with POD_NAMESPACE/POD_NAME, serve --probes on %s and wait --grace %s by default (requires --server)", sidecarProbes, sidecarGrace))
+	flag.BoolVar(&daemon, "daemon", false, "Run in the background, detached from the terminal, reading stdin from a file or a FIFO")
+	flag.StringVar(&pidfile, "pidfile", "", "Write the process ID to the file, removed on exit")
+	flag.StringVar(&pprofAddr, "pprof", "", "Serve the net/http/pprof profiles on the address, e.g. localhost:6060")
+	flag.IntVar(&serverOpts.backlog, "backlog", 0, "Replay the last N lines to every new client (requires --server)")
+	flag.Func("topic-backlog", "Replay the last N lines of a topic to the clients subscribing to it, instead of those of --backlog, given as topic=N, comma-separated, e.g. build=10000,deploy=1000 (requires --server)", topicBacklogFlag(&serverOpts.topicBacklogs))
+	flag.StringVar(&serverOpts.httpAddr, "http", "", "Serve the stream on the address at /stream, for clients long-polling it with --connect http://host:port/stream (requires --server)")
+	flag.StringVar(&serverOpts.health, "health", "", "Serve a health check on the address and path, e.g. :8086/healthz, answering the uptime, the clients and how long ago the last line came as JSON (requires --server)")
+	flag.StringVar(&serverOpts.webAddr, "web", "", "Serve a page viewing the stream live on the address, e.g. :8080 (requires --server)")
+	flag.StringVar(&serverOpts.metricsAddr, "metrics", "", "Serve Prometheus metrics at /metrics on the address, e.g. :9100, the clients at /clients, and pause or resume the broadcast on POST /pause and /resume (requires --server)")
+	flag.StringVar(&configPath, "config", "", "Read more filters, transforms and sinks from the file, one flag per line without dashes such as 'filter ERROR', applied again on SIGHUP (requires --server or --proxy)")
 	flag.Parse()
 
+	serverOpts.middlewares, serverOpts.bind, serverOpts.tag, serverOpts.sinks = stream.middlewares, stream.bind, stream.tag, stream.sinks
+	if configPath != "" {
+		config, err := loadConfig(configPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "invalid config:", err)
+			os.Exit(2)
+		}
+		serverOpts.config, serverOpts.configPath = config, configPath
+		serverOpts.tag = cmp.Or(serverOpts.tag, config.tag)
+	}
+
+	if secret := os.Getenv("TEECP_PSK"); secret != "" && serverOpts.psk == nil {
+		serverOpts.psk = newPSK(secret)
+		clientOpts.psk = serverOpts.psk
+	}
+
+	if serverClientSetted.isServer() || serverClientSetted.isProxy() {
+		var err error
+		switch {
+		case len(acmeDomains) > 0 && (useTLS || tlsCert != "" || tlsKey != ""):
+			err = errors.New("--acme-domain gets the certificate, without --tls, --tls-cert nor --tls-key")
+		case len(acmeDomains) > 0:
+			if serverOpts.acme, err = newACME(acmeDomains, acmeCache); err == nil {
+				serverOpts.tls = serverOpts.acme.TLSConfig()
+			}
+		case useTLS || tlsCert != "" || tlsKey != "":
+			serverOpts.tls, err = serverTLS(tlsCert, tlsKey)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		// A server serving TLS expects the other servers to, verifying each
+		// against its own host name.
+		if serverOpts.tls != nil || len(pins) > 0 {
+			serverOpts.peerTLS = clientTLS("", pins)
+		}
+	} else if useTLS || len(pins) > 0 {
+		// The servers found by discovery are verified each against its own host
+		// name, once resolved.
+		serverName := "localhost"
+		if discovered(clientOpts.connect) {
+			serverName = ""
+		} else if host, _, err := net.SplitHostPort(clientOpts.connect); err == nil {
+			serverName = host
+		}
+		clientOpts.tls = clientTLS(serverName, pins)
+	}
+
+	if sidecar {
+		set := map[string]bool{}
+		flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		if !set["probes"] {
+			serverOpts.probes = sidecarProbes
+		}
+		if !set["grace"] {
+			grace = sidecarGrace
+		}
+		serverOpts.tag = podTag()
+		tag, _ := tagMiddleware(serverOpts.tag)
+		serverOpts.middlewares = append(serverOpts.middlewares, tag)
+	}
+	if templateText != "" {
+		tmpl, err := teecp.NewTemplate(templateText, serverOpts.tag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "invalid template:", err)
+			os.Exit(2)
+		}
+		serverOpts.template, clientOpts.template = tmpl, tmpl
+	}
+	serverOpts.newline, clientOpts.newline = newline, newline
+
+	if daemon && os.Getenv(daemonEnv) == "" {
+		process, err := daemonize()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "could not run in the background:", err)
+			os.Exit(1)
+		}
+		fmt.Fprintln(os.Stderr, "running in the background with pid", process.Pid)
+		return
+	}
+	if pidfile != "" {
+		if err := os.WriteFile(pidfile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+			fmt.Fprintln(os.Stderr, "could not write the pidfile:", err)
+			os.Exit(1)
+		}
+	}
+
+	logLevel := slog.LevelWarn
+	if verbose {
+		logLevel = slog.LevelDebug
+	}
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+	asService := runningAsService()
+	if asService {
+		var err error
+		if logger, err = serviceLogger(logLevel); err != nil {
+			fmt.Fprintln(os.Stderr, "could not open the event log:", err)
+			os.Exit(1)
+		}
+	}
+
+	// Cancelling the context tears down every connection and goroutine.
+	ctx, draining, stop := gracefulContext(grace)
+	defer stop()
+	serverOpts.draining = draining
+
+	run := func(ctx context.Context) error {
+		if pprofAddr != "" {
+			if err := serveHTTP(ctx, pprofAddr, pprofHandler(), logger); err != nil {
+				return err
+			}
+		}
+
+		if serverClientSetted.isProxy() {
+			return proxyTeecp(ctx, port, logger, serverClientSetted, serverOpts)
+		} else if serverClientSetted.isServer() {
+			return serverTeecp(ctx, port, logger, serverOpts)
+		}
+		clientOpts.notifications = serverOpts.notifications
+		return listenerTeecp(ctx, port, logger, serverClientSetted, clientOpts)
+	}
 	var err error
-	if serverClientSetted.isServer() {
-		err = serverTeecp(port)
+	if asService {
+		err = runService(ctx, logger, run)
 	} else {
-		err = listenerTeecp(port, serverClientSetted)
+		err = run(ctx)
 	}
 
-	if err != nil {
+	if pidfile != "" {
+		os.Remove(pidfile)
+	}
+	if err != nil && !errors.Is(err, context.Canceled) {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
 
-func connectSocket(port int, appState appStateDescription) (net.Conn, error) {
+func connectSocket(ctx context.Context, port int, opts clientOptions, appState appStateDescription) (net.Conn, error) {
 	var conn net.Conn
 	var err error
+	var dialer net.Dialer
 	start := time.Now()
 
 	if appState.waitConnection > 0 {
@@ -132,7 +862,19 @@ func connectSocket(port int, appState appStateDescription) (net.Conn, error) {
 	}
 
 	for {
-		conn, err = net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+		if opts.pipe != "" {
+			conn, err = dialPipe(ctx, opts.pipe)
+		} else if opts.ssh != "" {
+			target := opts.connect
+			if target == "" {
+				target = fmt.Sprintf("localhost:%d", port)
+			}
+			conn, err = dialSSH(ctx, opts.ssh, target)
+		} else if opts.connect != "" {
+			conn, err = dialTarget(ctx, opts.connect, opts.egressProxy, opts.tls)
+		} else {
+			conn, err = dialer.DialContext(ctx, "tcp", fmt.Sprintf("localhost:%d", port))
+		}
 
 		if appState.waitConnection == 0 || time.Since(start) > appState.waitConnection || appState.waitConnection < appState.retryInterval {
 			break
@@ -143,96 +885,747 @@ func connectSocket(port int, appState appStateDescription) (net.Conn, error) {
 		}
 
 		fmt.Fprintf(os.Stderr, "Waiting for %f seconds\n", appState.retryInterval.Seconds())
-		time.Sleep(appState.retryInterval)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(appState.retryInterval):
+		}
 	}
 
+	// dialTarget secures the connections to --connect itself, server by server.
+	if err == nil && opts.tls != nil && (opts.pipe != "" || opts.ssh != "" || opts.connect == "") {
+		conn, err = tlsClient(conn, withServerName(opts.tls, "localhost"))
+	}
+	if err == nil && opts.psk != nil {
+		return encrypt(conn, opts.psk)
+	}
 	return conn, err
 }
 
-func listenerTeecp(port int, appState appStateDescription) error {
-	conn, err := connectSocket(port, appState)
+// encrypt readies the connection to a server for the pre-shared key, closing it
+// when that fails.
+func encrypt(conn net.Conn, key *psk) (net.Conn, error) {
+	encrypted, err := key.client(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return encrypted, nil
+}
+
+// dialTarget connects to the server given to --connect or --proxy: host:port,
+// srv://name for the hosts of the DNS SRV records of name, tried in the order of
+// their priority and weight, consul:// or etcd:// for the servers registered to
+// a registry, or mdns://name for a server advertised on the local network. The
+// connection goes through the egress proxy, if any, see egressDialer. With
+// config, it is secured with TLS, the certificate being verified against the
+// host dialed unless config names the server.
+func dialTarget(ctx context.Context, target, egressProxy string, config *tls.Config) (net.Conn, error) {
+	dialer, err := egressDialer(egressProxy)
+	if err != nil {
+		return nil, err
+	}
+	dial := func(addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil || config == nil {
+			return conn, err
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		return tlsClient(conn, withServerName(config, host))
+	}
+	if name, ok := strings.CutPrefix(target, "mdns://"); ok {
+		addr, err := resolveMDNS(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return dial(addr)
+	}
+	var addrs []string
+	if name, ok := strings.CutPrefix(target, "srv://"); ok {
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range records {
+			addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+		}
+	} else if discovered(target) {
+		r, err := parseRegistry(target)
+		if err != nil {
+			return nil, err
+		}
+		if addrs, err = r.resolve(ctx); err != nil {
+			return nil, err
+		}
+	} else {
+		return dial(target)
+	}
+
+	err = fmt.Errorf("no server found for %s", target)
+	for _, addr := range addrs {
+		var conn net.Conn
+		if conn, err = dial(addr); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// discovered tells if target names servers to find, with DNS SRV records, a
+// registry or mDNS, rather than the address of one.
+func discovered(target string) bool {
+	scheme, _, _ := strings.Cut(target, "://")
+	switch scheme {
+	case "srv", "mdns", "consul", "consul+https", "etcd", "etcd+https":
+		return true
+	}
+	return false
+}
 
+func listenerTeecp(ctx context.Context, port int, logger *slog.Logger, appState appStateDescription, opts clientOptions) error {
+	notifiers, err := openNotifiers(opts.notifications, logger)
 	if err != nil {
+		return err
+	}
+	defer closeSinks(notifiers, logger)
+
+	// An HTTP server is polled, instead of keeping a connection open.
+	longPoll := opts.ssh == "" && (strings.HasPrefix(opts.connect, "http://") || strings.HasPrefix(opts.connect, "https://"))
+	if longPoll && opts.verify {
+		return errors.New("--verify needs a teecp connection, not HTTP long-polling")
+	}
+	if opts.verify && len(opts.subscribe) > 0 {
+		return errors.New("--verify checks the lines without topic, not those of --subscribe")
+	}
+	if opts.verify && opts.consumerGroup != "" {
+		return errors.New("--verify checks every line, not the share of --consumer-group")
+	}
+	if longPoll && opts.consumerGroup != "" {
+		return errors.New("--consumer-group needs a teecp connection, not HTTP long-polling")
+	}
+	switch {
+	case opts.ack && longPoll:
+		return errors.New("--ack needs a teecp connection, not HTTP long-polling")
+	case opts.ack && opts.name == "":
+		return errors.New("--ack needs a --name, which the server retains the lines for")
+	case opts.ack && opts.consumerGroup != "":
+		return errors.New("--ack and --consumer-group do not go together")
+	}
+	switch {
+	case opts.raw && opts.template != nil:
+		return errors.New("--raw writes the bytes as received, not formatted by --template")
+	case opts.raw && opts.showLatency:
+		return errors.New("--raw writes the bytes as received, without the age of --show-latency")
+	case opts.sendSize && opts.name == "":
+		return errors.New("--send-size needs a --name, which the server names its --pty-controller")
+	case opts.sendSize && longPoll:
+		return errors.New("--send-size needs a teecp connection, not HTTP long-polling")
+	}
+	var conn net.Conn
+	if !longPoll {
+		conn, err = connectSocket(ctx, port, opts, appState)
+	}
+
+	if err != nil && opts.pipe != "" {
+		return fmt.Errorf("could not open pipe %s: %w", opts.pipe, err)
+	} else if err != nil && opts.ssh != "" {
+		return fmt.Errorf("could not connect through %s: %w", opts.ssh, err)
+	} else if err != nil && opts.connect != "" {
+		return fmt.Errorf("could not connect to %s: %w", opts.connect, err)
+	} else if err != nil {
 		return fmt.Errorf("could not open socket to port %d: %w", port, err)
 	}
 
-	defer conn.Close()
+	var desktop *desktopNotifier
+	if opts.notifyDesktop != nil {
+		desktop = newDesktopNotifier(opts.notifyDesktop, logger)
+		defer desktop.close()
+	}
 
-	reader := bufio.NewReader(conn)
-	for {
-		txt, err := reader.ReadString('\n')
+	// A closed stdout, as with teecp --client | head, ends the reception quietly.
+	failOnBrokenPipe()
+	var stdout io.Writer = os.Stdout
+	// Only the lines written to stdout are acknowledged, and raw output is
+	// written as it arrives.
+	if opts.flushInterval > 0 && !opts.ack && !opts.raw {
+		buffered := newBufferedOutput(os.Stdout, opts.flushInterval)
+		defer buffered.Flush()
+		stdout = buffered
+	}
+	write := func(m teecp.Message) error {
+		_, err := stdout.Write(m.Data)
+		if opts.ignoreSIGPIPE && isBrokenPipe(err) {
+			logger.Debug("stdout closed, discarding the stream")
+			stdout, err = io.Discard, nil
+		}
+		return err
+	}
+	if opts.showLatency {
+		write = withLatency(write)
+	}
+	output := write
+	if !opts.raw {
+		output = formatOutput(write, opts.template, opts.newline)
+	}
+
+	var received bytes.Buffer
+	client := teecp.Client{Features: []teecp.Feature{teecp.FeatureFramed}, Logger: logger, ReadBufferSize: opts.readBuffer, Verify: opts.verify, Name: opts.name, Labels: opts.labels, Subscribe: opts.subscribe, Group: opts.consumerGroup, Ack: opts.ack, Window: opts.window, Since: opts.since}
+	if opts.sendSize {
+		sizes, err := terminalSizes(ctx)
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
+			return fmt.Errorf("--send-size: %w", err)
+		}
+		client.Resize = sizes
+	}
+	// The server tells why it ended the stream, not to be mistaken for a failure,
+	// after the lines it sent before.
+	client.OnStreamEnd = func(reason string) {
+		if buffered, ok := stdout.(*bufferedOutput); ok {
+			buffered.Flush()
+		}
+		fmt.Fprintf(os.Stderr, "stream-end reason=%s\n", reason)
+	}
+	receive := func(m teecp.Message) error {
+		if err := output(m); err != nil {
+			return err
+		}
+		for _, n := range notifiers {
+			n.Write(m)
+		}
+
+		line := bytes.TrimSuffix(m.Data, []byte("\n"))
+		if desktop != nil {
+			desktop.notify(line)
+		}
+		if opts.clipboardMatch != nil {
+			if opts.clipboardMatch.Match(line) {
+				if err := copyToClipboard(line); err != nil {
+					logger.Warn("could not copy to the clipboard", "err", err)
+				}
 			}
-			return fmt.Errorf("error reading stream: %w\nclosing", err)
+		} else if opts.toClipboard {
+			received.Write(m.Data)
 		}
+		return nil
+	}
+	if opts.progress {
+		meter := startProgress()
+		defer meter.stop()
+		output := receive
+		receive = func(m teecp.Message) error {
+			meter.count(m)
+			return output(m)
+		}
+	}
+	if longPoll {
+		err = client.ReceiveHTTP(ctx, opts.connect, receive)
+	} else {
+		err = client.ReceiveMessages(ctx, conn, receive)
+	}
+	if isBrokenPipe(err) {
+		logger.Debug("stdout closed, disconnecting")
+		err = nil
+	}
 
-		// Fprint not strictly needed, but doing so for consistency.
-		fmt.Fprint(os.Stdout, txt)
+	if opts.toClipboard && opts.clipboardMatch == nil && received.Len() > 0 {
+		if err := copyToClipboard(received.Bytes()); err != nil {
+			logger.Warn("could not copy to the clipboard", "err", err)
+		}
 	}
+	return err
+}
 
-	return nil
+// formatOutput makes receive get the messages formatted by the template, if any,
+// and with the newline, if any.
+func formatOutput(receive teecp.MessageReceiver, tmpl *teecp.Template, newline string) teecp.MessageReceiver {
+	if newline != "" {
+		receive = teecp.NormalizeNewlines(newline, receive)
+	}
+	if tmpl != nil {
+		receive = tmpl.Apply(receive)
+	}
+	return receive
 }
 
-func serverTeecp(port int) error {
-	// When creating the teecp.Clients, always have a local client so we can see the echo.
-	clients := teecp.Clients{}
-	clients.Attach(func(msg string) bool {
-		fmt.Print(msg)
+// setupServer applies the server options, echoing the broadcast to stdout. The
+// stream tells where the broadcast comes from. The returned function releases what
+// was set up once the server is done.
+func setupServer(ctx context.Context, server *teecp.Server, stream string, logger *slog.Logger, opts serverOptions) (func(), error) {
+	server.Logger = logger
+	server.Topic = opts.topic
+	for _, bind := range opts.bind {
+		bind(server, 0)
+	}
+	server.Use(opts.middlewares...)
+	if opts.multiline.Start != nil {
+		server.Multiline = &opts.multiline
+	}
+	// --coalesce-delay 0 means no coalescing, which the server spells with a
+	// negative delay.
+	server.ReadBufferSize = opts.readBuffer
+	server.PauseBuffer = opts.pauseBuffer
+	server.CoalesceDelay = opts.coalesceDelay
+	if opts.coalesceDelay == 0 {
+		server.CoalesceDelay = -1
+	}
+	if opts.backlog > 0 {
+		server.Backlog = teecp.NewReplayBuffer(opts.backlog)
+	}
+	if opts.acked {
+		server.Acked = &teecp.AckedDelivery{SpoolDir: opts.ackSpool}
+	}
+	server.WindowQueue = opts.windowQueue
+	server.DropSlowClients = opts.dropSlowClients
+	server.MaxClients = opts.maxClients
+	server.MaxConnsPerIP = opts.maxConnsPerIP
+	for topic, n := range opts.topicBacklogs {
+		if server.TopicBacklogs == nil {
+			server.TopicBacklogs = make(map[string]*teecp.ReplayBuffer)
+		}
+		server.TopicBacklogs[topic] = teecp.NewReplayBuffer(n)
+	}
+
+	// Always have a local client so we can see the echo.
+	server.Attach(func(msg []byte) bool {
+		os.Stdout.Write(msg)
 		return true
 	})
 
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if opts.metricsAddr != "" {
+		metrics := &teecp.PrometheusMetrics{}
+		server.Metrics = metrics
+
+		if err := serveHTTP(ctx, opts.metricsAddr, adminHandler(server, metrics), logger); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.httpAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/stream", server)
+		if err := serveHTTP(ctx, opts.httpAddr, mux, logger); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.health != "" {
+		addr, path := opts.health, "/healthz"
+		if i := strings.Index(opts.health, "/"); i >= 0 {
+			addr, path = opts.health[:i], opts.health[i:]
+		}
+		if err := serveHTTP(ctx, addr, healthHandler(server, path, time.Now()), logger); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.webAddr != "" {
+		if err := serveHTTPTLS(ctx, opts.webAddr, webHandler(server, logger), opts.tls, logger); err != nil {
+			return nil, err
+		}
+	}
+	if opts.acme != nil && opts.acmeHTTP != "" {
+		if err := serveHTTP(ctx, opts.acmeHTTP, opts.acme.HTTPHandler(nil), logger); err != nil {
+			return nil, err
+		}
+	}
+	togglePauseOnSignal(ctx, server)
+
+	var sinks []sink.Sink
+	var handles []*teecp.Handle
+	var archiver *sink.Archiver
+	var meter *progress
+	var hooks *clientHooks
+	var config *configuration
+	release := func() {
+		for _, h := range handles {
+			h.Detach()
+		}
+		if config != nil {
+			config.close()
+		}
+		if meter != nil {
+			meter.stop()
+		}
+		if hooks != nil {
+			hooks.close()
+		}
+		closeSinks(sinks, logger)
+		if archiver != nil {
+			archiver.Close()
+		}
+	}
+
+	notifiers, err := openNotifiers(opts.notifications, logger)
 	if err != nil {
-		return fmt.Errorf("could not open socket to port %d: %w", port, err)
+		return nil, err
+	}
+	for _, n := range notifiers {
+		sinks = append(sinks, n)
+		handles = append(handles, sink.Attach(server, n))
 	}
-	defer ln.Close()
 
-	// Create a channel so we can signal to the goroutine that it can quit.
-	quit := make(chan bool)
-	defer close(quit)
+	if (opts.statsdAddr == "") != (len(opts.metrics) == 0) {
+		release()
+		return nil, errors.New("--statsd and --metric go together")
+	}
+	if opts.statsdAddr != "" {
+		s, err := sink.StatsD(opts.statsdAddr, opts.metrics, logger)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		sinks = append(sinks, s)
+		handles = append(handles, sink.Attach(server, s))
+	}
 
-	go acceptNewConns(ln, &clients, quit)
+	if opts.otlpEndpoint != "" {
+		hostname, _ := os.Hostname()
+		resource := map[string]string{"service.name": "teecp", "host.name": hostname, "teecp.stream": stream}
+		if opts.tag != "" {
+			resource["teecp.tag"] = opts.tag
+		}
+		s, err := sink.OTLP(opts.otlpEndpoint, resource, logger)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		sinks = append(sinks, s)
+		handles = append(handles, sink.Attach(server, s))
+	}
 
-	reader := bufio.NewReader(os.Stdin)
-	for {
-		txt, err := reader.ReadString('\n')
+	for _, rawURL := range opts.sinks {
+		s, err := sink.Open(rawURL, logger)
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				break
+			release()
+			return nil, err
+		}
+		sinks = append(sinks, s)
+		handles = append(handles, server.AttachMessages(formatOutput(s.Write, opts.template, opts.newline)))
+	}
+	if opts.config != nil {
+		config = &configuration{
+			path:   opts.configPath,
+			server: server,
+			base:   opts.middlewares,
+			output: func(s sink.Sink) teecp.MessageReceiver {
+				return formatOutput(s.Write, opts.template, opts.newline)
+			},
+			logger: logger,
+		}
+		if err := config.apply(opts.config); err != nil {
+			release()
+			return nil, err
+		}
+		config.reloadOnSignal(ctx)
+	}
+
+	if opts.archive != "" {
+		var err error
+		if archiver, err = sink.NewArchiver(opts.archive, logger); err != nil {
+			release()
+			return nil, err
+		}
+
+		archived := sinks
+		if config != nil {
+			archived = slices.Concat(sinks, config.archive(archiver))
+		}
+		var rotated bool
+		for _, s := range archived {
+			if f, ok := s.(*sink.File); ok && f.Rotates() {
+				f.OnRotate(archiver.Archive)
+				rotated = true
 			}
-			return fmt.Errorf("error reading form stdin: %w\nclosing teecp", err)
 		}
-		clients.Broadcast(txt)
+		if !rotated {
+			release()
+			return nil, errors.New("--archive requires a file sink with rotate or every")
+		}
 	}
 
-	return nil
+	if opts.progress {
+		meter = startProgress()
+		handles = append(handles, server.AttachMessages(meter.count))
+	}
+	if opts.onConnect != "" || opts.onDisconnect != "" {
+		hooks = startClientHooks(server, opts.onConnect, opts.onDisconnect, logger)
+	}
+	if opts.stallCmd != "" && opts.stallAlert == 0 {
+		release()
+		return nil, errors.New("--stall-cmd needs --stall-alert")
+	}
+	if opts.stallAlert > 0 {
+		go watchStall(ctx, server, opts.stallAlert, opts.stallCmd, logger)
+	}
+	for _, target := range opts.mirrors {
+		server.Mirror(ctx, func(ctx context.Context) (net.Conn, error) {
+			return dialServer(ctx, target, opts)
+		})
+	}
+	return release, nil
 }
 
-func acceptNewConns(ln net.Listener, clients *teecp.Clients, quit chan bool) {
-	// We need the label to break out of the for loop because otherwise we would only break out of the select.
-LOOP:
-	for {
-		select {
-		case <-quit:
-			// Break out of the loop.
-			break LOOP
-		default:
-			conn, err := ln.Accept()
-			if err != nil {
-				os.Stderr.WriteString(fmt.Sprintf("tried to connect but failed %s\n", err.Error()))
-				return
+// listen opens the listener of a server, on the port or the named pipe, or takes
+// it from systemd, and then drops the privileges for --user and --group, binding
+// being what needed them. With --advertise, the port is announced over mDNS, and
+// with --register it is registered until the listener is closed.
+func listen(ctx context.Context, port int, logger *slog.Logger, opts serverOptions) (net.Listener, error) {
+	ln, err := activationListener()
+	if ln == nil && err == nil && opts.pipe != "" {
+		if ln, err = listenPipe(opts.pipe); err != nil {
+			err = fmt.Errorf("could not open pipe %s: %w", opts.pipe, err)
+		}
+	} else if ln == nil && err == nil {
+		var lc net.ListenConfig
+		if ln, err = lc.Listen(ctx, "tcp", fmt.Sprintf(":%d", port)); err != nil {
+			err = fmt.Errorf("could not open socket to port %d: %w", port, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var prepare []func(conn net.Conn) (net.Conn, error)
+	if opts.proxyProtocol {
+		prepare = append(prepare, readProxyHeader)
+	}
+	if opts.tls != nil {
+		prepare = append(prepare, tlsServer(opts.tls))
+	}
+	if opts.psk != nil {
+		prepare = append(prepare, opts.psk.server)
+	}
+	if len(prepare) > 0 {
+		ln = newPreparedListener(ln, logger, prepare...)
+	}
+
+	if err := dropPrivileges(opts.user, opts.group); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	if opts.probes != "" {
+		if err := serveHTTP(ctx, opts.probes, probesHandler(opts.draining), logger); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	if opts.advertise == "" && opts.register == nil {
+		return ln, nil
+	}
+	addr, ok := ln.Addr().(*net.TCPAddr)
+	if !ok {
+		ln.Close()
+		return nil, errors.New("--advertise and --register need a TCP port")
+	}
+	if opts.advertise != "" {
+		if err := advertise(ctx, opts.advertise, addr.Port, logger); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	if opts.register != nil {
+		deregister, err := opts.register.register(addr.Port, logger)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+		ln = &registeredListener{Listener: ln, registry: deregister}
+	}
+	return ln, nil
+}
+
+// activationListener returns the socket passed by systemd socket activation, if
+// any: the first of LISTEN_FDS, when LISTEN_PID is the current process.
+func activationListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	if n, err := strconv.Atoi(os.Getenv("LISTEN_FDS")); err != nil || n < 1 {
+		return nil, nil
+	}
+	// The sockets are not for child processes.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	// Passed sockets start right after stderr.
+	f := os.NewFile(3, "systemd-socket")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not use the socket passed by systemd: %w", err)
+	}
+	return ln, nil
+}
+
+func serverTeecp(ctx context.Context, port int, logger *slog.Logger, opts serverOptions) error {
+	// Stop accepting connections once the input is over.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var input io.Reader = os.Stdin
+	stream := "stdin"
+	switch {
+	case opts.acceptMirror && opts.follow != "":
+		return errors.New("--accept-mirror and --follow are two inputs, choose one")
+	case opts.exec != "" && (opts.acceptMirror || opts.follow != ""):
+		return errors.New("--exec is an input of its own, not to go with --accept-mirror or --follow")
+	case opts.pty && opts.exec == "":
+		return errors.New("--pty needs a command to run with --exec")
+	case opts.ptyController != "" && !opts.pty:
+		return errors.New("--pty-controller sizes the terminal of --pty")
+	case opts.acceptMirror && len(opts.clusterPeers) > 0:
+		return errors.New("--accept-mirror has no input of its own to share with --cluster-peer")
+	case opts.acceptMirror:
+		stream = "mirror"
+	case opts.follow != "":
+		input, stream = newFollower(ctx, opts.follow, opts.draining), opts.follow
+	case opts.exec != "":
+		stream = opts.exec
+	}
+
+	// The stream is hashed for the clients with --verify.
+	server := teecp.Server{Features: []teecp.Feature{teecp.FeatureChecksum}, AcceptMirrors: opts.acceptMirror, RawInput: opts.pty}
+	release, err := setupServer(ctx, &server, stream, logger, opts)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if len(opts.clusterPeers) > 0 {
+		joinCluster(ctx, &server, port, opts)
+	}
+
+	ln, err := listen(ctx, port, logger, opts)
+	if err != nil {
+		return err
+	}
+
+	// The command starts once the privileges are dropped, and before the clients
+	// are served, for its terminal to be there to be sized by the first ones.
+	var command *command
+	if opts.exec != "" {
+		if command, err = startCommand(opts.exec, opts.pty); err != nil {
+			ln.Close()
+			return err
+		}
+		input = command
+	}
+	if opts.ptyController != "" {
+		server.ResizeController = opts.ptyController
+		server.Resize = func(size teecp.TerminalSize) {
+			if err := command.resize(size); err != nil {
+				logger.Warn("could not resize the terminal", "err", err)
 			}
+		}
+	}
 
-			// Add the connection as a client.
-			clients.Attach(func(msg string) bool {
-				if _, err := fmt.Fprint(conn, msg); err != nil {
-					conn.Close()
-					return false
-				}
-				return true
-			})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := server.Serve(ctx, ln); err != nil && ctx.Err() == nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	if opts.acceptMirror {
+		return server.BroadcastMirrored(ctx)
+	}
+	if opts.inputEncoding != nil {
+		input = transform.NewReader(input, opts.inputEncoding.NewDecoder())
+	}
+	err = server.BroadcastFrom(ctx, input)
+	if command != nil {
+		if waitErr := command.wait(err != nil); err == nil {
+			err = waitErr
 		}
 	}
+	return err
+}
+
+// dialServer connects to another teecp server, to relay it, to mirror to it or to
+// share the input with it as a node of the cluster, through the egress proxy,
+// with TLS and with the pre-shared key, if any.
+func dialServer(ctx context.Context, target string, opts serverOptions) (net.Conn, error) {
+	conn, err := dialTarget(ctx, target, opts.egressProxy, opts.peerTLS)
+	if err != nil || opts.psk == nil {
+		return conn, err
+	}
+	return encrypt(conn, opts.psk)
+}
+
+// joinCluster makes the server a node of the cluster of the other nodes given with
+// --cluster-peer.
+func joinCluster(ctx context.Context, server *teecp.Server, port int, opts serverOptions) {
+	server.ClusterNode = opts.clusterNode
+	if server.ClusterNode == "" {
+		hostname, _ := os.Hostname()
+		server.ClusterNode = net.JoinHostPort(hostname, strconv.Itoa(port))
+	}
+	for _, target := range opts.clusterPeers {
+		server.JoinCluster(ctx, func(ctx context.Context) (net.Conn, error) {
+			return dialServer(ctx, target, opts)
+		})
+	}
+}
+
+// passthroughRefused returns the flags given of what a --passthrough proxy does
+// not do: the options setupServer handles, the stream flags, and --sidecar for
+// the tag it adds.
+func passthroughRefused() []string {
+	server := []string{
+		"config", "backlog", "topic-backlog", "topic", "acked", "ack-spool", "window-queue", "drop-slow-clients",
+		"max-clients", "max-conns-per-ip", "coalesce-delay", "read-buffer", "pause-buffer", "multiline-start",
+		"multiline-timeout", "template", "newline", "notify", "statsd", "metric", "otlp-endpoint", "archive",
+		"mirror", "http", "health", "web", "metrics", "acme-http", "progress", "on-connect", "on-disconnect",
+		"stall-alert", "stall-cmd", "sidecar",
+	}
+	stream := flag.NewFlagSet("stream", flag.ContinueOnError)
+	(&streamFlags{}).define(stream)
+
+	var refused []string
+	flag.Visit(func(f *flag.Flag) {
+		if slices.Contains(server, f.Name) || stream.Lookup(f.Name) != nil {
+			refused = append(refused, "--"+f.Name)
+		}
+	})
+	return refused
+}
+
+func proxyTeecp(ctx context.Context, port int, logger *slog.Logger, appState appStateDescription, opts serverOptions) error {
+	proxy := teecp.Proxy{
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			return dialServer(ctx, appState.upstream, opts)
+		},
+		Client:        teecp.Client{Features: []teecp.Feature{teecp.FeatureFramed}, Logger: logger, ReadBufferSize: opts.readBuffer},
+		RetryInterval: appState.retryInterval,
+	}
+	if opts.passthrough {
+		if refused := passthroughRefused(); len(refused) > 0 {
+			return fmt.Errorf("--passthrough forwards the bytes as they are, without filters, transforms, backlog, sinks nor the other options of a server: %s", strings.Join(refused, ", "))
+		}
+		proxy.Passthrough = true
+		proxy.Server.Logger = logger
+
+		ln, err := listen(ctx, port, logger, opts)
+		if err != nil {
+			return err
+		}
+		return proxy.Run(ctx, ln)
+	}
+
+	release, err := setupServer(ctx, &proxy.Server, appState.upstream, logger, opts)
+	if err != nil {
+		return err
+	}
+	defer release()
+	proxy.Client.Metrics = proxy.Server.Metrics
+
+	ln, err := listen(ctx, port, logger, opts)
+	if err != nil {
+		return err
+	}
+	return proxy.Run(ctx, ln)
 }
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// mdnsService is the DNS-SD service type servers are advertised as.
+const mdnsService = "_teecp._tcp.local."
+
+// mdnsServices is asked by browsers for every service type on the network.
+const mdnsServices = "_services._dns-sd._udp.local."
+
+// mdnsTTL is how long, in seconds, the records of a server may be cached.
+const mdnsTTL = 120
+
+// mdnsLegacyTTL caps the records sent to plain DNS resolvers, as RFC 6762 asks.
+const mdnsLegacyTTL = 10
+
+// mdnsResolveTimeout bounds how long servers are looked for by name.
+const mdnsResolveTimeout = 3 * time.Second
+
+// mdnsCacheFlush marks the records only the server owns, in the class of
+// multicast answers.
+const mdnsCacheFlush = 1 << 15
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdnsServer is a server found on the local network.
+type mdnsServer struct {
+	name  string
+	host  string
+	port  uint16
+	addrs []net.IP
+}
+
+// address is where the server is reached, its host name when it did not tell its
+// IPv4 addresses.
+func (s mdnsServer) address() string {
+	host := strings.TrimSuffix(s.host, ".")
+	for _, ip := range s.addrs {
+		if ip.To4() != nil {
+			host = ip.String()
+			break
+		}
+	}
+	return net.JoinHostPort(host, fmt.Sprint(s.port))
+}
+
+// mdnsAdvertiser answers the mDNS queries for a server, as a DNS-SD instance of
+// mdnsService.
+type mdnsAdvertiser struct {
+	instance dnsmessage.Name
+	host     dnsmessage.Name
+	port     uint16
+	addrs    []net.IP
+}
+
+// advertise announces the server listening on port as name on the local network
+// until ctx is done, when it says goodbye.
+func advertise(ctx context.Context, name string, port int, logger *slog.Logger) error {
+	if name == "" || strings.Contains(name, ".") {
+		return fmt.Errorf("invalid name to advertise %q", name)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	hostname, _, _ = strings.Cut(hostname, ".")
+
+	a := &mdnsAdvertiser{port: uint16(port)}
+	if a.instance, err = dnsmessage.NewName(name + "." + mdnsService); err != nil {
+		return err
+	}
+	if a.host, err = dnsmessage.NewName(hostname + ".local."); err != nil {
+		return err
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && !ipnet.IP.IsLinkLocalUnicast() {
+			a.addrs = append(a.addrs, ipnet.IP)
+		}
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return fmt.Errorf("could not join the mDNS group: %w", err)
+	}
+	context.AfterFunc(ctx, func() {
+		a.send(conn, mdnsGroup, dnsmessage.Header{}, nil, a.records(0))
+		conn.Close()
+	})
+	go a.serve(conn, logger)
+	go func() {
+		// Announce the server twice, as some packets get lost.
+		for range 2 {
+			a.send(conn, mdnsGroup, dnsmessage.Header{}, nil, a.records(mdnsTTL))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+	return nil
+}
+
+// records are all the records of the server, with their time to live in seconds,
+// zero saying goodbye.
+func (a *mdnsAdvertiser) records(ttl uint32) []dnsmessage.Resource {
+	service := dnsmessage.MustNewName(mdnsService)
+	unique := dnsmessage.ClassINET | mdnsCacheFlush
+	records := []dnsmessage.Resource{
+		{
+			Header: dnsmessage.ResourceHeader{Name: service, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.PTRResource{PTR: a.instance},
+		},
+		{
+			Header: dnsmessage.ResourceHeader{Name: a.instance, Type: dnsmessage.TypeSRV, Class: unique, TTL: ttl},
+			Body:   &dnsmessage.SRVResource{Target: a.host, Port: a.port},
+		},
+		{
+			Header: dnsmessage.ResourceHeader{Name: a.instance, Type: dnsmessage.TypeTXT, Class: unique, TTL: ttl},
+			Body:   &dnsmessage.TXTResource{TXT: []string{"txtvers=1"}},
+		},
+	}
+	for _, ip := range a.addrs {
+		if ip4 := ip.To4(); ip4 != nil {
+			records = append(records, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: a.host, Type: dnsmessage.TypeA, Class: unique, TTL: ttl},
+				Body:   &dnsmessage.AResource{A: [4]byte(ip4)},
+			})
+		} else {
+			records = append(records, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: a.host, Type: dnsmessage.TypeAAAA, Class: unique, TTL: ttl},
+				Body:   &dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())},
+			})
+		}
+	}
+	return records
+}
+
+func (a *mdnsAdvertiser) serve(conn *net.UDPConn, logger *slog.Logger) {
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Warn("mdns advertising stopped", "err", err)
+			}
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil || query.Response {
+			continue
+		}
+		answers := a.answer(query.Questions)
+		if len(answers) == 0 {
+			continue
+		}
+		if from.Port != mdnsGroup.Port {
+			// A plain DNS resolver asking, which expects a unicast answer to its
+			// question.
+			for i := range answers {
+				answers[i].Header.TTL = min(answers[i].Header.TTL, mdnsLegacyTTL)
+				answers[i].Header.Class &^= mdnsCacheFlush
+			}
+			a.send(conn, from, dnsmessage.Header{ID: query.ID}, query.Questions, answers)
+			continue
+		}
+		a.send(conn, mdnsGroup, dnsmessage.Header{}, nil, answers)
+	}
+}
+
+// answer returns the records answering the questions, with those a browser will
+// ask next: the SRV, TXT and addresses of an instance it is told about.
+func (a *mdnsAdvertiser) answer(questions []dnsmessage.Question) []dnsmessage.Resource {
+	var answers []dnsmessage.Resource
+	records := a.records(mdnsTTL)
+	for _, q := range questions {
+		name := strings.ToLower(q.Name.String())
+		switch {
+		case name == mdnsServices && (q.Type == dnsmessage.TypePTR || q.Type == dnsmessage.TypeALL):
+			answers = append(answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: mdnsTTL},
+				Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(mdnsService)},
+			})
+		case name == mdnsService && (q.Type == dnsmessage.TypePTR || q.Type == dnsmessage.TypeALL):
+			answers = append(answers, records...)
+		case strings.EqualFold(name, a.instance.String()):
+			for _, r := range records[1:] {
+				if q.Type == dnsmessage.TypeALL || r.Header.Type == q.Type || r.Header.Name == a.host {
+					answers = append(answers, r)
+				}
+			}
+		case strings.EqualFold(name, a.host.String()):
+			for _, r := range records[3:] {
+				if q.Type == dnsmessage.TypeALL || r.Header.Type == q.Type {
+					answers = append(answers, r)
+				}
+			}
+		}
+	}
+	return answers
+}
+
+func (a *mdnsAdvertiser) send(conn *net.UDPConn, to *net.UDPAddr, h dnsmessage.Header, questions []dnsmessage.Question, answers []dnsmessage.Resource) {
+	h.Response, h.Authoritative = true, true
+	msg := dnsmessage.Message{Header: h, Questions: questions, Answers: answers}
+	packet, err := msg.Pack()
+	if err != nil {
+		return
+	}
+	conn.WriteToUDP(packet, to)
+}
+
+// browse asks for the servers advertised on the local network, calling found
+// with each of them until ctx is done or found returns false.
+func browse(ctx context.Context, found func(s mdnsServer) bool) error {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(rand.Uint32())},
+		Questions: []dnsmessage.Question{
+			{Name: dnsmessage.MustNewName(mdnsService), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET},
+		},
+	}
+	packet, err := query.Pack()
+	if err != nil {
+		return err
+	}
+	if _, err := conn.WriteToUDP(packet, mdnsGroup); err != nil {
+		return fmt.Errorf("could not ask the mDNS group: %w", err)
+	}
+
+	// Answers may come in pieces, the addresses of a server apart from its port.
+	instances := map[string]bool{}
+	servers := map[string]*mdnsServer{}
+	addrs := map[string][]net.IP{}
+	reported := map[string]bool{}
+	buf := make([]byte, 9000)
+	for {
+		n, err := conn.Read(buf)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil || !msg.Response {
+			continue
+		}
+		for _, r := range append(msg.Answers, msg.Additionals...) {
+			name := strings.ToLower(r.Header.Name.String())
+			switch body := r.Body.(type) {
+			case *dnsmessage.PTRResource:
+				if name == mdnsService {
+					instances[strings.ToLower(body.PTR.String())] = true
+				}
+			case *dnsmessage.SRVResource:
+				if strings.HasSuffix(name, "."+mdnsService) {
+					instance := r.Header.Name.String()[:len(name)-len(mdnsService)-1]
+					servers[name] = &mdnsServer{name: instance, host: strings.ToLower(body.Target.String()), port: body.Port}
+				}
+			case *dnsmessage.AResource:
+				addrs[name] = append(addrs[name], net.IP(body.A[:]))
+			case *dnsmessage.AAAAResource:
+				addrs[name] = append(addrs[name], net.IP(body.AAAA[:]))
+			}
+		}
+		for instance := range instances {
+			s, ok := servers[instance]
+			if !ok || reported[instance] {
+				continue
+			}
+			reported[instance] = true
+			s.addrs = addrs[s.host]
+			if !found(*s) {
+				return nil
+			}
+		}
+	}
+}
+
+// resolveMDNS looks on the local network for the server advertised as name,
+// returning its host:port.
+func resolveMDNS(ctx context.Context, name string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, mdnsResolveTimeout)
+	defer cancel()
+	var addr string
+	err := browse(ctx, func(s mdnsServer) bool {
+		if strings.EqualFold(s.name, name) {
+			addr = s.address()
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+	if addr == "" {
+		return "", fmt.Errorf("no server advertised as %s", name)
+	}
+	return addr, nil
+}
+
+// ls lists the servers advertised on the local network.
+func ls(args []string) error {
+	flags := flag.NewFlagSet("ls", flag.ContinueOnError)
+	timeout := flags.Duration("timeout", time.Second, "How long to wait for the servers to answer")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+	return browse(ctx, func(s mdnsServer) bool {
+		fmt.Fprintf(w, "%s\tmdns://%s\t%s\n", s.name, s.name, s.address())
+		return true
+	})
+}
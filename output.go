@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+// outputBufferSize is how much output is held before writing it anyway.
+const outputBufferSize = 64 << 10
+
+// bufferedOutput holds what is written for at most an interval before writing it,
+// so that a slow terminal or pipe gets a few large writes instead of one per line.
+// A failed write is reported by the next one.
+type bufferedOutput struct {
+	interval time.Duration
+	timer    *time.Timer
+
+	mu      sync.Mutex
+	w       *bufio.Writer
+	pending bool
+	err     error
+}
+
+func newBufferedOutput(w io.Writer, interval time.Duration) *bufferedOutput {
+	o := &bufferedOutput{interval: interval, w: bufio.NewWriterSize(w, outputBufferSize)}
+	o.timer = time.AfterFunc(interval, func() { o.Flush() })
+	o.timer.Stop()
+	return o
+}
+
+func (o *bufferedOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.err != nil {
+		return 0, o.err
+	}
+	n, err := o.w.Write(p)
+	if err != nil {
+		o.err = err
+		return n, err
+	}
+	if !o.pending {
+		o.pending = true
+		o.timer.Reset(o.interval)
+	}
+	return n, nil
+}
+
+// Flush writes what is held.
+func (o *bufferedOutput) Flush() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.pending = false
+	if o.err == nil {
+		o.err = o.w.Flush()
+	}
+	return o.err
+}
+
+// withLatency prefixes the data of the messages with their age, the time since
+// the server broadcast them, before handing them to write. The messages of a
+// server unaware of teecp have no time, and are left as they are.
+func withLatency(write teecp.MessageReceiver) teecp.MessageReceiver {
+	return func(m teecp.Message) error {
+		if m.Time.IsZero() {
+			return write(m)
+		}
+		m.Data = append(fmt.Appendf(nil, "[+%s] ", formatLatency(time.Since(m.Time))), m.Data...)
+		return write(m)
+	}
+}
+
+// formatLatency rounds d the more it grows: 12ms, 3.4s, 2m5s.
+func formatLatency(d time.Duration) string {
+	switch {
+	case d < 0:
+		// The clock of the server is ahead of ours.
+		d = 0
+	case d < time.Second:
+		d = d.Round(time.Millisecond)
+	case d < time.Minute:
+		d = d.Round(100 * time.Millisecond)
+	default:
+		d = d.Round(time.Second)
+	}
+	return d.String()
+}
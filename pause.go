@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+// togglePauseOnSignal pauses the broadcast at a pause signal, and resumes it at
+// the next one, until ctx is done.
+func togglePauseOnSignal(ctx context.Context, server *teecp.Server) {
+	if len(pauseSignals) == 0 {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, pauseSignals...)
+	go func() {
+		defer signal.Stop(signals)
+		for {
+			select {
+			case <-signals:
+			case <-ctx.Done():
+				return
+			}
+			if server.Paused() {
+				server.Resume()
+			} else {
+				server.Pause()
+			}
+		}
+	}()
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var errPipeUnsupported = errors.New("--pipe is only supported on Windows")
+
+// listenPipe is only supported on Windows.
+func listenPipe(path string) (net.Listener, error) {
+	return nil, errPipeUnsupported
+}
+
+// dialPipe is only supported on Windows.
+func dialPipe(ctx context.Context, path string) (net.Conn, error) {
+	return nil, errPipeUnsupported
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// pipeBufferSize is the size of the buffers of a pipe instance in each direction.
+const pipeBufferSize = 64 << 10
+
+// pipeAddr is the path of a named pipe, e.g. \\.\pipe\teecp.
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeListener accepts the clients of a named pipe. An instance of the pipe is
+// always waiting for the next client, so that clients are not turned away as
+// busy while another one is being accepted.
+type pipeListener struct {
+	path pipeAddr
+
+	mu        sync.Mutex
+	next      windows.Handle
+	accepting bool
+	closed    bool
+}
+
+// listenPipe creates the named pipe, failing if another process owns it already.
+// Remote clients are rejected: the pipe is for processes of the same machine.
+func listenPipe(path string) (net.Listener, error) {
+	h, err := createPipeInstance(path, windows.FILE_FLAG_FIRST_PIPE_INSTANCE)
+	if err != nil {
+		return nil, &os.PathError{Op: "listen", Path: path, Err: err}
+	}
+	return &pipeListener{path: pipeAddr(path), next: h}, nil
+}
+
+func createPipeInstance(path string, flags uint32) (windows.Handle, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return windows.InvalidHandle, err
+	}
+	return windows.CreateNamedPipe(name,
+		windows.PIPE_ACCESS_DUPLEX|windows.FILE_FLAG_OVERLAPPED|flags,
+		windows.PIPE_TYPE_BYTE|windows.PIPE_READMODE_BYTE|windows.PIPE_WAIT|windows.PIPE_REJECT_REMOTE_CLIENTS,
+		windows.PIPE_UNLIMITED_INSTANCES, pipeBufferSize, pipeBufferSize, 0, nil)
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	event, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer windows.CloseHandle(event)
+	o := &windows.Overlapped{HEvent: event}
+
+	// Waiting starts under the lock, so that Close either comes first or cancels
+	// it.
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	h := l.next
+	err = startIO(o, func(o *windows.Overlapped) error {
+		return windows.ConnectNamedPipe(h, o)
+	})
+	if err == nil {
+		l.accepting = true
+		l.mu.Unlock()
+		_, err = waitIO(h, o)
+		l.mu.Lock()
+		l.accepting = false
+	} else if errors.Is(err, windows.ERROR_PIPE_CONNECTED) {
+		// The client connected before the instance waited for it.
+		err = nil
+	}
+	defer l.mu.Unlock()
+
+	if l.closed {
+		windows.CloseHandle(h)
+		return nil, net.ErrClosed
+	}
+	next, nextErr := createPipeInstance(string(l.path), 0)
+	if nextErr != nil {
+		// Without an instance waiting, the listener cannot go on.
+		l.closed = true
+		windows.CloseHandle(h)
+		return nil, &os.PathError{Op: "accept", Path: string(l.path), Err: nextErr}
+	}
+	l.next = next
+	if err != nil {
+		windows.CloseHandle(h)
+		return nil, &os.PathError{Op: "accept", Path: string(l.path), Err: err}
+	}
+	return &pipeConn{h: h, addr: l.path, server: true}, nil
+}
+
+// Close stops accepting clients. The connected ones are left alone.
+func (l *pipeListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return net.ErrClosed
+	}
+	l.closed = true
+	if l.accepting {
+		// The pending Accept closes the instance once it gave up.
+		return windows.CancelIoEx(l.next, nil)
+	}
+	return windows.CloseHandle(l.next)
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return l.path
+}
+
+// dialPipe connects to the named pipe, waiting while all its instances are busy.
+func dialPipe(ctx context.Context, path string) (net.Conn, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		h, err := windows.CreateFile(name,
+			windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil, windows.OPEN_EXISTING,
+			windows.FILE_FLAG_OVERLAPPED|windows.SECURITY_SQOS_PRESENT|windows.SECURITY_IDENTIFICATION, 0)
+		if err == nil {
+			return &pipeConn{h: h, addr: pipeAddr(path)}, nil
+		}
+		if !errors.Is(err, windows.ERROR_PIPE_BUSY) {
+			return nil, &os.PathError{Op: "dial", Path: path, Err: err}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// startIO starts an asynchronous operation, whose outcome is then given by
+// waitIO even if it was over right away.
+func startIO(o *windows.Overlapped, start func(o *windows.Overlapped) error) error {
+	if err := start(o); err != nil && !errors.Is(err, windows.ERROR_IO_PENDING) {
+		return err
+	}
+	return nil
+}
+
+// waitIO waits for the operation started on h with o, returning how many bytes it
+// transferred.
+func waitIO(h windows.Handle, o *windows.Overlapped) (uint32, error) {
+	var n uint32
+	err := windows.GetOverlappedResult(h, o, &n, true)
+	return n, err
+}
+
+// pipeConn is one end of a connected named pipe. Reads and writes are overlapped,
+// so that they can run at the same time and be cancelled by a deadline or by
+// Close.
+type pipeConn struct {
+	h      windows.Handle
+	addr   pipeAddr
+	server bool
+	closed atomic.Bool
+
+	reads  pipeDirection
+	writes pipeDirection
+}
+
+// pipeDirection is the state of the reads or of the writes of a pipeConn, which
+// run one at a time.
+type pipeDirection struct {
+	sync.Mutex
+	o windows.Overlapped
+	// mu guards the fields below, also used by SetDeadline and Close while an
+	// operation runs.
+	mu       sync.Mutex
+	deadline time.Time
+	busy     bool
+	timedOut bool
+}
+
+func (c *pipeConn) Read(p []byte) (int, error) {
+	n, err := c.do(&c.reads, func(o *windows.Overlapped) error {
+		return windows.ReadFile(c.h, p, nil, o)
+	})
+	if errors.Is(err, windows.ERROR_BROKEN_PIPE) || errors.Is(err, windows.ERROR_PIPE_NOT_CONNECTED) {
+		return n, io.EOF
+	}
+	return n, err
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n, err := c.do(&c.writes, func(o *windows.Overlapped) error {
+			return windows.WriteFile(c.h, p[written:], nil, o)
+		})
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// do runs an operation in the direction d, cancelling it once the deadline of d
+// passes.
+func (c *pipeConn) do(d *pipeDirection, start func(o *windows.Overlapped) error) (int, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.o.HEvent == 0 {
+		event, err := windows.CreateEvent(nil, 1, 0, nil)
+		if err != nil {
+			return 0, err
+		}
+		d.o.HEvent = event
+	}
+
+	// The operation starts under d.mu, so that Close and deadlines either come
+	// first or cancel it.
+	d.mu.Lock()
+	if c.closed.Load() {
+		d.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	if !d.deadline.IsZero() && !d.deadline.After(time.Now()) {
+		d.mu.Unlock()
+		return 0, os.ErrDeadlineExceeded
+	}
+	if err := startIO(&d.o, start); err != nil {
+		d.mu.Unlock()
+		return 0, err
+	}
+	var timer *time.Timer
+	if !d.deadline.IsZero() {
+		timer = time.AfterFunc(time.Until(d.deadline), func() { c.cancel(d, true) })
+	}
+	d.busy, d.timedOut = true, false
+	d.mu.Unlock()
+
+	n, err := waitIO(c.h, &d.o)
+
+	if timer != nil {
+		timer.Stop()
+	}
+	d.mu.Lock()
+	d.busy = false
+	timedOut := d.timedOut
+	d.mu.Unlock()
+
+	if errors.Is(err, windows.ERROR_OPERATION_ABORTED) {
+		switch {
+		case c.closed.Load():
+			err = net.ErrClosed
+		case timedOut:
+			err = os.ErrDeadlineExceeded
+		}
+	}
+	return int(n), err
+}
+
+// cancel aborts the operation running in the direction d, if any, telling if it
+// is for its deadline.
+func (c *pipeConn) cancel(d *pipeDirection, timedOut bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.busy {
+		d.timedOut = timedOut
+		windows.CancelIoEx(c.h, &d.o)
+	}
+}
+
+func (c *pipeConn) setDeadline(d *pipeDirection, t time.Time) {
+	d.mu.Lock()
+	d.deadline = t
+	expired := !t.IsZero() && !t.After(time.Now())
+	d.mu.Unlock()
+	if expired {
+		c.cancel(d, true)
+	}
+}
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.setDeadline(&c.reads, t)
+	c.setDeadline(&c.writes, t)
+	return nil
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.setDeadline(&c.reads, t)
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	c.setDeadline(&c.writes, t)
+	return nil
+}
+
+// Close aborts the running operations, waits for them to give up and closes the
+// pipe.
+func (c *pipeConn) Close() error {
+	if c.closed.Swap(true) {
+		return net.ErrClosed
+	}
+	c.cancel(&c.reads, false)
+	c.cancel(&c.writes, false)
+	c.reads.Lock()
+	c.writes.Lock()
+	defer c.reads.Unlock()
+	defer c.writes.Unlock()
+
+	for _, d := range []*pipeDirection{&c.reads, &c.writes} {
+		if d.o.HEvent != 0 {
+			windows.CloseHandle(d.o.HEvent)
+		}
+	}
+	if c.server {
+		// Drop the client right away, even if it still holds its handle.
+		windows.DisconnectNamedPipe(c.h)
+	}
+	return windows.CloseHandle(c.h)
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.addr }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.addr }
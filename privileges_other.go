@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// dropPrivileges is only supported on Unix systems.
+func dropPrivileges(username, groupname string) error {
+	if username == "" && groupname == "" {
+		return nil
+	}
+	return errors.New("--user and --group are not supported on this platform")
+}
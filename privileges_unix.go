@@ -0,0 +1,62 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches to the user and the group, given by name or ID. The
+// group defaults to the primary group of the user.
+func dropPrivileges(username, groupname string) error {
+	if username == "" && groupname == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if username != "" {
+		lookup := user.Lookup
+		if isID(username) {
+			lookup = user.LookupId
+		}
+		u, err := lookup(username)
+		if err != nil {
+			return fmt.Errorf("could not find user %s: %w", username, err)
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if groupname != "" {
+		lookup := user.LookupGroup
+		if isID(groupname) {
+			lookup = user.LookupGroupId
+		}
+		g, err := lookup(groupname)
+		if err != nil {
+			return fmt.Errorf("could not find group %s: %w", groupname, err)
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	// The group goes first: once the user changed, it is not allowed anymore.
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("could not drop supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("could not switch to group %d: %w", gid, err)
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("could not switch to user %d: %w", uid, err)
+		}
+	}
+	return nil
+}
+
+func isID(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
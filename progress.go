@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+// progressInterval is how often --progress reports on a terminal, a tenth of how
+// often it does in a log.
+const progressInterval = time.Second
+
+// progress counts the stream for --progress and reports it to stderr like pv:
+// in place on a terminal, one line per report otherwise.
+type progress struct {
+	bytes atomic.Int64
+	lines atomic.Int64
+	w     io.Writer
+	tty   bool
+	start time.Time
+
+	stopping chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+func startProgress() *progress {
+	p := &progress{
+		w:        os.Stderr,
+		start:    time.Now(),
+		stopping: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if info, err := os.Stderr.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		p.tty = true
+	}
+	go p.run()
+	return p
+}
+
+// count is a receiver adding the message to the counts.
+func (p *progress) count(m teecp.Message) error {
+	p.bytes.Add(int64(len(m.Data)))
+	p.lines.Add(1)
+	return nil
+}
+
+func (p *progress) run() {
+	defer close(p.done)
+	interval := progressInterval
+	if !p.tty {
+		interval *= 10
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastBytes, lastLines int64
+	last := p.start
+	for {
+		select {
+		case <-p.stopping:
+			// The rates of the last report are those of the whole stream.
+			p.report(0, 0, p.start, true)
+			return
+		case now := <-ticker.C:
+			bytes, lines := p.bytes.Load(), p.lines.Load()
+			p.report(lastBytes, lastLines, last, false)
+			lastBytes, lastLines, last = bytes, lines, now
+		}
+	}
+}
+
+// report prints the totals, with the rates since the counts were those given.
+func (p *progress) report(sinceBytes, sinceLines int64, since time.Time, final bool) {
+	bytes, lines := p.bytes.Load(), p.lines.Load()
+	elapsed := time.Since(since).Seconds()
+	text := fmt.Sprintf("%s %d lines %s [%s/s, %.0f lines/s]",
+		formatBytes(float64(bytes)), lines, formatElapsed(time.Since(p.start)),
+		formatBytes(float64(bytes-sinceBytes)/elapsed), float64(lines-sinceLines)/elapsed)
+	switch {
+	case p.tty && final:
+		fmt.Fprintf(p.w, "\r\033[K%s\n", text)
+	case p.tty:
+		fmt.Fprintf(p.w, "\r\033[K%s", text)
+	default:
+		fmt.Fprintln(p.w, text)
+	}
+}
+
+// stop prints the last report.
+func (p *progress) stop() {
+	p.once.Do(func() { close(p.stopping) })
+	<-p.done
+}
+
+// formatBytes writes a size with binary units, as pv does.
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
+
+func formatElapsed(d time.Duration) string {
+	s := int(d.Seconds())
+	return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+}
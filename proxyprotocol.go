@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout is how long a load balancer has to send the PROXY header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature starts the headers of version 2 of the PROXY protocol.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolConn is a connection whose remote address came from its header.
+type proxyProtocolConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads the PROXY protocol header, versions 1 and 2, a load
+// balancer sends first, for the remote address of the connection to be the one
+// of the client behind it. A connection without the header is refused: it did
+// not come through the load balancer.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	c := &proxyProtocolConn{Conn: conn, r: bufio.NewReader(conn)}
+	signature, err := c.r.Peek(len(proxyV2Signature))
+	switch {
+	case err != nil:
+	case bytes.Equal(signature, proxyV2Signature):
+		c.remote, err = c.readV2()
+	case bytes.HasPrefix(signature, []byte("PROXY ")):
+		c.remote, err = c.readV1()
+	default:
+		err = errors.New("no PROXY protocol header")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("PROXY protocol: %w", err)
+	}
+	return c, nil
+}
+
+// readV1 reads a header such as "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+// The addresses of UNKNOWN connections, such as health checks, are not given.
+func (c *proxyProtocolConn) readV1() (net.Addr, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("invalid version 1 header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid version 1 header %q", bytes.TrimSpace(line))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid version 1 header %q", bytes.TrimSpace(line))
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readV2 reads a binary header. LOCAL connections, the health checks of the load
+// balancer, and the families other than TCP keep the address of the load balancer.
+func (c *proxyProtocolConn) readV2() (net.Addr, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unknown version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return nil, err
+	}
+	if header[12]&0xf == 0 {
+		return nil, nil
+	}
+
+	// The addresses, source then destination, then the ports, followed by TLVs.
+	switch header[13] {
+	case 0x11:
+		if len(payload) < 12 {
+			return nil, errors.New("truncated version 2 header")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[:4]), Port: int(binary.BigEndian.Uint16(payload[8:]))}, nil
+	case 0x21:
+		if len(payload) < 36 {
+			return nil, errors.New("truncated version 2 header")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[:16]), Port: int(binary.BigEndian.Uint16(payload[32:]))}, nil
+	}
+	return nil, nil
+}
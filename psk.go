@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// pskMagic starts every encrypted connection, before the salt of each side, and
+// is the first record each side seals.
+const pskMagic = "teecp-psk-1\n"
+
+// pskSaltSize is the size of the random salt each side sends, from which the keys
+// of the connection are derived.
+const pskSaltSize = 16
+
+// pskRecordSize is the most plaintext bytes sealed in one record.
+const pskRecordSize = 16 << 10
+
+// pskExchangeTimeout is how long the salts may take to be exchanged.
+const pskExchangeTimeout = 5 * time.Second
+
+// errWrongPSK is what a connection encrypted with another key looks like.
+var errWrongPSK = errors.New("wrong pre-shared key, or corrupted stream")
+
+// psk is the pre-shared key of --psk, encrypting connections with AES-256-GCM
+// where TLS certificates are impractical. Every connection gets keys of its own,
+// derived from the key and random salts of both sides, so that nonces, counting
+// the records, never repeat under a key.
+type psk [sha256.Size]byte
+
+func newPSK(secret string) *psk {
+	k := psk(sha256.Sum256([]byte(secret)))
+	return &k
+}
+
+// server and client exchange the salts on conn, the server being the accepting
+// side, and return the encrypted connection.
+func (k *psk) server(conn net.Conn) (net.Conn, error) { return k.wrap(conn, false) }
+func (k *psk) client(conn net.Conn) (net.Conn, error) { return k.wrap(conn, true) }
+
+func (k *psk) wrap(conn net.Conn, client bool) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(pskExchangeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	local := make([]byte, len(pskMagic)+pskSaltSize)
+	copy(local, pskMagic)
+	if _, err := rand.Read(local[len(pskMagic):]); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReaderSize(conn, 4+pskRecordSize+16)
+	remote := make([]byte, len(local))
+	// The client speaks first, so that a plain client gets nothing from the
+	// server.
+	if client {
+		if _, err := conn.Write(local); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := io.ReadFull(r, remote); err != nil {
+		return nil, fmt.Errorf("pre-shared key exchange: %w", err)
+	}
+	if !bytes.HasPrefix(remote, []byte(pskMagic)) {
+		return nil, errors.New("pre-shared key exchange: the peer does not encrypt with --psk")
+	}
+	if !client {
+		if _, err := conn.Write(local); err != nil {
+			return nil, err
+		}
+	}
+
+	clientSalt, serverSalt := local[len(pskMagic):], remote[len(pskMagic):]
+	if !client {
+		clientSalt, serverSalt = serverSalt, clientSalt
+	}
+	send, err := k.aead("client", clientSalt, serverSalt)
+	if err != nil {
+		return nil, err
+	}
+	receive, err := k.aead("server", clientSalt, serverSalt)
+	if err != nil {
+		return nil, err
+	}
+	if !client {
+		send, receive = receive, send
+	}
+	c := &pskConn{Conn: conn, r: r, send: send, receive: receive}
+
+	// Both sides prove they have the key before anything else goes through.
+	if _, err := c.Write([]byte(pskMagic)); err != nil {
+		return nil, err
+	}
+	confirm := make([]byte, len(pskMagic))
+	if _, err := io.ReadFull(c, confirm); err != nil {
+		return nil, fmt.Errorf("pre-shared key exchange: %w", err)
+	}
+	if string(confirm) != pskMagic {
+		return nil, errWrongPSK
+	}
+	return c, nil
+}
+
+// aead derives the key sealing what one side sends.
+func (k *psk) aead(side string, clientSalt, serverSalt []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, k[:])
+	mac.Write([]byte(pskMagic + side))
+	mac.Write(clientSalt)
+	mac.Write(serverSalt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// pskConn reads and writes records: the length of the sealed bytes, then the
+// sealed bytes, whose nonce is the number of records sent before.
+type pskConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	readMu   sync.Mutex
+	receive  cipher.AEAD
+	received uint64
+	plain    []byte
+	pending  []byte
+
+	writeMu sync.Mutex
+	send    cipher.AEAD
+	sent    uint64
+	record  []byte
+}
+
+func nonce(aead cipher.AEAD, n uint64) []byte {
+	b := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(b[len(b)-8:], n)
+	return b
+}
+
+// Read opens the next record once the previous one was read. A record is only
+// consumed once whole, so that a deadline expiring in its middle loses nothing.
+func (c *pskConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if len(c.pending) == 0 {
+		header, err := c.r.Peek(4)
+		if err != nil {
+			return 0, err
+		}
+		size := int(binary.BigEndian.Uint32(header))
+		if size > pskRecordSize+c.receive.Overhead() {
+			return 0, errWrongPSK
+		}
+		record, err := c.r.Peek(4 + size)
+		if err != nil {
+			return 0, noEOF(err)
+		}
+		c.plain, err = c.receive.Open(c.plain[:0], nonce(c.receive, c.received), record[4:], nil)
+		if err != nil {
+			return 0, errWrongPSK
+		}
+		c.r.Discard(4 + size)
+		c.received++
+		c.pending = c.plain
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *pskConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), pskRecordSize)]
+		c.record = append(c.record[:0], 0, 0, 0, 0)
+		c.record = c.send.Seal(c.record, nonce(c.send, c.sent), chunk, nil)
+		binary.BigEndian.PutUint32(c.record, uint32(len(c.record)-4))
+		c.sent++
+		if _, err := c.Conn.Write(c.record); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// noEOF reports a record cut short as such.
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
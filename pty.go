@@ -0,0 +1,108 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+// ptyDefaultSize is the size of the terminal of a command when teecp itself has
+// none to copy.
+var ptyDefaultSize = unix.Winsize{Row: 24, Col: 80}
+
+// startPTY starts cmd in a session of its own, on a new terminal which it
+// returns the other side of, where its output is read and its input written.
+func startPTY(cmd *exec.Cmd) (*os.File, error) {
+	terminal, name, err := openPTY()
+	if err != nil {
+		return nil, err
+	}
+	tty, err := os.OpenFile(name, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		terminal.Close()
+		return nil, err
+	}
+	defer tty.Close()
+
+	size, err := unix.IoctlGetWinsize(int(os.Stdin.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		size = &ptyDefaultSize
+	}
+	if err := unix.IoctlSetWinsize(int(tty.Fd()), unix.TIOCSWINSZ, size); err != nil {
+		terminal.Close()
+		return nil, err
+	}
+
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true}
+	if os.Getenv("TERM") == "" {
+		cmd.Env = append(os.Environ(), "TERM=xterm-256color")
+	}
+	if err := cmd.Start(); err != nil {
+		terminal.Close()
+		return nil, err
+	}
+	return terminal, nil
+}
+
+// resizePTY sets the size of the terminal, signaling the command running in it.
+func resizePTY(terminal *os.File, size teecp.TerminalSize) error {
+	conn, err := terminal.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ioctlErr error
+	err = conn.Control(func(fd uintptr) {
+		ioctlErr = unix.IoctlSetWinsize(int(fd), unix.TIOCSWINSZ, &unix.Winsize{Row: uint16(size.Rows), Col: uint16(size.Cols)})
+	})
+	if err != nil {
+		return err
+	}
+	return ioctlErr
+}
+
+// terminalSizes gives the size of the terminal of stdout, and then its size again
+// every time it is resized, until ctx is done.
+func terminalSizes(ctx context.Context) (<-chan teecp.TerminalSize, error) {
+	fd := int(os.Stdout.Fd())
+	if _, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ); err != nil {
+		return nil, errors.New("stdout is not a terminal")
+	}
+
+	resized := make(chan os.Signal, 1)
+	signal.Notify(resized, syscall.SIGWINCH)
+	sizes := make(chan teecp.TerminalSize)
+	go func() {
+		defer signal.Stop(resized)
+		for {
+			if size, err := unix.IoctlGetWinsize(fd, unix.TIOCGWINSZ); err == nil {
+				select {
+				case sizes <- teecp.TerminalSize{Cols: int(size.Col), Rows: int(size.Row)}:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-resized:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return sizes, nil
+}
+
+// ptyClosed tells whether err is that of reading the terminal of a command that
+// exited.
+func ptyClosed(err error) bool {
+	return errors.Is(err, syscall.EIO)
+}
@@ -0,0 +1,33 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+// startPTY is only supported on Linux and macOS.
+func startPTY(cmd *exec.Cmd) (*os.File, error) {
+	return nil, errors.New("--pty is only supported on Linux and macOS")
+}
+
+// resizePTY is only supported on Linux and macOS.
+func resizePTY(terminal *os.File, size teecp.TerminalSize) error {
+	return errors.ErrUnsupported
+}
+
+// terminalSizes is only supported on Linux and macOS.
+func terminalSizes(ctx context.Context) (<-chan teecp.TerminalSize, error) {
+	return nil, errors.New("only supported on Linux and macOS")
+}
+
+// ptyClosed tells whether err is that of reading the terminal of a command that
+// exited.
+func ptyClosed(err error) bool {
+	return false
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// registryTTL is how long an etcd registration outlives its server, renewed at a
+// third of it.
+const registryTTL = 30 * time.Second
+
+// registryTimeout bounds every call to a registry.
+const registryTimeout = 5 * time.Second
+
+// etcdPrefix is where servers are registered in etcd, under the name of their
+// service.
+const etcdPrefix = "/teecp/services/"
+
+// registry is a service catalog servers register to and clients find them in:
+// consul://host:8500?service=NAME or etcd://host:2379?service=NAME, with
+// consul+https and etcd+https for TLS. The address option is the host servers
+// are registered with, the one reaching the registry by default, and token
+// authenticates, defaulting to CONSUL_HTTP_TOKEN for Consul.
+type registry struct {
+	kind     string
+	endpoint string
+	service  string
+	address  string
+	header   http.Header
+	client   *http.Client
+}
+
+func parseRegistry(s string) (*registry, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	kind, secure := strings.CutSuffix(u.Scheme, "+https")
+	if kind != "consul" && kind != "etcd" {
+		return nil, fmt.Errorf("unknown registry %q, expected consul:// or etcd://", u.Scheme)
+	}
+	q := u.Query()
+	r := &registry{
+		kind:     kind,
+		endpoint: "http://" + u.Host,
+		service:  q.Get("service"),
+		address:  q.Get("address"),
+		header:   http.Header{"Content-Type": {"application/json"}},
+		client:   &http.Client{Timeout: registryTimeout},
+	}
+	if secure {
+		r.endpoint = "https://" + u.Host
+	}
+	if r.service == "" {
+		return nil, errors.New("the registry needs a service, e.g. ?service=teecp-build-logs")
+	}
+
+	token := q.Get("token")
+	if token == "" && kind == "consul" {
+		token = os.Getenv("CONSUL_HTTP_TOKEN")
+	}
+	if token != "" && kind == "consul" {
+		r.header.Set("X-Consul-Token", token)
+	} else if token != "" {
+		r.header.Set("Authorization", token)
+	}
+	return r, nil
+}
+
+// call sends the JSON body to the API of the registry, decoding the answer into
+// reply unless it is nil.
+func (r *registry) call(ctx context.Context, method, path string, body, reply any) error {
+	var payload io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, r.endpoint+path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header = r.header.Clone()
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		reason, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", r.kind, path, resp.Status, bytes.TrimSpace(reason))
+	}
+	if reply != nil {
+		// etcd streams some answers, of which only the first one matters.
+		return json.NewDecoder(resp.Body).Decode(reply)
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// register records the server listening on port in the registry until the
+// returned function is called. Consul checks that the port accepts connections,
+// while etcd drops the registration once it is not renewed anymore.
+func (r *registry) register(port int, logger *slog.Logger) (deregister func(), err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+	defer cancel()
+
+	if r.address == "" {
+		if r.address, err = r.localAddress(ctx); err != nil {
+			return nil, err
+		}
+	}
+	addr := net.JoinHostPort(r.address, strconv.Itoa(port))
+	hostname, _ := os.Hostname()
+	id := fmt.Sprintf("%s-%s-%d", r.service, hostname, port)
+
+	if r.kind == "consul" {
+		return r.registerConsul(ctx, id, port, addr)
+	}
+	return r.registerEtcd(ctx, id, addr, logger)
+}
+
+// localAddress is the address of the interface the registry is reached from.
+func (r *registry) localAddress(ctx context.Context) (string, error) {
+	u, err := url.Parse(r.endpoint)
+	if err != nil {
+		return "", err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", u.Host)
+	if err != nil {
+		return "", fmt.Errorf("could not find the address to register: %w", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+type consulCheck struct {
+	TCP                            string
+	Interval                       string
+	Timeout                        string
+	DeregisterCriticalServiceAfter string
+}
+
+type consulService struct {
+	ID      string
+	Name    string
+	Address string
+	Port    int
+	Check   consulCheck
+}
+
+func (r *registry) registerConsul(ctx context.Context, id string, port int, addr string) (func(), error) {
+	service := consulService{
+		ID:      id,
+		Name:    r.service,
+		Address: r.address,
+		Port:    port,
+		Check: consulCheck{
+			TCP:                            addr,
+			Interval:                       "10s",
+			Timeout:                        "2s",
+			DeregisterCriticalServiceAfter: "1m",
+		},
+	}
+	if err := r.call(ctx, http.MethodPut, "/v1/agent/service/register", service, nil); err != nil {
+		return nil, fmt.Errorf("could not register to consul: %w", err)
+	}
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+		defer cancel()
+		r.call(ctx, http.MethodPut, "/v1/agent/service/deregister/"+url.PathEscape(id), nil, nil)
+	}, nil
+}
+
+// etcdLease is a lease of the etcd JSON gateway, which encodes 64 bits integers
+// as strings.
+type etcdLease struct {
+	ID  int64 `json:"ID,string"`
+	TTL int64 `json:"TTL,string,omitempty"`
+}
+
+func (r *registry) registerEtcd(ctx context.Context, id, addr string, logger *slog.Logger) (func(), error) {
+	key := etcdPrefix + r.service + "/" + id
+	lease, err := r.putEtcd(ctx, key, addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not register to etcd: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(registryTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			var renewed struct {
+				Result etcdLease `json:"result"`
+			}
+			err := r.call(ctx, http.MethodPost, "/v3/lease/keepalive", etcdLease{ID: lease}, &renewed)
+			if err == nil && renewed.Result.TTL <= 0 {
+				// The lease expired, e.g. while etcd was unreachable.
+				lease, err = r.putEtcd(ctx, key, addr)
+			}
+			if err != nil && ctx.Err() == nil {
+				logger.Warn("could not renew the etcd registration", "err", err)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+		ctx, cancel := context.WithTimeout(context.Background(), registryTimeout)
+		defer cancel()
+		r.call(ctx, http.MethodPost, "/v3/lease/revoke", etcdLease{ID: lease}, nil)
+	}, nil
+}
+
+// putEtcd grants a lease and puts the key under it, returning the lease.
+func (r *registry) putEtcd(ctx context.Context, key, value string) (int64, error) {
+	var lease etcdLease
+	if err := r.call(ctx, http.MethodPost, "/v3/lease/grant", etcdLease{TTL: int64(registryTTL.Seconds())}, &lease); err != nil {
+		return 0, err
+	}
+	put := struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Lease int64  `json:"lease,string"`
+	}{base64.StdEncoding.EncodeToString([]byte(key)), base64.StdEncoding.EncodeToString([]byte(value)), lease.ID}
+	return lease.ID, r.call(ctx, http.MethodPost, "/v3/kv/put", put, nil)
+}
+
+// resolve returns the host:port of the healthy servers of the service, shuffled
+// to spread the clients among them.
+func (r *registry) resolve(ctx context.Context) ([]string, error) {
+	var addrs []string
+	if r.kind == "consul" {
+		var entries []struct {
+			Node    struct{ Address string }
+			Service struct {
+				Address string
+				Port    int
+			}
+		}
+		if err := r.call(ctx, http.MethodGet, "/v1/health/service/"+url.PathEscape(r.service)+"?passing=true", nil, &entries); err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			host := e.Service.Address
+			if host == "" {
+				host = e.Node.Address
+			}
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(e.Service.Port)))
+		}
+	} else {
+		prefix := etcdPrefix + r.service + "/"
+		// The range of the keys starting with the prefix ends where the last byte
+		// of the prefix is incremented.
+		end := []byte(prefix)
+		end[len(end)-1]++
+		query := struct {
+			Key      string `json:"key"`
+			RangeEnd string `json:"range_end"`
+		}{base64.StdEncoding.EncodeToString([]byte(prefix)), base64.StdEncoding.EncodeToString(end)}
+		var found struct {
+			KVs []struct {
+				Value []byte `json:"value"`
+			} `json:"kvs"`
+		}
+		if err := r.call(ctx, http.MethodPost, "/v3/kv/range", query, &found); err != nil {
+			return nil, err
+		}
+		for _, kv := range found.KVs {
+			addrs = append(addrs, string(kv.Value))
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no healthy server of %s in %s", r.service, r.kind)
+	}
+	rand.Shuffle(len(addrs), func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	return addrs, nil
+}
+
+// registeredListener deregisters the server when it stops listening.
+type registeredListener struct {
+	net.Listener
+	deregister sync.Once
+	registry   func()
+}
+
+func (l *registeredListener) Close() error {
+	l.deregister.Do(l.registry)
+	return l.Listener.Close()
+}
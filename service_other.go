@@ -0,0 +1,27 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+)
+
+// service is only supported on Windows, systemd or --daemon serving elsewhere.
+func service(args []string) error {
+	return errors.New("teecp service is only supported on Windows")
+}
+
+// runningAsService tells if teecp was started by the service manager.
+func runningAsService() bool {
+	return false
+}
+
+func serviceLogger(level slog.Leveler) (*slog.Logger, error) {
+	return nil, errors.New("there is no service logger on this platform")
+}
+
+func runService(ctx context.Context, logger *slog.Logger, run func(ctx context.Context) error) error {
+	return run(ctx)
+}
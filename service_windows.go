@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceName names the Windows service and the source of its events.
+const serviceName = "teecp"
+
+// serviceStopTimeout bounds how long stop waits for the service to be over.
+const serviceStopTimeout = 10 * time.Second
+
+// service installs, uninstalls, starts or stops the Windows service. Installing
+// takes the flags the service runs teecp with.
+func service(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: teecp service install|uninstall|start|stop [flags]")
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("could not connect to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	switch command, flags := args[0], args[1:]; command {
+	case "install":
+		return installService(m, flags)
+	case "uninstall":
+		return uninstallService(m)
+	case "start":
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return fmt.Errorf("could not open the service: %w", err)
+		}
+		defer s.Close()
+		return s.Start()
+	case "stop":
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return fmt.Errorf("could not open the service: %w", err)
+		}
+		defer s.Close()
+		return stopService(s)
+	default:
+		return fmt.Errorf("unknown service command %q", command)
+	}
+}
+
+func installService(m *mgr.Mgr, flags []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "teecp",
+		Description: "Broadcasts a stream of lines to the clients connecting over TCP",
+		StartType:   mgr.StartAutomatic,
+	}, flags...)
+	if err != nil {
+		return fmt.Errorf("could not install the service: %w", err)
+	}
+	defer s.Close()
+
+	if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		s.Delete()
+		return fmt.Errorf("could not register the event source: %w", err)
+	}
+	return nil
+}
+
+func uninstallService(m *mgr.Mgr) error {
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("could not open the service: %w", err)
+	}
+	defer s.Close()
+
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("could not uninstall the service: %w", err)
+	}
+	return eventlog.Remove(serviceName)
+}
+
+// stopService asks the service to stop and waits for it to be over.
+func stopService(s *mgr.Service) error {
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return fmt.Errorf("could not stop the service: %w", err)
+	}
+	deadline := time.Now().Add(serviceStopTimeout)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return errors.New("the service did not stop in time")
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runningAsService tells if teecp was started by the service manager.
+func runningAsService() bool {
+	isService, err := svc.IsWindowsService()
+	return err == nil && isService
+}
+
+// serviceLogger logs to the Windows event log, where the output of a service would
+// otherwise be lost.
+func serviceLogger(level slog.Leveler) (*slog.Logger, error) {
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return nil, err
+	}
+	return slog.New(slog.NewTextHandler(eventLogWriter{elog}, &slog.HandlerOptions{
+		Level: level,
+		// Events carry their own time.
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})), nil
+}
+
+// eventLogWriter reports every record of a slog.TextHandler, which writes them
+// one at a time starting with their level, as an event of that level.
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	msg := string(bytes.TrimSpace(p))
+	var err error
+	switch {
+	case bytes.HasPrefix(p, []byte("level=ERROR")):
+		err = w.elog.Error(1, msg)
+	case bytes.HasPrefix(p, []byte("level=WARN")):
+		err = w.elog.Warning(1, msg)
+	default:
+		err = w.elog.Info(1, msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// runService runs teecp under the service manager until it asks the service to
+// stop, which cancels the context given to run.
+func runService(ctx context.Context, logger *slog.Logger, run func(ctx context.Context) error) error {
+	h := &serviceHandler{ctx: ctx, logger: logger, run: run}
+	if err := svc.Run(serviceName, h); err != nil {
+		return err
+	}
+	return h.err
+}
+
+type serviceHandler struct {
+	ctx    context.Context
+	logger *slog.Logger
+	run    func(ctx context.Context) error
+	err    error
+}
+
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	ctx, cancel := context.WithCancel(h.ctx)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- h.run(ctx) }()
+
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case h.err = <-done:
+			if h.err != nil && !errors.Is(h.err, context.Canceled) {
+				h.logger.Error("teecp failed", "err", h.err)
+				return true, 1
+			}
+			return false, 0
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+			}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// followPollInterval is how often a followed file is checked for new lines.
+const followPollInterval = 250 * time.Millisecond
+
+// drainQuiet is how long a followed file must go without new lines, once a
+// shutdown signal arrived, to be considered over: the application writing it
+// gets the signal at the same time, and may log a few more lines.
+const drainQuiet = time.Second
+
+// sidecarProbes and sidecarGrace are the defaults of --probes and --grace in
+// sidecar mode, the grace fitting the 30s Kubernetes gives by default.
+const (
+	sidecarProbes = ":8086"
+	sidecarGrace  = 25 * time.Second
+)
+
+// podTag names the pod from the POD_NAMESPACE and POD_NAME variables, set from
+// the downward API as in
+//
+//	env:
+//	- name: POD_NAME
+//	  valueFrom: {fieldRef: {fieldPath: metadata.name}}
+//
+// and CONTAINER_NAME, set by hand, telling the container followed.
+func podTag() string {
+	tag := os.Getenv("POD_NAME")
+	if tag == "" {
+		tag, _ = os.Hostname()
+	}
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		tag = ns + "/" + tag
+	}
+	if container := os.Getenv("CONTAINER_NAME"); container != "" {
+		tag += "/" + container
+	}
+	return tag
+}
+
+// gracefulContext is done once a shutdown signal arrived and grace passed, or at
+// the second signal. draining is closed at the first signal, for the input to be
+// read until its end in the meantime.
+func gracefulContext(grace time.Duration) (ctx context.Context, draining <-chan struct{}, stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	drain := make(chan struct{})
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, shutdownSignals...)
+	go func() {
+		select {
+		case <-signals:
+		case <-ctx.Done():
+			return
+		}
+		close(drain)
+		select {
+		case <-signals:
+		case <-time.After(grace):
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	return ctx, drain, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+// probesHandler answers the liveness probes on /livez, and the readiness probes on
+// /readyz until the server drains.
+func probesHandler(draining <-chan struct{}) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok\n")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-draining:
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		default:
+			io.WriteString(w, "ok\n")
+		}
+	})
+	return mux
+}
+
+// follower reads a file as it grows, like tail -F: it waits for the file to be
+// created, and reopens it once rotated or truncated. It ends when ctx is done,
+// or once draining is closed and the file went quiet.
+type follower struct {
+	ctx      context.Context
+	path     string
+	draining <-chan struct{}
+	f        *os.File
+	offset   int64
+	lastRead time.Time
+	done     bool
+}
+
+func newFollower(ctx context.Context, path string, draining <-chan struct{}) *follower {
+	return &follower{ctx: ctx, path: path, draining: draining}
+}
+
+func (r *follower) Read(p []byte) (int, error) {
+	for !r.done {
+		if r.f == nil {
+			f, err := os.Open(r.path)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return 0, err
+			}
+			r.f, r.offset = f, 0
+		}
+		if r.f != nil {
+			n, err := r.f.Read(p)
+			r.offset += int64(n)
+			if n > 0 {
+				r.lastRead = time.Now()
+			}
+			if n > 0 || (err != nil && err != io.EOF) {
+				return n, err
+			}
+			if r.rotated() {
+				r.f.Close()
+				r.f = nil
+				continue
+			}
+		}
+
+		select {
+		case <-r.ctx.Done():
+			r.done = true
+		case <-r.draining:
+			r.done = time.Since(r.lastRead) >= drainQuiet
+			if !r.done {
+				time.Sleep(followPollInterval)
+			}
+		case <-time.After(followPollInterval):
+		}
+	}
+	r.Close()
+	return 0, io.EOF
+}
+
+// rotated tells if the path now leads to another file, or if the file was
+// truncated, once its end is reached.
+func (r *follower) rotated() bool {
+	current, err := r.f.Stat()
+	if err != nil {
+		return true
+	}
+	if current.Size() < r.offset {
+		return true
+	}
+	latest, err := os.Stat(r.path)
+	if err != nil {
+		// Removed without being replaced yet: wait for the new one.
+		return errors.Is(err, os.ErrNotExist)
+	}
+	return !os.SameFile(current, latest)
+}
+
+func (r *follower) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
@@ -0,0 +1,234 @@
+package sink
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Archiver uploads closed file segments to object storage and removes them
+// locally. Segments failing to upload are kept.
+type Archiver struct {
+	bucket   string
+	prefix   string
+	endpoint string
+	// pathStyle puts the bucket in the path rather than in the host name.
+	pathStyle bool
+	region    string
+	gzip      bool
+	logger    *slog.Logger
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+
+	wg sync.WaitGroup
+}
+
+// NewArchiver returns an archiver for s3://bucket/prefix or gs://bucket/prefix.
+// Credentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN, which are HMAC keys for Google Cloud Storage. Options are
+// gzip=true, region (AWS_REGION or us-east-1) and endpoint, for S3 compatible
+// stores.
+func NewArchiver(rawURL string, logger *slog.Logger) (*Archiver, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive %q: %w", rawURL, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("missing bucket, expected %s://bucket/prefix", u.Scheme)
+	}
+
+	q := u.Query()
+	a := &Archiver{
+		bucket:       u.Host,
+		prefix:       strings.Trim(u.Path, "/"),
+		gzip:         q.Get("gzip") == "true",
+		logger:       logger.With("archive", u.Scheme+"://"+u.Host),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	switch u.Scheme {
+	case "s3":
+		a.region = cmp.Or(q.Get("region"), os.Getenv("AWS_REGION"), "us-east-1")
+		a.endpoint = "https://s3." + a.region + ".amazonaws.com"
+	case "gs":
+		a.region = "auto"
+		a.endpoint, a.pathStyle = "https://storage.googleapis.com", true
+	default:
+		return nil, fmt.Errorf("unknown archive %q, expected s3 or gs", u.Scheme)
+	}
+	if endpoint := q.Get("endpoint"); endpoint != "" {
+		a.endpoint, a.pathStyle = strings.TrimSuffix(endpoint, "/"), true
+	}
+	if a.accessKey == "" || a.secretKey == "" {
+		return nil, errors.New("missing credentials, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return a, nil
+}
+
+// Archive uploads the segment on the side.
+func (a *Archiver) Archive(segment string) {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+
+		backoff := time.Second
+		for attempt := 0; ; attempt++ {
+			err := a.upload(segment)
+			if err == nil {
+				break
+			}
+			if attempt == 4 {
+				a.logger.Error("could not archive segment, keeping it", "segment", segment, "err", err)
+				return
+			}
+			a.logger.Warn("could not archive segment, retrying", "segment", segment, "retry_in", backoff, "err", err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		if err := os.Remove(segment); err != nil {
+			a.logger.Error("could not remove archived segment", "segment", segment, "err", err)
+		}
+	}()
+}
+
+// Close waits for the ongoing uploads.
+func (a *Archiver) Close() error {
+	a.wg.Wait()
+	return nil
+}
+
+func (a *Archiver) upload(segment string) error {
+	data, err := os.ReadFile(segment)
+	if err != nil {
+		return err
+	}
+
+	key := filepath.Base(segment)
+	if a.prefix != "" {
+		key = a.prefix + "/" + key
+	}
+	header := http.Header{"Content-Type": {"text/plain; charset=utf-8"}}
+	if a.gzip {
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			return err
+		}
+		data, key = b.Bytes(), key+".gz"
+		header.Set("Content-Type", "application/gzip")
+	}
+
+	target := strings.Replace(a.endpoint, "://", "://"+a.bucket+".", 1) + "/" + uriEncode(key)
+	if a.pathStyle {
+		target = a.endpoint + "/" + a.bucket + "/" + uriEncode(key)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	a.sign(req, data, time.Now().UTC())
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		reason, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(reason))
+	}
+	return nil
+}
+
+// sign adds an AWS Signature Version 4 to the request, which Google Cloud Storage
+// also accepts with HMAC keys.
+func (a *Archiver) sign(req *http.Request, payload []byte, now time.Time) {
+	payloadHash := sha256.Sum256(payload)
+	date := now.Format("20060102T150405Z")
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if a.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", a.sessionToken)
+	}
+
+	var names []string
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(req.Header.Get(name)))
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := now.Format("20060102") + "/" + a.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := []byte("AWS4" + a.secretKey)
+	for _, part := range []string{now.Format("20060102"), a.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Del("Host")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		a.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode escapes every byte of the object key but unreserved characters and
+// slashes, as signatures expect.
+func uriEncode(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
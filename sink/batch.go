@@ -0,0 +1,197 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+// closeTimeout bounds how long Close keeps retrying what is still queued.
+const closeTimeout = 5 * time.Second
+
+// batchConfig tells how a batcher groups messages. Every field can be set from the
+// sink URL query: batch, interval, queue and retries.
+type batchConfig struct {
+	// size is how many messages make a batch.
+	size int
+	// interval is how long a message waits for its batch to fill up.
+	interval time.Duration
+	// maxQueued is how many messages may wait to be sent. Beyond that they are
+	// dropped, so that a sink being down does not exhaust the memory.
+	maxQueued int
+	// retries is how many times a failed batch is sent again.
+	retries int
+}
+
+var defaultBatchConfig = batchConfig{size: 100, interval: time.Second, maxQueued: 10000, retries: 5}
+
+// realtimeBatchConfig suits sinks feeding live dashboards: lines should not wait
+// long for their batch.
+var realtimeBatchConfig = batchConfig{size: 100, interval: 50 * time.Millisecond, maxQueued: 10000, retries: 5}
+
+// parseBatchConfig reads the batch options from the query, using defaults for the
+// missing ones.
+func parseBatchConfig(q url.Values, defaults batchConfig) (batchConfig, error) {
+	cfg := defaults
+	ints := map[string]*int{"batch": &cfg.size, "queue": &cfg.maxQueued, "retries": &cfg.retries}
+	for key, value := range ints {
+		if s := q.Get(key); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return cfg, fmt.Errorf("invalid %s %q", key, s)
+			}
+			*value = n
+		}
+	}
+	if s := q.Get("interval"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("invalid interval %q", s)
+		}
+		cfg.interval = d
+	}
+	cfg.size = max(cfg.size, 1)
+	cfg.maxQueued = max(cfg.maxQueued, cfg.size)
+	return cfg, nil
+}
+
+// batcher is a Sink queueing the messages and handing them to send in batches,
+// from its own goroutine. Failed batches are retried with an exponential backoff.
+type batcher struct {
+	cfg    batchConfig
+	send   func(ctx context.Context, batch []teecp.Message) error
+	close  func() error
+	logger *slog.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	queue  chan teecp.Message
+	done   chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+
+	dropped atomic.Uint64
+}
+
+// newBatcher starts sending batches with send. close, if any, is called once the
+// last batch was sent.
+func newBatcher(cfg batchConfig, logger *slog.Logger, send func(ctx context.Context, batch []teecp.Message) error, close func() error) *batcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &batcher{
+		cfg:    cfg,
+		send:   send,
+		close:  close,
+		logger: logger,
+		ctx:    ctx,
+		cancel: cancel,
+		queue:  make(chan teecp.Message, cfg.maxQueued),
+		done:   make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *batcher) Write(m teecp.Message) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return nil
+	}
+
+	m.Data = append([]byte(nil), m.Data...)
+	select {
+	case b.queue <- m:
+	default:
+		if b.dropped.Add(1) == 1 {
+			b.logger.Warn("queue is full, dropping messages", "max_queued", b.cfg.maxQueued)
+		}
+	}
+	return nil
+}
+
+func (b *batcher) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.queue)
+	b.mu.Unlock()
+
+	timer := time.AfterFunc(closeTimeout, b.cancel)
+	defer timer.Stop()
+	<-b.done
+	b.cancel()
+
+	if dropped := b.dropped.Load(); dropped > 0 {
+		b.logger.Warn("messages were dropped", "count", dropped)
+	}
+	if b.close != nil {
+		return b.close()
+	}
+	return nil
+}
+
+func (b *batcher) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.cfg.interval)
+	defer ticker.Stop()
+
+	batch := make([]teecp.Message, 0, b.cfg.size)
+	for {
+		select {
+		case m, ok := <-b.queue:
+			if !ok {
+				b.flush(batch)
+				return
+			}
+			batch = append(batch, m)
+			if len(batch) >= b.cfg.size {
+				b.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			b.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// flush sends the batch, retrying with a backoff. A batch that keeps failing is
+// dropped.
+func (b *batcher) flush(batch []teecp.Message) {
+	if len(batch) == 0 {
+		return
+	}
+
+	backoff := 100 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err := b.send(b.ctx, batch)
+		if err == nil {
+			return
+		}
+		if attempt >= b.cfg.retries || b.ctx.Err() != nil {
+			b.dropped.Add(uint64(len(batch)))
+			b.logger.Error("could not send batch, dropping it", "size", len(batch), "err", err)
+			return
+		}
+
+		b.logger.Warn("could not send batch, retrying", "size", len(batch), "retry_in", backoff, "err", err)
+		select {
+		case <-time.After(backoff):
+		case <-b.ctx.Done():
+		}
+		backoff = min(2*backoff, 10*time.Second)
+	}
+}
@@ -0,0 +1,94 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+func init() {
+	Register("elastic", openElastic)
+	Register("elastic+https", openElastic)
+}
+
+// openElastic indexes every message, as a teecp.Envelope, with the bulk API:
+// elastic://[user:password@]host:9200/index.
+func openElastic(u *url.URL, logger *slog.Logger) (Sink, error) {
+	index := strings.Trim(u.Path, "/")
+	if index == "" {
+		return nil, errors.New("missing index, expected elastic://host:9200/index")
+	}
+
+	cfg, err := parseBatchConfig(u.Query(), defaultBatchConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := url.URL{Scheme: "http", User: u.User, Host: u.Host, Path: "/_bulk"}
+	if u.Scheme == "elastic+https" {
+		endpoint.Scheme = "https"
+	}
+	if endpoint.Host == "" {
+		endpoint.Host = "localhost:9200"
+	}
+
+	action, _ := json.Marshal(map[string]any{"index": map[string]string{"_index": index}})
+	e := &elasticIndexer{
+		endpoint: endpoint.String(),
+		action:   append(action, '\n'),
+		logger:   logger,
+	}
+	return newBatcher(cfg, logger, e.index, nil), nil
+}
+
+type elasticIndexer struct {
+	endpoint string
+	// action is the bulk action line preceding every document.
+	action []byte
+	logger *slog.Logger
+}
+
+type elasticBulkReply struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+func (e *elasticIndexer) index(ctx context.Context, batch []teecp.Message) error {
+	var body []byte
+	for _, m := range batch {
+		body = append(body, e.action...)
+		body = append(body, envelope(m)...)
+		body = append(body, '\n')
+	}
+
+	var reply elasticBulkReply
+	if err := post(ctx, e.endpoint, http.Header{"Content-Type": {"application/x-ndjson"}}, body, &reply); err != nil {
+		return err
+	}
+	if !reply.Errors {
+		return nil
+	}
+
+	// Sending the whole batch again would index the other documents twice: the
+	// documents that were refused are reported and dropped.
+	for i, item := range reply.Items {
+		for _, result := range item {
+			if result.Status/100 != 2 && i < len(batch) {
+				e.logger.Warn("document was not indexed", "seq", batch[i].Seq, "status", result.Status, "type", result.Error.Type, "reason", result.Error.Reason)
+			}
+		}
+	}
+	return nil
+}
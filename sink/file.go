@@ -0,0 +1,177 @@
+package sink
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+func init() {
+	Register("file", openFile)
+}
+
+// File is a sink appending the lines to a file, optionally rotated by size or age.
+// Rotated segments are renamed after the time they were closed.
+type File struct {
+	*batcher
+
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+	opened time.Time
+
+	mu      sync.Mutex
+	rotated func(segment string)
+}
+
+// openFile appends every line to a file: file:stream.log or file:///var/log/stream.log.
+// Options are rotate, the size after which the file is rotated such as 100MB, and
+// every, its maximum age such as 1h, checked when lines are written.
+func openFile(u *url.URL, logger *slog.Logger) (Sink, error) {
+	path := cmp.Or(u.Opaque, u.Path)
+	if path == "" {
+		return nil, errors.New("missing path, expected file:stream.log")
+	}
+
+	q := u.Query()
+	cfg, err := parseBatchConfig(q, realtimeBatchConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &File{path: path}
+	if s := q.Get("rotate"); s != "" {
+		if f.maxSize, err = ParseSize(s); err != nil {
+			return nil, err
+		}
+	}
+	if s := q.Get("every"); s != "" {
+		if f.maxAge, err = time.ParseDuration(s); err != nil || f.maxAge <= 0 {
+			return nil, fmt.Errorf("invalid every %q", s)
+		}
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	f.batcher = newBatcher(cfg, logger, f.write, f.close)
+	return f, nil
+}
+
+// Rotates tells if the file is rotated.
+func (f *File) Rotates() bool {
+	return f.maxSize > 0 || f.maxAge > 0
+}
+
+// OnRotate makes rotated get the path of every segment once it is closed. It is
+// called from the goroutine writing the file.
+func (f *File) OnRotate(rotated func(segment string)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rotated = rotated
+}
+
+func (f *File) write(ctx context.Context, batch []teecp.Message) error {
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range batch {
+		if _, err := f.writer.Write(m.Data); err != nil {
+			return err
+		}
+		f.size += int64(len(m.Data))
+	}
+	if err := f.writer.Flush(); err != nil {
+		return err
+	}
+
+	if (f.maxSize > 0 && f.size >= f.maxSize) || (f.maxAge > 0 && time.Since(f.opened) >= f.maxAge) {
+		return f.rotate()
+	}
+	return nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.writer, f.size, f.opened = file, bufio.NewWriter(file), info.Size(), time.Now()
+	return nil
+}
+
+func (f *File) rotate() error {
+	if err := f.close(); err != nil {
+		return err
+	}
+
+	segment := f.path + "." + time.Now().UTC().Format("20060102T150405.000000000Z")
+	if err := os.Rename(f.path, segment); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	rotated := f.rotated
+	f.mu.Unlock()
+	if rotated != nil {
+		rotated(segment)
+	}
+	return f.open()
+}
+
+func (f *File) close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.writer.Flush()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	f.file, f.writer = nil, nil
+	return err
+}
+
+// ParseSize parses a size such as 512, 64KB, 100MB or 2GB, the B being optional.
+func ParseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		size   int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"B", 1}}
+
+	number, unit := strings.ToUpper(s), int64(1)
+	for _, u := range units {
+		if rest, ok := strings.CutSuffix(number, u.suffix); ok {
+			number, unit = rest, u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * unit, nil
+}
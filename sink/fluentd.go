@@ -0,0 +1,229 @@
+package sink
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+func init() {
+	Register("fluentd", openFluentd)
+	Register("fluentd+tls", openFluentd)
+}
+
+// openFluentd sends lines with the Fluentd forward protocol: fluentd://host:24224.
+// Records have the line as message and its sequence number as seq. Options are
+// tag (teecp) and ack=true to wait for the server to acknowledge every batch.
+func openFluentd(u *url.URL, logger *slog.Logger) (Sink, error) {
+	q := u.Query()
+	cfg, err := parseBatchConfig(q, realtimeBatchConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &fluentdForwarder{
+		host: cmp.Or(u.Hostname(), "localhost"),
+		tls:  u.Scheme == "fluentd+tls",
+		tag:  cmp.Or(q.Get("tag"), "teecp"),
+		ack:  q.Get("ack") == "true",
+	}
+	f.addr = net.JoinHostPort(f.host, cmp.Or(u.Port(), "24224"))
+	return newBatcher(cfg, logger, f.forward, f.close), nil
+}
+
+// fluentdForwarder is only used from the batcher goroutine.
+type fluentdForwarder struct {
+	addr string
+	host string
+	tls  bool
+	tag  string
+	ack  bool
+
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// forward sends the batch in Forward mode: [tag, [[time, record]...], option].
+func (f *fluentdForwarder) forward(ctx context.Context, batch []teecp.Message) error {
+	if f.conn == nil {
+		if err := f.connect(ctx); err != nil {
+			return err
+		}
+	}
+
+	b := msgpackArray(nil, 3)
+	b = msgpackString(b, f.tag)
+	b = msgpackArray(b, len(batch))
+	for _, m := range batch {
+		b = msgpackArray(b, 2)
+		// EventTime extension: seconds and nanoseconds.
+		b = append(b, 0xd7, 0x00)
+		b = binary.BigEndian.AppendUint32(b, uint32(m.Time.Unix()))
+		b = binary.BigEndian.AppendUint32(b, uint32(m.Time.Nanosecond()))
+		b = append(b, 0x82)
+		b = msgpackString(b, "message")
+		b = msgpackString(b, string(line(m)))
+		b = msgpackString(b, "seq")
+		b = append(b, 0xcf)
+		b = binary.BigEndian.AppendUint64(b, m.Seq)
+	}
+
+	var chunk string
+	if f.ack {
+		var id [16]byte
+		rand.Read(id[:])
+		chunk = base64.StdEncoding.EncodeToString(id[:])
+		b = append(b, 0x81)
+		b = msgpackString(b, "chunk")
+		b = msgpackString(b, chunk)
+	} else {
+		b = append(b, 0x80)
+	}
+
+	f.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := f.conn.Write(b); err != nil {
+		f.close()
+		return err
+	}
+	if !f.ack {
+		return nil
+	}
+
+	// The answer is {"ack": chunk}.
+	reply, err := f.readAck()
+	if err != nil {
+		f.close()
+		return err
+	}
+	if reply != chunk {
+		f.close()
+		return fmt.Errorf("acknowledged chunk %q instead of %q", reply, chunk)
+	}
+	return nil
+}
+
+func (f *fluentdForwarder) readAck() (string, error) {
+	n, err := f.reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if n&0xf0 != 0x80 {
+		return "", fmt.Errorf("unexpected answer %#x, expected a map", n)
+	}
+
+	var ack string
+	for i := 0; i < int(n&0x0f); i++ {
+		key, err := msgpackReadString(f.reader)
+		if err != nil {
+			return "", err
+		}
+		value, err := msgpackReadString(f.reader)
+		if err != nil {
+			return "", err
+		}
+		if key == "ack" {
+			ack = value
+		}
+	}
+	return ack, nil
+}
+
+func (f *fluentdForwarder) connect(ctx context.Context) error {
+	var conn net.Conn
+	var err error
+	if f.tls {
+		dialer := tls.Dialer{Config: &tls.Config{ServerName: f.host}}
+		conn, err = dialer.DialContext(ctx, "tcp", f.addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", f.addr)
+	}
+	if err != nil {
+		return err
+	}
+	f.conn, f.reader = conn, bufio.NewReader(conn)
+	return nil
+}
+
+func (f *fluentdForwarder) close() error {
+	if f.conn == nil {
+		return nil
+	}
+	err := f.conn.Close()
+	f.conn, f.reader = nil, nil
+	return err
+}
+
+// msgpackArray appends the header of an array of n elements.
+func msgpackArray(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x90|byte(n))
+	case n < 1<<16:
+		return binary.BigEndian.AppendUint16(append(b, 0xdc), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(n))
+	}
+}
+
+// msgpackString appends s as a str.
+func msgpackString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n < 1<<8:
+		b = append(b, 0xd9, byte(n))
+	case n < 1<<16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+// msgpackReadString reads a str or a bin.
+func msgpackReadString(r *bufio.Reader) (string, error) {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+
+	var n int
+	switch {
+	case kind&0xe0 == 0xa0:
+		n = int(kind & 0x1f)
+	case kind == 0xd9 || kind == 0xc4:
+		size, err := r.ReadByte()
+		n = int(size)
+		if err != nil {
+			return "", err
+		}
+	case kind == 0xda || kind == 0xc5:
+		var size [2]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return "", err
+		}
+		n = int(binary.BigEndian.Uint16(size[:]))
+	default:
+		return "", errors.New("unexpected answer, expected a string")
+	}
+
+	s := make([]byte, n)
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
@@ -0,0 +1,177 @@
+package sink
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+func init() {
+	Register("gelf", openGELF)
+	Register("gelf+tcp", openGELF)
+	Register("gelf+tls", openGELF)
+}
+
+const (
+	// gelfChunkSize is the size of an UDP datagram, headers included.
+	gelfChunkSize = 1420
+	// gelfMaxChunks is how many chunks Graylog reassembles at most.
+	gelfMaxChunks = 128
+)
+
+// openGELF sends every line as a Graylog message: gelf://host:12201 over UDP, with
+// chunking, or gelf+tcp://host:12201 and gelf+tls://, null byte delimited. Options
+// are level (6, informational) and hostname.
+func openGELF(u *url.URL, logger *slog.Logger) (Sink, error) {
+	q := u.Query()
+	cfg, err := parseBatchConfig(q, realtimeBatchConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	level := 6
+	if s := q.Get("level"); s != "" {
+		level, err = strconv.Atoi(s)
+		if err != nil || level < 0 || level > 7 {
+			return nil, fmt.Errorf("invalid level %q, expected 0 to 7", s)
+		}
+	}
+	hostname := q.Get("hostname")
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+
+	g := &gelfWriter{
+		network:  "udp",
+		host:     cmp.Or(u.Hostname(), "localhost"),
+		hostname: cmp.Or(hostname, "teecp"),
+		level:    level,
+	}
+	switch u.Scheme {
+	case "gelf+tcp":
+		g.network = "tcp"
+	case "gelf+tls":
+		g.network, g.tls = "tcp", true
+	}
+	g.addr = net.JoinHostPort(g.host, cmp.Or(u.Port(), "12201"))
+	return newBatcher(cfg, logger, g.send, g.close), nil
+}
+
+// gelfWriter is only used from the batcher goroutine.
+type gelfWriter struct {
+	network  string
+	addr     string
+	host     string
+	tls      bool
+	hostname string
+	level    int
+
+	conn net.Conn
+}
+
+type gelfMessage struct {
+	Version      string  `json:"version"`
+	Host         string  `json:"host"`
+	ShortMessage string  `json:"short_message"`
+	Timestamp    float64 `json:"timestamp"`
+	Level        int     `json:"level"`
+	Seq          uint64  `json:"_seq"`
+}
+
+func (g *gelfWriter) send(ctx context.Context, batch []teecp.Message) error {
+	if g.conn == nil {
+		if err := g.connect(ctx); err != nil {
+			return err
+		}
+	}
+
+	g.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	var stream []byte
+	for _, m := range batch {
+		msg, err := json.Marshal(gelfMessage{
+			Version:      "1.1",
+			Host:         g.hostname,
+			ShortMessage: string(line(m)),
+			Timestamp:    float64(m.Time.UnixMicro()) / 1e6,
+			Level:        g.level,
+			Seq:          m.Seq,
+		})
+		if err != nil {
+			return err
+		}
+
+		if g.network == "tcp" {
+			stream = append(append(stream, msg...), 0)
+			continue
+		}
+		for _, datagram := range gelfChunks(msg) {
+			if _, err := g.conn.Write(datagram); err != nil {
+				g.close()
+				return err
+			}
+		}
+	}
+
+	if len(stream) > 0 {
+		if _, err := g.conn.Write(stream); err != nil {
+			g.close()
+			return err
+		}
+	}
+	return nil
+}
+
+// gelfChunks splits a message too large for a datagram into chunks, each starting
+// with the magic bytes, the message id, the chunk index and the chunk count. A
+// message needing too many chunks is truncated.
+func gelfChunks(msg []byte) [][]byte {
+	if len(msg) <= gelfChunkSize {
+		return [][]byte{msg}
+	}
+
+	const header = 12
+	size := gelfChunkSize - header
+	count := min((len(msg)+size-1)/size, gelfMaxChunks)
+	var id [8]byte
+	rand.Read(id[:])
+
+	chunks := make([][]byte, count)
+	for i := range chunks {
+		chunk := append([]byte{0x1e, 0x0f}, id[:]...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunks[i] = append(chunk, msg[i*size:min((i+1)*size, len(msg))]...)
+	}
+	return chunks
+}
+
+func (g *gelfWriter) connect(ctx context.Context) error {
+	var err error
+	if g.tls {
+		dialer := tls.Dialer{Config: &tls.Config{ServerName: g.host}}
+		g.conn, err = dialer.DialContext(ctx, g.network, g.addr)
+	} else {
+		var dialer net.Dialer
+		g.conn, err = dialer.DialContext(ctx, g.network, g.addr)
+	}
+	return err
+}
+
+func (g *gelfWriter) close() error {
+	if g.conn == nil {
+		return nil
+	}
+	err := g.conn.Close()
+	g.conn = nil
+	return err
+}
@@ -0,0 +1,159 @@
+package sink
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+func init() {
+	Register("influx", openInflux)
+	Register("influx+https", openInflux)
+}
+
+// influxPair is a key=value pair whose value is a number, maybe followed by a unit.
+var influxPair = regexp.MustCompile(`([A-Za-z_][A-Za-z0-9_.]*)=(-?[0-9]+(?:\.[0-9]+)?)[A-Za-z%]*`)
+
+var influxNumber = regexp.MustCompile(`^-?[0-9]+(?:\.[0-9]+)?`)
+
+// openInflux writes points to an InfluxDB 2 bucket: influx://host:8086/bucket. Lines
+// become points of the measurement (teecp) with the numeric key=value pairs they
+// hold as fields, units being dropped, e.g. latency=123ms gives latency=123. With
+// match, a regex, the named groups of the lines matching it are the fields
+// instead. Lines without fields are skipped. Other options are org, tags, as
+// name=value pairs separated by commas, and token, which defaults to INFLUX_TOKEN.
+func openInflux(u *url.URL, logger *slog.Logger) (Sink, error) {
+	bucket := strings.Trim(u.Path, "/")
+	if bucket == "" {
+		return nil, errors.New("missing bucket, expected influx://host:8086/bucket")
+	}
+
+	q := u.Query()
+	cfg, err := parseBatchConfig(q, defaultBatchConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	i := &influxWriter{measurement: influxEscape(cmp.Or(q.Get("measurement"), "teecp"), ", ")}
+	if s := q.Get("match"); s != "" {
+		if i.match, err = regexp.Compile(s); err != nil {
+			return nil, err
+		}
+		if !slices.ContainsFunc(i.match.SubexpNames(), func(name string) bool { return name != "" }) {
+			return nil, fmt.Errorf("match %q has no named group", s)
+		}
+	}
+	tags, err := parseLabels(q.Get("tags"))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	// Sorted tags are what InfluxDB prefers.
+	slices.Sort(names)
+	for _, name := range names {
+		i.tags += "," + influxEscape(name, ",= ") + "=" + influxEscape(tags[name], ",= ")
+	}
+
+	endpoint := url.URL{Scheme: "http", Host: cmp.Or(u.Host, "localhost:8086"), Path: "/api/v2/write"}
+	if u.Scheme == "influx+https" {
+		endpoint.Scheme = "https"
+	}
+	params := url.Values{"bucket": {bucket}, "precision": {"ns"}}
+	if org := q.Get("org"); org != "" {
+		params.Set("org", org)
+	}
+	endpoint.RawQuery = params.Encode()
+	i.endpoint = endpoint.String()
+
+	i.header = http.Header{"Content-Type": {"text/plain; charset=utf-8"}}
+	if token := cmp.Or(q.Get("token"), os.Getenv("INFLUX_TOKEN")); token != "" {
+		i.header.Set("Authorization", "Token "+token)
+	}
+	return newBatcher(cfg, logger, i.write, nil), nil
+}
+
+type influxWriter struct {
+	endpoint    string
+	header      http.Header
+	measurement string
+	// tags is the tag set, with its leading comma.
+	tags  string
+	match *regexp.Regexp
+}
+
+func (i *influxWriter) write(ctx context.Context, batch []teecp.Message) error {
+	var body []byte
+	for _, m := range batch {
+		fields := i.fields(line(m))
+		if fields == "" {
+			continue
+		}
+		body = append(body, i.measurement...)
+		body = append(body, i.tags...)
+		body = append(body, ' ')
+		body = append(body, fields...)
+		body = append(body, ' ')
+		body = strconv.AppendInt(body, m.Time.UnixNano(), 10)
+		body = append(body, '\n')
+	}
+	if len(body) == 0 {
+		return nil
+	}
+	return post(ctx, i.endpoint, i.header, body, nil)
+}
+
+// fields returns the field set of the line, empty if it has none.
+func (i *influxWriter) fields(line []byte) string {
+	var fields []string
+	if i.match == nil {
+		for _, pair := range influxPair.FindAllSubmatch(line, -1) {
+			fields = append(fields, influxEscape(string(pair[1]), ",= ")+"="+string(pair[2]))
+		}
+		return strings.Join(fields, ",")
+	}
+
+	groups := i.match.FindSubmatch(line)
+	if groups == nil {
+		return ""
+	}
+	for j, name := range i.match.SubexpNames() {
+		if name == "" || groups[j] == nil {
+			continue
+		}
+		value := string(groups[j])
+		if number := influxNumber.FindString(value); number != "" {
+			value = number
+		} else {
+			value = `"` + influxEscape(value, `"`) + `"`
+		}
+		fields = append(fields, influxEscape(name, ",= ")+"="+value)
+	}
+	return strings.Join(fields, ",")
+}
+
+// influxEscape escapes backslashes and the special characters of a line protocol
+// element.
+func influxEscape(s, special string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r == '\\' || strings.ContainsRune(special, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
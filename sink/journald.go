@@ -0,0 +1,127 @@
+//go:build linux
+
+package sink
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+func init() {
+	Register("journald", openJournald)
+}
+
+// openJournald writes every line to the systemd journal: journald, with the fields
+// TEECP_SEQ and, if set, TEECP_TAG. Options are tag, identifier (teecp), priority
+// (6, informational) and socket, the path of the journal socket.
+func openJournald(u *url.URL, logger *slog.Logger) (Sink, error) {
+	q := u.Query()
+	cfg, err := parseBatchConfig(q, realtimeBatchConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	priority := cmp.Or(q.Get("priority"), "6")
+	if n, err := strconv.Atoi(priority); err != nil || n < 0 || n > 7 {
+		return nil, errors.New("invalid priority " + strconv.Quote(priority) + ", expected 0 to 7")
+	}
+
+	j := &journalWriter{addr: &net.UnixAddr{Name: cmp.Or(q.Get("socket"), "/run/systemd/journal/socket"), Net: "unixgram"}}
+	j.fields = journalField(nil, "PRIORITY", priority)
+	j.fields = journalField(j.fields, "SYSLOG_IDENTIFIER", cmp.Or(q.Get("identifier"), "teecp"))
+	if tag := q.Get("tag"); tag != "" {
+		j.fields = journalField(j.fields, "TEECP_TAG", tag)
+	}
+	return newBatcher(cfg, logger, j.send, j.close), nil
+}
+
+// journalWriter speaks the native journal protocol. It is only used from the
+// batcher goroutine.
+type journalWriter struct {
+	addr *net.UnixAddr
+	// fields are the fields common to every entry.
+	fields []byte
+
+	conn *net.UnixConn
+}
+
+func (j *journalWriter) send(ctx context.Context, batch []teecp.Message) error {
+	if j.conn == nil {
+		// The socket is not connected so that it can also pass files.
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+		if err != nil {
+			return err
+		}
+		j.conn = conn
+	}
+
+	for _, m := range batch {
+		entry := append([]byte(nil), j.fields...)
+		entry = journalField(entry, "TEECP_SEQ", strconv.FormatUint(m.Seq, 10))
+		entry = journalField(entry, "MESSAGE", string(line(m)))
+
+		_, _, err := j.conn.WriteMsgUnix(entry, nil, j.addr)
+		if errors.Is(err, syscall.EMSGSIZE) || errors.Is(err, syscall.ENOBUFS) {
+			err = j.sendLarge(entry)
+		}
+		if err != nil {
+			j.close()
+			return err
+		}
+	}
+	return nil
+}
+
+// sendLarge passes an entry too large for a datagram as an unlinked file, as
+// journald accepts.
+func (j *journalWriter) sendLarge(entry []byte) error {
+	f, err := os.CreateTemp("/dev/shm", "teecp-journal-")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	os.Remove(f.Name())
+
+	if _, err := f.Write(entry); err != nil {
+		return err
+	}
+	_, _, err = j.conn.WriteMsgUnix(nil, syscall.UnixRights(int(f.Fd())), j.addr)
+	return err
+}
+
+func (j *journalWriter) close() error {
+	if j.conn == nil {
+		return nil
+	}
+	err := j.conn.Close()
+	j.conn = nil
+	return err
+}
+
+// journalField appends a field: NAME=value, or for values spanning lines the name,
+// the length of the value and the value.
+func journalField(b []byte, name, value string) []byte {
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\n' {
+			b = append(b, name...)
+			b = append(b, '\n')
+			b = binary.LittleEndian.AppendUint64(b, uint64(len(value)))
+			b = append(b, value...)
+			return append(b, '\n')
+		}
+	}
+	b = append(b, name...)
+	b = append(b, '=')
+	b = append(b, value...)
+	return append(b, '\n')
+}
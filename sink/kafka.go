@@ -0,0 +1,70 @@
+//go:build !plan9
+
+package sink
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/segmentio/kafka-go"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+func init() {
+	Register("kafka", openKafka)
+}
+
+// openKafka produces every line to a topic: kafka://broker1:9092,broker2:9092/topic.
+// The acks query option is "one" (the default), "all" or "none".
+func openKafka(u *url.URL, logger *slog.Logger) (Sink, error) {
+	topic := strings.TrimPrefix(u.Path, "/")
+	if topic == "" {
+		return nil, errors.New("missing topic, expected kafka://broker:9092/topic")
+	}
+
+	cfg, err := parseBatchConfig(u.Query(), defaultBatchConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	acks := kafka.RequireOne
+	switch a := u.Query().Get("acks"); a {
+	case "", "one":
+	case "all":
+		acks = kafka.RequireAll
+	case "none":
+		acks = kafka.RequireNone
+	default:
+		return nil, errors.New("invalid acks " + strconv.Quote(a))
+	}
+
+	w := &kafka.Writer{
+		Addr:         kafka.TCP(strings.Split(u.Host, ",")...),
+		Topic:        topic,
+		Balancer:     &kafka.LeastBytes{},
+		RequiredAcks: acks,
+		BatchSize:    cfg.size,
+		// Messages are already batched by us, do not wait for more.
+		BatchTimeout: 1,
+		// Retries are handled by the batcher as well.
+		MaxAttempts: 1,
+	}
+
+	send := func(ctx context.Context, batch []teecp.Message) error {
+		messages := make([]kafka.Message, len(batch))
+		for i, m := range batch {
+			messages[i] = kafka.Message{
+				Value:   line(m),
+				Time:    m.Time,
+				Headers: []kafka.Header{{Key: "teecp-seq", Value: []byte(strconv.FormatUint(m.Seq, 10))}},
+			}
+		}
+		return w.WriteMessages(ctx, messages...)
+	}
+	return newBatcher(cfg, logger, send, w.Close), nil
+}
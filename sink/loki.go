@@ -0,0 +1,105 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+func init() {
+	Register("loki", openLoki)
+	Register("loki+https", openLoki)
+}
+
+// openLoki pushes lines to Grafana Loki: loki://[user:password@]host:3100. The path
+// defaults to the push API. Options are labels, as name=value pairs separated by
+// commas where values may refer to environment variables, and tenant.
+func openLoki(u *url.URL, logger *slog.Logger) (Sink, error) {
+	q := u.Query()
+	cfg, err := parseBatchConfig(q, defaultBatchConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	labels, err := parseLabels(q.Get("labels"))
+	if err != nil {
+		return nil, err
+	}
+	if len(labels) == 0 {
+		labels = map[string]string{"job": "teecp"}
+	}
+
+	endpoint := url.URL{Scheme: "http", User: u.User, Host: u.Host, Path: u.Path}
+	if u.Scheme == "loki+https" {
+		endpoint.Scheme = "https"
+	}
+	if endpoint.Host == "" {
+		endpoint.Host = "localhost:3100"
+	}
+	if endpoint.Path == "" || endpoint.Path == "/" {
+		endpoint.Path = "/loki/api/v1/push"
+	}
+
+	l := &lokiPusher{endpoint: endpoint.String(), labels: labels, header: http.Header{"Content-Type": {"application/json"}}}
+	if tenant := q.Get("tenant"); tenant != "" {
+		l.header.Set("X-Scope-OrgID", tenant)
+	}
+	return newBatcher(cfg, logger, l.push, nil), nil
+}
+
+type lokiPusher struct {
+	endpoint string
+	labels   map[string]string
+	header   http.Header
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func (l *lokiPusher) push(ctx context.Context, batch []teecp.Message) error {
+	stream := lokiStream{Stream: l.labels, Values: make([][2]string, len(batch))}
+	for i, m := range batch {
+		stream.Values[i] = [2]string{strconv.FormatInt(m.Time.UnixNano(), 10), string(line(m))}
+	}
+	body, err := json.Marshal(struct {
+		Streams []lokiStream `json:"streams"`
+	}{[]lokiStream{stream}})
+	if err != nil {
+		return err
+	}
+	return post(ctx, l.endpoint, l.header, body, nil)
+}
+
+// parseLabels parses name=value pairs separated by commas. Values are expanded
+// with the environment, HOSTNAME falling back to the name of the host when it is
+// not exported.
+func parseLabels(s string) (map[string]string, error) {
+	labels := map[string]string{}
+	if s == "" {
+		return labels, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid label %q, expected name=value", pair)
+		}
+		labels[name] = os.Expand(value, func(key string) string {
+			if v, ok := os.LookupEnv(key); ok || key != "HOSTNAME" {
+				return v
+			}
+			hostname, _ := os.Hostname()
+			return hostname
+		})
+	}
+	return labels, nil
+}
@@ -0,0 +1,257 @@
+package sink
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+func init() {
+	Register("mqtt", openMQTT)
+	Register("mqtts", openMQTT)
+}
+
+// MQTT 3.1.1 control packet types, shifted in the fixed header.
+const (
+	mqttConnect  = 1 << 4
+	mqttConnack  = 2 << 4
+	mqttPublish  = 3 << 4
+	mqttPuback   = 4 << 4
+	mqttPubrec   = 5 << 4
+	mqttPubrel   = 6<<4 | 0x02
+	mqttPubcomp  = 7 << 4
+	mqttPingresp = 13 << 4
+)
+
+// openMQTT publishes every line to a topic: mqtt://[user:password@]broker:1883/topic.
+// The mqtts scheme connects with TLS. Options are qos=0|1|2 and retain=true.
+func openMQTT(u *url.URL, logger *slog.Logger) (Sink, error) {
+	topic := strings.TrimPrefix(u.Path, "/")
+	if topic == "" {
+		return nil, errors.New("missing topic, expected mqtt://broker/topic")
+	}
+
+	q := u.Query()
+	cfg, err := parseBatchConfig(q, realtimeBatchConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &mqttPublisher{topic: topic, tls: u.Scheme == "mqtts", host: cmp.Or(u.Hostname(), "localhost")}
+	port := u.Port()
+	if port == "" {
+		port = "1883"
+		if m.tls {
+			port = "8883"
+		}
+	}
+	m.addr = net.JoinHostPort(m.host, port)
+	if u.User != nil {
+		m.user = u.User.Username()
+		m.password, _ = u.User.Password()
+	}
+
+	switch qos := q.Get("qos"); qos {
+	case "", "0":
+	case "1":
+		m.qos = 1
+	case "2":
+		m.qos = 2
+	default:
+		return nil, fmt.Errorf("invalid qos %q, expected 0, 1 or 2", qos)
+	}
+	m.retain = q.Get("retain") == "true"
+
+	return newBatcher(cfg, logger, m.publish, m.close), nil
+}
+
+// mqttPublisher speaks just enough MQTT 3.1.1 to publish messages. It is only used
+// from the batcher goroutine.
+type mqttPublisher struct {
+	addr     string
+	host     string
+	tls      bool
+	user     string
+	password string
+	topic    string
+	qos      byte
+	retain   bool
+
+	conn     net.Conn
+	reader   *bufio.Reader
+	packetID uint16
+}
+
+func (m *mqttPublisher) publish(ctx context.Context, batch []teecp.Message) error {
+	if m.conn == nil {
+		if err := m.connect(ctx); err != nil {
+			return err
+		}
+	}
+
+	header := byte(mqttPublish) | m.qos<<1
+	if m.retain {
+		header |= 1
+	}
+
+	var packets []byte
+	pending := map[uint16]bool{}
+	for _, msg := range batch {
+		body := mqttString(nil, m.topic)
+		if m.qos > 0 {
+			m.packetID++
+			if m.packetID == 0 {
+				m.packetID = 1
+			}
+			pending[m.packetID] = true
+			body = binary.BigEndian.AppendUint16(body, m.packetID)
+		}
+		packets = mqttPacket(packets, header, append(body, line(msg)...))
+	}
+
+	m.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := m.conn.Write(packets); err != nil {
+		m.close()
+		return err
+	}
+
+	// QoS 1 is acknowledged by PUBACK, QoS 2 by PUBREC then PUBCOMP once we sent
+	// PUBREL.
+	for len(pending) > 0 {
+		kind, body, err := m.readPacket()
+		if err != nil {
+			m.close()
+			return err
+		}
+		if len(body) < 2 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(body)
+		switch kind & 0xf0 {
+		case mqttPuback, mqttPubcomp:
+			delete(pending, id)
+		case mqttPubrec:
+			if _, err := m.conn.Write(mqttPacket(nil, mqttPubrel, body[:2])); err != nil {
+				m.close()
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *mqttPublisher) connect(ctx context.Context) error {
+	var conn net.Conn
+	var err error
+	if m.tls {
+		dialer := tls.Dialer{Config: &tls.Config{ServerName: m.host}}
+		conn, err = dialer.DialContext(ctx, "tcp", m.addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", m.addr)
+	}
+	if err != nil {
+		return err
+	}
+	m.conn, m.reader = conn, bufio.NewReader(conn)
+
+	var id [6]byte
+	rand.Read(id[:])
+
+	// Clean session, no keep alive: the connection is dropped and made again on
+	// any failure.
+	flags := byte(0x02)
+	body := mqttString(nil, "MQTT")
+	if m.user != "" {
+		flags |= 0x80
+	}
+	if m.password != "" {
+		flags |= 0x40
+	}
+	body = append(body, 4, flags, 0, 0)
+	body = mqttString(body, "teecp-"+hex.EncodeToString(id[:]))
+	if m.user != "" {
+		body = mqttString(body, m.user)
+	}
+	if m.password != "" {
+		body = mqttString(body, m.password)
+	}
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(mqttPacket(nil, mqttConnect, body)); err != nil {
+		m.close()
+		return err
+	}
+
+	kind, ack, err := m.readPacket()
+	if err != nil {
+		m.close()
+		return err
+	}
+	if kind != mqttConnack || len(ack) < 2 {
+		m.close()
+		return fmt.Errorf("unexpected packet %#x instead of CONNACK", kind)
+	}
+	if ack[1] != 0 {
+		m.close()
+		return fmt.Errorf("connection refused by the broker, return code %d", ack[1])
+	}
+	return nil
+}
+
+func (m *mqttPublisher) readPacket() (byte, []byte, error) {
+	for {
+		kind, err := m.reader.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		size, err := binary.ReadUvarint(m.reader)
+		if err != nil {
+			return 0, nil, err
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(m.reader, body); err != nil {
+			return 0, nil, err
+		}
+		if kind != mqttPingresp {
+			return kind, body, nil
+		}
+	}
+}
+
+func (m *mqttPublisher) close() error {
+	if m.conn == nil {
+		return nil
+	}
+	err := m.conn.Close()
+	m.conn, m.reader = nil, nil
+	return err
+}
+
+// mqttPacket appends a control packet: its fixed header and its body.
+func mqttPacket(b []byte, header byte, body []byte) []byte {
+	b = append(b, header)
+	// The remaining length is encoded like an unsigned varint.
+	b = binary.AppendUvarint(b, uint64(len(body)))
+	return append(b, body...)
+}
+
+// mqttString appends a length-prefixed UTF-8 string.
+func mqttString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
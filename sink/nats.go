@@ -0,0 +1,279 @@
+package sink
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+func init() {
+	Register("nats", openNATS)
+}
+
+// openNATS publishes every line to a subject: nats://[user:password@]host:4222/subject.
+// Options are format=json, to publish JSON envelopes instead of bare lines, and
+// mode=jetstream, to wait for the acknowledgement of a JetStream stream so lines
+// are delivered at least once. The default mode=core is at most once.
+func openNATS(u *url.URL, logger *slog.Logger) (Sink, error) {
+	subject := strings.TrimPrefix(u.Path, "/")
+	if subject == "" {
+		return nil, errors.New("missing subject, expected nats://host:4222/subject")
+	}
+
+	q := u.Query()
+	cfg, err := parseBatchConfig(q, realtimeBatchConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &natsPublisher{addr: u.Host, subject: subject, host: u.Hostname()}
+	if u.Port() == "" {
+		n.addr = net.JoinHostPort(cmp.Or(u.Hostname(), "localhost"), "4222")
+	}
+	if u.User != nil {
+		n.user = u.User.Username()
+		n.password, _ = u.User.Password()
+	}
+
+	switch mode := q.Get("mode"); mode {
+	case "", "core":
+	case "jetstream":
+		n.jetstream = true
+	default:
+		return nil, fmt.Errorf("invalid mode %q, expected core or jetstream", mode)
+	}
+	switch format := q.Get("format"); format {
+	case "", "line":
+	case "json":
+		n.json = true
+	default:
+		return nil, fmt.Errorf("invalid format %q, expected line or json", format)
+	}
+
+	return newBatcher(cfg, logger, n.publish, n.close), nil
+}
+
+// natsPublisher speaks just enough of the NATS client protocol to publish messages.
+// It is only used from the batcher goroutine.
+type natsPublisher struct {
+	addr      string
+	host      string
+	user      string
+	password  string
+	subject   string
+	jetstream bool
+	json      bool
+
+	conn   net.Conn
+	reader *bufio.Reader
+	inbox  string
+}
+
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+}
+
+func (n *natsPublisher) publish(ctx context.Context, batch []teecp.Message) error {
+	if n.conn == nil {
+		if err := n.connect(ctx); err != nil {
+			return err
+		}
+	}
+
+	var cmds []byte
+	for i, m := range batch {
+		payload := line(m)
+		if n.json {
+			payload = envelope(m)
+		}
+
+		cmds = append(cmds, "PUB "...)
+		cmds = append(cmds, n.subject...)
+		if n.jetstream {
+			cmds = append(cmds, ' ')
+			cmds = append(cmds, n.inbox...)
+			cmds = strconv.AppendInt(append(cmds, '.'), int64(i), 10)
+		}
+		cmds = append(cmds, ' ')
+		cmds = strconv.AppendInt(cmds, int64(len(payload)), 10)
+		cmds = append(cmds, "\r\n"...)
+		cmds = append(cmds, payload...)
+		cmds = append(cmds, "\r\n"...)
+	}
+	if !n.jetstream {
+		// The PONG tells the server went through every PUB.
+		cmds = append(cmds, "PING\r\n"...)
+	}
+
+	n.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := n.conn.Write(cmds); err != nil {
+		n.close()
+		return err
+	}
+
+	var err error
+	if n.jetstream {
+		err = n.waitAcks(len(batch))
+	} else {
+		err = n.waitPong()
+	}
+	if err != nil {
+		n.close()
+	}
+	return err
+}
+
+func (n *natsPublisher) connect(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", n.addr)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	n.conn, n.reader = conn, bufio.NewReader(conn)
+
+	op, args, err := n.readOp()
+	if err != nil || op != "INFO" {
+		n.close()
+		return fmt.Errorf("unexpected greeting %q: %v", op, err)
+	}
+	var info natsInfo
+	if err := json.Unmarshal([]byte(args), &info); err != nil {
+		n.close()
+		return fmt.Errorf("invalid server info: %w", err)
+	}
+	if info.TLSRequired {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: n.host})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			n.close()
+			return err
+		}
+		n.conn, n.reader = tlsConn, bufio.NewReader(tlsConn)
+	}
+
+	options := map[string]any{"verbose": false, "pedantic": false, "name": "teecp", "lang": "go", "version": "1", "protocol": 1}
+	switch {
+	case n.password != "":
+		options["user"], options["pass"] = n.user, n.password
+	case n.user != "":
+		options["auth_token"] = n.user
+	}
+	connect, _ := json.Marshal(options)
+
+	cmds := "CONNECT " + string(connect) + "\r\n"
+	if n.jetstream {
+		var id [8]byte
+		rand.Read(id[:])
+		n.inbox = "_INBOX." + hex.EncodeToString(id[:])
+		cmds += "SUB " + n.inbox + ".* 1\r\n"
+	}
+	cmds += "PING\r\n"
+	if _, err := io.WriteString(n.conn, cmds); err != nil {
+		n.close()
+		return err
+	}
+	if err := n.waitPong(); err != nil {
+		n.close()
+		return err
+	}
+	return nil
+}
+
+// waitPong reads until the server answers a PING.
+func (n *natsPublisher) waitPong() error {
+	for {
+		op, args, err := n.readOp()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case "PONG":
+			return nil
+		case "-ERR":
+			return errors.New(args)
+		}
+	}
+}
+
+// waitAcks reads the JetStream acknowledgements of count publications.
+func (n *natsPublisher) waitAcks(count int) error {
+	var failed error
+	for acked := 0; acked < count; {
+		op, args, err := n.readOp()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case "-ERR":
+			return errors.New(args)
+		case "MSG":
+			// MSG <subject> <sid> [reply-to] <#bytes>
+			fields := strings.Fields(args)
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil {
+				return fmt.Errorf("invalid message %q", args)
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(n.reader, payload); err != nil {
+				return err
+			}
+
+			var ack struct {
+				Error *struct {
+					Description string `json:"description"`
+				} `json:"error"`
+			}
+			if err := json.Unmarshal(payload[:size], &ack); err != nil {
+				return fmt.Errorf("invalid acknowledgement: %w", err)
+			}
+			if ack.Error != nil && failed == nil {
+				failed = fmt.Errorf("jetstream refused the message: %s", ack.Error.Description)
+			}
+			acked++
+		}
+	}
+	return failed
+}
+
+// readOp reads a protocol line, answering the server PINGs on the way.
+func (n *natsPublisher) readOp() (op, args string, err error) {
+	for {
+		l, err := n.reader.ReadString('\n')
+		if err != nil {
+			return "", "", err
+		}
+		op, args, _ = strings.Cut(strings.TrimRight(l, "\r\n"), " ")
+		op = strings.ToUpper(op)
+		if op == "PING" {
+			if _, err := io.WriteString(n.conn, "PONG\r\n"); err != nil {
+				return "", "", err
+			}
+			continue
+		}
+		return op, args, nil
+	}
+}
+
+func (n *natsPublisher) close() error {
+	if n.conn == nil {
+		return nil
+	}
+	err := n.conn.Close()
+	n.conn, n.reader = nil, nil
+	return err
+}
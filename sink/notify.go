@@ -0,0 +1,79 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+// notifyContext is how many lines preceding a match are sent along with it.
+const notifyContext = 3
+
+// Notify returns a sink posting a chat message to a Slack or Discord incoming
+// webhook whenever a line matches re. The message has the line and the lines
+// preceding it. Matches close in time are sent together.
+func Notify(re *regexp.Regexp, endpoint string, logger *slog.Logger) (Sink, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid webhook %q, expected an http or https URL", endpoint)
+	}
+
+	n := &notifier{re: re, endpoint: endpoint}
+	n.batcher = newBatcher(defaultBatchConfig, logger.With("notify", re.String()), n.post, nil)
+	return n, nil
+}
+
+type notifier struct {
+	re       *regexp.Regexp
+	endpoint string
+	batcher  *batcher
+
+	mu     sync.Mutex
+	recent []string
+}
+
+func (n *notifier) Write(m teecp.Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	text := string(line(m))
+	if n.re.MatchString(text) {
+		// The queued message is the notification itself: context and match.
+		notice := strings.Join(append(n.recent, text), "\n")
+		n.recent = n.recent[:0]
+		return n.batcher.Write(teecp.Message{Seq: m.Seq, Time: m.Time, Data: []byte(notice)})
+	}
+
+	if len(n.recent) == notifyContext {
+		n.recent = append(n.recent[:0], n.recent[1:]...)
+	}
+	n.recent = append(n.recent, text)
+	return nil
+}
+
+func (n *notifier) Close() error {
+	return n.batcher.Close()
+}
+
+func (n *notifier) post(ctx context.Context, batch []teecp.Message) error {
+	var text strings.Builder
+	fmt.Fprintf(&text, "teecp: `%s` matched", n.re)
+	for _, m := range batch {
+		fmt.Fprintf(&text, "\n```\n%s\n```", m.Data)
+	}
+
+	// Slack reads text and Discord reads content, each ignoring the other.
+	body, err := json.Marshal(map[string]string{"text": text.String(), "content": text.String()})
+	if err != nil {
+		return err
+	}
+	return post(ctx, n.endpoint, http.Header{"Content-Type": {"application/json"}}, body, nil)
+}
@@ -0,0 +1,251 @@
+package sink
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeffque/teecp/teecp"
+	"golang.org/x/net/http2"
+)
+
+// OTLP returns a sink exporting every line as an OpenTelemetry log record. The
+// endpoint is host:port or a full URL. Those on 4317, the port of gRPC
+// collectors, and the grpc:// URLs, or grpcs:// for TLS, get OTLP/gRPC; the
+// others OTLP/HTTP JSON, 4318 being its usual port and /v1/logs the default
+// path. The resource describing teecp gets the given attributes.
+func OTLP(endpoint string, resource map[string]string, logger *slog.Logger) (Sink, error) {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q", endpoint)
+	}
+
+	var attributes []otlpAttribute
+	for key, value := range resource {
+		attributes = append(attributes, otlpString(key, value))
+	}
+	slices.SortFunc(attributes, func(a, b otlpAttribute) int { return strings.Compare(a.Key, b.Key) })
+	o := &otlpExporter{resource: attributes}
+	logger = logger.With("sink", "otlp")
+
+	switch {
+	case u.Scheme == "grpc" || u.Scheme == "grpcs" || u.Port() == otlpGRPCPort && (u.Scheme == "http" || u.Scheme == "https"):
+		secure := u.Scheme == "grpcs" || u.Scheme == "https"
+		u.Scheme, u.Path = "http", otlpGRPCMethod
+		if secure {
+			u.Scheme = "https"
+		}
+		o.endpoint, o.client = u.String(), grpcClient(secure)
+		return newBatcher(defaultBatchConfig, logger, o.exportGRPC, func() error {
+			o.client.CloseIdleConnections()
+			return nil
+		}), nil
+	case u.Scheme == "http" || u.Scheme == "https":
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/v1/logs"
+		}
+		o.endpoint = u.String()
+		return newBatcher(defaultBatchConfig, logger, o.export, nil), nil
+	default:
+		return nil, fmt.Errorf("OTLP endpoint %q: the scheme is http, https, grpc or grpcs", endpoint)
+	}
+}
+
+// otlpGRPCPort is the port collectors receive OTLP/gRPC on.
+const otlpGRPCPort = "4317"
+
+// otlpGRPCMethod is the path of the gRPC method exporting logs.
+const otlpGRPCMethod = "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+
+type otlpExporter struct {
+	endpoint string
+	resource []otlpAttribute
+	// client, for OTLP/gRPC, speaks HTTP/2 only.
+	client *http.Client
+}
+
+// The types below follow the JSON mapping of the OTLP protobuf messages, where
+// 64-bit integers are strings.
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    string  `json:"intValue,omitempty"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         string          `json:"timeUnixNano"`
+	ObservedTimeUnixNano string          `json:"observedTimeUnixNano"`
+	SeverityNumber       int             `json:"severityNumber"`
+	SeverityText         string          `json:"severityText"`
+	Body                 otlpValue       `json:"body"`
+	Attributes           []otlpAttribute `json:"attributes"`
+}
+
+func otlpString(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func (o *otlpExporter) export(ctx context.Context, batch []teecp.Message) error {
+	records := make([]otlpLogRecord, len(batch))
+	for i, m := range batch {
+		body := string(line(m))
+		ts := strconv.FormatInt(m.Time.UnixNano(), 10)
+		records[i] = otlpLogRecord{
+			TimeUnixNano:         ts,
+			ObservedTimeUnixNano: ts,
+			SeverityNumber:       9,
+			SeverityText:         "INFO",
+			Body:                 otlpValue{StringValue: &body},
+			Attributes:           []otlpAttribute{{Key: "teecp.seq", Value: otlpValue{IntValue: strconv.FormatUint(m.Seq, 10)}}},
+		}
+	}
+
+	type scope struct {
+		Name string `json:"name"`
+	}
+	type scopeLogs struct {
+		Scope      scope           `json:"scope"`
+		LogRecords []otlpLogRecord `json:"logRecords"`
+	}
+	type resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	type resourceLogs struct {
+		Resource  resource    `json:"resource"`
+		ScopeLogs []scopeLogs `json:"scopeLogs"`
+	}
+	body, err := json.Marshal(struct {
+		ResourceLogs []resourceLogs `json:"resourceLogs"`
+	}{[]resourceLogs{{
+		Resource:  resource{o.resource},
+		ScopeLogs: []scopeLogs{{Scope: scope{"teecp"}, LogRecords: records}},
+	}}})
+	if err != nil {
+		return err
+	}
+	return post(ctx, o.endpoint, http.Header{"Content-Type": {"application/json"}}, body, nil)
+}
+
+// grpcClient returns a client of HTTP/2 only, as gRPC is, over TLS when secure
+// and in clear text otherwise, the way gRPC collectors listen by default.
+func grpcClient(secure bool) *http.Client {
+	t := &http2.Transport{}
+	if !secure {
+		t.AllowHTTP = true
+		t.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		}
+	}
+	return &http.Client{Transport: t, Timeout: 30 * time.Second}
+}
+
+// exportGRPC sends the batch with the unary call of OTLP/gRPC: the protobuf
+// request after the 5 bytes of a gRPC message, the status coming in the
+// trailers, or in the headers when the call fails right away.
+func (o *otlpExporter) exportGRPC(ctx context.Context, batch []teecp.Message) error {
+	request := o.protobuf(batch)
+	body := make([]byte, 5, 5+len(request))
+	binary.BigEndian.PutUint32(body[1:], uint32(len(request)))
+	body = append(body, request...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("gRPC export: %s", resp.Status)
+	}
+	io.Copy(io.Discard, resp.Body)
+
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		message, _ = url.PathUnescape(message)
+		return fmt.Errorf("gRPC export: status %s: %s", cmp.Or(status, "missing"), message)
+	}
+	return nil
+}
+
+// protobuf encodes the ExportLogsServiceRequest of the batch, with the fields of
+// the OTLP protobuf messages the JSON of export has.
+func (o *otlpExporter) protobuf(batch []teecp.Message) []byte {
+	var records []byte
+	for _, m := range batch {
+		var record []byte
+		ts := uint64(m.Time.UnixNano())
+		record = protoFixed64(record, 1, ts)
+		record = protoVarint(record, 2, 9)
+		record = protoBytes(record, 3, []byte("INFO"))
+		// Strings are UTF-8 in protobuf, as encoding/json makes them for export.
+		body := strings.ToValidUTF8(string(line(m)), "\uFFFD")
+		record = protoBytes(record, 5, protoBytes(nil, 1, []byte(body)))
+		record = protoBytes(record, 6, protoKeyValue("teecp.seq", protoVarint(nil, 3, m.Seq)))
+		record = protoFixed64(record, 11, ts)
+		records = protoBytes(records, 2, record)
+	}
+	var resource []byte
+	for _, a := range o.resource {
+		resource = protoBytes(resource, 1, protoKeyValue(a.Key, protoBytes(nil, 1, []byte(*a.Value.StringValue))))
+	}
+
+	scopeLogs := protoBytes(nil, 1, protoBytes(nil, 1, []byte("teecp")))
+	scopeLogs = append(scopeLogs, records...)
+	resourceLogs := protoBytes(nil, 1, resource)
+	resourceLogs = protoBytes(resourceLogs, 2, scopeLogs)
+	return protoBytes(nil, 1, resourceLogs)
+}
+
+// protoKeyValue encodes a KeyValue of the given encoded AnyValue.
+func protoKeyValue(key string, value []byte) []byte {
+	return protoBytes(protoBytes(nil, 1, []byte(key)), 2, value)
+}
+
+// The functions below append a field of protobuf, of the wire type its name
+// tells, to b.
+
+func protoVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3)
+	return binary.AppendUvarint(b, v)
+}
+
+func protoFixed64(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|1)
+	return binary.LittleEndian.AppendUint64(b, v)
+}
+
+func protoBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
@@ -0,0 +1,111 @@
+package sink
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffque/teecp/teecp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+func TestOTLPEndpoints(t *testing.T) {
+	for endpoint, ok := range map[string]bool{
+		"collector:4318":                 true,
+		"https://collector/otlp/v1/logs": true,
+		"collector:4317":                 true,
+		"http://collector:4317":          true,
+		"grpc://collector:9000":          true,
+		"grpcs://collector":              true,
+		"collector":                      true,
+		"ftp://collector":                false,
+	} {
+		s, err := OTLP(endpoint, nil, slog.Default())
+		if (err == nil) != ok {
+			t.Errorf("%s: got %v, want accepted %v", endpoint, err, ok)
+		}
+		if s != nil {
+			s.Close()
+		}
+	}
+}
+
+func TestOTLPOverGRPC(t *testing.T) {
+	requests := make(chan []byte, 1)
+	status := "0"
+	srv := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != otlpGRPCMethod || r.Header.Get("Content-Type") != "application/grpc" {
+			t.Errorf("got %s %s of %q, want a gRPC call of %s", r.Proto, r.URL.Path, r.Header.Get("Content-Type"), otlpGRPCMethod)
+		}
+		body, _ := io.ReadAll(r.Body)
+		requests <- body
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Grpc-Status", status)
+		w.Header().Set("Grpc-Message", "bad%20request")
+	}), &http2.Server{}))
+	defer srv.Close()
+
+	o := &otlpExporter{endpoint: srv.URL + otlpGRPCMethod, resource: []otlpAttribute{otlpString("service.name", "build")}, client: grpcClient(false)}
+	batch := []teecp.Message{{Seq: 7, Time: time.Unix(1, 0), Data: []byte("hello\n")}}
+	if err := o.exportGRPC(context.Background(), batch); err != nil {
+		t.Fatal(err)
+	}
+
+	body := <-requests
+	if len(body) < 5 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+		t.Fatalf("got %q, want a gRPC message", body)
+	}
+	resourceLogs := protoField(t, body[5:], 1)
+	service := protoField(t, protoField(t, protoField(t, resourceLogs, 1), 1), 2)
+	record := protoField(t, protoField(t, resourceLogs, 2), 2)
+	if got := string(protoField(t, service, 1)); got != "build" {
+		t.Errorf("got the service %q, want build", got)
+	}
+	if got := string(protoField(t, protoField(t, record, 5), 1)); got != "hello" {
+		t.Errorf("got the body %q, want hello", got)
+	}
+
+	status = "3"
+	err := o.exportGRPC(context.Background(), batch)
+	<-requests
+	if err == nil || !strings.Contains(err.Error(), "bad request") {
+		t.Errorf("got %v, want the status of the collector", err)
+	}
+}
+
+// protoField returns the first field of b of the given number, of the wire type
+// of bytes, failing the test when there is none.
+func protoField(t *testing.T, b []byte, field uint64) []byte {
+	t.Helper()
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		b = b[n:]
+		switch key & 7 {
+		case 0:
+			_, n := binary.Uvarint(b)
+			b = b[n:]
+		case 1:
+			b = b[8:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			value := b[n : n+int(size)]
+			if key>>3 == field {
+				return value
+			}
+			b = b[n+int(size):]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	t.Fatalf("no field %d", field)
+	return nil
+}
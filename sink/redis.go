@@ -0,0 +1,167 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+func init() {
+	Register("redis", openRedis)
+	Register("rediss", openRedis)
+}
+
+// openRedis publishes every line to a channel: redis://[user:password@]host:6379/channel.
+// The rediss scheme connects with TLS.
+func openRedis(u *url.URL, logger *slog.Logger) (Sink, error) {
+	channel := strings.TrimPrefix(u.Path, "/")
+	if channel == "" {
+		return nil, errors.New("missing channel, expected redis://host:6379/channel")
+	}
+
+	cfg, err := parseBatchConfig(u.Query(), realtimeBatchConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &redisPublisher{addr: u.Host, channel: channel, tls: u.Scheme == "rediss"}
+	if r.addr == "" {
+		r.addr = "localhost:6379"
+	} else if u.Port() == "" {
+		r.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		r.user = u.User.Username()
+		r.password, _ = u.User.Password()
+	}
+	return newBatcher(cfg, logger, r.publish, r.close), nil
+}
+
+// redisPublisher speaks just enough of the Redis protocol to publish messages. It
+// is only used from the batcher goroutine.
+type redisPublisher struct {
+	addr     string
+	tls      bool
+	user     string
+	password string
+	channel  string
+
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (r *redisPublisher) publish(ctx context.Context, batch []teecp.Message) error {
+	if r.conn == nil {
+		if err := r.connect(ctx); err != nil {
+			return err
+		}
+	}
+
+	// Pipeline every command and then read every reply.
+	var cmds []byte
+	for _, m := range batch {
+		cmds = appendRESP(cmds, "PUBLISH", r.channel, string(line(m)))
+	}
+	r.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := r.conn.Write(cmds); err != nil {
+		r.close()
+		return err
+	}
+	for range batch {
+		if err := r.readReply(); err != nil {
+			r.close()
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *redisPublisher) connect(ctx context.Context) error {
+	var conn net.Conn
+	var err error
+	if r.tls {
+		dialer := tls.Dialer{}
+		conn, err = dialer.DialContext(ctx, "tcp", r.addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", r.addr)
+	}
+	if err != nil {
+		return err
+	}
+	r.conn, r.reader = conn, bufio.NewReader(conn)
+
+	if r.password != "" {
+		var auth []byte
+		if r.user != "" {
+			auth = appendRESP(nil, "AUTH", r.user, r.password)
+		} else {
+			auth = appendRESP(nil, "AUTH", r.password)
+		}
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write(auth); err != nil {
+			r.close()
+			return err
+		}
+		if err := r.readReply(); err != nil {
+			r.close()
+			return fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// readReply reads a simple reply, which is all PUBLISH and AUTH answer with.
+func (r *redisPublisher) readReply() error {
+	reply, err := r.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	reply = strings.TrimRight(reply, "\r\n")
+	if reply == "" {
+		return io.ErrUnexpectedEOF
+	}
+	switch reply[0] {
+	case '+', ':':
+		return nil
+	case '-':
+		return errors.New(reply[1:])
+	default:
+		return fmt.Errorf("unexpected reply %q", reply)
+	}
+}
+
+func (r *redisPublisher) close() error {
+	if r.conn == nil {
+		return nil
+	}
+	err := r.conn.Close()
+	r.conn, r.reader = nil, nil
+	return err
+}
+
+// appendRESP appends a command encoded as a RESP array of bulk strings.
+func appendRESP(b []byte, args ...string) []byte {
+	b = append(b, '*')
+	b = strconv.AppendInt(b, int64(len(args)), 10)
+	b = append(b, "\r\n"...)
+	for _, arg := range args {
+		b = append(b, '$')
+		b = strconv.AppendInt(b, int64(len(arg)), 10)
+		b = append(b, "\r\n"...)
+		b = append(b, arg...)
+		b = append(b, "\r\n"...)
+	}
+	return b
+}
@@ -0,0 +1,148 @@
+// Package sink forwards the broadcast of a teecp server to other systems, such as
+// message brokers, log stores or databases. Sinks are opened from URLs whose scheme
+// selects the implementation, e.g. kafka://broker:9092/topic.
+package sink
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+// Sink receives every broadcast message.
+type Sink interface {
+	// Write hands a message to the sink. It is called while broadcasting, so it
+	// must not block: sinks talking to the network queue the messages and send
+	// them on the side. The message data must be copied to be kept. An error
+	// detaches the sink for good.
+	Write(m teecp.Message) error
+	// Close sends what is still queued and releases the sink.
+	Close() error
+}
+
+// Opener builds a sink from its URL. The logger receives what happens once the
+// sink works on the side.
+type Opener func(u *url.URL, logger *slog.Logger) (Sink, error)
+
+var (
+	mu      sync.Mutex
+	openers = map[string]Opener{}
+)
+
+// Register makes a sink available for the URL scheme.
+func Register(scheme string, open Opener) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, dup := openers[scheme]; dup {
+		panic("sink: Register called twice for scheme " + scheme)
+	}
+	openers[scheme] = open
+}
+
+// Schemes returns the registered URL schemes, sorted.
+func Schemes() []string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	schemes := make([]string, 0, len(openers))
+	for scheme := range openers {
+		schemes = append(schemes, scheme)
+	}
+	slices.Sort(schemes)
+	return schemes
+}
+
+// Open opens the sink described by rawURL. A sink talking to an URL of another
+// scheme is described as scheme=URL, e.g. webhook=https://example.com/ingest, and
+// a sink without address by its scheme alone, e.g. journald?tag=build.
+func Open(rawURL string, logger *slog.Logger) (Sink, error) {
+	scheme, u, err := parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	mu.Lock()
+	open := openers[scheme]
+	mu.Unlock()
+
+	s, err := open(u, logger.With("sink", scheme))
+	if err != nil {
+		return nil, fmt.Errorf("could not open sink %s: %w", u.Redacted(), err)
+	}
+	return s, nil
+}
+
+// Check tells what would keep the sink described by rawURL from opening, short of
+// opening it: an invalid URL, an unknown scheme or hosts that do not resolve.
+func Check(ctx context.Context, rawURL string) error {
+	_, u, err := parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	// Some sinks take a list of hosts, such as the brokers of Kafka.
+	var errs []error
+	for _, host := range strings.Split(u.Host, ",") {
+		if name, _, err := net.SplitHostPort(host); err == nil {
+			host = name
+		}
+		if host == "" {
+			continue
+		}
+		if _, err := net.DefaultResolver.LookupHost(ctx, host); err != nil {
+			errs = append(errs, fmt.Errorf("sink %s: %w", u.Redacted(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// parse returns the scheme of the sink described by rawURL, which has an opener,
+// and its URL.
+func parse(rawURL string) (string, *url.URL, error) {
+	scheme, target, ok := strings.Cut(rawURL, "=")
+	if !ok || strings.ContainsAny(scheme, ":/?") {
+		scheme, target = "", rawURL
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid sink %q: %w", rawURL, err)
+	}
+	scheme = cmp.Or(scheme, u.Scheme, u.Path)
+
+	mu.Lock()
+	_, ok = openers[scheme]
+	mu.Unlock()
+	if !ok {
+		return "", nil, fmt.Errorf("unknown sink %q, expected one of %v", scheme, Schemes())
+	}
+	return scheme, u, nil
+}
+
+// Attach makes the sink receive the broadcast of the server.
+func Attach(server *teecp.Server, s Sink) *teecp.Handle {
+	return server.AttachMessages(s.Write)
+}
+
+// envelope returns the message as a JSON teecp.Envelope.
+func envelope(m teecp.Message) []byte {
+	b, _ := json.Marshal(teecp.Envelope{Seq: m.Seq, Time: m.Time, Line: string(line(m))})
+	return b
+}
+
+// line returns the data of the message without its trailing newline.
+func line(m teecp.Message) []byte {
+	return bytes.TrimSuffix(m.Data, []byte("\n"))
+}
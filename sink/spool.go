@@ -0,0 +1,151 @@
+package sink
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+func init() {
+	Register("spool", openSpool)
+}
+
+// spoolExt is the extension of the files recording a session, described by a
+// file of the same name ending with .json instead.
+const spoolExt = ".spool"
+
+// Spool is a sink recording the session, the lines along with their sequence
+// number, time and topic, in the framed format of teecp, for the session to be
+// exported later. Every run records a file of its own in the directory, named
+// after the time it started.
+type Spool struct {
+	*batcher
+
+	file   *os.File
+	writer *bufio.Writer
+	enc    teecp.Encoder
+}
+
+// SpoolSession describes a session recorded by a Spool.
+type SpoolSession struct {
+	// Name is the name of the file recording the session, without extension.
+	Name    string    `json:"name"`
+	Host    string    `json:"host"`
+	PID     int       `json:"pid"`
+	Started time.Time `json:"started"`
+
+	path string
+}
+
+// openSpool records the session in a directory: spool:/var/spool/teecp.
+func openSpool(u *url.URL, logger *slog.Logger) (Sink, error) {
+	dir := cmp.Or(u.Opaque, u.Path)
+	if dir == "" {
+		return nil, errors.New("missing directory, expected spool:/var/spool/teecp")
+	}
+	cfg, err := parseBatchConfig(u.Query(), realtimeBatchConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+	started := time.Now()
+	session := SpoolSession{
+		Name:    started.UTC().Format("20060102T150405.000000000Z"),
+		Host:    host,
+		PID:     os.Getpid(),
+		Started: started,
+	}
+	meta, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+	base := filepath.Join(dir, session.Name)
+	if err := os.WriteFile(base+".json", append(meta, '\n'), 0o644); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(base+spoolExt, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spool{file: file, writer: bufio.NewWriter(file)}
+	s.enc = teecp.FramedCodec{}.NewEncoder(s.writer)
+	s.batcher = newBatcher(cfg, logger, s.write, file.Close)
+	return s, nil
+}
+
+func (s *Spool) write(ctx context.Context, batch []teecp.Message) error {
+	for _, m := range batch {
+		if err := s.enc.Encode(m); err != nil {
+			return err
+		}
+	}
+	return s.writer.Flush()
+}
+
+// SpoolSessions returns the sessions recorded in the directory by spool sinks,
+// oldest first.
+func SpoolSessions(dir string) ([]SpoolSession, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+spoolExt))
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(paths)
+
+	sessions := make([]SpoolSession, 0, len(paths))
+	for _, path := range paths {
+		base := strings.TrimSuffix(path, spoolExt)
+		session := SpoolSession{Name: filepath.Base(base)}
+		// A session whose description is lost is still worth its lines.
+		if meta, err := os.ReadFile(base + ".json"); err == nil {
+			if err := json.Unmarshal(meta, &session); err != nil {
+				return nil, fmt.Errorf("%s.json: %w", base, err)
+			}
+		}
+		session.path = path
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// Messages hands the messages recorded in the session to each, in order. A
+// last frame cut short, as when the server was killed while writing it, ends
+// the session.
+func (s SpoolSession) Messages(each func(m teecp.Message) error) error {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := teecp.FramedCodec{}.NewDecoder(bufio.NewReader(f))
+	for {
+		m, err := dec.Decode()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", s.path, err)
+		}
+		if err := each(m); err != nil {
+			return err
+		}
+	}
+}
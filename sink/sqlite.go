@@ -0,0 +1,203 @@
+package sink
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+func init() {
+	Register("sqlite", openSQLite)
+}
+
+// sqliteAck is selected after every batch, and after the table is created, to
+// know it was committed.
+const sqliteAck = "teecp-committed"
+
+var sqliteIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// openSQLite appends every line to a table of a SQLite database: sqlite:stream.db
+// or sqlite:///var/log/stream.db. Rows have the sequence number, the time as
+// RFC 3339, the tag and the line. Options are table (lines) and tag. The database
+// is written by the sqlite3 command, which must be installed: it is started, and
+// the table created, right away.
+func openSQLite(u *url.URL, logger *slog.Logger) (Sink, error) {
+	path := cmp.Or(u.Opaque, u.Path)
+	if path == "" {
+		return nil, errors.New("missing database, expected sqlite:stream.db")
+	}
+
+	q := u.Query()
+	cfg, err := parseBatchConfig(q, defaultBatchConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	table := cmp.Or(q.Get("table"), "lines")
+	if !sqliteIdentifier.MatchString(table) {
+		return nil, fmt.Errorf("invalid table %q", table)
+	}
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		return nil, err
+	}
+
+	s := &sqliteWriter{path: path, table: table, tag: "NULL"}
+	if tag := q.Get("tag"); tag != "" {
+		s.tag = sqliteText([]byte(tag))
+	}
+	// sqlite3 waits 5s at most for a database locked by another process.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.start(ctx); err != nil {
+		return nil, err
+	}
+	return newBatcher(cfg, logger, s.insert, s.close), nil
+}
+
+// sqliteWriter feeds statements to a sqlite3 process, from the batcher goroutine
+// and a goroutine of its own reading the acknowledgements.
+type sqliteWriter struct {
+	path  string
+	table string
+	// tag is the SQL literal of the tag.
+	tag string
+
+	// mu guards the process, which close resets once the reading is over.
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	stdout  *bufio.Reader
+	stderr  strings.Builder
+	reading sync.WaitGroup
+}
+
+func (s *sqliteWriter) insert(ctx context.Context, batch []teecp.Message) error {
+	s.mu.Lock()
+	started := s.cmd != nil
+	s.mu.Unlock()
+	if !started {
+		if err := s.start(ctx); err != nil {
+			return err
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("BEGIN;\n")
+	for _, m := range batch {
+		fmt.Fprintf(&b, "INSERT INTO %s (seq, time, tag, line) VALUES (%d, '%s', %s, %s);\n",
+			s.table, m.Seq, m.Time.Format(time.RFC3339Nano), s.tag, sqliteText(line(m)))
+	}
+	b.WriteString("COMMIT;\n")
+	return s.run(ctx, b.String())
+}
+
+// start runs sqlite3 and creates the table, failing when the database does not
+// open.
+func (s *sqliteWriter) start(ctx context.Context) error {
+	cmd := exec.Command("sqlite3", "-bail", "-batch", s.path)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	s.stderr.Reset()
+	cmd.Stderr = &s.stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.cmd, s.stdin, s.stdout = cmd, stdin, bufio.NewReader(stdout)
+	s.mu.Unlock()
+
+	// .timeout, unlike PRAGMA busy_timeout, prints nothing to be taken for the
+	// acknowledgement.
+	return s.run(ctx, ".timeout 5000\n"+
+		"CREATE TABLE IF NOT EXISTS "+s.table+" (seq INTEGER NOT NULL, time TEXT NOT NULL, tag TEXT, line TEXT NOT NULL);\n")
+}
+
+// run feeds the statements to sqlite3 and waits for them to be acknowledged,
+// which is only printed once they succeeded, as sqlite3 stops at the first
+// error. The reading goes on until sqlite3 is stopped when they are given up on.
+func (s *sqliteWriter) run(ctx context.Context, statements string) error {
+	s.mu.Lock()
+	stdin, stdout := s.stdin, s.stdout
+	s.mu.Unlock()
+
+	if _, err := io.WriteString(stdin, statements+"SELECT '"+sqliteAck+"';\n"); err != nil {
+		return s.fail(err)
+	}
+	done := make(chan error, 1)
+	s.reading.Add(1)
+	go func() {
+		defer s.reading.Done()
+		reply, err := stdout.ReadString('\n')
+		if err == nil && strings.TrimSpace(reply) != sqliteAck {
+			err = fmt.Errorf("unexpected output %q", reply)
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			return s.fail(err)
+		}
+		return nil
+	case <-ctx.Done():
+		return s.fail(ctx.Err())
+	}
+}
+
+// fail stops sqlite3, whose error output is the best explanation.
+func (s *sqliteWriter) fail(err error) error {
+	s.close()
+	if reason := strings.TrimSpace(s.stderr.String()); reason != "" {
+		return errors.New(reason)
+	}
+	return err
+}
+
+func (s *sqliteWriter) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cmd == nil {
+		return nil
+	}
+	s.stdin.Close()
+	done := make(chan error, 1)
+	go func() { done <- s.cmd.Wait() }()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(closeTimeout):
+		s.cmd.Process.Kill()
+		err = <-done
+	}
+	// Waiting closed the output, so the reading is over.
+	s.reading.Wait()
+	s.cmd, s.stdin, s.stdout = nil, nil, nil
+	return err
+}
+
+// sqliteText returns data as a SQL text literal, written as a blob so that any
+// byte is safe.
+func sqliteText(data []byte) string {
+	return "CAST(X'" + hex.EncodeToString(data) + "' AS TEXT)"
+}
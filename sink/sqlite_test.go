@@ -0,0 +1,57 @@
+package sink
+
+import (
+	"bytes"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+func TestSQLiteInsertsEveryLineOnce(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+	db := filepath.Join(t.TempDir(), "stream.db")
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+
+	s, err := Open("sqlite:"+db, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, line := range []string{"one\n", "two\n", "three\n"} {
+		if err := s.Write(teecp.Message{Seq: uint64(i + 1), Time: time.Now(), Data: []byte(line)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command("sqlite3", "-batch", db, "SELECT count(*), count(DISTINCT seq) FROM lines;").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(out)); got != "3|3" {
+		t.Errorf("rows and distinct sequence numbers = %s, want 3|3", got)
+	}
+	if strings.Contains(logs.String(), "level=WARN") || strings.Contains(logs.String(), "level=ERROR") {
+		t.Errorf("unexpected logs:\n%s", logs.String())
+	}
+}
+
+func TestSQLiteFailsToOpenRightAway(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+	db := filepath.Join(t.TempDir(), "missing", "stream.db")
+	if s, err := Open("sqlite:"+db, slog.Default()); err == nil {
+		s.Close()
+		t.Fatal("opened a database in a missing directory")
+	}
+}
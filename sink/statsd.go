@@ -0,0 +1,104 @@
+package sink
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"regexp"
+	"strconv"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+// statsdPacketSize keeps datagrams under the usual MTU.
+const statsdPacketSize = 1432
+
+// Metric is a StatsD counter incremented by every line matching Pattern.
+type Metric struct {
+	Name    string
+	Pattern *regexp.Regexp
+}
+
+// StatsD returns a sink counting the lines matching each metric and sending the
+// counters to the StatsD server at addr over UDP. Lines are matched on the side,
+// not while broadcasting.
+func StatsD(addr string, metrics []Metric, logger *slog.Logger) (Sink, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, err
+	}
+
+	s := &statsdCounter{addr: addr, metrics: metrics}
+	return newBatcher(defaultBatchConfig, logger.With("sink", "statsd"), s.send, s.close), nil
+}
+
+// statsdCounter is only used from the batcher goroutine.
+type statsdCounter struct {
+	addr    string
+	metrics []Metric
+
+	conn net.Conn
+}
+
+func (s *statsdCounter) send(ctx context.Context, batch []teecp.Message) error {
+	counts := make([]int, len(s.metrics))
+	for _, m := range batch {
+		for i, metric := range s.metrics {
+			if metric.Pattern.Match(line(m)) {
+				counts[i]++
+			}
+		}
+	}
+
+	if s.conn == nil {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "udp", s.addr)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	// Counters are name:count|c, one per line, packed in as few datagrams as
+	// possible.
+	var packet []byte
+	for i, metric := range s.metrics {
+		if counts[i] == 0 {
+			continue
+		}
+		counter := append([]byte(metric.Name), ':')
+		counter = strconv.AppendInt(counter, int64(counts[i]), 10)
+		counter = append(counter, "|c"...)
+
+		if len(packet) > 0 && len(packet)+1+len(counter) > statsdPacketSize {
+			if err := s.write(packet); err != nil {
+				return err
+			}
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, counter...)
+	}
+	if len(packet) > 0 {
+		return s.write(packet)
+	}
+	return nil
+}
+
+func (s *statsdCounter) write(packet []byte) error {
+	if _, err := s.conn.Write(packet); err != nil {
+		s.close()
+		return err
+	}
+	return nil
+}
+
+func (s *statsdCounter) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -0,0 +1,170 @@
+package sink
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+func init() {
+	Register("syslog", openSyslog)
+	Register("syslog+tcp", openSyslog)
+	Register("syslog+tls", openSyslog)
+}
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11, "ntp": 12, "audit": 13, "alert": 14, "clock": 15,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var syslogSeverities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3, "warning": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// openSyslog sends every line as a RFC 5424 message: syslog://host:514 over UDP,
+// syslog+tcp://host:514 or syslog+tls://host:6514 with octet counting framing.
+// Options are facility (user), severity (info), app (teecp) and hostname.
+func openSyslog(u *url.URL, logger *slog.Logger) (Sink, error) {
+	q := u.Query()
+	cfg, err := parseBatchConfig(q, realtimeBatchConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	facility, ok := syslogFacilities[cmp.Or(q.Get("facility"), "user")]
+	if !ok {
+		return nil, fmt.Errorf("unknown facility %q", q.Get("facility"))
+	}
+	severity, ok := syslogSeverities[cmp.Or(q.Get("severity"), "info")]
+	if !ok {
+		return nil, fmt.Errorf("unknown severity %q", q.Get("severity"))
+	}
+
+	hostname := q.Get("hostname")
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+
+	s := &syslogWriter{
+		network: "udp",
+		host:    cmp.Or(u.Hostname(), "localhost"),
+		header: fmt.Sprintf(" %s %s %d - - ", syslogField(hostname),
+			syslogField(cmp.Or(q.Get("app"), "teecp")), os.Getpid()),
+		priority: facility*8 + severity,
+	}
+	port := "514"
+	switch u.Scheme {
+	case "syslog+tcp":
+		s.network = "tcp"
+	case "syslog+tls":
+		s.network, s.tls = "tcp", true
+		port = "6514"
+	}
+	s.addr = net.JoinHostPort(s.host, cmp.Or(u.Port(), port))
+
+	return newBatcher(cfg, logger, s.send, s.close), nil
+}
+
+// syslogWriter is only used from the batcher goroutine.
+type syslogWriter struct {
+	network  string
+	addr     string
+	host     string
+	tls      bool
+	priority int
+	// header is what follows the timestamp: hostname, app name, process id, and
+	// neither message id nor structured data.
+	header string
+
+	conn net.Conn
+}
+
+func (s *syslogWriter) send(ctx context.Context, batch []teecp.Message) error {
+	if s.conn == nil {
+		if err := s.connect(ctx); err != nil {
+			return err
+		}
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if s.network == "udp" {
+		// One datagram per message.
+		for _, m := range batch {
+			if _, err := s.conn.Write(s.format(nil, m)); err != nil {
+				s.close()
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Streams frame every message with its length, as of RFC 6587.
+	var b, msg []byte
+	for _, m := range batch {
+		msg = s.format(msg[:0], m)
+		b = strconv.AppendInt(b, int64(len(msg)), 10)
+		b = append(b, ' ')
+		b = append(b, msg...)
+	}
+	if _, err := s.conn.Write(b); err != nil {
+		s.close()
+		return err
+	}
+	return nil
+}
+
+// format appends the message as <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG.
+func (s *syslogWriter) format(b []byte, m teecp.Message) []byte {
+	b = append(b, '<')
+	b = strconv.AppendInt(b, int64(s.priority), 10)
+	b = append(b, ">1 "...)
+	b = m.Time.AppendFormat(b, "2006-01-02T15:04:05.000000Z07:00")
+	b = append(b, s.header...)
+	return append(b, line(m)...)
+}
+
+func (s *syslogWriter) connect(ctx context.Context) error {
+	var err error
+	if s.tls {
+		dialer := tls.Dialer{Config: &tls.Config{ServerName: s.host}}
+		s.conn, err = dialer.DialContext(ctx, s.network, s.addr)
+	} else {
+		var dialer net.Dialer
+		s.conn, err = dialer.DialContext(ctx, s.network, s.addr)
+	}
+	return err
+}
+
+func (s *syslogWriter) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// syslogField makes a header field out of s: printable ASCII without spaces, or the
+// nil value.
+func syslogField(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c <= ' ' || c > '~' {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 {
+		return "-"
+	}
+	return string(b)
+}
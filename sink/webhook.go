@@ -0,0 +1,80 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jeffque/teecp/teecp"
+)
+
+func init() {
+	Register("webhook", openWebhook)
+}
+
+// openWebhook posts batches of lines as a JSON array to an HTTP endpoint:
+// webhook=https://example.com/ingest. Options, removed from the URL before
+// posting, are format=json, to post JSON envelopes instead of bare lines, and
+// header=Name:Value, which may be repeated.
+func openWebhook(u *url.URL, logger *slog.Logger) (Sink, error) {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid endpoint %q, expected webhook=https://host/path", u.Redacted())
+	}
+
+	q := u.Query()
+	cfg, err := parseBatchConfig(q, defaultBatchConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &webhookPoster{header: http.Header{"Content-Type": {"application/json"}}}
+	switch format := q.Get("format"); format {
+	case "", "line":
+	case "json":
+		w.envelopes = true
+	default:
+		return nil, fmt.Errorf("invalid format %q, expected line or json", format)
+	}
+	for _, h := range q["header"] {
+		name, value, ok := strings.Cut(h, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid header %q, expected Name:Value", h)
+		}
+		w.header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	for _, key := range []string{"batch", "interval", "queue", "retries", "format", "header"} {
+		q.Del(key)
+	}
+	endpoint := *u
+	endpoint.RawQuery = q.Encode()
+	w.endpoint = endpoint.String()
+
+	return newBatcher(cfg, logger, w.post, nil), nil
+}
+
+type webhookPoster struct {
+	endpoint  string
+	header    http.Header
+	envelopes bool
+}
+
+func (w *webhookPoster) post(ctx context.Context, batch []teecp.Message) error {
+	items := make([]json.RawMessage, len(batch))
+	for i, m := range batch {
+		if w.envelopes {
+			items[i] = envelope(m)
+		} else {
+			items[i], _ = json.Marshal(string(line(m)))
+		}
+	}
+	body, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	return post(ctx, w.endpoint, w.header, body, nil)
+}
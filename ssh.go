@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dialSSH connects to addr, as reached from the jump host, through ssh -W. ssh
+// does the authentication, with the agent and the keys of the user, and checks
+// the jump host against known_hosts, as configured in ~/.ssh/config.
+func dialSSH(ctx context.Context, jump, addr string) (net.Conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if strings.Contains(addr, "://") {
+		return nil, fmt.Errorf("--ssh connects to host:port, not to %s", addr)
+	}
+
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		stdinR.Close()
+		stdinW.Close()
+		return nil, err
+	}
+
+	c := &sshConn{jump: jump, addr: addr, r: stdoutR, w: stdinW, exited: make(chan struct{})}
+	// BatchMode keeps ssh from asking for a password on the terminal, stdin being
+	// the stream.
+	c.cmd = exec.Command("ssh", "-o", "BatchMode=yes", "-W", addr, jump)
+	c.cmd.Stdin, c.cmd.Stdout, c.cmd.Stderr = stdinR, stdoutW, &c.stderr
+	err = c.cmd.Start()
+	stdinR.Close()
+	stdoutW.Close()
+	if err != nil {
+		stdoutR.Close()
+		stdinW.Close()
+		return nil, fmt.Errorf("could not run ssh: %w", err)
+	}
+	go func() {
+		c.err = c.cmd.Wait()
+		close(c.exited)
+	}()
+	return c, nil
+}
+
+// sshConn is the connection forwarded by ssh, over its stdin and stdout.
+type sshConn struct {
+	jump   string
+	addr   string
+	cmd    *exec.Cmd
+	r      *os.File
+	w      *os.File
+	stderr bytes.Buffer
+	// err is how ssh exited, set once exited is closed.
+	err    error
+	exited chan struct{}
+	close  sync.Once
+}
+
+// Read tells why ssh exited, rather than just the end of the stream, when it
+// failed.
+func (c *sshConn) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err == io.EOF {
+		select {
+		case <-c.exited:
+		case <-time.After(time.Second):
+		}
+		if reason := c.failure(); reason != nil {
+			return n, reason
+		}
+	}
+	return n, err
+}
+
+func (c *sshConn) failure() error {
+	select {
+	case <-c.exited:
+	default:
+		return nil
+	}
+	var exit *exec.ExitError
+	if !errors.As(c.err, &exit) {
+		return c.err
+	}
+	if msg := strings.TrimSpace(c.stderr.String()); msg != "" {
+		return fmt.Errorf("ssh %s: %s", c.jump, msg)
+	}
+	return fmt.Errorf("ssh %s: %w", c.jump, c.err)
+}
+
+func (c *sshConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+// Close ends ssh, which closes the forwarded connection.
+func (c *sshConn) Close() error {
+	c.close.Do(func() {
+		c.w.Close()
+		c.r.Close()
+		c.cmd.Process.Kill()
+	})
+	return nil
+}
+
+func (c *sshConn) LocalAddr() net.Addr  { return sshAddr(c.jump) }
+func (c *sshConn) RemoteAddr() net.Addr { return sshAddr(c.addr + " via " + c.jump) }
+
+func (c *sshConn) SetDeadline(t time.Time) error {
+	return errors.Join(c.r.SetReadDeadline(t), c.w.SetWriteDeadline(t))
+}
+
+func (c *sshConn) SetReadDeadline(t time.Time) error  { return c.r.SetReadDeadline(t) }
+func (c *sshConn) SetWriteDeadline(t time.Time) error { return c.w.SetWriteDeadline(t) }
+
+// sshAddr describes the ends of a connection forwarded by ssh.
+type sshAddr string
+
+func (a sshAddr) Network() string { return "ssh" }
+func (a sshAddr) String() string  { return string(a) }
@@ -0,0 +1,219 @@
+package teecp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FeatureAck is announced by the clients acknowledging what they received, with
+// ack frames holding the sequence number of the last message they are done with.
+// A server with Acked retains the messages until then, and sends them again to
+// the client connecting again under the same Hello.Name, so that none is lost.
+const FeatureAck Feature = "ack"
+
+// DefaultAckRetention is how many messages not yet acknowledged are kept in
+// memory for a client, the older ones going to a spool file.
+const DefaultAckRetention = 65536
+
+// frameAck is the kind of the frames clients of FeatureAck send, with the
+// sequence number of the header and no data.
+const frameAck = 4
+
+// AckedDelivery retains the messages for the clients of FeatureAck, by name,
+// until they acknowledge them: at-least-once delivery for the consumers that
+// must not lose a line, such as audit feeds. What is retained for a client that
+// never comes back is only forgotten once the server closes.
+type AckedDelivery struct {
+	// Retention is how many messages are kept in memory for a client, the older
+	// ones being spilled to a file of SpoolDir. Zero means DefaultAckRetention.
+	Retention int
+	// SpoolDir is where the spool files are, removed once acknowledged. Empty
+	// means os.TempDir().
+	SpoolDir string
+
+	mu   sync.Mutex
+	logs map[string]*ackLog
+}
+
+// ackLog holds what a client did not acknowledge yet: the older messages in the
+// spool file, the newer ones in memory.
+type ackLog struct {
+	mu        sync.Mutex
+	logger    *slog.Logger
+	retention int
+	spoolPath string
+	spool     *os.File
+	spoolEnc  *framedEncoder
+	// spooled is the last sequence number spooled, and acked the last one
+	// acknowledged.
+	spooled uint64
+	acked   uint64
+	mem     []Message
+}
+
+// log returns the log of the client name, and whether it is new, attaching it
+// to the server for it to retain the messages of topics from then on.
+func (a *AckedDelivery) log(s *Server, name string, topics []string) (*ackLog, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if l, ok := a.logs[name]; ok {
+		return l, false
+	}
+	dir := a.SpoolDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	l := &ackLog{
+		logger:    loggerOrDefault(s.Logger).With("name", name),
+		retention: a.Retention,
+		spoolPath: filepath.Join(dir, fmt.Sprintf("teecp-ack-%d-%s.spool", os.Getpid(), url.PathEscape(name))),
+	}
+	if l.retention == 0 {
+		l.retention = DefaultAckRetention
+	}
+	if a.logs == nil {
+		a.logs = make(map[string]*ackLog)
+	}
+	a.logs[name] = l
+	s.clients.AttachMessages(func(m Message) error {
+		if Subscribed(topics, m.Topic) {
+			l.retain(m)
+		}
+		return nil
+	}, Metadata{})
+	return l, true
+}
+
+// close removes the spool files.
+func (a *AckedDelivery) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, l := range a.logs {
+		l.mu.Lock()
+		l.removeSpool()
+		l.mu.Unlock()
+	}
+}
+
+func (l *ackLog) retain(m Message) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	m.Data = append([]byte(nil), m.Data...)
+	l.mem = append(l.mem, m)
+	if len(l.mem) <= l.retention {
+		return
+	}
+	// Spill the older half, for the spool not to be written on every message.
+	n := len(l.mem) / 2
+	if err := l.spill(l.mem[:n]); err != nil {
+		// Keeping them in memory is better than losing them.
+		l.logger.Warn("could not spool the messages not acknowledged", "err", err)
+		return
+	}
+	l.mem = append(l.mem[:0], l.mem[n:]...)
+}
+
+func (l *ackLog) spill(messages []Message) error {
+	if l.spool == nil {
+		f, err := os.OpenFile(l.spoolPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return err
+		}
+		l.spool, l.spoolEnc = f, &framedEncoder{w: f}
+	}
+	for _, m := range messages {
+		if err := l.spoolEnc.Encode(m); err != nil {
+			return err
+		}
+		l.spooled = m.Seq
+	}
+	return nil
+}
+
+// ack forgets the messages up to seq.
+func (l *ackLog) ack(seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if seq <= l.acked {
+		return
+	}
+	l.acked = seq
+	if l.spool != nil && seq >= l.spooled {
+		l.removeSpool()
+	}
+	i := 0
+	for i < len(l.mem) && l.mem[i].Seq <= seq {
+		i++
+	}
+	l.mem = append(l.mem[:0], l.mem[i:]...)
+}
+
+func (l *ackLog) removeSpool() {
+	if l.spool == nil {
+		return
+	}
+	l.spool.Close()
+	os.Remove(l.spoolPath)
+	l.spool, l.spoolEnc = nil, nil
+}
+
+// unacked returns what was not acknowledged, oldest first, those of the spool
+// included.
+func (l *ackLog) unacked() ([]Message, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var messages []Message
+	if l.spool != nil {
+		if _, err := l.spool.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		dec := &framedDecoder{r: bufio.NewReader(l.spool)}
+		for {
+			m, err := dec.Decode()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("reading the spool: %w", err)
+			}
+			if m.Seq > l.acked {
+				messages = append(messages, m)
+			}
+		}
+		if _, err := l.spool.Seek(0, io.SeekEnd); err != nil {
+			return nil, err
+		}
+	}
+	return append(messages, l.mem...), nil
+}
+
+// ackedReplay returns what is sent to a client of FeatureAck as it connects:
+// what it did not acknowledge and, the first time, the backlog before it.
+func (s *Server) ackedReplay(l *ackLog, first bool, keep func(topic string) bool) []Message {
+	unacked, err := l.unacked()
+	if err != nil {
+		l.logger.Error("could not replay the messages not acknowledged", "err", err)
+	}
+	if !first {
+		return unacked
+	}
+	var replay []Message
+	for _, m := range s.Replay(0, keep) {
+		if len(unacked) == 0 || m.Seq < unacked[0].Seq {
+			replay = append(replay, m)
+		}
+	}
+	return append(replay, unacked...)
+}
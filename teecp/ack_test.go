@@ -0,0 +1,48 @@
+package teecp
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestAckedClientGetsWhatItDidNotAcknowledge(t *testing.T) {
+	s := &Server{CoalesceDelay: -1, Acked: &AckedDelivery{SpoolDir: t.TempDir()}}
+	connected := connections(s)
+	disconnected := make(chan struct{}, 1)
+	s.OnClientDisconnect(func(*Handle, error) { disconnected <- struct{}{} })
+	ln := serve(t, s)
+
+	errCrash := errors.New("crash")
+	crashing := receive(t, ln, &Client{Features: []Feature{FeatureFramed}, Name: "audit", Ack: true}, func(m Message) error {
+		if m.Seq == 2 {
+			return errCrash
+		}
+		return nil
+	})
+	await(t, connected, 1)
+	for i := 1; i <= 3; i++ {
+		s.BroadcastString(fmt.Sprintf("line%d\n", i))
+	}
+	if m := crashing.next(t); m.Seq != 1 {
+		t.Fatalf("got message %d first, want 1", m.Seq)
+	}
+	if err := <-crashing.done; !errors.Is(err, errCrash) {
+		t.Fatalf("got %v, want the receive error", err)
+	}
+	<-disconnected
+
+	// What was not acknowledged comes again, at least once: message 1 too if its
+	// ack did not make it.
+	r := receive(t, ln, &Client{Features: []Feature{FeatureFramed}, Name: "audit", Ack: true}, nil)
+	await(t, connected, 1)
+	broadcastAll(t, s, "line4\n")
+	got := r.all(t)
+	if len(got) > 0 && got[0] == "line1\n" {
+		got = got[1:]
+	}
+	want := []string{"line2\n", "line3\n", "line4\n"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
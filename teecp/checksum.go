@@ -0,0 +1,101 @@
+package teecp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"sync"
+)
+
+// FeatureChecksum asks for the SHA-256 of the data of every message broadcast,
+// sent by the server once its input is over. Only FramedCodec carries it.
+const FeatureChecksum Feature = "checksum/sha256"
+
+// ErrChecksumMismatch is returned by a Client verifying a stream that differs from
+// the one broadcast.
+var ErrChecksumMismatch = errors.New("stream checksum mismatch")
+
+// streamDigest hashes the data of the messages of DefaultTopic broadcast by a
+// server announcing FeatureChecksum, from the first one.
+type streamDigest struct {
+	start sync.Once
+	mu    sync.Mutex
+	h     hash.Hash
+}
+
+// startDigest attaches the receiver hashing the stream, if the server announces
+// FeatureChecksum. It is called before the first broadcast.
+func (s *Server) startDigest() {
+	s.digest.start.Do(func() {
+		for _, f := range s.Features {
+			if f == FeatureChecksum {
+				s.digest.h = sha256.New()
+				s.clients.AttachMessages(func(m Message) error {
+					if m.Topic != DefaultTopic {
+						return nil
+					}
+					s.digest.mu.Lock()
+					defer s.digest.mu.Unlock()
+					s.digest.h.Write(m.Data)
+					return nil
+				}, Metadata{})
+				return
+			}
+		}
+	})
+}
+
+// sum returns the checksum of the stream, nil if the server does not announce
+// FeatureChecksum. It is called once the input is over.
+func (s *Server) sum() []byte {
+	s.startDigest()
+	if s.digest.h == nil {
+		return nil
+	}
+	s.digest.mu.Lock()
+	defer s.digest.mu.Unlock()
+	return s.digest.h.Sum(nil)
+}
+
+// receivedDigest checks what a Client received against the checksum of the
+// stream.
+type receivedDigest struct {
+	h       hash.Hash
+	next    uint64
+	missing bool
+	// gaps tells that missing sequence numbers are not missed messages, the
+	// checksum alone telling them.
+	gaps bool
+}
+
+func newReceivedDigest() *receivedDigest {
+	return &receivedDigest{h: sha256.New(), next: 1}
+}
+
+func (d *receivedDigest) add(m Message) {
+	if m.Seq != d.next && !d.gaps {
+		d.missing = true
+	}
+	d.next = m.Seq + 1
+	d.h.Write(m.Data)
+}
+
+// verify tells if the stream ended by err is the one broadcast.
+func (d *receivedDigest) verify(err error) error {
+	var end *StreamEnd
+	if errors.As(err, &end) && end.SHA256 == nil && end.Reason != "" {
+		return fmt.Errorf("%w: the stream ended early (%s)", ErrChecksumMismatch, end.Reason)
+	}
+	if end == nil || end.SHA256 == nil {
+		return fmt.Errorf("%w: the server sent no checksum", ErrChecksumMismatch)
+	}
+	if d.missing {
+		return fmt.Errorf("%w: messages were missed, e.g. before connecting", ErrChecksumMismatch)
+	}
+	if !bytes.Equal(d.h.Sum(nil), end.SHA256) {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
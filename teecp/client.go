@@ -0,0 +1,230 @@
+package teecp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// Client receives the stream of a teecp server.
+type Client struct {
+	// Features announced to the server during the handshake. Announcing codec
+	// features lets the server pick one of them as the wire format.
+	Features []Feature
+	// Logger receives what happens to the connection. Nil means slog.Default().
+	Logger *slog.Logger
+	// Metrics receives the measurements of the buffer pools. Nil means
+	// NopMetrics.
+	Metrics Metrics
+	// ReadBufferSize is how many bytes of the connection are read at once. Zero
+	// means the bufio default of 4KB.
+	ReadBufferSize int
+	// Verify asks the server for the checksum of the stream, with FeatureChecksum,
+	// and checks it against the messages received once the stream is over,
+	// returning ErrChecksumMismatch when they differ. The checksum covers
+	// DefaultTopic only, so Verify and Subscribe do not go together.
+	Verify bool
+	// Name and Labels describe the client to the server, which shows them in its
+	// logs and metrics. Label names must satisfy ValidLabelName.
+	Name   string
+	Labels map[string]string
+	// Subscribe are the topics received from a server announcing FeatureTopics,
+	// instead of DefaultTopic, or patterns of them such as build/*, see
+	// ValidTopicPattern.
+	Subscribe []string
+	// Group, if set, joins the consumer group of the name on a server announcing
+	// FeatureGroups: the clients of a group receive the messages in turn, each
+	// one a share of them, rather than all of them.
+	Group string
+	// Ack acknowledges the messages once receive took them, with FeatureAck, for
+	// a server with Acked to send them again, to the client of the same Name,
+	// when the connection is lost before.
+	Ack bool
+	// Window, if set, is how many messages the client takes at once from a
+	// server announcing FeatureWindow, granting it credit again as they are
+	// received, for the server to queue the rest rather than the TCP buffers.
+	Window int
+	// Since, if set, asks a server announcing FeatureSince for its backlog from
+	// that time on only, rather than all of it.
+	Since time.Time
+	// Resize, if set, sends the terminal sizes it gets to a server announcing
+	// FeatureResize, for the terminal its input runs in to take them when the
+	// client controls it, the first one as soon as it comes.
+	Resize <-chan TerminalSize
+	// OnStreamEnd, if set, is called with the reason the server gave for ending
+	// the stream, such as EndEOF, before Receive returns.
+	OnStreamEnd func(reason string)
+
+	readers     pool[*bufio.Reader]
+	instruments clientMetrics
+}
+
+// Receive copies the stream read from conn to w until the server closes it or
+// until ctx is done. The connection is closed when Receive returns.
+func (c *Client) Receive(ctx context.Context, conn net.Conn, w io.Writer) error {
+	return c.ReceiveMessages(ctx, conn, func(m Message) error {
+		_, err := w.Write(m.Data)
+		return err
+	})
+}
+
+// ReceiveMessages is like Receive, handing every message to receive instead. An
+// error from receive stops the reception and is returned.
+func (c *Client) ReceiveMessages(ctx context.Context, conn net.Conn, receive func(m Message) error) error {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	defer conn.Close()
+
+	reader := c.readers.get(&c.metrics().pool, newReader(c.ReadBufferSize))
+	reader.Reset(conn)
+	defer func() {
+		reader.Reset(nil)
+		c.readers.put(reader)
+	}()
+
+	features := append(c.Features[:len(c.Features):len(c.Features)], FeatureStreamEnd, FeatureTopics, FeatureGroups)
+	var digest *receivedDigest
+	if c.Verify && len(c.Subscribe) > 0 {
+		return errors.New("the checksum of the stream does not cover topics")
+	}
+	if c.Verify && c.Group != "" {
+		return errors.New("the checksum of the stream covers more than the share of a group")
+	}
+	if c.Verify && !c.Since.IsZero() {
+		return errors.New("the checksum of the stream covers more than what came since")
+	}
+	if !c.Since.IsZero() {
+		features = append(features, FeatureSince)
+	}
+	if c.Ack {
+		if c.Name == "" || c.Group != "" {
+			return errors.New("acknowledging clients are known by their name, and without group")
+		}
+		features = append(features, FeatureAck)
+	}
+	if c.Window > 0 {
+		features = append(features, FeatureWindow)
+	}
+	if c.Resize != nil {
+		features = append(features, FeatureResize)
+	}
+	if c.Verify {
+		features = append(features, FeatureChecksum)
+		digest = newReceivedDigest()
+	}
+	hello := LocalHello(features...)
+	hello.Name, hello.Labels, hello.Subscribe, hello.Group, hello.Since = c.Name, c.Labels, c.Subscribe, c.Group, c.Since
+	caps, err := ClientHandshake(conn, reader, hello)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("handshake with server failed: %w", err)
+	}
+	if len(c.Subscribe) > 0 && !caps.Has(FeatureTopics) {
+		return fmt.Errorf("%w %s", errRefused, FeatureTopics)
+	}
+	if c.Group != "" && !caps.Has(FeatureGroups) {
+		return fmt.Errorf("%w %s", errRefused, FeatureGroups)
+	}
+	if c.Ack && !caps.Has(FeatureAck) {
+		return fmt.Errorf("%w %s", errRefused, FeatureAck)
+	}
+	if !c.Since.IsZero() && !caps.Has(FeatureSince) {
+		return fmt.Errorf("%w %s", errRefused, FeatureSince)
+	}
+	if digest != nil && caps.Has(FeatureTopics) {
+		// The messages of the other topics leave gaps in the sequence numbers.
+		digest.gaps = true
+	}
+
+	// The credit of the messages received is granted again once half the window
+	// is used. A server that ended the stream does not read the frames anymore,
+	// while what it sent before is still to be received: the frames stop once
+	// one could not be written. The terminal sizes are told on the side.
+	var received int
+	var telling sync.Mutex
+	talking := true
+	tell := func(kind byte, n uint64) {
+		telling.Lock()
+		defer telling.Unlock()
+		if !talking {
+			return
+		}
+		if err := writeClientFrame(conn, kind, n); err != nil {
+			loggerOrDefault(c.Logger).Debug("server not listening anymore", "err", err)
+			talking = false
+		}
+	}
+	if caps.Has(FeatureWindow) {
+		tell(frameWindow, uint64(c.Window))
+	}
+	switch {
+	case c.Resize != nil && caps.Has(FeatureResize):
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			for {
+				select {
+				case size, ok := <-c.Resize:
+					if !ok {
+						return
+					}
+					tell(frameResize, size.frame())
+				case <-done:
+					return
+				}
+			}
+		}()
+	case c.Resize != nil:
+		loggerOrDefault(c.Logger).Warn("server runs no terminal to resize")
+	}
+
+	codec := CodecFor(caps)
+	loggerOrDefault(c.Logger).Debug("connected", "remote", conn.RemoteAddr(), "version", caps.Version, "codec", codec.Feature())
+
+	dec := codec.NewDecoder(reader)
+	for {
+		m, err := dec.Decode()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, io.EOF) {
+				var end *StreamEnd
+				if errors.As(err, &end) && end.Reason != "" {
+					loggerOrDefault(c.Logger).Debug("stream ended", "reason", end.Reason)
+					if c.OnStreamEnd != nil {
+						c.OnStreamEnd(end.Reason)
+					}
+				}
+				if digest != nil {
+					return digest.verify(err)
+				}
+				return nil
+			}
+			return fmt.Errorf("error reading stream: %w", err)
+		}
+
+		if digest != nil {
+			digest.add(m)
+		}
+		if err := receive(m); err != nil {
+			return err
+		}
+		// One ack covers the messages received at once.
+		if c.Ack && reader.Buffered() == 0 {
+			tell(frameAck, m.Seq)
+		}
+		if received++; caps.Has(FeatureWindow) && received >= max(c.Window/2, 1) {
+			tell(frameWindow, uint64(received))
+			received = 0
+		}
+	}
+}
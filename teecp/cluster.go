@@ -0,0 +1,144 @@
+package teecp
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// FeatureCluster is announced by a node of a cluster sharing its input with
+// another node, which broadcasts it along with its own. Servers announce it with
+// ClusterNode.
+const FeatureCluster Feature = "cluster"
+
+// clusterRunLabel is the label of the hello of a node telling its run apart from
+// the previous ones, whose sequence numbers started over.
+const clusterRunLabel = "run"
+
+// clusterState holds the nodes a server shares its input with, and what was
+// broadcast of the inputs of the others.
+type clusterState struct {
+	mu    sync.Mutex
+	peers []*mirror
+	// seq numbers the messages of the input shared with the peers.
+	seq uint64
+	// seen is the last sequence number broadcast from every node run, so that
+	// what a node sends again once reconnected, or sends through two
+	// connections, is broadcast once.
+	seen map[string]uint64
+
+	run     string
+	runOnce sync.Once
+}
+
+// JoinCluster shares the input of the server, what Broadcast gets, with the
+// node dial connects to, which broadcasts it to its clients along with its own
+// input. Nodes joining each other's cluster, with ClusterNode set, broadcast the
+// union of their inputs: clients get the same stream from any of them, but for
+// the order. The connection is opened again whenever it is lost, until ctx is
+// done. Once the input is over, the node gets what is still queued for it.
+func (s *Server) JoinCluster(ctx context.Context, dial func(ctx context.Context) (net.Conn, error)) {
+	hello := LocalHello(FeatureCluster, FeatureFramed, FeatureStreamEnd, FeatureTopics)
+	hello.Name = s.ClusterNode
+	hello.Labels = map[string]string{clusterRunLabel: s.clusterRun()}
+	m := s.newMirror(dial, FeatureCluster, hello, loggerOrDefault(s.Logger).With("cluster", s.ClusterNode))
+	m.detach = func() { s.leaveCluster(m) }
+
+	s.cluster.mu.Lock()
+	s.cluster.peers = append(s.cluster.peers, m)
+	s.cluster.mu.Unlock()
+
+	go m.run(ctx)
+}
+
+// clusterRun returns what tells this run of the server apart from the others.
+func (s *Server) clusterRun() string {
+	s.cluster.runOnce.Do(func() {
+		run := make([]byte, 8)
+		rand.Read(run)
+		s.cluster.run = hex.EncodeToString(run)
+	})
+	return s.cluster.run
+}
+
+// leaveCluster stops sharing the input with a node that refused it.
+func (s *Server) leaveCluster(m *mirror) {
+	s.cluster.mu.Lock()
+	defer s.cluster.mu.Unlock()
+
+	for i, peer := range s.cluster.peers {
+		if peer == m {
+			s.cluster.peers = append(s.cluster.peers[:i], s.cluster.peers[i+1:]...)
+			return
+		}
+	}
+}
+
+// share queues msg, a message of the input, for the nodes of the cluster.
+func (s *Server) share(msg []byte) {
+	s.cluster.mu.Lock()
+	defer s.cluster.mu.Unlock()
+
+	if len(s.cluster.peers) == 0 {
+		return
+	}
+	s.cluster.seq++
+	m := Message{Seq: s.cluster.seq, Time: time.Now(), Data: msg, Topic: s.Topic}
+	for _, peer := range s.cluster.peers {
+		peer.receive(m)
+	}
+}
+
+// firstSeen tells if the message seq of the node run is new, remembering it.
+func (s *Server) firstSeen(run string, seq uint64) bool {
+	s.cluster.mu.Lock()
+	defer s.cluster.mu.Unlock()
+
+	if seq <= s.cluster.seen[run] {
+		return false
+	}
+	if s.cluster.seen == nil {
+		s.cluster.seen = make(map[string]uint64)
+	}
+	s.cluster.seen[run] = seq
+	return true
+}
+
+// receiveCluster broadcasts the input another node shares, until it hangs up or
+// its input is over.
+func (s *Server) receiveCluster(conn net.Conn, r *bufio.Reader, caps Capabilities, remote Hello) {
+	logger := loggerOrDefault(s.Logger).With("node", remote.Name, "remote", conn.RemoteAddr())
+	run := remote.Labels[clusterRunLabel]
+	if remote.Name == s.ClusterNode && run == s.clusterRun() {
+		logger.Warn("cluster node joined itself")
+		s.drop(conn)
+		return
+	}
+	logger.Info("cluster node connected")
+	run = remote.Name + "/" + run
+
+	dec := CodecFor(caps).NewDecoder(r)
+	var err error
+	for {
+		var m Message
+		if m, err = dec.Decode(); err != nil {
+			break
+		}
+		if s.firstSeen(run, m.Seq) {
+			// The sequence numbers are those of this server.
+			s.publish(Message{Time: m.Time, Data: m.Data, Topic: m.Topic})
+		}
+	}
+
+	var end *StreamEnd
+	if errors.As(err, &end) {
+		err = errors.New("input over")
+	}
+	s.drop(conn)
+	logger.Info("cluster node disconnected", "err", err)
+}
@@ -0,0 +1,118 @@
+package teecp
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultCoalesceDelay is how long a message written to a client waits for the
+// following ones, so that they go out in a single write.
+const DefaultCoalesceDelay = 2 * time.Millisecond
+
+// coalesceSize is how many bytes are held before writing them without waiting any
+// longer.
+const coalesceSize = 64 << 10
+
+// closeFlushTimeout bounds the last write on Close, for clients that stopped
+// reading.
+const closeFlushTimeout = 100 * time.Millisecond
+
+// coalescedConn holds what is written to the connection for a short delay, cutting
+// the number of syscalls and TCP segments of streams of many short lines. A
+// failed write is reported by the next one.
+type coalescedConn struct {
+	net.Conn
+	delay   time.Duration
+	timer   *time.Timer
+	buffers *pool[*[]byte]
+	metrics *poolMetrics
+
+	mu sync.Mutex
+	// buf is taken from buffers when something is written and given back once
+	// flushed, so that idle clients do not hold any.
+	buf     *[]byte
+	pending bool
+	err     error
+	// held is how many bytes wait to be written, readable without c.mu which a
+	// stuck write holds.
+	held atomic.Int64
+}
+
+func newCoalescedConn(conn net.Conn, delay time.Duration, buffers *pool[*[]byte], metrics *poolMetrics) *coalescedConn {
+	c := &coalescedConn{Conn: conn, delay: delay, buffers: buffers, metrics: metrics}
+	c.timer = time.AfterFunc(delay, c.flush)
+	c.timer.Stop()
+	return c
+}
+
+func (c *coalescedConn) Write(p []byte) (int, error) {
+	if err := c.writeBuffers(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeBuffers appends the buffers to what is held, as a single write would.
+func (c *coalescedConn) writeBuffers(bufs ...[]byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return c.err
+	}
+	if c.buf == nil {
+		c.buf = c.buffers.get(c.metrics, newBuffer(coalesceSize))
+	}
+	for _, p := range bufs {
+		*c.buf = append(*c.buf, p...)
+	}
+	c.held.Store(int64(len(*c.buf)))
+	if len(*c.buf) >= coalesceSize {
+		return c.flushLocked()
+	}
+	if !c.pending {
+		c.pending = true
+		c.timer.Reset(c.delay)
+	}
+	return nil
+}
+
+func (c *coalescedConn) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.flushLocked()
+}
+
+// flushLocked writes what is held. Callers must hold c.mu.
+func (c *coalescedConn) flushLocked() error {
+	c.pending = false
+	if c.buf == nil {
+		return c.err
+	}
+	if c.err == nil {
+		_, c.err = c.Conn.Write(*c.buf)
+	}
+	// Buffers grown by huge messages are left to the garbage collector.
+	if cap(*c.buf) <= 2*coalesceSize {
+		*c.buf = (*c.buf)[:0]
+		c.buffers.put(c.buf)
+	}
+	c.buf = nil
+	c.held.Store(0)
+	return c.err
+}
+
+// Close writes what is held, unless a write is already stuck on a slow client,
+// and closes the connection.
+func (c *coalescedConn) Close() error {
+	if c.mu.TryLock() {
+		c.Conn.SetWriteDeadline(time.Now().Add(closeFlushTimeout))
+		c.flushLocked()
+		c.mu.Unlock()
+	}
+	c.timer.Stop()
+	return c.Conn.Close()
+}
@@ -0,0 +1,366 @@
+package teecp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Message is a unit of the stream: a line along with its sequence number and the
+// time it was broadcast.
+type Message struct {
+	Seq  uint64
+	Time time.Time
+	Data []byte
+	// Topic is the stream the message belongs to, DefaultTopic for most.
+	Topic string
+}
+
+// Encoder writes messages in a wire format.
+type Encoder interface {
+	Encode(m Message) error
+}
+
+// Decoder reads messages written by the matching Encoder. It returns io.EOF once
+// the stream is over.
+type Decoder interface {
+	Decode() (Message, error)
+}
+
+// Codec is a wire format. Codecs are negotiated during the handshake through their
+// feature, which must be in the "codec/" group.
+type Codec interface {
+	Feature() Feature
+	NewEncoder(w io.Writer) Encoder
+	NewDecoder(r *bufio.Reader) Decoder
+}
+
+// Codec features, in order of preference.
+const (
+	FeatureFramed Feature = "codec/framed"
+	FeatureJSON   Feature = "codec/json"
+)
+
+var (
+	codecsMu sync.Mutex
+	codecs   = []Codec{FramedCodec{}, JSONCodec{}}
+)
+
+// RegisterCodec adds a wire format, preferred over the ones already registered.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	if !strings.HasPrefix(string(c.Feature()), "codec/") {
+		panic(fmt.Sprintf("codec feature %q is not in the codec/ group", c.Feature()))
+	}
+	codecs = append([]Codec{c}, codecs...)
+}
+
+// CodecFeatures returns the features of every registered codec, in order of
+// preference.
+func CodecFeatures() []Feature {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	features := make([]Feature, len(codecs))
+	for i, c := range codecs {
+		features[i] = c.Feature()
+	}
+	return features
+}
+
+// CodecFor returns the codec agreed in the capabilities, PlainCodec if none.
+func CodecFor(caps Capabilities) Codec {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	for _, c := range codecs {
+		if caps.Has(c.Feature()) {
+			return c
+		}
+	}
+	return PlainCodec{}
+}
+
+// PlainCodec writes the bare lines, which is what clients unaware of teecp expect.
+// Sequence numbers and times are lost.
+type PlainCodec struct{}
+
+// Feature of the plain codec is empty: it is used when nothing was negotiated.
+func (PlainCodec) Feature() Feature { return "" }
+
+func (PlainCodec) NewEncoder(w io.Writer) Encoder { return plainEncoder{w} }
+
+func (PlainCodec) NewDecoder(r *bufio.Reader) Decoder { return plainDecoder{r} }
+
+type plainEncoder struct{ w io.Writer }
+
+func (e plainEncoder) Encode(m Message) error {
+	_, err := e.w.Write(m.Data)
+	return err
+}
+
+type plainDecoder struct{ r *bufio.Reader }
+
+func (d plainDecoder) Decode() (Message, error) {
+	line, err := d.r.ReadBytes('\n')
+	// At EOF the last line may come without its newline, still deliver it.
+	if len(line) > 0 && errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return Message{Data: line}, err
+}
+
+// FramedCodec writes length-prefixed binary frames, so the data may be anything.
+// A frame is a kind byte, the sequence number, the time in nanoseconds since the
+// Unix epoch, the length of the data and the data itself. Numbers are big endian,
+// 8 bytes wide but for the length, 4 bytes wide.
+type FramedCodec struct{}
+
+func (FramedCodec) Feature() Feature { return FeatureFramed }
+
+func (FramedCodec) NewEncoder(w io.Writer) Encoder { return &framedEncoder{w: w} }
+
+func (FramedCodec) NewDecoder(r *bufio.Reader) Decoder { return &framedDecoder{r: r} }
+
+const framedHeaderSize = 1 + 8 + 8 + 4
+
+// MaxFrameSize is the most data a frame carries. Larger frames are refused by
+// the decoder rather than allocated, a bogus length asking for up to 4GiB, and
+// so are larger messages by the encoder.
+const MaxFrameSize = 64 << 20
+
+// Kinds of frames: frameData carries a message; frameEnd, sent once the input
+// is over to the clients of FeatureChecksum, the SHA-256 of the data of every
+// message; frameControl a notice of the server, such as the end of the stream to
+// the clients of FeatureStreamEnd; and frameTopic the topic of the following
+// data frames, when it is not the one of the previous ones. Only data frames
+// have a sequence number and a time.
+const (
+	frameData    = 0
+	frameEnd     = 1
+	frameControl = 2
+	frameTopic   = 3
+)
+
+// framedEncoder reuses its buffers from one frame to the next: it is used by a
+// single goroutine at a time.
+type framedEncoder struct {
+	w      io.Writer
+	header [framedHeaderSize]byte
+	buf    []byte
+	// topic is the topic of the last data frame, and topicFrame the frame changing it.
+	topic      string
+	topicFrame []byte
+}
+
+func (e *framedEncoder) Encode(m Message) error {
+	if len(m.Data) > MaxFrameSize {
+		return fmt.Errorf("message of %d bytes, more than the %d of a frame", len(m.Data), MaxFrameSize)
+	}
+	e.topicFrame = e.topicFrame[:0]
+	if m.Topic != e.topic {
+		e.topicFrame = appendFrame(e.topicFrame, frameTopic, []byte(m.Topic))
+		e.topic = m.Topic
+	}
+
+	e.header[0] = frameData
+	binary.BigEndian.PutUint64(e.header[1:], m.Seq)
+	binary.BigEndian.PutUint64(e.header[9:], uint64(m.Time.UnixNano()))
+	binary.BigEndian.PutUint32(e.header[17:], uint32(len(m.Data)))
+
+	// Sockets take the header and the data at once with writev, sparing the copy,
+	// and so do coalesced connections, copying them once into what they hold.
+	// Other writers, such as TLS connections, get a single write so that a frame
+	// is not split.
+	switch w := e.w.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		bufs := net.Buffers{e.topicFrame, e.header[:], m.Data}
+		_, err := bufs.WriteTo(w)
+		return err
+	case *coalescedConn:
+		return w.writeBuffers(e.topicFrame, e.header[:], m.Data)
+	}
+	e.buf = append(append(append(e.buf[:0], e.topicFrame...), e.header[:]...), m.Data...)
+	_, err := e.w.Write(e.buf)
+	return err
+}
+
+// encodeEnd writes the checksum and the notice at once, the latter being the last
+// frame of the stream.
+func (e *framedEncoder) encodeEnd(sum []byte, reason string) error {
+	var b []byte
+	if sum != nil {
+		b = appendFrame(b, frameEnd, sum)
+	}
+	if reason != "" {
+		b = appendFrame(b, frameControl, formatEndNotice(reason))
+	}
+	_, err := e.w.Write(b)
+	return err
+}
+
+// appendFrame appends a frame without sequence number nor time.
+func appendFrame(b []byte, kind byte, data []byte) []byte {
+	var header [framedHeaderSize]byte
+	header[0] = kind
+	binary.BigEndian.PutUint32(header[17:], uint32(len(data)))
+	return append(append(b, header[:]...), data...)
+}
+
+// framedDecoder keeps the checksum of the stream until its end: servers send the
+// notice of FeatureStreamEnd after it. It also keeps the topic of the data frames.
+type framedDecoder struct {
+	r     *bufio.Reader
+	sum   []byte
+	topic string
+}
+
+func (d *framedDecoder) Decode() (Message, error) {
+	for {
+		var header [framedHeaderSize]byte
+		if _, err := io.ReadFull(d.r, header[:]); err != nil {
+			if d.sum != nil && err == io.EOF {
+				return Message{}, &StreamEnd{SHA256: d.sum}
+			}
+			return Message{}, err
+		}
+		size := binary.BigEndian.Uint32(header[17:])
+		if size > MaxFrameSize {
+			return Message{}, fmt.Errorf("frame of %d bytes, more than the %d allowed", size, MaxFrameSize)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(d.r, data); err != nil {
+			return Message{}, noEOF(err)
+		}
+
+		switch header[0] {
+		case frameData:
+			return Message{
+				Seq:   binary.BigEndian.Uint64(header[1:]),
+				Time:  time.Unix(0, int64(binary.BigEndian.Uint64(header[9:]))),
+				Data:  data,
+				Topic: d.topic,
+			}, nil
+		case frameEnd:
+			d.sum = data
+		case frameTopic:
+			d.topic = string(data)
+		case frameControl:
+			if reason, ok := parseEndNotice(data); ok {
+				return Message{}, &StreamEnd{SHA256: d.sum, Reason: reason}
+			}
+			// Other notices are for later versions.
+		default:
+			return Message{}, fmt.Errorf("unknown frame kind %d", header[0])
+		}
+	}
+}
+
+// JSONCodec writes one JSON envelope per line: {"seq":1,"time":"...","line":"..."}.
+// The trailing newline of the data is not part of "line". Messages of another
+// topic than DefaultTopic also have a "topic".
+type JSONCodec struct{}
+
+func (JSONCodec) Feature() Feature { return FeatureJSON }
+
+func (JSONCodec) NewEncoder(w io.Writer) Encoder { return &jsonEncoder{w: w} }
+
+func (JSONCodec) NewDecoder(r *bufio.Reader) Decoder { return jsonDecoder{json.NewDecoder(r)} }
+
+// Envelope is the JSON representation of a message.
+type Envelope struct {
+	Seq   uint64    `json:"seq"`
+	Time  time.Time `json:"time"`
+	Topic string    `json:"topic,omitempty"`
+	Line  string    `json:"line"`
+}
+
+// jsonEncoder writes the envelopes by hand into a buffer reused from one message
+// to the next: it is used by a single goroutine at a time.
+type jsonEncoder struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (e *jsonEncoder) Encode(m Message) error {
+	line, _ := bytes.CutSuffix(m.Data, []byte("\n"))
+	b := append(e.buf[:0], `{"seq":`...)
+	b = strconv.AppendUint(b, m.Seq, 10)
+	b = append(b, `,"time":"`...)
+	b = m.Time.AppendFormat(b, time.RFC3339Nano)
+	b = append(b, '"')
+	if m.Topic != "" {
+		b = append(b, `,"topic":`...)
+		b = appendJSONString(b, []byte(m.Topic))
+	}
+	b = append(b, `,"line":`...)
+	b = appendJSONString(b, line)
+	b = append(b, "}\n"...)
+	e.buf = b
+
+	_, err := e.w.Write(b)
+	return err
+}
+
+// appendJSONString appends s as a JSON string, replacing invalid UTF-8 with
+// U+FFFD like encoding/json.
+func appendJSONString(b, s []byte) []byte {
+	const hex = "0123456789abcdef"
+
+	b = append(b, '"')
+	for len(s) > 0 {
+		r, size := utf8.DecodeRune(s)
+		switch {
+		case r == '"' || r == '\\':
+			b = append(b, '\\', byte(r))
+		case r == '\n':
+			b = append(b, '\\', 'n')
+		case r == '\r':
+			b = append(b, '\\', 'r')
+		case r == '\t':
+			b = append(b, '\\', 't')
+		case r < 0x20:
+			b = append(b, '\\', 'u', '0', '0', hex[r>>4], hex[r&0xf])
+		case r == utf8.RuneError && size == 1:
+			b = append(b, `\ufffd`...)
+		case r == '\u2028' || r == '\u2029':
+			// Valid JSON, but not valid JavaScript.
+			b = append(b, `\u202`...)
+			b = append(b, hex[r&0xf])
+		default:
+			b = append(b, s[:size]...)
+		}
+		s = s[size:]
+	}
+	return append(b, '"')
+}
+
+type jsonDecoder struct{ dec *json.Decoder }
+
+func (d jsonDecoder) Decode() (Message, error) {
+	var env Envelope
+	if err := d.dec.Decode(&env); err != nil {
+		return Message{}, err
+	}
+	return Message{Seq: env.Seq, Time: env.Time, Data: []byte(env.Line + "\n"), Topic: env.Topic}, nil
+}
+
+// noEOF turns an EOF in the middle of a frame into an unexpected one.
+func noEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,26 @@
+package teecp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestFramedRefusesOversizedFrames(t *testing.T) {
+	var header [framedHeaderSize]byte
+	binary.BigEndian.PutUint32(header[17:], MaxFrameSize+1)
+	dec := FramedCodec{}.NewDecoder(bufio.NewReader(bytes.NewReader(header[:])))
+	if _, err := dec.Decode(); err == nil || err == io.ErrUnexpectedEOF {
+		t.Errorf("got %v, want the frame refused", err)
+	}
+
+	enc := FramedCodec{}.NewEncoder(io.Discard)
+	if err := enc.Encode(Message{Data: make([]byte, MaxFrameSize+1)}); err == nil {
+		t.Error("oversized message encoded")
+	}
+	if err := enc.Encode(Message{Data: make([]byte, MaxFrameSize)}); err != nil {
+		t.Errorf("got %v, want the largest frame encoded", err)
+	}
+}
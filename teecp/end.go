@@ -0,0 +1,112 @@
+package teecp
+
+import (
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FeatureStreamEnd asks for a notice when the server ends the stream, telling
+// why, so that a client knows it was not merely cut. Servers and clients always
+// announce it. Only FramedCodec carries it.
+const FeatureStreamEnd Feature = "stream-end"
+
+// Reasons given by a server ending the stream.
+const (
+	// EndEOF is given once the input of the server is over.
+	EndEOF = "eof"
+	// EndShutdown is given when the server closes before its input is over.
+	EndShutdown = "shutdown"
+)
+
+// StreamEnd is returned by decoders at the end of a stream that carries the
+// checksum of FeatureChecksum or the notice of FeatureStreamEnd. It is an io.EOF
+// for those not interested in it.
+type StreamEnd struct {
+	SHA256 []byte
+	// Reason is why the server ended the stream, such as EndEOF, empty if it sent
+	// no notice.
+	Reason string
+}
+
+func (e *StreamEnd) Error() string { return "end of stream" }
+
+func (e *StreamEnd) Unwrap() error { return io.EOF }
+
+// endNotice is the control message ending a stream, followed by its reason.
+const endNotice = "stream-end"
+
+func formatEndNotice(reason string) []byte {
+	return []byte(endNotice + " reason=" + reason)
+}
+
+// parseEndNotice returns the reason of the notice, if it is one.
+func parseEndNotice(notice []byte) (reason string, ok bool) {
+	fields := strings.Fields(string(notice))
+	if len(fields) == 0 || fields[0] != endNotice {
+		return "", false
+	}
+	for _, field := range fields[1:] {
+		if v, ok := strings.CutPrefix(field, "reason="); ok {
+			reason = v
+		}
+	}
+	return reason, true
+}
+
+// endEncoder is an Encoder able to end a stream.
+type endEncoder interface {
+	// encodeEnd writes the checksum of the stream, unless sum is nil, and the
+	// notice of its end, unless reason is empty.
+	encodeEnd(sum []byte, reason string) error
+}
+
+// streamEnds tell the connections that asked for it that the stream is over,
+// once.
+type streamEnds struct {
+	mu   sync.Mutex
+	ends map[net.Conn]func(sum []byte, reason string) error
+}
+
+// endStream ends the stream of the connections that asked for it, with the
+// checksum of the stream when its input is over, and that of the mirrors.
+func (s *Server) endStream(reason string) {
+	var sum []byte
+	if reason == EndEOF {
+		sum = s.sum()
+		s.endMirrors()
+	}
+
+	s.ends.mu.Lock()
+	ends := s.ends.ends
+	s.ends.ends = nil
+	s.ends.mu.Unlock()
+
+	if reason == EndShutdown {
+		// Clients that stopped reading are not waited for, all at once.
+		for conn := range ends {
+			conn.SetWriteDeadline(time.Now().Add(closeFlushTimeout))
+		}
+	}
+	for _, end := range ends {
+		end(sum, reason)
+	}
+}
+
+// onEnd registers how to end the stream of the connection, until it is
+// forgotten with onEnd(conn, nil).
+func (s *Server) onEnd(conn net.Conn, end func(sum []byte, reason string) error) {
+	s.ends.mu.Lock()
+	defer s.ends.mu.Unlock()
+
+	if end == nil {
+		delete(s.ends.ends, conn)
+		return
+	}
+	if s.ends.ends == nil {
+		s.ends.ends = make(map[net.Conn]func(sum []byte, reason string) error)
+	}
+	s.ends.ends[conn] = end
+}
@@ -0,0 +1,75 @@
+package teecp
+
+import "sync"
+
+// events holds the lifecycle callbacks registered on a server.
+type events struct {
+	mu             sync.Mutex
+	connect        []func(h *Handle)
+	disconnect     []func(h *Handle, err error)
+	broadcastError []func(h *Handle, err error)
+}
+
+// OnClientConnect registers f to be called once a client completed its handshake and
+// starts receiving the broadcast.
+//
+// Callbacks run synchronously, some of them while a broadcast is in progress: they
+// must be quick and must not broadcast themselves.
+func (s *Server) OnClientConnect(f func(h *Handle)) {
+	s.events.mu.Lock()
+	defer s.events.mu.Unlock()
+
+	s.events.connect = append(s.events.connect, f)
+}
+
+// OnClientDisconnect registers f to be called once a connected client is gone. err
+// is nil when the client hung up by itself and ErrServerClosed when the server
+// is shutting down.
+func (s *Server) OnClientDisconnect(f func(h *Handle, err error)) {
+	s.events.mu.Lock()
+	defer s.events.mu.Unlock()
+
+	s.events.disconnect = append(s.events.disconnect, f)
+}
+
+// OnBroadcastError registers f to be called when sending a message to a client
+// fails. The client is disconnected right after.
+//
+// With many clients, messages are sent to them in parallel, so f may be called
+// concurrently.
+func (s *Server) OnBroadcastError(f func(h *Handle, err error)) {
+	s.events.mu.Lock()
+	defer s.events.mu.Unlock()
+
+	s.events.broadcastError = append(s.events.broadcastError, f)
+}
+
+func (e *events) clientConnect(h *Handle) {
+	e.mu.Lock()
+	callbacks := e.connect
+	e.mu.Unlock()
+
+	for _, f := range callbacks {
+		f(h)
+	}
+}
+
+func (e *events) clientDisconnect(h *Handle, err error) {
+	e.mu.Lock()
+	callbacks := e.disconnect
+	e.mu.Unlock()
+
+	for _, f := range callbacks {
+		f(h, err)
+	}
+}
+
+func (e *events) broadcastFailed(h *Handle, err error) {
+	e.mu.Lock()
+	callbacks := e.broadcastError
+	e.mu.Unlock()
+
+	for _, f := range callbacks {
+		f(h, err)
+	}
+}
@@ -0,0 +1,40 @@
+package teecp
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/expr-lang/expr"
+)
+
+// exprEnv is what filter expressions see of a line.
+type exprEnv struct {
+	// Line is the line without its newline.
+	Line string `expr:"line"`
+	// JSON is the line parsed as a JSON object, nil if it is not one.
+	JSON map[string]any `expr:"json"`
+}
+
+// FilterExpr keeps only the lines for which the expression, in the language of
+// github.com/expr-lang/expr, is true, e.g.
+//
+//	line contains "ERROR" && !(line matches "retryable")
+//	json.level == "error" && json.http.status >= 500
+//
+// A line the expression fails on, such as comparing a missing field to a number,
+// is dropped.
+func FilterExpr(source string) (Middleware, error) {
+	program, err := expr.Compile(source, expr.Env(exprEnv{}), expr.AsBool())
+	if err != nil {
+		return nil, err
+	}
+
+	return func(line []byte) ([]byte, bool) {
+		env := exprEnv{Line: string(line)}
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 && trimmed[0] == '{' {
+			json.Unmarshal(trimmed, &env.JSON)
+		}
+		matched, err := expr.Run(program, env)
+		return line, err == nil && matched.(bool)
+	}, nil
+}
@@ -0,0 +1,112 @@
+package teecp
+
+import (
+	"slices"
+	"strings"
+	"sync"
+)
+
+// FeatureGroups is announced by the servers sharing the messages among the
+// clients of a consumer group, named by Hello.Group: each message goes to one of
+// them in turn rather than to all of them.
+const FeatureGroups Feature = "groups"
+
+// consumerGroups holds the members of the consumer groups of a server.
+type consumerGroups struct {
+	mu     sync.Mutex
+	groups map[string]*consumerGroup
+}
+
+// consumerGroup takes turns among its members, one message each.
+type consumerGroup struct {
+	mu      sync.Mutex
+	members []*Handle
+	// seq is the last message given a turn, and turn the member it went to.
+	seq  uint64
+	turn int
+}
+
+// groupKey tells the groups apart: the clients of a group subscribing to other
+// topics are a group of their own, for no message to go to a member not
+// subscribed to it.
+func groupKey(meta Metadata) string {
+	return meta.Group + "\x00" + strings.Join(meta.Topics, ",")
+}
+
+// joinGroup makes the client of h take turns with the other members of its
+// group, if it has one.
+func (s *Server) joinGroup(h *Handle) {
+	meta := h.Metadata()
+	if meta.Group == "" {
+		return
+	}
+	s.groups.mu.Lock()
+	defer s.groups.mu.Unlock()
+
+	key := groupKey(meta)
+	g := s.groups.groups[key]
+	if g == nil {
+		if s.groups.groups == nil {
+			s.groups.groups = make(map[string]*consumerGroup)
+		}
+		g = &consumerGroup{}
+		s.groups.groups[key] = g
+	}
+	g.mu.Lock()
+	g.members = append(g.members, h)
+	g.mu.Unlock()
+}
+
+// leaveGroup gives the turns of the client of h to the other members of its
+// group, forgetting the group once empty.
+func (s *Server) leaveGroup(h *Handle) {
+	meta := h.Metadata()
+	if meta.Group == "" {
+		return
+	}
+	s.groups.mu.Lock()
+	defer s.groups.mu.Unlock()
+
+	key := groupKey(meta)
+	g := s.groups.groups[key]
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.members = slices.DeleteFunc(g.members, func(member *Handle) bool { return member == h })
+	if g.turn >= len(g.members) {
+		g.turn = 0
+	}
+	if len(g.members) == 0 {
+		delete(s.groups.groups, key)
+	}
+}
+
+// hasTurn tells if the message seq goes to the client of h: always without
+// group, when it is its turn otherwise. Every member is asked about every
+// message, in any order, the first asking giving the turn to the next member.
+func (s *Server) hasTurn(h *Handle, seq uint64) bool {
+	meta := h.Metadata()
+	if meta.Group == "" {
+		return true
+	}
+	s.groups.mu.Lock()
+	g := s.groups.groups[groupKey(meta)]
+	s.groups.mu.Unlock()
+	if g == nil {
+		// Not a member yet, or anymore.
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.members) == 0 {
+		return false
+	}
+	if seq != g.seq {
+		g.seq = seq
+		g.turn = (g.turn + 1) % len(g.members)
+	}
+	return g.members[g.turn] == h
+}
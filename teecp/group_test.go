@@ -0,0 +1,32 @@
+package teecp
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestGroupMembersTakeTurns(t *testing.T) {
+	s := &Server{CoalesceDelay: -1}
+	connected := connections(s)
+	ln := serve(t, s)
+	first := receive(t, ln, &Client{Features: []Feature{FeatureFramed}, Group: "w"}, nil)
+	second := receive(t, ln, &Client{Features: []Feature{FeatureFramed}, Group: "w"}, nil)
+	await(t, connected, 2)
+
+	var lines []string
+	for i := range 10 {
+		lines = append(lines, fmt.Sprintf("line%d\n", i))
+	}
+	broadcastAll(t, s, lines...)
+
+	a, b := first.all(t), second.all(t)
+	if len(a) != len(lines)/2 || len(b) != len(lines)/2 {
+		t.Errorf("got %d and %d messages, want %d each", len(a), len(b), len(lines)/2)
+	}
+	got := append(a, b...)
+	slices.SortFunc(got, func(x, y string) int { return slices.Index(lines, x) - slices.Index(lines, y) })
+	if !slices.Equal(got, lines) {
+		t.Errorf("got %q, want every line once", got)
+	}
+}
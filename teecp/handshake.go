@@ -0,0 +1,304 @@
+package teecp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProtocolVersion is the highest teecp protocol version spoken by this package.
+const ProtocolVersion = 1
+
+// DefaultHandshakeTimeout is how long a server waits for a client hello before
+// treating the connection as a plain line stream.
+const DefaultHandshakeTimeout = 200 * time.Millisecond
+
+// helloPrefix starts every hello line, e.g. "TEECP/1 feature-a,feature-b\n".
+const helloPrefix = "TEECP/"
+
+// ErrIncompatible is returned when two peers share no protocol version.
+var ErrIncompatible = errors.New("incompatible teecp protocol version")
+
+// RefusedError is returned by ClientHandshake when the server refused the
+// connection, such as when it has MaxClients already.
+type RefusedError struct {
+	Reason string
+}
+
+func (e *RefusedError) Error() string {
+	return "refused by server: " + e.Reason
+}
+
+// Feature names an optional protocol capability that peers may agree to use.
+type Feature string
+
+// Hello is what a peer announces about itself during the handshake.
+type Hello struct {
+	Version  int
+	Features []Feature
+	// Name and Labels describe a client to the server, for its logs and metrics.
+	// They travel among the features as name=value and label.key=value, which
+	// servers unaware of them ignore as features they do not know.
+	Name   string
+	Labels map[string]string
+	// Subscribe are the topics a client receives, as subscribe=a,b; clients
+	// subscribing none receive DefaultTopic.
+	Subscribe []string
+	// Group is the consumer group of a client, as group=name, whose members
+	// take turns receiving the messages.
+	Group string
+	// Since, as since=time in RFC 3339, asks a server announcing FeatureSince
+	// to replay its backlog from that time on only.
+	Since time.Time
+	// Error, as error=reason, is why a server refuses the client, answering its
+	// hello without negotiating anything.
+	Error string
+}
+
+// labelName is what label names may be, the same as in Prometheus.
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// ValidLabelName tells if name may be the name of a label of a Hello.
+func ValidLabelName(name string) bool {
+	return labelName.MatchString(name)
+}
+
+// LocalHello returns the hello for this package: the current protocol version and
+// the given features.
+func LocalHello(features ...Feature) Hello {
+	return Hello{Version: ProtocolVersion, Features: features}
+}
+
+// Capabilities is the result of a negotiation: what both peers agreed to use on a
+// connection. The zero value describes a plain line stream without handshake.
+type Capabilities struct {
+	Version  int
+	Features []Feature
+}
+
+// Plain tells if the connection did not negotiate anything.
+func (c Capabilities) Plain() bool {
+	return c.Version == 0
+}
+
+// Has tells if the feature was agreed by both peers.
+func (c Capabilities) Has(f Feature) bool {
+	for _, feature := range c.Features {
+		if feature == f {
+			return true
+		}
+	}
+	return false
+}
+
+// Negotiate computes the capabilities shared by two hellos: the lowest of both
+// versions and the features announced by both, in the order of local.
+//
+// Features named "group/name" are alternatives to each other: only the first one
+// of a group shared by both peers is kept.
+func Negotiate(local, remote Hello) (Capabilities, error) {
+	version := min(local.Version, remote.Version)
+	if version < 1 {
+		return Capabilities{}, fmt.Errorf("%w: local %d, remote %d", ErrIncompatible, local.Version, remote.Version)
+	}
+
+	c := Capabilities{Version: version}
+	groups := map[string]bool{}
+	for _, f := range local.Features {
+		for _, r := range remote.Features {
+			if f != r {
+				continue
+			}
+			if group, _, alternative := strings.Cut(string(f), "/"); alternative {
+				if groups[group] {
+					break
+				}
+				groups[group] = true
+			}
+			c.Features = append(c.Features, f)
+			break
+		}
+	}
+	return c, nil
+}
+
+// String encodes the hello as a single line, without the trailing newline.
+func (h Hello) String() string {
+	features := make([]string, len(h.Features))
+	for i, f := range h.Features {
+		features[i] = string(f)
+	}
+	if h.Name != "" {
+		features = append(features, "name="+url.QueryEscape(h.Name))
+	}
+	if h.Group != "" {
+		features = append(features, "group="+url.QueryEscape(h.Group))
+	}
+	if len(h.Subscribe) > 0 {
+		features = append(features, "subscribe="+url.QueryEscape(strings.Join(h.Subscribe, ",")))
+	}
+	if !h.Since.IsZero() {
+		features = append(features, "since="+url.QueryEscape(h.Since.Format(time.RFC3339Nano)))
+	}
+	if h.Error != "" {
+		features = append(features, "error="+url.QueryEscape(h.Error))
+	}
+	labels := make([]string, 0, len(h.Labels))
+	for k, v := range h.Labels {
+		labels = append(labels, "label."+k+"="+url.QueryEscape(v))
+	}
+	slices.Sort(labels)
+	features = append(features, labels...)
+	return fmt.Sprintf("%s%d %s", helloPrefix, h.Version, strings.Join(features, ","))
+}
+
+// ParseHello decodes a hello line, as written by Hello.String.
+func ParseHello(line string) (Hello, error) {
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, helloPrefix) {
+		return Hello{}, fmt.Errorf("not a teecp hello: %q", line)
+	}
+
+	versionStr, featuresStr, _ := strings.Cut(line[len(helloPrefix):], " ")
+	version, err := strconv.Atoi(versionStr)
+	if err != nil {
+		return Hello{}, fmt.Errorf("invalid hello version %q", versionStr)
+	}
+
+	h := Hello{Version: version}
+	for _, f := range strings.Split(featuresStr, ",") {
+		f = strings.TrimSpace(f)
+		key, escaped, attribute := strings.Cut(f, "=")
+		switch {
+		case f == "":
+		case !attribute:
+			h.Features = append(h.Features, Feature(f))
+		default:
+			value, err := url.QueryUnescape(escaped)
+			if err != nil {
+				return Hello{}, fmt.Errorf("invalid hello attribute %q", f)
+			}
+			if key == "name" {
+				h.Name = value
+			} else if key == "subscribe" {
+				h.Subscribe = strings.Split(value, ",")
+			} else if key == "group" {
+				h.Group = value
+			} else if key == "error" {
+				h.Error = value
+			} else if key == "since" {
+				if h.Since, err = time.Parse(time.RFC3339Nano, value); err != nil {
+					return Hello{}, fmt.Errorf("invalid hello attribute %q", f)
+				}
+			} else if label, ok := strings.CutPrefix(key, "label."); ok && ValidLabelName(label) {
+				if h.Labels == nil {
+					h.Labels = make(map[string]string)
+				}
+				h.Labels[label] = value
+			}
+			// Other attributes are for later versions.
+		}
+	}
+	return h, nil
+}
+
+// WriteHello sends the hello line to w.
+func WriteHello(w io.Writer, h Hello) error {
+	_, err := io.WriteString(w, h.String()+"\n")
+	return err
+}
+
+// ClientHandshake announces local to the server and reads its answer from r. A
+// server that does not answer with a hello is a plain server: the zero
+// Capabilities are returned and nothing is consumed from r.
+func ClientHandshake(w io.Writer, r *bufio.Reader, local Hello) (Capabilities, error) {
+	if err := WriteHello(w, local); err != nil {
+		return Capabilities{}, err
+	}
+
+	if !peekHello(r) {
+		return Capabilities{}, nil
+	}
+
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return Capabilities{}, err
+	}
+	remote, err := ParseHello(line)
+	if err != nil {
+		return Capabilities{}, err
+	}
+	if remote.Error != "" {
+		return Capabilities{}, &RefusedError{Reason: remote.Error}
+	}
+	return Negotiate(local, remote)
+}
+
+// ServerHandshake waits up to timeout for the client hello. Clients that stay
+// silent are plain clients and get the zero Capabilities. Otherwise the agreed
+// capabilities are sent back to the client as a hello.
+func ServerHandshake(conn net.Conn, r *bufio.Reader, local Hello, timeout time.Duration) (Capabilities, error) {
+	c, _, err := serverHandshake(conn, r, local, timeout)
+	return c, err
+}
+
+// serverHandshake is ServerHandshake, also returning the hello of the client.
+func serverHandshake(conn net.Conn, r *bufio.Reader, local Hello, timeout time.Duration) (Capabilities, Hello, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return Capabilities{}, Hello{}, err
+	}
+	if !peekHello(r) {
+		return Capabilities{}, Hello{}, conn.SetReadDeadline(time.Time{})
+	}
+	// The deadline holds until the hello is read whole, for a client sending the
+	// start of one and nothing more not to be waited for forever.
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return Capabilities{}, Hello{}, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return Capabilities{}, Hello{}, err
+	}
+	remote, err := ParseHello(line)
+	if err != nil {
+		return Capabilities{}, Hello{}, err
+	}
+
+	c, err := Negotiate(local, remote)
+	if err != nil {
+		return Capabilities{}, Hello{}, err
+	}
+	return c, remote, WriteHello(conn, Hello{Version: c.Version, Features: c.Features})
+}
+
+// refuseHandshake waits up to timeout for the client hello, as serverHandshake
+// does, and answers it with the reason the client is refused. Plain clients are
+// told nothing.
+func refuseHandshake(conn net.Conn, r *bufio.Reader, reason string, timeout time.Duration) error {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if !peekHello(r) {
+		return nil
+	}
+	// The hello is read whole: closing the connection with some of it unread
+	// would reset it, losing the answer.
+	if _, err := r.ReadString('\n'); err != nil {
+		return err
+	}
+	return WriteHello(conn, Hello{Version: ProtocolVersion, Error: reason})
+}
+
+// peekHello tells if the next bytes of r are a hello, without consuming them.
+func peekHello(r *bufio.Reader) bool {
+	prefix, err := r.Peek(len(helloPrefix))
+	return err == nil && string(prefix) == helloPrefix
+}
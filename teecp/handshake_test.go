@@ -0,0 +1,121 @@
+package teecp
+
+import (
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name          string
+		local, remote Hello
+		version       int
+		features      []Feature
+		incompatible  bool
+	}{
+		{
+			name:     "common features in local order",
+			local:    Hello{Version: 2, Features: []Feature{FeatureStreamEnd, FeatureTopics, FeatureAck}},
+			remote:   Hello{Version: 1, Features: []Feature{FeatureAck, FeatureStreamEnd, "unknown"}},
+			version:  1,
+			features: []Feature{FeatureStreamEnd, FeatureAck},
+		},
+		{
+			name:     "first alternative of a group",
+			local:    Hello{Version: 1, Features: []Feature{FeatureFramed, FeatureJSON}},
+			remote:   Hello{Version: 1, Features: []Feature{FeatureJSON, FeatureFramed}},
+			version:  1,
+			features: []Feature{FeatureFramed},
+		},
+		{
+			name:         "no common version",
+			local:        Hello{Version: 1},
+			remote:       Hello{Version: 0},
+			incompatible: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caps, err := Negotiate(tt.local, tt.remote)
+			if tt.incompatible {
+				if !errors.Is(err, ErrIncompatible) {
+					t.Fatalf("got %v, want ErrIncompatible", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if caps.Version != tt.version || !slices.Equal(caps.Features, tt.features) {
+				t.Errorf("got version %d features %v, want %d %v", caps.Version, caps.Features, tt.version, tt.features)
+			}
+		})
+	}
+}
+
+func TestHelloRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		set  func(h *Hello)
+	}{
+		{name: "version and features", set: func(*Hello) {}},
+		{name: "name and labels", set: func(h *Hello) { h.Name, h.Labels = "ci runner", map[string]string{"team": "infra"} }},
+		{name: "subscribe", set: func(h *Hello) { h.Subscribe = []string{"build/*", "deploy"} }},
+		{name: "group", set: func(h *Hello) { h.Group = "workers" }},
+		{name: "since", set: func(h *Hello) { h.Since = time.Date(2024, 5, 1, 10, 42, 0, 0, time.UTC) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hello := LocalHello(FeatureFramed, FeatureTopics)
+			tt.set(&hello)
+			got, err := ParseHello(hello.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, hello) {
+				t.Errorf("got %+v, want %+v", got, hello)
+			}
+		})
+	}
+}
+
+func TestCodecsOverPipe(t *testing.T) {
+	tests := []struct {
+		name     string
+		features []Feature
+		// sequenced codecs carry the sequence number and time.
+		sequenced bool
+	}{
+		{name: "plain"},
+		{name: "framed", features: []Feature{FeatureFramed}, sequenced: true},
+		{name: "json", features: []Feature{FeatureJSON}, sequenced: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{CoalesceDelay: -1}
+			connected := connections(s)
+			ln := serve(t, s)
+			r := receive(t, ln, &Client{Features: tt.features}, nil)
+			h := await(t, connected, 1)[0]
+			for _, f := range tt.features {
+				if !h.Metadata().Capabilities.Has(f) {
+					t.Errorf("%s not negotiated: %v", f, h.Metadata().Capabilities)
+				}
+			}
+
+			broadcastAll(t, s, "one\n", "two\n")
+			for i, want := range []string{"one\n", "two\n"} {
+				m := r.next(t)
+				if string(m.Data) != want {
+					t.Errorf("got %q, want %q", m.Data, want)
+				}
+				if tt.sequenced && (m.Seq != uint64(i+1) || m.Time.IsZero()) {
+					t.Errorf("got seq %d time %v, want seq %d and a time", m.Seq, m.Time, i+1)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package teecp
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// JSONSelect keeps only the given fields of the lines holding a JSON object, in
+// that order. Dotted fields reach into nested objects, e.g. http.status, and keep
+// their dotted name. Lines that are not JSON objects are left as is.
+func JSONSelect(fields ...string) Middleware {
+	names := make([][]byte, len(fields))
+	for i, field := range fields {
+		names[i], _ = json.Marshal(field)
+	}
+
+	return func(line []byte) ([]byte, bool) {
+		var object map[string]json.RawMessage
+		if json.Unmarshal(line, &object) != nil || object == nil {
+			return line, true
+		}
+
+		selected := []byte{'{'}
+		for i, field := range fields {
+			value, ok := jsonLookup(object, field)
+			if !ok {
+				continue
+			}
+			if len(selected) > 1 {
+				selected = append(selected, ',')
+			}
+			selected = append(selected, names[i]...)
+			selected = append(selected, ':')
+			selected = append(selected, value...)
+		}
+		return append(selected, '}'), true
+	}
+}
+
+// jsonOperators are the comparisons of JSONWhere, two characters ones first so
+// that they are preferred.
+var jsonOperators = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+// JSONWhere keeps the lines holding a JSON object for which cond holds. The
+// condition is field, operator and value, such as level=="error" or
+// http.status>=500: operators are ==, !=, <, <=, > and >=, and the value is a JSON
+// literal or else a bare string. A missing field is null. Lines that are not JSON
+// objects are dropped.
+func JSONWhere(cond string) (Middleware, error) {
+	at, op := -1, ""
+	for _, candidate := range jsonOperators {
+		if i := strings.Index(cond, candidate); i > 0 && (at < 0 || i < at) {
+			at, op = i, candidate
+		}
+	}
+	if at < 0 {
+		return nil, fmt.Errorf("invalid condition %q, expected field, operator and value", cond)
+	}
+	field, literal := strings.TrimSpace(cond[:at]), strings.TrimSpace(cond[at+len(op):])
+
+	var want any
+	if err := json.Unmarshal([]byte(literal), &want); err != nil {
+		want = literal
+	}
+
+	return func(line []byte) ([]byte, bool) {
+		var object map[string]json.RawMessage
+		if json.Unmarshal(line, &object) != nil || object == nil {
+			return nil, false
+		}
+
+		var got any
+		if value, ok := jsonLookup(object, field); ok {
+			json.Unmarshal(value, &got)
+		}
+		return line, jsonCompare(got, op, want)
+	}, nil
+}
+
+func jsonCompare(got any, op string, want any) bool {
+	switch op {
+	case "==":
+		return reflect.DeepEqual(got, want)
+	case "!=":
+		return !reflect.DeepEqual(got, want)
+	}
+
+	var order int
+	switch g := got.(type) {
+	case float64:
+		w, ok := want.(float64)
+		if !ok {
+			return false
+		}
+		order = cmp.Compare(g, w)
+	case string:
+		w, ok := want.(string)
+		if !ok {
+			return false
+		}
+		order = cmp.Compare(g, w)
+	default:
+		return false
+	}
+
+	switch op {
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	default:
+		return order >= 0
+	}
+}
+
+// jsonLookup returns the value of a dotted field.
+func jsonLookup(object map[string]json.RawMessage, field string) (json.RawMessage, bool) {
+	if value, ok := object[field]; ok {
+		return value, true
+	}
+
+	head, rest, nested := strings.Cut(field, ".")
+	if !nested {
+		return nil, false
+	}
+	value, ok := object[head]
+	if !ok || !bytes.HasPrefix(bytes.TrimSpace(value), []byte("{")) {
+		return nil, false
+	}
+	var inner map[string]json.RawMessage
+	if json.Unmarshal(value, &inner) != nil {
+		return nil, false
+	}
+	return jsonLookup(inner, rest)
+}
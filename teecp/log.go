@@ -0,0 +1,11 @@
+package teecp
+
+import "log/slog"
+
+// loggerOrDefault returns l, or the default slog logger if l is nil.
+func loggerOrDefault(l *slog.Logger) *slog.Logger {
+	if l == nil {
+		return slog.Default()
+	}
+	return l
+}
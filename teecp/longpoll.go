@@ -0,0 +1,242 @@
+package teecp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultLongPollDuration is how long a response of Server.ServeHTTP streams
+// before ending, short enough for the proxies that cut long requests.
+const DefaultLongPollDuration = 25 * time.Second
+
+// longPollQueue is how many messages may wait for an HTTP client. A client lagging
+// further is cut off, to catch up from the backlog with its next request.
+const longPollQueue = 1024
+
+// errLagging detaches the HTTP clients that do not keep up.
+var errLagging = errors.New("client lagging behind")
+
+// ServeHTTP streams the broadcast to the clients that cannot keep a TCP
+// connection open, such as those behind restrictive proxies. A response carries
+// codec/json envelopes, one per line, for up to LongPollDuration, starting with
+// the Backlog, and TopicBacklogs, from the sequence number given as ?from=SEQ. Asking for the
+// sequence number following the last one received, as Client.ReceiveHTTP does,
+// no message is lost in between as long as the backlog holds it. Clients name
+// themselves with ?name=NAME&label=KEY=VALUE, subscribe to topics with
+// ?subscribe=a,b and, without ?from, ask for the backlog from a time on with
+// ?since=TIME in RFC 3339, as they would in a Hello, which a server without
+// backlog refuses.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var from uint64
+	if v := r.URL.Query().Get("from"); v != "" {
+		var err error
+		if from, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "invalid from", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var since time.Time
+	if v := r.URL.Query().Get("since"); v != "" && from == 0 {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+		if s.Backlog == nil && len(s.TopicBacklogs) == 0 {
+			http.Error(w, "no backlog to replay since", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var replay []Message
+	queue := make(chan Message, longPollQueue)
+	lagging := make(chan struct{})
+	remote, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	caps := Capabilities{Version: ProtocolVersion, Features: []Feature{FeatureJSON}}
+	meta := Metadata{RemoteAddr: remote, Capabilities: caps, Name: r.URL.Query().Get("name")}
+	for _, label := range r.URL.Query()["label"] {
+		if k, v, ok := strings.Cut(label, "="); ok && ValidLabelName(k) {
+			if meta.Labels == nil {
+				meta.Labels = make(map[string]string)
+			}
+			meta.Labels[k] = v
+		}
+	}
+	if topics := r.URL.Query().Get("subscribe"); topics != "" {
+		meta.Topics = strings.Split(topics, ",")
+	}
+	h := s.clients.attach(meta, func(h *Handle) MessageReceiver {
+		// Nothing is broadcast while attaching, so the backlog and the live
+		// stream follow each other without gap nor duplicate.
+		replay = replayedSince(s.Replay(from, func(topic string) bool { return Subscribed(meta.Topics, topic) }), since)
+		return func(m Message) error {
+			if !Subscribed(meta.Topics, m.Topic) {
+				return nil
+			}
+			m.Data = bytes.Clone(m.Data)
+			select {
+			case queue <- m:
+				return nil
+			default:
+				close(lagging)
+				return errLagging
+			}
+		}
+	})
+	defer h.Detach()
+	s.connected(h)
+	err := s.streamHTTP(w, r, replay, queue, lagging)
+	s.disconnected(h, err)
+}
+
+func (s *Server) streamHTTP(w http.ResponseWriter, r *http.Request, replay []Message, queue <-chan Message, lagging <-chan struct{}) error {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-store")
+	// Keep nginx from buffering the response.
+	w.Header().Set("X-Accel-Buffering", "no")
+	rc := http.NewResponseController(w)
+	enc := JSONCodec{}.NewEncoder(w)
+	for _, m := range replay {
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return err
+	}
+
+	duration := s.LongPollDuration
+	if duration == 0 {
+		duration = DefaultLongPollDuration
+	}
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	for {
+		select {
+		case m := <-queue:
+			if err := enc.Encode(m); err != nil {
+				return err
+			}
+			if len(queue) == 0 {
+				if err := rc.Flush(); err != nil {
+					return err
+				}
+			}
+		case <-lagging:
+			// Send what was queued, the rest being replayed at the next request.
+			for len(queue) > 0 {
+				if err := enc.Encode(<-queue); err != nil {
+					return err
+				}
+			}
+			rc.Flush()
+			return errLagging
+		case <-timer.C:
+			return nil
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+	}
+}
+
+// ReceiveHTTP is like ReceiveMessages with a server served by Server.ServeHTTP at
+// rawURL. Every time a response ends, or is cut, it is asked again from the
+// sequence number following the last one received. It returns when ctx is done,
+// when receive fails, or when a request fails.
+func (c *Client) ReceiveHTTP(ctx context.Context, rawURL string, receive func(m Message) error) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	q := u.Query()
+	if c.Name != "" {
+		q.Set("name", c.Name)
+	}
+	for k, v := range c.Labels {
+		q.Add("label", k+"="+v)
+	}
+	if len(c.Subscribe) > 0 {
+		q.Set("subscribe", strings.Join(c.Subscribe, ","))
+	}
+	if !c.Since.IsZero() {
+		// Once a message is received, the following requests ask from it.
+		q.Set("since", c.Since.Format(time.RFC3339Nano))
+	}
+	u.RawQuery = q.Encode()
+
+	var next uint64
+	for {
+		if next > 0 {
+			q.Set("from", strconv.FormatUint(next, 10))
+			u.RawQuery = q.Encode()
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("%s: %s", u.Redacted(), resp.Status)
+		}
+
+		err = c.receivePoll(resp.Body, &next, receive)
+		resp.Body.Close()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// receivePoll hands the messages of a response to receive, skipping those already
+// received. Only an error from receive is returned: a response cut in the middle
+// is just asked again.
+func (c *Client) receivePoll(body io.Reader, next *uint64, receive func(m Message) error) error {
+	reader := c.readers.get(&c.metrics().pool, newReader(c.ReadBufferSize))
+	reader.Reset(body)
+	defer func() {
+		reader.Reset(nil)
+		c.readers.put(reader)
+	}()
+
+	dec := JSONCodec{}.NewDecoder(reader)
+	for {
+		m, err := dec.Decode()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				loggerOrDefault(c.Logger).Debug("long-poll response cut", "err", err)
+			}
+			return nil
+		}
+		if m.Seq < *next {
+			continue
+		}
+		if *next > 0 && m.Seq > *next {
+			loggerOrDefault(c.Logger).Warn("messages lost, no longer in the backlog of the server", "from", *next, "to", m.Seq-1)
+		}
+		*next = m.Seq + 1
+		if err := receive(m); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package teecp
+
+import (
+	"sync"
+	"time"
+)
+
+// Metrics is where a server reports its measurements. Instruments are looked up
+// once by name and kept.
+type Metrics interface {
+	Counter(name string) Counter
+	Gauge(name string) Gauge
+	Histogram(name string) Histogram
+}
+
+// Counter is a value that only goes up.
+type Counter interface {
+	Add(delta float64)
+}
+
+// Gauge is a value that goes up and down.
+type Gauge interface {
+	Add(delta float64)
+	Set(value float64)
+}
+
+// Histogram tracks the distribution of observed values.
+type Histogram interface {
+	Observe(value float64)
+}
+
+// Names of the instruments reported by a server.
+const (
+	MetricBroadcastMessages = "teecp_broadcast_messages_total"
+	MetricBroadcastBytes    = "teecp_broadcast_bytes_total"
+	MetricBroadcastDuration = "teecp_broadcast_duration_seconds"
+	MetricBroadcastErrors   = "teecp_broadcast_errors_total"
+	MetricDroppedMessages   = "teecp_dropped_messages_total"
+	MetricConnections       = "teecp_connections_total"
+	MetricClients           = "teecp_clients"
+)
+
+// Names of the series of every client, written by WriteClientStats.
+const (
+	MetricClientMessages = "teecp_client_sent_messages_total"
+	MetricClientBytes    = "teecp_client_sent_bytes_total"
+	MetricClientQueued   = "teecp_client_queued_bytes"
+	MetricClientBehind   = "teecp_client_behind_messages"
+	MetricClientLag      = "teecp_client_lag_seconds"
+)
+
+// Names of the instruments of the buffer pools, reported by servers and clients.
+// Allocations growing along with gets mean buffers are not recycled.
+const (
+	MetricPoolGets        = "teecp_pool_gets_total"
+	MetricPoolAllocations = "teecp_pool_allocations_total"
+)
+
+// NopMetrics discards every measurement.
+type NopMetrics struct{}
+
+func (NopMetrics) Counter(string) Counter     { return nopInstrument{} }
+func (NopMetrics) Gauge(string) Gauge         { return nopInstrument{} }
+func (NopMetrics) Histogram(string) Histogram { return nopInstrument{} }
+
+type nopInstrument struct{}
+
+func (nopInstrument) Add(float64)     {}
+func (nopInstrument) Set(float64)     {}
+func (nopInstrument) Observe(float64) {}
+
+// serverMetrics are the instruments of a server, resolved on first use.
+type serverMetrics struct {
+	once sync.Once
+
+	messages    Counter
+	bytes       Counter
+	duration    Histogram
+	errors      Counter
+	dropped     Counter
+	connections Counter
+	clients     Gauge
+	pool        poolMetrics
+}
+
+func (s *Server) metrics() *serverMetrics {
+	s.instruments.once.Do(func() {
+		m := metricsOrNop(s.Metrics)
+
+		s.instruments.messages = m.Counter(MetricBroadcastMessages)
+		s.instruments.bytes = m.Counter(MetricBroadcastBytes)
+		s.instruments.duration = m.Histogram(MetricBroadcastDuration)
+		s.instruments.errors = m.Counter(MetricBroadcastErrors)
+		s.instruments.dropped = m.Counter(MetricDroppedMessages)
+		s.instruments.connections = m.Counter(MetricConnections)
+		s.instruments.clients = m.Gauge(MetricClients)
+		s.instruments.pool = newPoolMetrics(m)
+	})
+	return &s.instruments
+}
+
+// clientMetrics are the instruments of a client, resolved on first use.
+type clientMetrics struct {
+	once sync.Once
+
+	pool poolMetrics
+}
+
+func (c *Client) metrics() *clientMetrics {
+	c.instruments.once.Do(func() {
+		c.instruments.pool = newPoolMetrics(metricsOrNop(c.Metrics))
+	})
+	return &c.instruments
+}
+
+func newPoolMetrics(m Metrics) poolMetrics {
+	return poolMetrics{
+		gets:        m.Counter(MetricPoolGets),
+		allocations: m.Counter(MetricPoolAllocations),
+	}
+}
+
+// metricsOrNop returns m, or NopMetrics if m is nil.
+func metricsOrNop(m Metrics) Metrics {
+	if m == nil {
+		return NopMetrics{}
+	}
+	return m
+}
+
+// observeSince records the seconds elapsed since start.
+func observeSince(h Histogram, start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
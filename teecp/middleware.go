@@ -0,0 +1,190 @@
+package teecp
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Middleware transforms a line before it is broadcast. The line comes without its
+// trailing newline, which is put back afterwards. Returning false drops the line.
+type Middleware func(line []byte) ([]byte, bool)
+
+// Chain applies the middlewares in order, stopping at the first one dropping the
+// line.
+func Chain(middlewares ...Middleware) Middleware {
+	return func(line []byte) ([]byte, bool) {
+		for _, m := range middlewares {
+			var ok bool
+			if line, ok = m(line); !ok {
+				return nil, false
+			}
+		}
+		return line, true
+	}
+}
+
+// Filter keeps only the lines matching re.
+func Filter(re *regexp.Regexp) Middleware {
+	return func(line []byte) ([]byte, bool) {
+		return line, re.Match(line)
+	}
+}
+
+// Exclude drops the lines matching re.
+func Exclude(re *regexp.Regexp) Middleware {
+	return func(line []byte) ([]byte, bool) {
+		return line, !re.Match(line)
+	}
+}
+
+// Redact replaces every match of re with replacement, taken literally.
+func Redact(re *regexp.Regexp, replacement string) Middleware {
+	repl := []byte(replacement)
+	return func(line []byte) ([]byte, bool) {
+		return re.ReplaceAllLiteral(line, repl), true
+	}
+}
+
+// Timestamp prefixes the lines with the time they went through, formatted with
+// layout.
+func Timestamp(layout string) Middleware {
+	return func(line []byte) ([]byte, bool) {
+		prefixed := time.Now().AppendFormat(nil, layout)
+		prefixed = append(prefixed, ' ')
+		return append(prefixed, line...), true
+	}
+}
+
+// Tag prefixes the lines with "[tag] ".
+func Tag(tag string) Middleware {
+	prefix := []byte("[" + tag + "] ")
+	return func(line []byte) ([]byte, bool) {
+		return append(prefix[:len(prefix):len(prefix)], line...), true
+	}
+}
+
+// Substitute replaces the first match of re with replacement, or every match when
+// all is set. Inside replacement, $1 or ${name} stand for the submatches, as in
+// regexp.Regexp.Expand.
+func Substitute(re *regexp.Regexp, replacement string, all bool) Middleware {
+	template := []byte(replacement)
+	return func(line []byte) ([]byte, bool) {
+		if all {
+			return re.ReplaceAll(line, template), true
+		}
+
+		match := re.FindSubmatchIndex(line)
+		if match == nil {
+			return line, true
+		}
+		replaced := append([]byte(nil), line[:match[0]]...)
+		replaced = re.Expand(replaced, template, line, match)
+		return append(replaced, line[match[1]:]...), true
+	}
+}
+
+// Dedup collapses the identical lines coming within window of one another,
+// taming producers stuck in a loop: the first line goes through and its repeats
+// are dropped until the window is over. The next one to come then goes through
+// with the count of those dropped, e.g. "connection refused (repeated 4182
+// times)", starting a window of its own. When none comes, the line with the
+// count is given to emit once the window is over, for it to be broadcast all
+// the same; without emit, the count is forgotten then.
+func Dedup(window time.Duration, emit func(line []byte)) Middleware {
+	type seen struct {
+		since   time.Time
+		repeats int
+		expire  *time.Timer
+	}
+	var (
+		mu        sync.Mutex
+		lines     = make(map[string]*seen)
+		lastSweep time.Time
+	)
+	repeated := func(line []byte, repeats int) []byte {
+		return fmt.Appendf(line[:len(line):len(line)], " (repeated %d times)", repeats)
+	}
+	// expire emits the count of the repeats of line once its window is over,
+	// unless an identical line came to carry it.
+	expire := func(line string, s *seen, since time.Time) {
+		mu.Lock()
+		if lines[line] != s || !s.since.Equal(since) || s.repeats == 0 {
+			mu.Unlock()
+			return
+		}
+		delete(lines, line)
+		mu.Unlock()
+		emit(repeated([]byte(line), s.repeats))
+	}
+	return func(line []byte) ([]byte, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		now := time.Now()
+		if now.Sub(lastSweep) >= window {
+			// The lines with repeats to tell about are left to their timer.
+			for l, s := range lines {
+				if s.expire == nil && now.Sub(s.since) >= window {
+					delete(lines, l)
+				}
+			}
+			lastSweep = now
+		}
+
+		s, ok := lines[string(line)]
+		if !ok {
+			lines[string(line)] = &seen{since: now}
+			return line, true
+		}
+		if now.Sub(s.since) < window {
+			if s.repeats++; s.repeats == 1 && emit != nil {
+				l, since := string(line), s.since
+				s.expire = time.AfterFunc(window-now.Sub(since), func() { expire(l, s, since) })
+			}
+			return nil, false
+		}
+		if s.expire != nil {
+			s.expire.Stop()
+			s.expire = nil
+		}
+		if s.repeats > 0 {
+			line = repeated(line, s.repeats)
+		}
+		s.since, s.repeats = now, 0
+		return line, true
+	}
+}
+
+// sampleInterval is how often AdaptiveSample measures the rate of the input.
+const sampleInterval = 100 * time.Millisecond
+
+// AdaptiveSample keeps about target lines per second at most, keeping viewers
+// responsive during bursts: while the input comes faster, only one line in n
+// is kept, n following the rate measured over the previous sampleInterval, and
+// every line again once the rate is back under target.
+func AdaptiveSample(target float64) Middleware {
+	var (
+		mu    sync.Mutex
+		start time.Time
+		count int
+		every = 1
+	)
+	return func(line []byte) ([]byte, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		now := time.Now()
+		if elapsed := now.Sub(start); elapsed >= sampleInterval {
+			if !start.IsZero() {
+				rate := float64(count) / elapsed.Seconds()
+				every = max(1, int(math.Ceil(rate/target)))
+			}
+			start, count = now, 0
+		}
+		count++
+		return line, (count-1)%every == 0
+	}
+}
@@ -0,0 +1,65 @@
+package teecp
+
+import (
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFiltersOverPipe(t *testing.T) {
+	s := &Server{CoalesceDelay: -1}
+	s.Use(Filter(regexp.MustCompile(`ERROR|WARN`)), Exclude(regexp.MustCompile(`ignored`)))
+	connected := connections(s)
+	ln := serve(t, s)
+	r := receive(t, ln, &Client{Features: []Feature{FeatureFramed}}, nil)
+	await(t, connected, 1)
+
+	broadcastAll(t, s, "INFO started\n", "WARN disk\n", "ERROR ignored\n", "ERROR failed\n")
+	if got, want := r.all(t), []string{"WARN disk\n", "ERROR failed\n"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDedupEmitsTheRepeatsOnceTheWindowIsOver(t *testing.T) {
+	emitted := make(chan string, 1)
+	dedup := Dedup(50*time.Millisecond, func(line []byte) { emitted <- string(line) })
+
+	for i, want := range []bool{true, false, false} {
+		if _, ok := dedup([]byte("refused")); ok != want {
+			t.Fatalf("line %d kept %v, want %v", i, ok, want)
+		}
+	}
+	select {
+	case line := <-emitted:
+		if want := "refused (repeated 2 times)"; line != want {
+			t.Errorf("got %q, want %q", line, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the repeats were never told")
+	}
+
+	// The count was told: the next line starts over.
+	if line, ok := dedup([]byte("refused")); !ok || string(line) != "refused" {
+		t.Errorf("got %q kept %v, want the line as it is", line, ok)
+	}
+}
+
+func TestEmitGoesThroughTheMiddlewaresAfter(t *testing.T) {
+	s := &Server{CoalesceDelay: -1}
+	tag := func(line []byte) ([]byte, bool) { return append([]byte("[build] "), line...), true }
+	s.Use(Dedup(50*time.Millisecond, func(line []byte) { s.Emit(0, append(line, '\n')) }), tag)
+	connected := connections(s)
+	ln := serve(t, s)
+	r := receive(t, ln, &Client{Features: []Feature{FeatureFramed}}, nil)
+	await(t, connected, 1)
+
+	for range 3 {
+		s.BroadcastString("refused\n")
+	}
+	for _, want := range []string{"[build] refused\n", "[build] refused (repeated 2 times)\n"} {
+		if m := r.next(t); string(m.Data) != want {
+			t.Fatalf("got %q, want %q", m.Data, want)
+		}
+	}
+}
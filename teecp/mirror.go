@@ -0,0 +1,318 @@
+package teecp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FeatureMirror is announced by a peer pushing the broadcast of its server to
+// another server, rather than receiving it. Servers announce it with
+// AcceptMirrors.
+const FeatureMirror Feature = "mirror"
+
+// DefaultMirrorQueue is how many messages may wait to be pushed to a mirror. A
+// mirror further behind, or away for longer, misses the following ones.
+const DefaultMirrorQueue = 4096
+
+// mirrorEndTimeout bounds how long the end of the stream waits for the mirrors to
+// take what is queued for them.
+const mirrorEndTimeout = 10 * time.Second
+
+// errRefused is returned when pushing to a server that does not accept what is
+// pushed.
+var errRefused = errors.New("server does not accept")
+
+// mirrorState holds the mirrors a server pushes to, and what the servers
+// mirroring to it push.
+type mirrorState struct {
+	mu  sync.Mutex
+	out []*mirror
+
+	start sync.Once
+	in    chan mirrored
+	// closed is closed with the server, for the pushes to stop waiting.
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// mirrored is a message pushed by a mirroring server, or the end of its stream.
+type mirrored struct {
+	m   Message
+	end bool
+}
+
+// Mirror pushes the broadcast to the server dial connects to, which broadcasts it
+// again to its own clients with AcceptMirrors and BroadcastMirrored, so that
+// servers make a fan-out tree. The connection is opened again whenever it is
+// lost, until ctx is done. Once the input is over, the mirror gets what is still
+// queued and the end of the stream. The end of the stream of a server with a
+// Topic only ends that topic.
+func (s *Server) Mirror(ctx context.Context, dial func(ctx context.Context) (net.Conn, error)) {
+	m := s.newMirror(dial, FeatureMirror, LocalHello(FeatureMirror, FeatureFramed, FeatureStreamEnd, FeatureTopics), loggerOrDefault(s.Logger))
+	m.detach = s.clients.AttachMessages(m.receive, Metadata{}).Detach
+	go m.run(ctx)
+}
+
+// newMirror returns a mirror pushing with the feature, announced in hello, that
+// is ended along with the stream.
+func (s *Server) newMirror(dial func(ctx context.Context) (net.Conn, error), feature Feature, hello Hello, logger *slog.Logger) *mirror {
+	m := &mirror{
+		dial:    dial,
+		feature: feature,
+		hello:   hello,
+		logger:  logger,
+		topic:   s.Topic,
+		queue:   make(chan Message, DefaultMirrorQueue),
+		end:     make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	s.mirrors.mu.Lock()
+	s.mirrors.out = append(s.mirrors.out, m)
+	s.mirrors.mu.Unlock()
+	return m
+}
+
+// endMirrors ends the stream of the mirrors, waiting a while for them to take it.
+func (s *Server) endMirrors() {
+	s.mirrors.mu.Lock()
+	out := s.mirrors.out
+	s.mirrors.out = nil
+	s.mirrors.mu.Unlock()
+
+	timeout := time.After(mirrorEndTimeout)
+	for _, m := range out {
+		close(m.end)
+	}
+	for _, m := range out {
+		select {
+		case <-m.done:
+		case <-timeout:
+			loggerOrDefault(s.Logger).Warn("mirror did not take the end of the stream in time")
+			return
+		}
+	}
+}
+
+// mirror pushes the broadcast to another server, or the input to another node of
+// the cluster, queueing it on the side so that it never slows down the broadcast.
+type mirror struct {
+	dial    func(ctx context.Context) (net.Conn, error)
+	feature Feature
+	hello   Hello
+	logger  *slog.Logger
+	// topic is the one of the input of the server, which the other server must
+	// know of.
+	topic string
+	// detach stops feeding the queue, once the server refused the feature.
+	detach  func()
+	queue   chan Message
+	dropped atomic.Uint64
+	// end is closed once the input is over, and done once the mirror stopped.
+	end  chan struct{}
+	done chan struct{}
+}
+
+func (m *mirror) receive(msg Message) error {
+	msg.Data = bytes.Clone(msg.Data)
+	select {
+	case m.queue <- msg:
+	default:
+		m.dropped.Add(1)
+	}
+	return nil
+}
+
+func (m *mirror) run(ctx context.Context) {
+	defer close(m.done)
+	logger := m.logger
+
+	// A message whose write failed is sent again first.
+	var pending *Message
+	for {
+		conn, caps, err := m.connect(ctx)
+		if err == nil {
+			logger.Info("mirroring", "remote", conn.RemoteAddr())
+			pending, err = m.push(ctx, conn, caps.Has(FeatureTopics), pending)
+			conn.Close()
+			if err == nil {
+				return
+			}
+			logger.Warn("mirror lost", "remote", conn.RemoteAddr(), "err", err)
+		} else if errors.Is(err, errRefused) {
+			// Trying again would not change its mind.
+			logger.Error("could not mirror", "err", err)
+			m.detach()
+			return
+		} else if ctx.Err() == nil {
+			logger.Warn("could not connect to mirror", "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(DefaultRetryInterval):
+		}
+	}
+}
+
+func (m *mirror) connect(ctx context.Context) (net.Conn, Capabilities, error) {
+	conn, err := m.dial(ctx)
+	if err != nil {
+		return nil, Capabilities{}, err
+	}
+	conn.SetDeadline(time.Now().Add(DefaultHandshakeTimeout * 10))
+	caps, err := ClientHandshake(conn, bufio.NewReader(conn), m.hello)
+	conn.SetDeadline(time.Time{})
+	switch {
+	case err != nil:
+	case !(caps.Has(m.feature) && caps.Has(FeatureFramed)):
+		err = fmt.Errorf("%w %s", errRefused, m.feature)
+	case m.topic != DefaultTopic && !caps.Has(FeatureTopics):
+		err = fmt.Errorf("%w %s", errRefused, FeatureTopics)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, Capabilities{}, err
+	}
+	return conn, caps, nil
+}
+
+// push writes the queue to conn until it fails, returning the message that could
+// not be written, or until the stream is over, returning a nil error. Without
+// topics, the messages of other topics than DefaultTopic are left out.
+func (m *mirror) push(ctx context.Context, conn net.Conn, topics bool, pending *Message) (*Message, error) {
+	enc := &framedEncoder{w: conn}
+	encode := func(msg Message) error {
+		if !topics && msg.Topic != DefaultTopic {
+			return nil
+		}
+		return enc.Encode(msg)
+	}
+	if pending != nil {
+		if err := encode(*pending); err != nil {
+			return pending, err
+		}
+	}
+	for {
+		if dropped := m.dropped.Swap(0); dropped > 0 {
+			m.logger.Warn("mirror lagging, messages dropped", "remote", conn.RemoteAddr(), "dropped", dropped)
+			marker := droppedMarker(dropped)
+			marker.Topic = m.topic
+			if err := encode(marker); err != nil {
+				m.dropped.Add(dropped)
+				return nil, err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case msg := <-m.queue:
+			if err := encode(msg); err != nil {
+				return &msg, err
+			}
+		case <-m.end:
+			// Nothing is queued anymore once the input is over.
+			for len(m.queue) > 0 {
+				msg := <-m.queue
+				if err := encode(msg); err != nil {
+					return &msg, err
+				}
+			}
+			return nil, enc.encodeEnd(nil, EndEOF)
+		}
+	}
+}
+
+// mirrorInput returns where the pushes of mirroring servers go.
+func (s *Server) mirrorInput() chan mirrored {
+	s.mirrors.start.Do(func() {
+		s.mirrors.in = make(chan mirrored)
+		s.mirrors.closed = make(chan struct{})
+	})
+	return s.mirrors.in
+}
+
+// receiveMirror hands what a mirroring server pushes to BroadcastMirrored, until
+// it hangs up. The end of its stream is handed along unless it only pushed other
+// topics than DefaultTopic: the end of a topic is not the end of the others.
+func (s *Server) receiveMirror(conn net.Conn, r *bufio.Reader, caps Capabilities) {
+	logger := loggerOrDefault(s.Logger)
+	logger.Info("mirror connected", "remote", conn.RemoteAddr())
+
+	in := s.mirrorInput()
+	dec := CodecFor(caps).NewDecoder(r)
+	var err error
+	var topics []string
+	defaultTopic := false
+	for err == nil {
+		var m Message
+		if m, err = dec.Decode(); err != nil {
+			break
+		}
+		if m.Topic == DefaultTopic {
+			defaultTopic = true
+		} else if !slices.Contains(topics, m.Topic) {
+			topics = append(topics, m.Topic)
+		}
+		// The sequence numbers are those of this server.
+		m.Seq = 0
+		select {
+		case in <- mirrored{m: m}:
+		case <-s.mirrors.closed:
+			err = ErrServerClosed
+		}
+	}
+
+	var end *StreamEnd
+	switch {
+	case !errors.As(err, &end) || end.Reason != EndEOF:
+	case len(topics) > 0 && !defaultTopic:
+		logger.Info("topics over", "remote", conn.RemoteAddr(), "topics", topics)
+	default:
+		select {
+		case in <- mirrored{end: true}:
+		case <-s.mirrors.closed:
+		}
+	}
+	s.drop(conn)
+	logger.Info("mirror disconnected", "remote", conn.RemoteAddr(), "err", err)
+}
+
+// closeMirrors stops the pushes of the mirroring servers, once the server closes.
+func (s *Server) closeMirrors() {
+	s.mirrorInput()
+	s.mirrors.closeOnce.Do(func() { close(s.mirrors.closed) })
+}
+
+// BroadcastMirrored broadcasts what the servers mirroring to this one push, with
+// AcceptMirrors, until ctx is done or one of them ends the stream once its input
+// is over.
+func (s *Server) BroadcastMirrored(ctx context.Context) error {
+	in := s.mirrorInput()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case m := <-in:
+			if !m.end {
+				s.publish(m.m)
+				continue
+			}
+			if err := s.awaitResume(ctx); err != nil {
+				return err
+			}
+			s.endStream(EndEOF)
+			return nil
+		}
+	}
+}
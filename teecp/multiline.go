@@ -0,0 +1,66 @@
+package teecp
+
+import (
+	"bytes"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// DefaultMultilineTimeout is how long a record waits for more lines when
+// Multiline.Timeout is zero.
+const DefaultMultilineTimeout = 500 * time.Millisecond
+
+// Multiline groups lines into records, such as stack traces, broadcast as a single
+// message: a line matching Start begins a record and the lines not matching it are
+// part of the current record.
+type Multiline struct {
+	Start *regexp.Regexp
+	// Timeout is how long a record waits for more lines before being broadcast.
+	// Zero means DefaultMultilineTimeout.
+	Timeout time.Duration
+}
+
+// recordGrouper accumulates the lines of the current record.
+type recordGrouper struct {
+	mu      sync.Mutex
+	pending []byte
+	timer   *time.Timer
+}
+
+// add appends line, newline included, to the current record, or emits the record
+// and starts a new one when line starts a record.
+func (g *recordGrouper) add(line []byte, m *Multiline, emit func(record []byte) error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if len(g.pending) > 0 && m.Start.Match(bytes.TrimSuffix(line, []byte("\n"))) {
+		emit(g.pending)
+		g.pending = g.pending[:0]
+	}
+	g.pending = append(g.pending, line...)
+
+	timeout := m.Timeout
+	if timeout == 0 {
+		timeout = DefaultMultilineTimeout
+	}
+	if g.timer == nil {
+		g.timer = time.AfterFunc(timeout, func() { g.flush(emit) })
+	} else {
+		g.timer.Reset(timeout)
+	}
+}
+
+// flush emits the current record, if any.
+func (g *recordGrouper) flush(emit func(record []byte) error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.timer != nil {
+		g.timer.Stop()
+	}
+	if len(g.pending) > 0 {
+		emit(g.pending)
+		g.pending = g.pending[:0]
+	}
+}
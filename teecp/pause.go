@@ -0,0 +1,144 @@
+package teecp
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultPauseBuffer is how many bytes of messages a paused server holds before it
+// stops reading its input, for the writer to wait rather than lose them.
+const DefaultPauseBuffer = 64 << 20
+
+// pauseState holds the messages broadcast while the server is paused, until they
+// are all broadcast on resume.
+type pauseState struct {
+	mu     sync.Mutex
+	paused bool
+	// draining is set while Resume broadcasts what was held, for the messages
+	// coming meanwhile to wait their turn.
+	draining bool
+	held     []Message
+	size     int
+	// closed is set once the server closes, for nothing to wait anymore.
+	closed bool
+	// room is signaled when held empties, or when the server resumes or closes.
+	room *sync.Cond
+}
+
+// Pause holds the messages broadcast from now on, keeping the clients connected,
+// until Resume. Middlewares still apply and the input is still read, up to
+// PauseBuffer bytes.
+func (s *Server) Pause() {
+	s.pause.mu.Lock()
+	defer s.pause.mu.Unlock()
+
+	if !s.pause.paused {
+		s.pause.paused = true
+		loggerOrDefault(s.Logger).Info("broadcast paused")
+	}
+}
+
+// Resume broadcasts the messages held since Pause, in order, and then the
+// following ones as they come.
+func (s *Server) Resume() {
+	s.pause.mu.Lock()
+	if !s.pause.paused {
+		s.pause.mu.Unlock()
+		return
+	}
+	s.pause.paused = false
+	if s.pause.draining {
+		// Another Resume is broadcasting what is held.
+		s.pause.mu.Unlock()
+		return
+	}
+	s.pause.draining = true
+	loggerOrDefault(s.Logger).Info("broadcast resumed", "held", len(s.pause.held))
+
+	for len(s.pause.held) > 0 && !s.pause.paused {
+		held := s.pause.held
+		s.pause.held, s.pause.size = nil, 0
+		s.pauseRoom().Broadcast()
+		s.pause.mu.Unlock()
+
+		for _, m := range held {
+			s.broadcast(m)
+		}
+		s.pause.mu.Lock()
+	}
+	s.pause.draining = false
+	s.pauseRoom().Broadcast()
+	s.pause.mu.Unlock()
+}
+
+// Paused tells if the server holds the messages broadcast.
+func (s *Server) Paused() bool {
+	s.pause.mu.Lock()
+	defer s.pause.mu.Unlock()
+	return s.pause.paused
+}
+
+// hold keeps m for Resume if the server is paused, or resuming, and tells if it
+// did. It waits for room while PauseBuffer is full.
+func (s *Server) hold(m Message) bool {
+	s.pause.mu.Lock()
+	defer s.pause.mu.Unlock()
+
+	limit := cmp.Or(s.PauseBuffer, DefaultPauseBuffer)
+	for s.pause.paused && !s.pause.closed && s.pause.size > 0 && s.pause.size+len(m.Data) > limit {
+		s.pauseRoom().Wait()
+	}
+	if s.pause.closed && s.pause.paused {
+		// Nobody is left to resume.
+		return true
+	}
+	if !s.pause.paused && !s.pause.draining {
+		return false
+	}
+	// The data belongs to the caller, such as the chunks of BroadcastFrom.
+	m.Data = bytes.Clone(m.Data)
+	if m.Time.IsZero() {
+		m.Time = time.Now()
+	}
+	s.pause.held = append(s.pause.held, m)
+	s.pause.size += len(m.Data)
+	return true
+}
+
+// awaitResume waits until what is held was broadcast, or until ctx is done or the
+// server closes.
+func (s *Server) awaitResume(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		s.pause.mu.Lock()
+		s.pauseRoom().Broadcast()
+		s.pause.mu.Unlock()
+	})
+	defer stop()
+
+	s.pause.mu.Lock()
+	defer s.pause.mu.Unlock()
+	for (s.pause.paused || s.pause.draining) && !s.pause.closed && ctx.Err() == nil {
+		s.pauseRoom().Wait()
+	}
+	return ctx.Err()
+}
+
+// closePause wakes up what waits for Resume, once the server closes.
+func (s *Server) closePause() {
+	s.pause.mu.Lock()
+	defer s.pause.mu.Unlock()
+
+	s.pause.closed = true
+	s.pauseRoom().Broadcast()
+}
+
+// pauseRoom returns the condition of s.pause.mu. Callers must hold s.pause.mu.
+func (s *Server) pauseRoom() *sync.Cond {
+	if s.pause.room == nil {
+		s.pause.room = sync.NewCond(&s.pause.mu)
+	}
+	return s.pause.room
+}
@@ -0,0 +1,118 @@
+package teecp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// Plugin is a WebAssembly module filtering and transforming lines. It exports:
+//
+//   - memory, its linear memory;
+//   - alloc(size i32) i32, returning where teecp may write an input of size bytes;
+//   - filter(ptr i32, len i32) i64, handling the line written at ptr and returning
+//     where its output lies, as ptr<<32 | len, or -1 to drop the line.
+//
+// The line comes without its trailing newline. The output must stay valid until
+// the next call, the plugin being free to reuse its buffers. WASI is available,
+// so modules built by TinyGo, Rust or Go for wasip1 work.
+type Plugin struct {
+	// Logger reports the lines the plugin fails on. Nil means slog.Default().
+	Logger *slog.Logger
+
+	mu      sync.Mutex
+	runtime wazero.Runtime
+	memory  api.Memory
+	alloc   api.Function
+	filter  api.Function
+}
+
+// LoadPlugin compiles and instantiates the WebAssembly module at path, what it
+// writes to its stdout and stderr going to stdout and stderr, or nowhere when nil.
+func LoadPlugin(ctx context.Context, path string, stdout, stderr io.Writer) (*Plugin, error) {
+	wasm, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	runtime := wazero.NewRuntime(ctx)
+	wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+	config := wazero.NewModuleConfig().WithStartFunctions("_initialize")
+	if stdout != nil {
+		config = config.WithStdout(stdout)
+	}
+	if stderr != nil {
+		config = config.WithStderr(stderr)
+	}
+	module, err := runtime.InstantiateWithConfig(ctx, wasm, config)
+	if err != nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("plugin %s: %w", path, err)
+	}
+
+	p := &Plugin{
+		runtime: runtime,
+		memory:  module.Memory(),
+		alloc:   module.ExportedFunction("alloc"),
+		filter:  module.ExportedFunction("filter"),
+	}
+	if p.memory == nil || p.alloc == nil || p.filter == nil {
+		runtime.Close(ctx)
+		return nil, fmt.Errorf("plugin %s: must export memory, alloc and filter", path)
+	}
+	return p, nil
+}
+
+// Middleware hands the lines to the plugin. A line the plugin fails on is dropped
+// and the failure reported to Logger.
+func (p *Plugin) Middleware() Middleware {
+	return func(line []byte) ([]byte, bool) {
+		out, ok, err := p.call(line)
+		if err != nil {
+			loggerOrDefault(p.Logger).Warn("plugin failed, line dropped", "err", err)
+			return nil, false
+		}
+		return out, ok
+	}
+}
+
+func (p *Plugin) call(line []byte) ([]byte, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ctx := context.Background()
+	results, err := p.alloc.Call(ctx, uint64(len(line)))
+	if err != nil {
+		return nil, false, err
+	}
+	ptr := uint32(results[0])
+	if !p.memory.Write(ptr, line) {
+		return nil, false, errors.New("alloc returned memory out of range")
+	}
+
+	results, err = p.filter.Call(ctx, uint64(ptr), uint64(len(line)))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(results[0]) < 0 {
+		return nil, false, nil
+	}
+	out, ok := p.memory.Read(uint32(results[0]>>32), uint32(results[0]))
+	if !ok {
+		return nil, false, errors.New("filter returned memory out of range")
+	}
+	return append([]byte(nil), out...), true, nil
+}
+
+// Close releases the plugin.
+func (p *Plugin) Close() error {
+	return p.runtime.Close(context.Background())
+}
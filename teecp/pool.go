@@ -0,0 +1,55 @@
+package teecp
+
+import (
+	"bufio"
+	"sync"
+)
+
+// DefaultReadBufferSize is the size of the buffers the input of a server is read
+// into.
+const DefaultReadBufferSize = 32 << 10
+
+// pool recycles values with a sync.Pool. T should be a pointer, so that putting a
+// value back does not allocate.
+type pool[T any] struct {
+	sync.Pool
+}
+
+// poolMetrics count how many values are asked to the pools and how many of them
+// had to be made, telling how well recycling works.
+type poolMetrics struct {
+	gets        Counter
+	allocations Counter
+}
+
+// get returns a recycled value, or one made by make.
+func (p *pool[T]) get(m *poolMetrics, make func() T) T {
+	m.gets.Add(1)
+	if v, ok := p.Get().(T); ok {
+		return v
+	}
+	m.allocations.Add(1)
+	return make()
+}
+
+// put recycles v, which must not be used afterwards.
+func (p *pool[T]) put(v T) {
+	p.Put(v)
+}
+
+func newBuffer(size int) func() *[]byte {
+	return func() *[]byte {
+		b := make([]byte, 0, size)
+		return &b
+	}
+}
+
+// newReader makes readers of size bytes, zero meaning the bufio default.
+func newReader(size int) func() *bufio.Reader {
+	return func() *bufio.Reader {
+		if size == 0 {
+			return bufio.NewReader(nil)
+		}
+		return bufio.NewReaderSize(nil, size)
+	}
+}
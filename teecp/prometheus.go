@@ -0,0 +1,155 @@
+package teecp
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// DefaultBuckets are the histogram upper bounds used by PrometheusMetrics, in
+// seconds: broadcasts are expected to take from microseconds to a second.
+var DefaultBuckets = []float64{.00001, .0001, .001, .01, .1, 1}
+
+// PrometheusMetrics keeps the measurements in memory and serves them in the
+// Prometheus text exposition format, being an http.Handler.
+type PrometheusMetrics struct {
+	// Buckets are the histogram upper bounds. Nil means DefaultBuckets.
+	Buckets []float64
+
+	mu      sync.Mutex
+	metrics map[string]*promMetric
+}
+
+type promMetric struct {
+	kind    string
+	value   float64
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func (p *PrometheusMetrics) get(name, kind string) *promMetric {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metrics == nil {
+		p.metrics = make(map[string]*promMetric)
+	}
+	m, ok := p.metrics[name]
+	if !ok {
+		m = &promMetric{kind: kind}
+		if kind == "histogram" {
+			m.buckets = p.Buckets
+			if m.buckets == nil {
+				m.buckets = DefaultBuckets
+			}
+			m.counts = make([]uint64, len(m.buckets))
+		}
+		p.metrics[name] = m
+	}
+	return m
+}
+
+func (p *PrometheusMetrics) Counter(name string) Counter {
+	return promInstrument{p, p.get(name, "counter")}
+}
+
+func (p *PrometheusMetrics) Gauge(name string) Gauge {
+	return promInstrument{p, p.get(name, "gauge")}
+}
+
+func (p *PrometheusMetrics) Histogram(name string) Histogram {
+	return promInstrument{p, p.get(name, "histogram")}
+}
+
+type promInstrument struct {
+	p *PrometheusMetrics
+	m *promMetric
+}
+
+func (i promInstrument) Add(delta float64) {
+	i.p.mu.Lock()
+	defer i.p.mu.Unlock()
+
+	i.m.value += delta
+}
+
+func (i promInstrument) Set(value float64) {
+	i.p.mu.Lock()
+	defer i.p.mu.Unlock()
+
+	i.m.value = value
+}
+
+func (i promInstrument) Observe(value float64) {
+	i.p.mu.Lock()
+	defer i.p.mu.Unlock()
+
+	for b, bound := range i.m.buckets {
+		if value <= bound {
+			i.m.counts[b]++
+		}
+	}
+	i.m.count++
+	i.m.sum += value
+}
+
+// ServeHTTP writes every metric in the Prometheus text exposition format.
+func (p *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p.WriteTo(w)
+}
+
+// WriteTo writes every metric in the Prometheus text exposition format.
+func (p *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	names := make([]string, 0, len(p.metrics))
+	for name := range p.metrics {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var n int64
+	printf := func(format string, args ...any) error {
+		written, err := fmt.Fprintf(w, format, args...)
+		n += int64(written)
+		return err
+	}
+
+	for _, name := range names {
+		m := p.metrics[name]
+		if err := printf("# TYPE %s %s\n", name, m.kind); err != nil {
+			return n, err
+		}
+		if m.kind != "histogram" {
+			if err := printf("%s %s\n", name, formatFloat(m.value)); err != nil {
+				return n, err
+			}
+			continue
+		}
+
+		for b, bound := range m.buckets {
+			if err := printf("%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), m.counts[b]); err != nil {
+				return n, err
+			}
+		}
+		if err := printf("%s_bucket{le=\"+Inf\"} %d\n%s_sum %s\n%s_count %d\n", name, m.count, name, formatFloat(m.sum), name, m.count); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
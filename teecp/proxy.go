@@ -0,0 +1,167 @@
+package teecp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultRetryInterval is the wait between two connection attempts of a Proxy.
+const DefaultRetryInterval = time.Second
+
+// Proxy receives the stream of an upstream server and broadcasts it again to its
+// own clients, reconnecting to upstream whenever the connection is lost.
+type Proxy struct {
+	// Dial opens a connection to the upstream server.
+	Dial func(ctx context.Context) (net.Conn, error)
+	// Client receives the upstream stream.
+	Client Client
+	// Server broadcasts the stream downstream. Its Backlog, if set, is kept
+	// across reconnections, so downstream clients catch up with what the proxy
+	// received even while upstream is away.
+	Server Server
+	// RetryInterval is the wait between connection attempts. Zero means
+	// DefaultRetryInterval; a negative interval disables reconnection.
+	RetryInterval time.Duration
+	// MaxAttempts is how many consecutive failed attempts are made before giving
+	// up. Zero means retrying forever.
+	MaxAttempts int
+	// Passthrough makes the proxy a pure relay: every downstream connection gets
+	// its own connection to upstream and the bytes are forwarded as they are, the
+	// handshake included. On Linux the kernel moves them from socket to socket
+	// (splice), sparing the copies to userspace. Client and Server are only used
+	// for their Logger, and a downstream client is disconnected when its upstream
+	// connection is lost.
+	Passthrough bool
+}
+
+// Run serves downstream clients on ln and relays the upstream stream to them until
+// ctx is done, upstream cannot be reached anymore or, with reconnection disabled,
+// upstream closes the stream. With Passthrough, it runs until ctx is done.
+func (p *Proxy) Run(ctx context.Context, ln net.Listener) error {
+	if p.Passthrough {
+		return p.forward(ctx, ln)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	served := make(chan error, 1)
+	go func() { served <- p.Server.Serve(ctx, ln) }()
+
+	err := p.relay(ctx)
+	cancel()
+	if serveErr := <-served; err == nil && !errors.Is(serveErr, context.Canceled) {
+		err = serveErr
+	}
+	return err
+}
+
+func (p *Proxy) relay(ctx context.Context) error {
+	interval := p.RetryInterval
+	if interval == 0 {
+		interval = DefaultRetryInterval
+	}
+	logger := loggerOrDefault(p.Server.Logger)
+
+	attempts := 0
+	for {
+		conn, err := p.Dial(ctx)
+		if err == nil {
+			attempts = 0
+			logger.Info("connected to upstream", "remote", conn.RemoteAddr())
+			err = p.Client.ReceiveMessages(ctx, conn, func(m Message) error {
+				p.Server.Broadcast(m.Data)
+				return nil
+			})
+			logger.Info("disconnected from upstream", "err", err)
+		} else {
+			attempts++
+			logger.Warn("could not connect to upstream", "attempt", attempts, "err", err)
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if interval < 0 {
+			return err
+		}
+		if p.MaxAttempts > 0 && attempts >= p.MaxAttempts {
+			return fmt.Errorf("giving up on upstream after %d attempts: %w", attempts, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+// forward accepts downstream connections on ln and pairs each of them with an
+// upstream connection until ctx is done.
+func (p *Proxy) forward(ctx context.Context, ln net.Listener) error {
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		down, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("tried to connect but failed: %w", err)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.pair(ctx, down)
+		}()
+	}
+}
+
+// pair forwards the bytes between down and a new upstream connection, both ways,
+// until either side hangs up.
+func (p *Proxy) pair(ctx context.Context, down net.Conn) {
+	logger := loggerOrDefault(p.Server.Logger)
+	defer down.Close()
+
+	up, err := p.Dial(ctx)
+	if err != nil {
+		logger.Warn("could not connect to upstream", "remote", down.RemoteAddr(), "err", err)
+		return
+	}
+	defer up.Close()
+	logger.Info("relaying", "remote", down.RemoteAddr(), "upstream", up.RemoteAddr())
+
+	stop := context.AfterFunc(ctx, func() {
+		down.Close()
+		up.Close()
+	})
+	defer stop()
+
+	// io.Copy between TCP connections splices on Linux. Whichever side is done
+	// first closes both, ending the other copy.
+	done := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(up, down)
+		done <- err
+	}()
+	go func() {
+		_, err := io.Copy(down, up)
+		done <- err
+	}()
+	err = <-done
+	down.Close()
+	up.Close()
+	<-done
+	logger.Info("relay done", "remote", down.RemoteAddr(), "err", err)
+}
@@ -0,0 +1,61 @@
+package teecp
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProxyReconnectsToUpstream(t *testing.T) {
+	upstream := &Server{CoalesceDelay: -1}
+	upstreamConnected := connections(upstream)
+	upstreamLn := serve(t, upstream)
+
+	// The connections to upstream are kept for the test to cut them.
+	var mu sync.Mutex
+	var conns []net.Conn
+	p := &Proxy{
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			conn, err := upstreamLn.Dial(ctx)
+			if err == nil {
+				mu.Lock()
+				conns = append(conns, conn)
+				mu.Unlock()
+			}
+			return conn, err
+		},
+		Server:        Server{CoalesceDelay: -1},
+		RetryInterval: 10 * time.Millisecond,
+	}
+	connected := connections(&p.Server)
+	ln := Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.Run(ctx, ln)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	r := receive(t, ln, &Client{}, nil)
+	await(t, connected, 1)
+	await(t, upstreamConnected, 1)
+	upstream.BroadcastString("before\n")
+	if m := r.next(t); string(m.Data) != "before\n" {
+		t.Fatalf("got %q, want %q", m.Data, "before\n")
+	}
+
+	mu.Lock()
+	conns[0].Close()
+	mu.Unlock()
+	await(t, upstreamConnected, 1)
+	upstream.BroadcastString("after\n")
+	if m := r.next(t); string(m.Data) != "after\n" {
+		t.Fatalf("got %q, want %q", m.Data, "after\n")
+	}
+}
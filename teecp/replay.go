@@ -0,0 +1,230 @@
+package teecp
+
+import (
+	"bytes"
+	"cmp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// FeatureSince is announced by the servers replaying their backlog from a time
+// on, as asked with Hello.Since, rather than all of it: "everything since 10:42"
+// is what people ask for, not sequence numbers. Only the servers with a Backlog
+// or TopicBacklogs announce it, having nothing to replay otherwise.
+const FeatureSince Feature = "since"
+
+// ReplayBuffer keeps the last messages of a stream in a ring, so that late comers
+// can catch up. It is safe for concurrent use.
+type ReplayBuffer struct {
+	mu    sync.Mutex
+	ring  []Message
+	start int
+	len   int
+}
+
+// NewReplayBuffer returns a buffer retaining up to capacity messages.
+func NewReplayBuffer(capacity int) *ReplayBuffer {
+	return &ReplayBuffer{ring: make([]Message, capacity)}
+}
+
+// Append records a copy of m, evicting the oldest message if the buffer is full.
+func (b *ReplayBuffer) Append(m Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.ring) == 0 {
+		return
+	}
+
+	m.Data = append([]byte(nil), m.Data...)
+	if b.len < len(b.ring) {
+		b.ring[(b.start+b.len)%len(b.ring)] = m
+		b.len++
+		return
+	}
+	b.ring[b.start] = m
+	b.start = (b.start + 1) % len(b.ring)
+}
+
+// Len returns how many messages are retained.
+func (b *ReplayBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.len
+}
+
+// Snapshot returns the retained messages, oldest first.
+func (b *ReplayBuffer) Snapshot() []Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.from(0)
+}
+
+// ReplayFrom returns the retained messages whose sequence number is seq or above,
+// oldest first. It also tells if they are complete: false when messages from seq
+// on were already evicted. Sequence numbers start at 1.
+func (b *ReplayBuffer) ReplayFrom(seq uint64) ([]Message, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.len == 0 {
+		return nil, true
+	}
+
+	complete := b.at(0).Seq <= max(seq, 1)
+	for i := 0; i < b.len; i++ {
+		if b.at(i).Seq >= seq {
+			return b.from(i), complete
+		}
+	}
+	return nil, complete
+}
+
+// at returns the i-th retained message, oldest first. Callers must hold b.mu.
+func (b *ReplayBuffer) at(i int) Message {
+	return b.ring[(b.start+i)%len(b.ring)]
+}
+
+// from copies the retained messages from the i-th on. Callers must hold b.mu.
+func (b *ReplayBuffer) from(i int) []Message {
+	messages := make([]Message, 0, b.len-i)
+	for ; i < b.len; i++ {
+		messages = append(messages, b.at(i))
+	}
+	return messages
+}
+
+// backlog returns the buffer recording the messages of topic, nil if none does.
+func (s *Server) backlog(topic string) *ReplayBuffer {
+	if b, ok := s.TopicBacklogs[topic]; ok {
+		return b
+	}
+	return s.Backlog
+}
+
+// Replay returns the messages recorded by Backlog and TopicBacklogs whose
+// sequence number is from or above, oldest first, keeping the topics for which
+// keep holds, every one if keep is nil.
+func (s *Server) Replay(from uint64, keep func(topic string) bool) []Message {
+	var replay []Message
+	if s.Backlog != nil {
+		messages, _ := s.Backlog.ReplayFrom(from)
+		for _, m := range messages {
+			if keep == nil || keep(m.Topic) {
+				replay = append(replay, m)
+			}
+		}
+	}
+	sources := 0
+	for topic, b := range s.TopicBacklogs {
+		if keep != nil && !keep(topic) {
+			continue
+		}
+		messages, _ := b.ReplayFrom(from)
+		replay = append(replay, messages...)
+		sources++
+	}
+	if sources > 0 {
+		slices.SortFunc(replay, func(a, b Message) int { return cmp.Compare(a.Seq, b.Seq) })
+	}
+	return replay
+}
+
+// withBuffered appends to the replay the messages broadcast during the handshake
+// which it does not have already, keeping the topics for which keep holds.
+func withBuffered(replay, buffered []Message, keep func(topic string) bool) []Message {
+	var last uint64
+	if len(replay) > 0 {
+		last = replay[len(replay)-1].Seq
+	}
+	for _, m := range buffered {
+		if m.Seq > last && keep(m.Topic) {
+			replay = append(replay, m)
+		}
+	}
+	return replay
+}
+
+// replayedUpTo keeps the messages of the replay broadcast up to seq, those
+// broadcast later reaching the client live.
+func replayedUpTo(replay []Message, seq uint64) []Message {
+	return slices.DeleteFunc(replay, func(m Message) bool { return m.Seq > seq })
+}
+
+// catchUp queues the messages broadcast to a client while its replay is written,
+// outside the lock of the clients for a slow client not to hold the broadcast
+// back. Beyond handshakeBufferSize of them, the broadcast waits for the client
+// as it would for any slow one.
+type catchUp struct {
+	mu    sync.Mutex
+	cond  sync.Cond
+	live  bool
+	queue []Message
+}
+
+func newCatchUp() *catchUp {
+	c := &catchUp{}
+	c.cond.L = &c.mu
+	return c
+}
+
+// push queues m, reporting false, unless the client caught up already.
+func (c *catchUp) push(m Message) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for !c.live && len(c.queue) >= handshakeBufferSize {
+		c.cond.Wait()
+	}
+	if c.live {
+		return true
+	}
+	m.Data = bytes.Clone(m.Data)
+	c.queue = append(c.queue, m)
+	return false
+}
+
+// drain writes the replay then what was queued meanwhile, until nothing is left
+// and the broadcasts write on their own.
+func (c *catchUp) drain(replay []Message, write func(m Message) error) error {
+	messages := replay
+	for {
+		for _, m := range messages {
+			if err := write(m); err != nil {
+				c.giveUp()
+				return err
+			}
+		}
+		c.mu.Lock()
+		messages, c.queue = c.queue, nil
+		c.live = len(messages) == 0
+		c.cond.Broadcast()
+		c.mu.Unlock()
+		if len(messages) == 0 {
+			return nil
+		}
+	}
+}
+
+// giveUp lets the broadcasts write on their own, dropping what is queued, once
+// writing failed.
+func (c *catchUp) giveUp() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.live = true
+	c.queue = nil
+	c.cond.Broadcast()
+}
+
+// replayedSince keeps the messages of the replay broadcast at since or later,
+// all of them when since is the zero time.
+func replayedSince(replay []Message, since time.Time) []Message {
+	if since.IsZero() {
+		return replay
+	}
+	return slices.DeleteFunc(replay, func(m Message) bool { return m.Time.Before(since) })
+}
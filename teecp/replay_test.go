@@ -0,0 +1,114 @@
+package teecp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBacklogReplayWithoutGapNorDuplicate(t *testing.T) {
+	const total = 2000
+	s := &Server{CoalesceDelay: -1, Backlog: NewReplayBuffer(total)}
+	ln := serve(t, s)
+
+	// The client connects while the stream goes on: it gets the backlog, then
+	// the live stream, from the first message to the last exactly once.
+	halfway := make(chan struct{})
+	go func() {
+		for i := 1; i <= total; i++ {
+			s.BroadcastString(fmt.Sprintf("line%d\n", i))
+			if i == total/2 {
+				close(halfway)
+			}
+		}
+	}()
+	<-halfway
+	r := receive(t, ln, &Client{Features: []Feature{FeatureFramed}}, nil)
+	for want := uint64(1); want <= total; want++ {
+		m := r.next(t)
+		if m.Seq != want || string(m.Data) != fmt.Sprintf("line%d\n", want) {
+			t.Fatalf("got %d %q, want %d", m.Seq, m.Data, want)
+		}
+	}
+}
+
+func TestReplayDoesNotHoldTheBroadcastBack(t *testing.T) {
+	s := &Server{CoalesceDelay: -1, Backlog: NewReplayBuffer(10)}
+	ln := serve(t, s)
+	for i := range 3 {
+		s.BroadcastString(fmt.Sprintf("line%d\n", i))
+	}
+
+	// The client takes the first message of its replay and nothing more until
+	// released, while the stream goes on.
+	reading, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	r := receive(t, ln, &Client{Features: []Feature{FeatureFramed}}, func(Message) error {
+		once.Do(func() { close(reading) })
+		<-release
+		return nil
+	})
+	<-reading
+	broadcast := make(chan struct{})
+	go func() {
+		defer close(broadcast)
+		s.BroadcastString("line3\n")
+	}()
+	select {
+	case <-broadcast:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the broadcast waited for the replay of a slow client")
+	}
+	close(release)
+	for i := range 4 {
+		if m := r.next(t); string(m.Data) != fmt.Sprintf("line%d\n", i) {
+			t.Fatalf("got %q, want line%d", m.Data, i)
+		}
+	}
+}
+
+func TestReplaySince(t *testing.T) {
+	s := &Server{CoalesceDelay: -1, Backlog: NewReplayBuffer(10)}
+	ln := serve(t, s)
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	for i := range 3 {
+		s.publish(Message{Time: start.Add(time.Duration(i) * time.Minute), Data: fmt.Appendf(nil, "line%d\n", i)})
+	}
+
+	r := receive(t, ln, &Client{Features: []Feature{FeatureFramed}, Since: start.Add(time.Minute)}, nil)
+	for _, want := range []string{"line1\n", "line2\n"} {
+		if m := r.next(t); string(m.Data) != want {
+			t.Fatalf("got %q, want %q", m.Data, want)
+		}
+	}
+}
+
+func TestReplayBufferEvictsTheOldest(t *testing.T) {
+	b := NewReplayBuffer(3)
+	for i := uint64(1); i <= 5; i++ {
+		b.Append(Message{Seq: i})
+	}
+	messages, complete := b.ReplayFrom(2)
+	if complete || len(messages) != 3 || messages[0].Seq != 3 || messages[2].Seq != 5 {
+		t.Errorf("got %v complete %v, want 3 to 5 and a gap", messages, complete)
+	}
+	if messages, complete := b.ReplayFrom(4); !complete || len(messages) != 2 {
+		t.Errorf("got %v complete %v, want 4 and 5", messages, complete)
+	}
+}
+
+func TestSinceRefusedWithoutBacklog(t *testing.T) {
+	s := &Server{CoalesceDelay: -1}
+	ln := serve(t, s)
+	r := receive(t, ln, &Client{Features: []Feature{FeatureFramed}, Since: time.Now().Add(-time.Minute)}, nil)
+	select {
+	case err := <-r.done:
+		if !errors.Is(err, errRefused) {
+			t.Errorf("got %v, want the server refusing %s", err, FeatureSince)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the refusal")
+	}
+}
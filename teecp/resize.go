@@ -0,0 +1,44 @@
+package teecp
+
+// FeatureResize is announced by the servers running their input in a terminal,
+// and by the clients sending the size of theirs in resize frames, for the
+// terminal of the server to take the size of the one of the client controlling
+// it, as it changes.
+const FeatureResize Feature = "resize"
+
+// frameResize is the kind of the frames clients of FeatureResize send, with the
+// columns of their terminal in the upper half of the sequence number of the
+// header, its rows in the lower half, and no data.
+const frameResize = 6
+
+// TerminalSize is the size of a terminal, in characters.
+type TerminalSize struct {
+	Cols, Rows int
+}
+
+func (t TerminalSize) frame() uint64 {
+	return uint64(uint32(t.Cols))<<32 | uint64(uint32(t.Rows))
+}
+
+func terminalSizeOf(n uint64) TerminalSize {
+	return TerminalSize{Cols: int(n >> 32), Rows: int(uint32(n))}
+}
+
+// resizer hands the sizes a client of FeatureResize sends to Server.Resize,
+// when the client is the one controlling the terminal.
+func (s *Server) resizer(h *Handle) func(n uint64) {
+	var ignored bool
+	return func(n uint64) {
+		size := terminalSizeOf(n)
+		logger := loggerOrDefault(s.Logger)
+		if h.Metadata().Name != s.ResizeController {
+			if !ignored {
+				logger.Warn("terminal size ignored, not the controlling client", h.logAttrs("controller", s.ResizeController)...)
+				ignored = true
+			}
+			return
+		}
+		logger.Info("terminal resized", h.logAttrs("cols", size.Cols, "rows", size.Rows)...)
+		s.Resize(size)
+	}
+}
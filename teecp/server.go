@@ -0,0 +1,673 @@
+package teecp
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Server broadcasts an input stream to every connection it accepts.
+type Server struct {
+	// Features announced to clients during the handshake, along with the
+	// registered codecs. Announcing FeatureChecksum makes the server hash the
+	// stream, for the clients asking for it.
+	Features []Feature
+	// HandshakeTimeout is how long to wait for a client hello. Zero means
+	// DefaultHandshakeTimeout.
+	HandshakeTimeout time.Duration
+	// Logger receives what happens to the connections. Nil means slog.Default().
+	Logger *slog.Logger
+	// Metrics receives the measurements of broadcasts and connections. Nil means
+	// NopMetrics.
+	Metrics Metrics
+	// Backlog, if set, records the broadcast messages and is replayed to every new
+	// client before it gets the live stream.
+	Backlog *ReplayBuffer
+	// Acked, if set, retains the messages for the clients of FeatureAck until they
+	// acknowledge them, sending them again as they connect again.
+	Acked *AckedDelivery
+	// WindowQueue is how many messages may wait for a client of FeatureWindow out
+	// of credit. Zero means DefaultWindowQueue.
+	WindowQueue int
+	// DropSlowClients drops the messages of the clients of FeatureWindow whose
+	// queue is full, rather than waiting for them, which throttles the broadcast.
+	DropSlowClients bool
+	// TopicBacklogs, if set, record the messages of their topic instead of
+	// Backlog, for the topics whose replay needs differ from the others'. They
+	// are replayed to the clients subscribed to their topic.
+	TopicBacklogs map[string]*ReplayBuffer
+	// Multiline, if set, groups the lines written to the server into records
+	// before they go through the middlewares.
+	Multiline *Multiline
+	// CoalesceDelay is how long a message waits for the following ones before
+	// being written to a client, so that they share a single write. Zero means
+	// DefaultCoalesceDelay; a negative delay writes every message right away.
+	CoalesceDelay time.Duration
+	// ReadBufferSize is how many bytes of the input are read at once. Zero means
+	// DefaultReadBufferSize.
+	ReadBufferSize int
+	// RawInput broadcasts what is written to the server as it comes, rather than
+	// cut into lines, for the output of a terminal whose progress bars and
+	// prompts end with no newline. Multiline does not apply to it.
+	RawInput bool
+	// LongPollDuration is how long a response of ServeHTTP lasts before the client
+	// asks again. Zero means DefaultLongPollDuration.
+	LongPollDuration time.Duration
+	// AcceptMirrors announces FeatureMirror, for other servers to push their
+	// broadcast to this one with Mirror. What they push is broadcast by
+	// BroadcastMirrored.
+	AcceptMirrors bool
+	// ClusterNode, if set, names the server as a node of a cluster, announcing
+	// FeatureCluster for the other nodes to share their input with it with
+	// JoinCluster. It must be unique within the cluster.
+	ClusterNode string
+	// PauseBuffer is how many bytes of messages are held while paused, before
+	// broadcasting blocks until Resume. Zero means DefaultPauseBuffer.
+	PauseBuffer int
+	// MaxClients, if set, is how many connections the server accepts at once,
+	// clients and mirrors alike. Those beyond are closed, their hello answered
+	// with a RefusedError for the clients aware of teecp.
+	MaxClients int
+	// MaxConnsPerIP, if set, is how many of them may come from the same IP
+	// address, refused the same way beyond, so that a single host cannot take
+	// every slot.
+	MaxConnsPerIP int
+	// Resize, if set, announces FeatureResize and takes the terminal sizes sent
+	// by the client named ResizeController, for the terminal the input runs in.
+	// Those of the other clients are ignored.
+	Resize           func(size TerminalSize)
+	ResizeController string
+	// Topic is the topic of what Broadcast gets, DefaultTopic unless set. Clients
+	// receive the topics they subscribed to, see FeatureTopics.
+	Topic string
+
+	clients     Clients
+	events      events
+	lines       lineSplitter
+	records     recordGrouper
+	middlewares []Middleware
+	instruments serverMetrics
+	digest      streamDigest
+	ends        streamEnds
+	pause       pauseState
+	mirrors     mirrorState
+	cluster     clusterState
+	groups      consumerGroups
+	// publishing serializes the messages of the input with those of the other
+	// nodes of the cluster through the middlewares, and guards them.
+	publishing sync.Mutex
+
+	// chunks are the buffers the input is read into, readers read from the
+	// connections and writeBuffers hold what coalesced connections write.
+	chunks       pool[*[]byte]
+	readers      pool[*bufio.Reader]
+	writeBuffers pool[*[]byte]
+
+	mu    sync.Mutex
+	conns map[net.Conn]*Handle
+	// accounts count what is handed to the connections, for ClientStats.
+	accounts map[net.Conn]*account
+	wg       sync.WaitGroup
+}
+
+// ErrServerClosed is the disconnection reason of the clients of a server that is
+// shutting down.
+var ErrServerClosed = errors.New("server closed")
+
+// Attach adds a local receiver, such as an echo to stdout, to the server.
+func (s *Server) Attach(receiver Receiver) *Handle {
+	return s.clients.Attach(receiver)
+}
+
+// AttachMessages adds a local receiver interested in whole messages, such as a
+// sink forwarding them to another system.
+func (s *Server) AttachMessages(receiver MessageReceiver) *Handle {
+	return s.clients.AttachMessages(receiver, Metadata{})
+}
+
+// Use appends middlewares to the chain applied to every line before it is
+// broadcast. It must be called before broadcasting starts.
+func (s *Server) Use(middlewares ...Middleware) {
+	s.middlewares = append(s.middlewares, middlewares...)
+}
+
+// SetMiddlewares replaces the chain of middlewares. Unlike Use, it may be called
+// while broadcasting: the messages being broadcast go through the former chain
+// and the following ones through the new one.
+func (s *Server) SetMiddlewares(middlewares ...Middleware) {
+	s.publishing.Lock()
+	defer s.publishing.Unlock()
+
+	s.middlewares = slices.Clone(middlewares)
+}
+
+// Broadcast sends a message to every client of the server, once it went through
+// the middlewares. The clients that failed are reported in a *BroadcastError.
+// While the server is paused, the message is held instead. The other nodes of
+// its cluster, if any, get the message as it was given.
+func (s *Server) Broadcast(msg []byte) error {
+	s.share(msg)
+	return s.publish(Message{Data: msg, Topic: s.Topic})
+}
+
+// Emit broadcasts a line the middleware at index i of the chain gives on its
+// own, rather than in place of one it was given, such as the count of the
+// repeats Dedup dropped once its window is over. The line only goes through the
+// middlewares after i, and the other nodes of the cluster do not get it: their
+// own middlewares give it to them.
+func (s *Server) Emit(i int, msg []byte) error {
+	return s.publishAfter(i, Message{Data: msg, Topic: s.Topic})
+}
+
+// publish is Broadcast for a message that may already have a time, such as one
+// mirrored from another server. Its sequence number is the server's to give.
+func (s *Server) publish(m Message) error {
+	return s.publishAfter(-1, m)
+}
+
+// publishAfter is publish going through the middlewares after the one at index
+// i only.
+func (s *Server) publishAfter(i int, m Message) error {
+	s.publishing.Lock()
+	defer s.publishing.Unlock()
+
+	s.startDigest()
+	if middlewares := s.middlewares[min(i+1, len(s.middlewares)):]; len(middlewares) > 0 {
+		var ok bool
+		if m.Data, ok = applyMiddlewares(middlewares, m.Data); !ok {
+			s.metrics().dropped.Add(1)
+			return nil
+		}
+	}
+	if s.hold(m) {
+		return nil
+	}
+	return s.broadcast(m)
+}
+
+func (s *Server) broadcast(m Message) error {
+	metrics := s.metrics()
+	defer observeSince(metrics.duration, time.Now())
+	err := s.clients.broadcast(m, s.backlog(m.Topic))
+	metrics.messages.Add(1)
+	metrics.bytes.Add(float64(len(m.Data)))
+
+	var broadcastErr *BroadcastError
+	if errors.As(err, &broadcastErr) {
+		for _, f := range broadcastErr.Failures {
+			loggerOrDefault(s.Logger).Warn("broadcast failed", f.Handle.logAttrs("seq", broadcastErr.Seq, "err", f.Err)...)
+		}
+	}
+	return err
+}
+
+// BroadcastString is the string flavor of Broadcast, kept for compatibility.
+func (s *Server) BroadcastString(msg string) error {
+	return s.Broadcast([]byte(msg))
+}
+
+// Write implements io.Writer, broadcasting every complete line of p, or every
+// complete record with Multiline, or p as it is with RawInput. Like
+// Clients.Write, failing clients are not an error of Write.
+func (s *Server) Write(p []byte) (int, error) {
+	if s.RawInput {
+		s.Broadcast(p)
+		return len(p), nil
+	}
+	return s.lines.write(p, s.group)
+}
+
+// Flush broadcasts the partial line kept by Write, and the current record, if any.
+func (s *Server) Flush() {
+	s.lines.flush(s.group)
+	s.records.flush(s.Broadcast)
+}
+
+// group broadcasts the line, or hands it to the current record with Multiline.
+func (s *Server) group(line []byte) error {
+	if s.Multiline == nil {
+		return s.Broadcast(line)
+	}
+	s.records.add(line, s.Multiline, s.Broadcast)
+	return nil
+}
+
+func applyMiddlewares(middlewares []Middleware, msg []byte) ([]byte, bool) {
+	line, newline := bytes.CutSuffix(msg, []byte("\n"))
+	for _, m := range middlewares {
+		var ok bool
+		if line, ok = m(line); !ok {
+			return nil, false
+		}
+	}
+	if newline {
+		line = append(line, '\n')
+	}
+	return line, true
+}
+
+// Serve accepts connections from ln until ctx is done or ln fails. The listener
+// and every accepted connection are closed when Serve returns.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+	defer s.closeConns()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("tried to connect but failed: %w", err)
+		}
+
+		if delay := cmp.Or(s.CoalesceDelay, DefaultCoalesceDelay); delay > 0 {
+			conn = newCoalescedConn(conn, delay, &s.writeBuffers, &s.metrics().pool)
+		}
+		var refusal string
+		switch all, fromIP := s.track(conn); {
+		case s.MaxClients > 0 && all > s.MaxClients:
+			refusal = "too many clients"
+		case s.MaxConnsPerIP > 0 && fromIP > s.MaxConnsPerIP:
+			refusal = "too many connections from your address"
+		}
+		// What is broadcast during the handshake is kept for the client, for it to
+		// get the stream from the time it connected.
+		var buffered *handshakeBuffer
+		if refusal == "" {
+			buffered = s.clients.buffer()
+		}
+		s.wg.Add(1)
+		// The handshake waits for the client hello, so do it away from the accept loop.
+		go func() {
+			defer s.wg.Done()
+			if refusal != "" {
+				s.refuse(conn, refusal)
+				return
+			}
+			s.attachConn(conn, buffered)
+		}()
+	}
+}
+
+// BroadcastFrom broadcasts everything read from r until EOF or until ctx is done.
+// A last line without a trailing newline is broadcast as well.
+func (s *Server) BroadcastFrom(ctx context.Context, r io.Reader) error {
+	chunks := make(chan *[]byte)
+	errs := make(chan error, 1)
+	metrics := &s.metrics().pool
+
+	// Reads cannot be interrupted in general (think of stdin), so read on the side
+	// and stop waiting for it once ctx is done. The chunks are recycled once
+	// written: nothing keeps them around.
+	go func() {
+		for {
+			chunk := s.chunks.get(metrics, newBuffer(cmp.Or(s.ReadBufferSize, DefaultReadBufferSize)))
+			n, err := r.Read((*chunk)[:cap(*chunk)])
+			if n > 0 {
+				*chunk = (*chunk)[:n]
+				select {
+				case chunks <- chunk:
+				case <-ctx.Done():
+					return
+				}
+			} else {
+				s.chunks.put(chunk)
+			}
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case chunk := <-chunks:
+			s.Write(*chunk)
+			s.chunks.put(chunk)
+		case err := <-errs:
+			s.Flush()
+			if errors.Is(err, io.EOF) {
+				// What a pause holds is part of the stream.
+				if err := s.awaitResume(ctx); err != nil {
+					return err
+				}
+				s.endStream(EndEOF)
+				return nil
+			}
+			return fmt.Errorf("error reading input: %w", err)
+		}
+	}
+}
+
+func (s *Server) attachConn(conn net.Conn, buffered *handshakeBuffer) {
+	defer s.clients.release(buffered)
+
+	timeout := s.HandshakeTimeout
+	if timeout == 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+
+	reader := s.readers.get(&s.metrics().pool, newReader(0))
+	reader.Reset(conn)
+	defer func() {
+		reader.Reset(nil)
+		s.readers.put(reader)
+	}()
+
+	features := append(s.Features[:len(s.Features):len(s.Features)], FeatureStreamEnd, FeatureTopics, FeatureGroups, FeatureWindow)
+	if s.Backlog != nil || len(s.TopicBacklogs) > 0 {
+		features = append(features, FeatureSince)
+	}
+	if s.Acked != nil {
+		features = append(features, FeatureAck)
+	}
+	if s.AcceptMirrors {
+		features = append(features, FeatureMirror)
+	}
+	if s.ClusterNode != "" {
+		features = append(features, FeatureCluster)
+	}
+	if s.Resize != nil {
+		features = append(features, FeatureResize)
+	}
+	hello := LocalHello(append(features, CodecFeatures()...)...)
+	caps, remote, err := serverHandshake(conn, reader, hello, timeout)
+	if err != nil {
+		loggerOrDefault(s.Logger).Warn("handshake failed", "remote", conn.RemoteAddr(), "err", err)
+		s.drop(conn)
+		return
+	}
+	if caps.Has(FeatureMirror) {
+		s.receiveMirror(conn, reader, caps)
+		return
+	}
+	if caps.Has(FeatureCluster) {
+		s.receiveCluster(conn, reader, caps, remote)
+		return
+	}
+
+	// Add the connection as a client.
+	enc := CodecFor(caps).NewEncoder(conn)
+	acct := &account{}
+	meta := Metadata{RemoteAddr: conn.RemoteAddr(), Capabilities: caps, Name: remote.Name, Labels: remote.Labels}
+	if caps.Has(FeatureTopics) {
+		meta.Topics = remote.Subscribe
+	}
+	if caps.Has(FeatureGroups) {
+		meta.Group = remote.Group
+	}
+	keep := func(topic string) bool { return Subscribed(meta.Topics, topic) }
+	// The clients acknowledging what they receive are known by their name, and
+	// share the messages with the members of their group otherwise.
+	var acks *ackLog
+	var firstAcked bool
+	if caps.Has(FeatureAck) && remote.Name != "" && meta.Group == "" {
+		acks, firstAcked = s.Acked.log(s, remote.Name, meta.Topics)
+	}
+	// The clients granting credit get their messages from a queue of their own.
+	var win *window
+	if caps.Has(FeatureWindow) {
+		win = newWindow(cmp.Or(s.WindowQueue, DefaultWindowQueue), s.DropSlowClients)
+	}
+	// Only where the replay stops is settled while attaching, as nothing is
+	// broadcast meanwhile: the replay is written afterwards, and the messages
+	// broadcast in between queued, for the client to get the backlog and then the
+	// live stream without gap nor duplicate, and without holding the broadcast
+	// back. The members of a group only share the live stream.
+	var cut uint64
+	var handshake []Message
+	var catching *catchUp
+	if win == nil {
+		catching = newCatchUp()
+	}
+	h := s.clients.attach(meta, func(h *Handle) MessageReceiver {
+		cut = s.clients.lastSeq
+		// The members of a group take their turns from now on only.
+		if meta.Group == "" {
+			handshake = s.clients.unbuffer(buffered)
+		}
+		if win != nil {
+			return func(m Message) error {
+				if keep(m.Topic) && s.hasTurn(h, m.Seq) {
+					win.push(m)
+				}
+				return nil
+			}
+		}
+
+		return func(m Message) error {
+			if !keep(m.Topic) || !s.hasTurn(h, m.Seq) || !catching.push(m) {
+				return nil
+			}
+			if err := acct.encode(enc, m); err != nil {
+				// We are inside the broadcast: returning the error detaches the handle.
+				s.metrics().errors.Add(1)
+				s.events.broadcastFailed(h, err)
+				if s.drop(conn) != nil {
+					s.disconnected(h, err)
+				}
+				return err
+			}
+			return nil
+		}
+	})
+	var replay []Message
+	switch {
+	case acks != nil:
+		replay = s.ackedReplay(acks, firstAcked, keep)
+	case meta.Group == "" && caps.Has(FeatureSince):
+		replay = replayedSince(s.Replay(0, keep), remote.Since)
+	case meta.Group == "":
+		replay = s.Replay(0, keep)
+	}
+	if meta.Group == "" {
+		replay = withBuffered(replayedUpTo(replay, cut), handshake, keep)
+	}
+	if win != nil {
+		win.preload(replay)
+	} else {
+		// The failure shows again on the first broadcast.
+		catching.drain(replay, enc.Encode)
+	}
+
+	s.mu.Lock()
+	_, open := s.conns[conn]
+	if open {
+		s.conns[conn] = h
+		if s.accounts == nil {
+			s.accounts = make(map[net.Conn]*account)
+		}
+		s.accounts[conn] = acct
+	}
+	s.mu.Unlock()
+	if end, ok := enc.(endEncoder); ok && open && (caps.Has(FeatureChecksum) || caps.Has(FeatureStreamEnd)) {
+		s.onEnd(conn, func(sum []byte, reason string) error {
+			if !caps.Has(FeatureChecksum) {
+				sum = nil
+			}
+			if !caps.Has(FeatureStreamEnd) {
+				reason = ""
+			}
+			if sum == nil && reason == "" {
+				return nil
+			}
+			if win != nil {
+				// The end comes after what is queued, which may be much more than
+				// what the connection holds back once closed.
+				win.finish(func() error {
+					err := end.encodeEnd(sum, reason)
+					closeWrite(conn)
+					return err
+				}, func() { conn.SetWriteDeadline(time.Now()) })
+				return nil
+			}
+			return end.encodeEnd(sum, reason)
+		})
+		defer s.onEnd(conn, nil)
+	}
+
+	if !open {
+		// Closed during the handshake, either by a failed broadcast or by the server.
+		h.Detach()
+		return
+	}
+	s.connected(h)
+	if win != nil {
+		defer win.close()
+		go func() {
+			err := win.run(func(m Message) error { return acct.encode(enc, m) }, func(n uint64) error {
+				loggerOrDefault(s.Logger).Warn("client lagging, messages dropped", h.logAttrs("dropped", n)...)
+				return acct.encode(enc, droppedMarker(n))
+			})
+			if err != nil {
+				s.metrics().errors.Add(1)
+				s.events.broadcastFailed(h, err)
+				if s.drop(conn) != nil {
+					h.Detach()
+					s.disconnected(h, err)
+				}
+			}
+		}()
+	}
+
+	// Clients are not expected to talk after the handshake, but for their acks,
+	// credit and terminal sizes, and reading is how we notice them hanging up.
+	resizing := s.Resize != nil && caps.Has(FeatureResize)
+	if acks != nil || win != nil || resizing {
+		var ack, grant, resize func(n uint64)
+		if acks != nil {
+			ack = acks.ack
+		}
+		if win != nil {
+			grant = win.grant
+		}
+		if resizing {
+			resize = s.resizer(h)
+		}
+		if err = readClientFrames(reader, ack, grant, resize); errors.Is(err, io.EOF) {
+			err = nil
+		}
+		if win != nil {
+			win.hangUp()
+		}
+	} else {
+		_, err = io.Copy(io.Discard, reader)
+	}
+	if s.drop(conn) != nil {
+		h.Detach()
+		s.disconnected(h, err)
+	}
+}
+
+func (s *Server) connected(h *Handle) {
+	loggerOrDefault(s.Logger).Info("client connected", h.logAttrs("codec", CodecFor(h.Metadata().Capabilities).Feature())...)
+	s.metrics().connections.Add(1)
+	s.metrics().clients.Add(1)
+	s.events.clientConnect(h)
+	s.joinGroup(h)
+}
+
+func (s *Server) disconnected(h *Handle, err error) {
+	s.leaveGroup(h)
+	loggerOrDefault(s.Logger).Info("client disconnected", h.logAttrs("err", err)...)
+	s.metrics().clients.Add(-1)
+	s.events.clientDisconnect(h, err)
+}
+
+// track records the connection, returning how many there are with it, in all
+// and from its IP address. Connections without one, such as those of a pipe,
+// are not counted by address.
+func (s *Server) track(conn net.Conn) (all, fromIP int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]*Handle)
+	}
+	s.conns[conn] = nil
+	if ip := remoteIP(conn); ip != nil && s.MaxConnsPerIP > 0 {
+		for c := range s.conns {
+			if other := remoteIP(c); other != nil && other.Equal(ip) {
+				fromIP++
+			}
+		}
+	}
+	return len(s.conns), fromIP
+}
+
+// remoteIP is the IP address of the peer of conn, nil if not a TCP one.
+func remoteIP(conn net.Conn) net.IP {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// refuse closes the connection, once the client, if aware of teecp, is told why.
+func (s *Server) refuse(conn net.Conn, reason string) {
+	defer s.drop(conn)
+	loggerOrDefault(s.Logger).Warn("client refused", "remote", conn.RemoteAddr(), "reason", reason)
+
+	reader := s.readers.get(&s.metrics().pool, newReader(0))
+	reader.Reset(conn)
+	defer func() {
+		reader.Reset(nil)
+		s.readers.put(reader)
+	}()
+	if err := refuseHandshake(conn, reader, reason, cmp.Or(s.HandshakeTimeout, DefaultHandshakeTimeout)); err != nil {
+		loggerOrDefault(s.Logger).Debug("could not tell the client it is refused", "remote", conn.RemoteAddr(), "err", err)
+	}
+}
+
+// drop forgets and closes the connection. It returns the handle of the connection
+// only the first time it is dropped after being attached.
+func (s *Server) drop(conn net.Conn) *Handle {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.conns[conn]
+	delete(s.conns, conn)
+	delete(s.accounts, conn)
+	conn.Close()
+	return h
+}
+
+func (s *Server) closeConns() {
+	// Nothing is sent to the clients that already got the end of the stream.
+	s.endStream(EndShutdown)
+	s.closePause()
+	s.closeMirrors()
+	if s.Acked != nil {
+		defer s.Acked.close()
+	}
+
+	s.mu.Lock()
+	conns := s.conns
+	s.conns = nil
+	s.accounts = nil
+	s.mu.Unlock()
+
+	for conn, h := range conns {
+		conn.Close()
+		if h != nil {
+			h.Detach()
+			s.disconnected(h, ErrServerClosed)
+		}
+	}
+
+	s.wg.Wait()
+}
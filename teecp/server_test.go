@@ -0,0 +1,265 @@
+package teecp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serve starts s on an in-memory listener, stopped with the test.
+func serve(t *testing.T, s *Server) *PipeListener {
+	t.Helper()
+	ln := Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Serve(ctx, ln)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return ln
+}
+
+// connections returns a channel getting the clients of s as they connect.
+func connections(s *Server) <-chan *Handle {
+	connected := make(chan *Handle, 64)
+	s.OnClientConnect(func(h *Handle) { connected <- h })
+	return connected
+}
+
+// receiver is a client of a test server.
+type receiver struct {
+	messages chan Message
+	done     chan error
+	cancel   context.CancelFunc
+}
+
+// receive connects c to ln, collecting what it receives on the side until the
+// stream is over, or receive fails, or the test is.
+func receive(t *testing.T, ln *PipeListener, c *Client, onReceive func(m Message) error) *receiver {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	conn, err := ln.Dial(ctx)
+	if err != nil {
+		cancel()
+		t.Fatal(err)
+	}
+	conn = buffered(conn)
+	r := &receiver{messages: make(chan Message, 1024), done: make(chan error, 1), cancel: cancel}
+	go func() {
+		defer close(r.messages)
+		r.done <- c.ReceiveMessages(ctx, conn, func(m Message) error {
+			if onReceive != nil {
+				if err := onReceive(m); err != nil {
+					return err
+				}
+			}
+			m.Data = bytes.Clone(m.Data)
+			r.messages <- m
+			return nil
+		})
+	}()
+	t.Cleanup(cancel)
+	return r
+}
+
+// bufferedConn queues what is written to its connection, as the buffers of a
+// socket would: the connections of Pipe are synchronous, where a client writing
+// its acks or credit would wait for the server writing to it otherwise.
+type bufferedConn struct {
+	net.Conn
+	mu      sync.Mutex
+	cond    sync.Cond
+	pending []byte
+	err     error
+	closed  bool
+}
+
+func buffered(conn net.Conn) net.Conn {
+	c := &bufferedConn{Conn: conn}
+	c.cond.L = &c.mu
+	go c.flush()
+	return c
+}
+
+func (c *bufferedConn) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		for len(c.pending) == 0 && !c.closed {
+			c.cond.Wait()
+		}
+		if c.closed {
+			return
+		}
+		p := c.pending
+		c.pending = nil
+		c.mu.Unlock()
+		_, err := c.Conn.Write(p)
+		c.mu.Lock()
+		if err != nil {
+			c.err = err
+			return
+		}
+	}
+}
+
+func (c *bufferedConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.pending = append(c.pending, p...)
+	c.cond.Signal()
+	return len(p), nil
+}
+
+func (c *bufferedConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.cond.Signal()
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// next returns the next message received, failing the test after a while.
+func (r *receiver) next(t *testing.T) Message {
+	t.Helper()
+	select {
+	case m, ok := <-r.messages:
+		if !ok {
+			t.Fatalf("stream over early: %v", <-r.done)
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+	}
+	return Message{}
+}
+
+// all returns what is received until the stream is over.
+func (r *receiver) all(t *testing.T) []string {
+	t.Helper()
+	var lines []string
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case m, ok := <-r.messages:
+			if !ok {
+				if err := <-r.done; err != nil {
+					t.Fatalf("receive failed: %v", err)
+				}
+				return lines
+			}
+			lines = append(lines, string(m.Data))
+		case <-timeout:
+			t.Fatalf("timed out waiting for the end of the stream, got %q", lines)
+		}
+	}
+}
+
+// broadcastAll broadcasts the lines and ends the stream, as at the end of the
+// input.
+func broadcastAll(t *testing.T, s *Server, lines ...string) {
+	t.Helper()
+	if err := s.BroadcastFrom(context.Background(), strings.NewReader(strings.Join(lines, ""))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// await waits for n clients to connect.
+func await(t *testing.T, connected <-chan *Handle, n int) []*Handle {
+	t.Helper()
+	handles := make([]*Handle, n)
+	for i := range handles {
+		select {
+		case handles[i] = <-connected:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for client %d to connect", i+1)
+		}
+	}
+	return handles
+}
+
+// eventually waits for cond to hold, failing the test after a while.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPlainClientGetsWhatIsBroadcastDuringHandshake(t *testing.T) {
+	s := &Server{CoalesceDelay: -1}
+	ln := serve(t, s)
+	s.BroadcastString("before\n")
+
+	conn, err := ln.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	eventually(t, "the connection to be accepted", func() bool {
+		s.clients.mu.Lock()
+		defer s.clients.mu.Unlock()
+		return len(s.clients.buffers) == 1
+	})
+
+	// The plain client sends no hello: the server waits for it all along.
+	for i := range 3 {
+		s.BroadcastString(fmt.Sprintf("line%d\n", i))
+	}
+	r := bufio.NewReader(conn)
+	for i := range 3 {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("line%d\n", i); line != want {
+			t.Fatalf("got %q, want %q", line, want)
+		}
+	}
+	eventually(t, "the buffer to be released", func() bool {
+		s.clients.mu.Lock()
+		defer s.clients.mu.Unlock()
+		return len(s.clients.buffers) == 0
+	})
+}
+
+func TestHelloWithoutNewlineTimesOut(t *testing.T) {
+	s := &Server{CoalesceDelay: -1, HandshakeTimeout: 50 * time.Millisecond}
+	ln := serve(t, s)
+	conn, err := ln.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go conn.Write([]byte(helloPrefix))
+
+	// The server hangs up, releasing what it kept for the client.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("got %v, want the server hanging up", err)
+	}
+	eventually(t, "the buffer to be released", func() bool {
+		s.clients.mu.Lock()
+		defer s.clients.mu.Unlock()
+		return len(s.clients.buffers) == 0
+	})
+}
@@ -0,0 +1,165 @@
+package teecp
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ClientStats is what a server measured of a connected client, to find the ones
+// slowing the fan-out down: a broadcast waits for every client to take the
+// message.
+type ClientStats struct {
+	ID          uint64
+	RemoteAddr  net.Addr
+	ConnectedAt time.Time
+	// Codec is the Feature of the codec of the connection, empty for PlainCodec.
+	Codec Feature
+	// Name and Labels are those the client announced in its Hello, if any.
+	Name   string
+	Labels map[string]string
+	// Messages and Bytes were handed to the connection, Bytes counting the data of
+	// the messages.
+	Messages uint64
+	Bytes    uint64
+	// Queued is how many bytes wait to be written to the connection.
+	Queued int
+	// LastSeq is the sequence number of the last message handed to the
+	// connection, and Behind how many messages were broadcast since.
+	LastSeq uint64
+	Behind  uint64
+	// Lag is how long ago the message being handed to the connection was
+	// broadcast, zero when none is.
+	Lag time.Duration
+}
+
+// account counts what is handed to a connection. Being updated for every message
+// of every client, it does not read the clock.
+type account struct {
+	messages atomic.Uint64
+	bytes    atomic.Uint64
+	lastSeq  atomic.Uint64
+	// writing is the time of the message being encoded, in nanoseconds since the
+	// Unix epoch, zero when none is.
+	writing atomic.Int64
+}
+
+func (a *account) encode(enc Encoder, m Message) error {
+	a.writing.Store(m.Time.UnixNano())
+	err := enc.Encode(m)
+	a.writing.Store(0)
+	if err == nil {
+		a.messages.Add(1)
+		a.bytes.Add(uint64(len(m.Data)))
+		a.lastSeq.Store(m.Seq)
+	}
+	return err
+}
+
+// ClientStats returns the measurements of the connected clients, by ID.
+func (s *Server) ClientStats() []ClientStats {
+	head := s.clients.head.Load()
+	now := time.Now()
+
+	s.mu.Lock()
+	stats := make([]ClientStats, 0, len(s.accounts))
+	for conn, a := range s.accounts {
+		h := s.conns[conn]
+		if h == nil {
+			continue
+		}
+		meta := h.Metadata()
+		st := ClientStats{
+			ID:          h.ID(),
+			RemoteAddr:  meta.RemoteAddr,
+			ConnectedAt: meta.ConnectedAt,
+			Codec:       CodecFor(meta.Capabilities).Feature(),
+			Name:        meta.Name,
+			Labels:      meta.Labels,
+			Messages:    a.messages.Load(),
+			Bytes:       a.bytes.Load(),
+			LastSeq:     a.lastSeq.Load(),
+		}
+		if c, ok := conn.(*coalescedConn); ok {
+			st.Queued = int(c.held.Load())
+		}
+		if head > st.LastSeq {
+			st.Behind = head - st.LastSeq
+		}
+		if writing := a.writing.Load(); writing != 0 {
+			st.Lag = now.Sub(time.Unix(0, writing))
+		}
+		stats = append(stats, st)
+	}
+	s.mu.Unlock()
+
+	slices.SortFunc(stats, func(a, b ClientStats) int { return cmp.Compare(a.ID, b.ID) })
+	return stats
+}
+
+// LastBroadcast returns the time of the last message broadcast, the zero time
+// when none was yet.
+func (s *Server) LastBroadcast() time.Time {
+	if t := s.clients.headTime.Load(); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
+}
+
+// WriteClientStats writes the measurements of the clients in the Prometheus text
+// exposition format, labeled with the ID, address, name and labels of each
+// client, to follow what PrometheusMetrics writes.
+func WriteClientStats(w io.Writer, stats []ClientStats) error {
+	series := []struct {
+		name, kind string
+		value      func(st ClientStats) float64
+	}{
+		{MetricClientMessages, "counter", func(st ClientStats) float64 { return float64(st.Messages) }},
+		{MetricClientBytes, "counter", func(st ClientStats) float64 { return float64(st.Bytes) }},
+		{MetricClientQueued, "gauge", func(st ClientStats) float64 { return float64(st.Queued) }},
+		{MetricClientBehind, "gauge", func(st ClientStats) float64 { return float64(st.Behind) }},
+		{MetricClientLag, "gauge", func(st ClientStats) float64 { return st.Lag.Seconds() }},
+	}
+	for _, s := range series {
+		if _, err := fmt.Fprintf(w, "# TYPE %s %s\n", s.name, s.kind); err != nil {
+			return err
+		}
+		for _, st := range stats {
+			if _, err := fmt.Fprintf(w, "%s{%s} %s\n", s.name, clientLabels(st), formatFloat(s.value(st))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func clientLabels(st ClientStats) string {
+	remote := ""
+	if st.RemoteAddr != nil {
+		remote = st.RemoteAddr.String()
+	}
+	labels := fmt.Sprintf(`id="%d",remote="%s"`, st.ID, labelEscaper.Replace(remote))
+	if st.Name != "" {
+		labels += fmt.Sprintf(`,name="%s"`, labelEscaper.Replace(st.Name))
+	}
+	keys := make([]string, 0, len(st.Labels))
+	for k := range st.Labels {
+		// Those of the client cannot replace ours.
+		if k != "id" && k != "remote" && k != "name" {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		labels += fmt.Sprintf(`,%s="%s"`, k, labelEscaper.Replace(st.Labels[k]))
+	}
+	return labels
+}
+
+// labelEscaper escapes label values as the exposition format wants.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
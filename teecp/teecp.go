@@ -1,40 +1,407 @@
 package teecp
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ErrInactive is the delivery error of a receiver that reported itself as no longer
+// active.
+var ErrInactive = errors.New("receiver is no longer active")
+
 // Clients maintains a slice of receivers for teecp.
 type Clients struct {
 	mu        sync.Mutex
-	receivers []Receiver
+	receivers []*Handle
+	lastID    uint64
+	lastSeq   uint64
+	// head is lastSeq, readable while a broadcast holds mu, and headTime the
+	// time of that message, in nanoseconds since the Unix epoch.
+	head     atomic.Uint64
+	headTime atomic.Int64
+	// buffers collect the messages for the connections still negotiating.
+	buffers map[*handshakeBuffer]struct{}
+
+	lines lineSplitter
 }
 
 // Broadcast sends a message to every knwon receiver. If the receiver is no longer active,
-// it is removed from the slice.
-func (c *Clients) Broadcast(msg string) {
+// it is removed from the slice. The receivers that failed are reported in a
+// *BroadcastError.
+func (c *Clients) Broadcast(msg []byte) error {
+	return c.BroadcastMessage(Message{Data: msg})
+}
+
+// BroadcastMessage is like Broadcast with the whole message. A message without
+// sequence number gets the one following the last broadcast and a message without
+// time gets the current time.
+func (c *Clients) BroadcastMessage(m Message) error {
+	return c.broadcast(m, nil)
+}
+
+// broadcast records the message in backlog, if any, before sending it, so that the
+// backlog is consistent with what attached receivers got.
+func (c *Clients) broadcast(m Message, backlog *ReplayBuffer) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	for i := 0; i < len(c.receivers); i++ {
-		r := c.receivers[i]
+	if m.Seq == 0 {
+		m.Seq = c.lastSeq + 1
+	}
+	c.lastSeq = m.Seq
+	c.head.Store(m.Seq)
+	if m.Time.IsZero() {
+		m.Time = time.Now()
+	}
+	c.headTime.Store(m.Time.UnixNano())
+	if backlog != nil {
+		backlog.Append(m)
+	}
+	for b := range c.buffers {
+		b.add(m)
+	}
+
+	failures := c.deliver(m)
+	for _, f := range failures {
+		c.removeHandle(f.Handle)
+	}
+
+	if failures != nil {
+		return &BroadcastError{Seq: m.Seq, Failures: failures}
+	}
+	return nil
+}
+
+// fanoutShardSize is how many receivers justify a goroutine of their own during a
+// broadcast.
+const fanoutShardSize = 256
+
+// deliver hands m to every receiver and returns the failed deliveries. Many
+// receivers, such as thousands of mostly idle clients, are split into shards
+// delivered in parallel, so that the broadcast takes about as long as the
+// slowest shard. Callers must hold c.mu.
+func (c *Clients) deliver(m Message) []Delivery {
+	workers := min(runtime.GOMAXPROCS(0), len(c.receivers)/fanoutShardSize)
+	if workers <= 1 {
+		return deliverTo(c.receivers, m)
+	}
+
+	shards := make([][]Delivery, workers)
+	size := (len(c.receivers) + workers - 1) / workers
+	var wg sync.WaitGroup
+	for w := range shards {
+		handles := c.receivers[w*size : min((w+1)*size, len(c.receivers))]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shards[w] = deliverTo(handles, m)
+		}()
+	}
+	wg.Wait()
+	return slices.Concat(shards...)
+}
+
+func deliverTo(handles []*Handle, m Message) []Delivery {
+	var failures []Delivery
+	for _, h := range handles {
+		if err := h.receive(m); err != nil {
+			failures = append(failures, Delivery{Handle: h, Err: err})
+		}
+	}
+	return failures
+}
+
+// Delivery is the failed delivery of a message to a receiver.
+type Delivery struct {
+	Handle *Handle
+	Err    error
+}
+
+// BroadcastError lists the receivers a message could not be delivered to. They
+// are detached.
+type BroadcastError struct {
+	Seq      uint64
+	Failures []Delivery
+}
+
+func (e *BroadcastError) Error() string {
+	reasons := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		reasons[i] = fmt.Sprintf("client %d: %s", f.Handle.ID(), f.Err)
+	}
+	return fmt.Sprintf("could not deliver message %d to %d clients: %s", e.Seq, len(e.Failures), strings.Join(reasons, "; "))
+}
 
-		if !r(msg) {
-			// Replace the current receive with the last one in the slice and reset the index.
-			// This allows for in-place replacement.
-			c.receivers[i] = c.receivers[len(c.receivers)-1]
-			c.receivers = c.receivers[:len(c.receivers)-1]
-			i--
+// remove drops the i-th receiver. Callers must hold c.mu.
+func (c *Clients) remove(i int) {
+	// Replace the current receive with the last one in the slice, allowing for in-place
+	// replacement. The freed slot is cleared so the dead closure can be collected.
+	last := len(c.receivers) - 1
+	c.receivers[i].detached = true
+	c.receivers[i] = c.receivers[last]
+	c.receivers[last] = nil
+	c.receivers = c.receivers[:last]
+}
+
+// removeHandle drops the receiver h, if still there. Callers must hold c.mu.
+func (c *Clients) removeHandle(h *Handle) {
+	for i, r := range c.receivers {
+		if r == h {
+			c.remove(i)
+			return
 		}
 	}
 }
 
+// BroadcastString is the string flavor of Broadcast, kept for compatibility.
+func (c *Clients) BroadcastString(msg string) error {
+	return c.Broadcast([]byte(msg))
+}
+
+// Write implements io.Writer: p is split into lines and every complete line is
+// broadcast. A trailing partial line is kept until a later Write completes it or
+// until Flush is called. Failing receivers are detached but are not an error of
+// Write, so an io.Copy is not stopped by a client going away.
+func (c *Clients) Write(p []byte) (int, error) {
+	return c.lines.write(p, c.Broadcast)
+}
+
+// Flush broadcasts the partial line kept by Write, if any.
+func (c *Clients) Flush() {
+	c.lines.flush(c.Broadcast)
+}
+
 // Attach adds a receiver as a client.
-func (c *Clients) Attach(receiver Receiver) {
+func (c *Clients) Attach(receiver Receiver) *Handle {
+	return c.AttachWith(receiver, Metadata{})
+}
+
+// AttachWith adds a receiver as a client, describing it with meta. A zero
+// ConnectedAt is set to the current time.
+func (c *Clients) AttachWith(receiver Receiver, meta Metadata) *Handle {
+	return c.AttachMessages(adaptReceiver(receiver), meta)
+}
+
+// AttachMessages adds a receiver interested in whole messages as a client.
+func (c *Clients) AttachMessages(receiver MessageReceiver, meta Metadata) *Handle {
+	return c.attach(meta, func(*Handle) MessageReceiver { return receiver })
+}
+
+// adaptReceiver turns a Receiver telling if it is active into a MessageReceiver.
+func adaptReceiver(receiver Receiver) MessageReceiver {
+	return func(m Message) error {
+		if !receiver(m.Data) {
+			return ErrInactive
+		}
+		return nil
+	}
+}
+
+// attach builds the receiver from its own handle, so it can refer to it when
+// receiving. No broadcast happens while building.
+func (c *Clients) attach(meta Metadata, build func(h *Handle) MessageReceiver) *Handle {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if meta.ConnectedAt.IsZero() {
+		meta.ConnectedAt = time.Now()
+	}
+
+	c.lastID++
+	h := &Handle{id: c.lastID, meta: meta, clients: c}
+	h.receive = build(h)
+	c.receivers = append(c.receivers, h)
+	return h
+}
+
+// handshakeBufferSize is how many messages are kept for a connection during its
+// handshake, the older ones being dropped beyond.
+const handshakeBufferSize = 8192
+
+// handshakeBuffer keeps the messages broadcast while a connection negotiates,
+// which a plain client waits the whole DefaultHandshakeTimeout for, so that it
+// gets them once attached rather than starting with a gap. It is guarded by the
+// mu of its Clients.
+type handshakeBuffer struct {
+	messages []Message
+}
+
+func (b *handshakeBuffer) add(m Message) {
+	if len(b.messages) == handshakeBufferSize {
+		b.messages = slices.Delete(b.messages, 0, 1)
+	}
+	m.Data = bytes.Clone(m.Data)
+	b.messages = append(b.messages, m)
+}
+
+// buffer starts keeping the messages broadcast from now on for a connection.
+func (c *Clients) buffer() *handshakeBuffer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b := &handshakeBuffer{}
+	if c.buffers == nil {
+		c.buffers = make(map[*handshakeBuffer]struct{})
+	}
+	c.buffers[b] = struct{}{}
+	return b
+}
+
+// unbuffer stops keeping messages in b, returning those kept. Callers must hold
+// c.mu, as while attaching.
+func (c *Clients) unbuffer(b *handshakeBuffer) []Message {
+	delete(c.buffers, b)
+	messages := b.messages
+	b.messages = nil
+	return messages
+}
+
+// release stops keeping messages in b, for a connection not attached in the end.
+func (c *Clients) release(b *handshakeBuffer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.unbuffer(b)
+}
+
+// Len returns the number of attached receivers.
+func (c *Clients) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.receivers)
+}
+
+// Metadata describes an attached receiver.
+type Metadata struct {
+	// RemoteAddr is the address of the peer, nil for local receivers.
+	RemoteAddr net.Addr
+	// ConnectedAt is when the receiver was attached.
+	ConnectedAt time.Time
+	// Capabilities are what was negotiated with the peer, if anything.
+	Capabilities Capabilities
+	// Name and Labels are those the peer announced in its Hello, if any.
+	Name   string
+	Labels map[string]string
+	// Topics are those the peer subscribed to, none meaning DefaultTopic.
+	Topics []string
+	// Group is the consumer group of the peer, if any, see FeatureGroups.
+	Group string
+}
+
+// Handle identifies an attached receiver.
+type Handle struct {
+	id      uint64
+	meta    Metadata
+	receive MessageReceiver
+	clients *Clients
+	// detached is guarded by clients.mu.
+	detached bool
+}
+
+// ID returns the identifier of the receiver, unique within its Clients.
+func (h *Handle) ID() uint64 {
+	return h.id
+}
+
+// Metadata returns the description given when the receiver was attached.
+func (h *Handle) Metadata() Metadata {
+	return h.meta
+}
+
+// logAttrs identify the receiver in logs, by its address and by the name,
+// labels and group it announced, followed by attrs.
+func (h *Handle) logAttrs(attrs ...any) []any {
+	id := []any{"id", h.id, "remote", h.meta.RemoteAddr}
+	if h.meta.Name != "" {
+		id = append(id, "name", h.meta.Name)
+	}
+	if len(h.meta.Labels) > 0 {
+		id = append(id, "labels", h.meta.Labels)
+	}
+	if h.meta.Group != "" {
+		id = append(id, "group", h.meta.Group)
+	}
+	return append(id, attrs...)
+}
+
+// Detach removes the receiver from its Clients. Detaching twice, or detaching a
+// receiver that already reported itself inactive, does nothing. A receiver must not
+// detach itself while receiving: it returns false instead.
+func (h *Handle) Detach() {
+	c := h.clients
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.receivers = append(c.receivers, receiver)
+	if !h.detached {
+		c.removeHandle(h)
+	}
+}
+
+// Receiver gets every broadcast message and tells if it is still active. The message
+// is only valid during the call: a receiver must copy it to keep it around.
+// Different receivers may be called concurrently, but a receiver gets one message
+// at a time.
+type Receiver func(msg []byte) bool
+
+// lineSplitter cuts a byte stream into lines, keeping a partial line between writes.
+type lineSplitter struct {
+	mu      sync.Mutex
+	pending []byte
 }
 
-type Receiver func(msg string) bool
+// write calls emit for every line completed by p, newline included. Errors of emit
+// are ignored.
+func (l *lineSplitter) write(p []byte, emit func(line []byte) error) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			l.pending = append(l.pending, p...)
+			break
+		}
+
+		line := p[:i+1]
+		if len(l.pending) > 0 {
+			line = append(l.pending, line...)
+			l.pending = l.pending[:0]
+		}
+		emit(line)
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// flush calls emit with the partial line, if any.
+func (l *lineSplitter) flush(emit func(line []byte) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.pending) > 0 {
+		emit(l.pending)
+		l.pending = l.pending[:0]
+	}
+}
+
+// MessageReceiver is like Receiver, getting the sequence number and time of the
+// message along with its data. Returning an error detaches the receiver and
+// reports the error to the broadcaster.
+type MessageReceiver func(m Message) error
+
+// StringReceiver adapts a receiver written against the former string API.
+func StringReceiver(receiver func(msg string) bool) Receiver {
+	return func(msg []byte) bool {
+		return receiver(string(msg))
+	}
+}
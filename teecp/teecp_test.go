@@ -0,0 +1,100 @@
+package teecp
+
+import (
+	"fmt"
+	"runtime"
+	"sync/atomic"
+	"testing"
+)
+
+// idleReceivers attaches n receivers checking that they get every message in
+// order, returning how many each got.
+func idleReceivers(t testing.TB, c *Clients, n int) []*atomic.Uint64 {
+	counts := make([]*atomic.Uint64, n)
+	for i := range counts {
+		count := &atomic.Uint64{}
+		counts[i] = count
+		c.AttachMessages(func(m Message) error {
+			if got := count.Add(1); got != m.Seq {
+				return fmt.Errorf("got message %d as the %dth", m.Seq, got)
+			}
+			return nil
+		}, Metadata{})
+	}
+	return counts
+}
+
+func TestBroadcastToThousandsOfReceivers(t *testing.T) {
+	// Enough workers for the receivers to be sharded, on any machine.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	const receivers, messages = 8 * fanoutShardSize, 200
+	var c Clients
+	counts := idleReceivers(t, &c, receivers)
+
+	for range messages {
+		if err := c.Broadcast([]byte("line\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, count := range counts {
+		if got := count.Load(); got != messages {
+			t.Fatalf("receiver %d got %d messages, want %d", i, got, messages)
+		}
+	}
+	if c.Len() != receivers {
+		t.Fatalf("%d receivers left, want %d", c.Len(), receivers)
+	}
+}
+
+func TestShardsAreDeliveredConcurrently(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	// The first receiver, of the first shard, takes its time: the receivers of
+	// the other shards get the message meanwhile.
+	var c Clients
+	release := make(chan struct{})
+	c.AttachMessages(func(Message) error {
+		<-release
+		return nil
+	}, Metadata{})
+	counts := idleReceivers(t, &c, 8*fanoutShardSize-1)
+
+	broadcast := make(chan error, 1)
+	go func() { broadcast <- c.Broadcast([]byte("line\n")) }()
+	eventually(t, "the other shards to get the message", func() bool {
+		for _, count := range counts[fanoutShardSize:] {
+			if count.Load() != 1 {
+				return false
+			}
+		}
+		return true
+	})
+	close(release)
+	if err := <-broadcast; err != nil {
+		t.Fatal(err)
+	}
+	for i, count := range counts {
+		if got := count.Load(); got != 1 {
+			t.Fatalf("receiver %d got %d messages, want 1", i+1, got)
+		}
+	}
+}
+
+// BenchmarkBroadcast reports the time of a broadcast per receiver, which stays
+// flat as receivers are sharded across workers.
+func BenchmarkBroadcast(b *testing.B) {
+	for _, receivers := range []int{16, fanoutShardSize, 16 * fanoutShardSize, 64 * fanoutShardSize} {
+		b.Run(fmt.Sprintf("receivers=%d", receivers), func(b *testing.B) {
+			var c Clients
+			idleReceivers(b, &c, receivers)
+			msg := []byte("line\n")
+			b.ResetTimer()
+			for range b.N {
+				c.Broadcast(msg)
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*receivers), "ns/receiver")
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package teecp
+
+import (
+	"bytes"
+	"io"
+	"text/template"
+	"time"
+)
+
+// Record is what a Template formats.
+type Record struct {
+	// Seq is the sequence number of the message.
+	Seq uint64
+	// Time is when the message was broadcast.
+	Time time.Time
+	// Timestamp is Time formatted as RFC 3339 with milliseconds.
+	Timestamp string
+	// Tag is the tag of the stream, if any.
+	Tag string
+	// Topic is the topic of the message, empty for DefaultTopic.
+	Topic string
+	// Line is the line without its trailing newline.
+	Line string
+}
+
+// Template formats messages with a text/template executed on their Record, e.g.
+// {{.Timestamp}} [{{.Tag}}] {{.Line}}.
+type Template struct {
+	tmpl *template.Template
+	tag  string
+}
+
+// NewTemplate parses text, tag being the Tag of every record. The template is
+// tried on an empty record, so that referring to an unknown field is an error.
+func NewTemplate(text, tag string) (*Template, error) {
+	tmpl, err := template.New("line").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(io.Discard, Record{}); err != nil {
+		return nil, err
+	}
+	return &Template{tmpl: tmpl, tag: tag}, nil
+}
+
+// Format returns the message formatted by the template, ending with a newline.
+func (t *Template) Format(m Message) ([]byte, error) {
+	line := bytes.TrimSuffix(m.Data, []byte("\n"))
+	r := Record{
+		Seq:       m.Seq,
+		Time:      m.Time,
+		Timestamp: m.Time.Format("2006-01-02T15:04:05.000Z07:00"),
+		Tag:       t.tag,
+		Topic:     m.Topic,
+		Line:      string(line),
+	}
+
+	var b bytes.Buffer
+	if err := t.tmpl.Execute(&b, r); err != nil {
+		return nil, err
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+// Apply returns a receiver handing the messages formatted by the template to
+// receive.
+func (t *Template) Apply(receive MessageReceiver) MessageReceiver {
+	return func(m Message) error {
+		data, err := t.Format(m)
+		if err != nil {
+			return err
+		}
+		m.Data = data
+		return receive(m)
+	}
+}
+
+// NormalizeNewlines returns a receiver handing the messages to receive with their
+// line endings, CRLF or LF, replaced by ending.
+func NormalizeNewlines(ending string, receive MessageReceiver) MessageReceiver {
+	replacement := []byte(ending)
+	return func(m Message) error {
+		data := bytes.ReplaceAll(m.Data, []byte("\r\n"), []byte("\n"))
+		if ending != "\n" {
+			data = bytes.ReplaceAll(data, []byte("\n"), replacement)
+		}
+		m.Data = data
+		return receive(m)
+	}
+}
@@ -0,0 +1,37 @@
+package teecp
+
+import "path"
+
+// FeatureTopics is announced by the peers aware of topics: servers carrying
+// several independent streams in one broadcast, and clients subscribing to some
+// of them with Hello.Subscribe. Peers without it only know DefaultTopic.
+const FeatureTopics Feature = "topics"
+
+// DefaultTopic is the topic of the messages of the plain protocol, and the one
+// clients subscribing to none receive.
+const DefaultTopic = ""
+
+// Subscribed tells if a client subscribed to topics receives the messages of
+// topic. Topics may be patterns of path.Match, such as build/* for every topic
+// of the build family, including the ones appearing after subscribing.
+func Subscribed(topics []string, topic string) bool {
+	if len(topics) == 0 {
+		return topic == DefaultTopic
+	}
+	for _, pattern := range topics {
+		if pattern == topic {
+			return true
+		}
+		if matched, _ := path.Match(pattern, topic); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidTopicPattern tells if pattern may be subscribed to, being a topic or a
+// well-formed pattern of path.Match.
+func ValidTopicPattern(pattern string) bool {
+	_, err := path.Match(pattern, "")
+	return pattern != "" && err == nil
+}
@@ -0,0 +1,34 @@
+package teecp
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTopicsOverPipe(t *testing.T) {
+	s := &Server{CoalesceDelay: -1}
+	connected := connections(s)
+	ln := serve(t, s)
+	builds := receive(t, ln, &Client{Features: []Feature{FeatureFramed}, Subscribe: []string{"build/*"}}, nil)
+	unsubscribed := receive(t, ln, &Client{Features: []Feature{FeatureFramed}}, nil)
+	await(t, connected, 2)
+
+	for _, m := range []Message{
+		{Topic: "build/linux", Data: []byte("compiling\n")},
+		{Topic: "deploy", Data: []byte("deploying\n")},
+		{Data: []byte("default\n")},
+		{Topic: "build/darwin", Data: []byte("linking\n")},
+	} {
+		if err := s.publish(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	broadcastAll(t, s)
+
+	if got, want := builds.all(t), []string{"compiling\n", "linking\n"}; !slices.Equal(got, want) {
+		t.Errorf("subscribed to build/*: got %q, want %q", got, want)
+	}
+	if got, want := unsubscribed.all(t), []string{"default\n"}; !slices.Equal(got, want) {
+		t.Errorf("subscribed to none: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,251 @@
+package teecp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// FeatureWindow is announced by the clients granting the server credit, in
+// window frames holding how many more messages they can take. A server sends a
+// client of FeatureWindow no more than it was granted, queueing the rest for
+// it, rather than relying on the TCP buffers alone: a slow client takes its time
+// without holding the broadcast back until its queue is full.
+const FeatureWindow Feature = "window"
+
+// DefaultWindowQueue is how many messages may wait for a client of FeatureWindow
+// out of credit.
+const DefaultWindowQueue = 8192
+
+// windowEndTimeout bounds how long the end of the stream waits for a client of
+// FeatureWindow to take what is queued for it.
+const windowEndTimeout = 10 * time.Second
+
+// frameWindow is the kind of the frames clients of FeatureWindow send, granting
+// the number of messages of the sequence number of the header, with no data.
+const frameWindow = 5
+
+// window queues the messages of a client of FeatureWindow, written to it on the
+// side as it grants credit.
+type window struct {
+	mu   sync.Mutex
+	cond sync.Cond
+	// max is how many messages may be queued, beyond which they are dropped
+	// with drop, and the broadcast waits for the client otherwise.
+	max    int
+	drop   bool
+	credit uint64
+	queue  []queued
+	// ending, once set, writes the end of the stream after the queue, whatever
+	// the credit left. closed stops the writes and done is closed once they did.
+	ending func() error
+	closed bool
+	done   chan struct{}
+	// hungUp is closed once the client is gone.
+	hungUp chan struct{}
+}
+
+// queued is a message waiting for credit, or the count of those dropped where
+// they would have been.
+type queued struct {
+	m       Message
+	dropped uint64
+}
+
+func newWindow(max int, drop bool) *window {
+	w := &window{max: max, drop: drop, done: make(chan struct{}), hungUp: make(chan struct{})}
+	w.cond.L = &w.mu
+	return w
+}
+
+// preload queues the messages of a replay, before the live ones queued already.
+func (w *window) preload(messages []Message) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	replay := make([]queued, 0, len(messages)+len(w.queue))
+	for _, m := range messages {
+		replay = append(replay, queued{m: m})
+	}
+	w.queue = append(replay, w.queue...)
+}
+
+// push queues m, a message being broadcast, waiting for room in the queue unless
+// dropping it.
+func (w *window) push(m Message) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for len(w.queue) >= w.max && !w.closed {
+		if w.drop {
+			// The dropped messages are counted where they would have been, past
+			// the end of the queue if need be.
+			if last := len(w.queue) - 1; w.queue[last].dropped > 0 {
+				w.queue[last].dropped++
+			} else {
+				w.queue = append(w.queue, queued{dropped: 1})
+			}
+			return
+		}
+		w.cond.Wait()
+	}
+	if w.closed {
+		return
+	}
+	m.Data = bytes.Clone(m.Data)
+	w.queue = append(w.queue, queued{m: m})
+	w.cond.Broadcast()
+}
+
+// grant gives the credit of n more messages.
+func (w *window) grant(n uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.credit += n
+	w.cond.Broadcast()
+}
+
+// finish writes the end of the stream once the queue is written, and waits for
+// the client to hang up, calling stop to interrupt the writes once
+// windowEndTimeout is over. Closing the connection while the client still grants
+// credit would reset it, losing what the client did not read yet.
+func (w *window) finish(end func() error, stop func()) {
+	w.mu.Lock()
+	w.ending = end
+	w.cond.Broadcast()
+	w.mu.Unlock()
+
+	timeout := time.NewTimer(windowEndTimeout)
+	defer timeout.Stop()
+	select {
+	case <-w.done:
+	case <-timeout.C:
+		stop()
+		<-w.done
+		return
+	}
+	select {
+	case <-w.hungUp:
+	case <-timeout.C:
+	}
+}
+
+// hangUp tells that the client is gone.
+func (w *window) hangUp() {
+	close(w.hungUp)
+}
+
+// close stops the writes, once the client is gone.
+func (w *window) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.closed = true
+	w.cond.Broadcast()
+}
+
+// run writes the queue as credit is granted, telling dropped about the messages
+// dropped where they would have been, until the end of the stream is written,
+// the window is closed or a write fails.
+func (w *window) run(write func(m Message) error, dropped func(n uint64) error) error {
+	defer close(w.done)
+	defer w.close()
+
+	for {
+		w.mu.Lock()
+		for !w.closed && !(len(w.queue) > 0 && (w.credit > 0 || w.ending != nil)) && !(len(w.queue) == 0 && w.ending != nil) {
+			w.cond.Wait()
+		}
+		if w.closed {
+			w.mu.Unlock()
+			return nil
+		}
+		if len(w.queue) == 0 {
+			end := w.ending
+			w.mu.Unlock()
+			return end()
+		}
+		q := w.queue[0]
+		w.queue = w.queue[1:]
+		if w.credit > 0 {
+			w.credit--
+		}
+		w.cond.Broadcast()
+		w.mu.Unlock()
+
+		var err error
+		if q.dropped > 0 {
+			err = dropped(q.dropped)
+		} else {
+			err = write(q.m)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// closeWrite closes the writing side of conn, if it can be, for the client to
+// see the end of the stream while the server still reads it.
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(*coalescedConn); ok {
+		c.flush()
+		conn = c.Conn
+	}
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	}
+}
+
+// readClientFrames hands what clients send after the handshake, the sequence
+// numbers of their ack frames to ack, the credit of their window frames to grant
+// and the terminal sizes of their resize frames to resize, until r fails. Any
+// may be nil when not negotiated.
+func readClientFrames(r io.Reader, ack, grant, resize func(n uint64)) error {
+	var header [framedHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return err
+		}
+		// These frames have no data, but later versions may add some.
+		if _, err := io.CopyN(io.Discard, r, int64(binary.BigEndian.Uint32(header[17:]))); err != nil {
+			return noEOF(err)
+		}
+		n := binary.BigEndian.Uint64(header[1:])
+		switch {
+		case header[0] == frameAck && ack != nil:
+			ack(n)
+		case header[0] == frameWindow && grant != nil:
+			grant(n)
+		case header[0] == frameResize && resize != nil:
+			resize(n)
+		default:
+			return fmt.Errorf("unexpected frame kind %d from client", header[0])
+		}
+	}
+}
+
+// writeClientFrame writes a frame of a client, with n as sequence number.
+func writeClientFrame(w io.Writer, kind byte, n uint64) error {
+	var header [framedHeaderSize]byte
+	header[0] = kind
+	binary.BigEndian.PutUint64(header[1:], n)
+	_, err := w.Write(header[:])
+	return err
+}
+
+// droppedMarker is the message taking the place of the n messages dropped for a
+// client, for it to know that what it got is incomplete. It has no sequence
+// number of its own.
+func droppedMarker(n uint64) Message {
+	unit := "lines"
+	if n == 1 {
+		unit = "line"
+	}
+	return Message{Time: time.Now(), Data: fmt.Appendf(nil, "[teecp: dropped %d %s]\n", n, unit)}
+}
@@ -0,0 +1,75 @@
+package teecp
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWindowDeliversInOrder(t *testing.T) {
+	const total = 500
+	s := &Server{CoalesceDelay: -1, WindowQueue: 16}
+	connected := connections(s)
+	ln := serve(t, s)
+	r := receive(t, ln, &Client{Features: []Feature{FeatureFramed}, Window: 4}, nil)
+	if h := await(t, connected, 1)[0]; !h.Metadata().Capabilities.Has(FeatureWindow) {
+		t.Fatalf("%s not negotiated", FeatureWindow)
+	}
+
+	var lines []string
+	for i := range total {
+		lines = append(lines, fmt.Sprintf("line%d\n", i))
+	}
+	broadcastAll(t, s, lines...)
+	got := r.all(t)
+	if len(got) != total {
+		t.Fatalf("got %d messages, want %d", len(got), total)
+	}
+	for i, line := range got {
+		if line != lines[i] {
+			t.Fatalf("got %q as message %d, want %q", line, i, lines[i])
+		}
+	}
+}
+
+var droppedLines = regexp.MustCompile(`^\[teecp: dropped (\d+) lines?\]\n$`)
+
+func TestWindowDropsForSlowClients(t *testing.T) {
+	const total = 100
+	s := &Server{CoalesceDelay: -1, WindowQueue: 3, DropSlowClients: true}
+	connected := connections(s)
+	ln := serve(t, s)
+	gate := make(chan struct{})
+	r := receive(t, ln, &Client{Features: []Feature{FeatureFramed}, Window: 1}, func(Message) error {
+		<-gate
+		return nil
+	})
+	await(t, connected, 1)
+
+	// The broadcast goes on while the client takes nothing.
+	for i := range total {
+		if err := s.BroadcastString(fmt.Sprintf("line%d\n", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(gate)
+	broadcastAll(t, s)
+
+	var received, dropped int
+	for _, line := range r.all(t) {
+		if match := droppedLines.FindStringSubmatch(line); match != nil {
+			n, _ := strconv.Atoi(match[1])
+			dropped += n
+			continue
+		}
+		if !strings.HasPrefix(line, "line") {
+			t.Fatalf("unexpected message %q", line)
+		}
+		received++
+	}
+	if dropped == 0 || received+dropped != total {
+		t.Errorf("got %d messages and %d dropped, want %d in all, some dropped", received, dropped, total)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsHandshakeTimeout is how long the TLS handshake of a connection may take.
+const tlsHandshakeTimeout = 5 * time.Second
+
+// selfSignedValidity is how long the certificate made up by --tls alone is
+// valid, longer than any run.
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// serverTLS returns the TLS configuration of a server, with the certificate of
+// --tls-cert and --tls-key, or with a certificate made up for the run when there
+// is none, whose fingerprint clients pin with --pin-sha256.
+func serverTLS(certFile, keyFile string) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	switch {
+	case certFile != "" && keyFile != "":
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	case certFile != "" || keyFile != "":
+		return nil, errors.New("--tls-cert and --tls-key go together")
+	default:
+		if cert, err = selfSigned(); err == nil {
+			fmt.Fprintln(os.Stderr, "serving a self-signed certificate, clients pin it with --pin-sha256", fingerprint(cert.Certificate[0]))
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not load the certificate: %w", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// newACME returns the manager of the certificates of the domains, which it gets
+// from Let's Encrypt as they are first needed and renews before they expire,
+// keeping them in cacheDir. Servers hand its TLSConfig to their listeners.
+func newACME(domains []string, cacheDir string) (*autocert.Manager, error) {
+	if cacheDir == "" {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, fmt.Errorf("no directory to keep the certificates in, set --acme-cache: %w", err)
+		}
+		cacheDir = filepath.Join(dir, "teecp", "acme")
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+	}, nil
+}
+
+// selfSigned makes up a certificate for the host and the loopback addresses.
+func selfSigned() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "teecp"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(selfSignedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname != "" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// fingerprint is the SHA-256 of a certificate, as printed by
+// openssl x509 -noout -fingerprint -sha256.
+func fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hexSum := strings.ToUpper(hex.EncodeToString(sum[:]))
+	pairs := make([]string, 0, len(sum))
+	for i := 0; i < len(hexSum); i += 2 {
+		pairs = append(pairs, hexSum[i:i+2])
+	}
+	return strings.Join(pairs, ":")
+}
+
+// pinFlag parses the SHA-256 of a certificate, in hexadecimal with or without
+// colons.
+func pinFlag(pins *[][]byte) func(s string) error {
+	return func(s string) error {
+		pin, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+		if err != nil || len(pin) != sha256.Size {
+			return errors.New("expected the SHA-256 of the certificate in hexadecimal, e.g. from openssl x509 -noout -fingerprint -sha256")
+		}
+		*pins = append(*pins, pin)
+		return nil
+	}
+}
+
+// clientTLS returns the TLS configuration of a client connecting to serverName.
+// With pins, the certificate of the server is accepted when it is one of them,
+// whoever signed it and whatever it is for, and refused otherwise.
+func clientTLS(serverName string, pins [][]byte) *tls.Config {
+	config := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	if len(pins) == 0 {
+		return config
+	}
+	// The pins replace the usual verification.
+	config.InsecureSkipVerify = true
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("the server sent no certificate")
+		}
+		sum := sha256.Sum256(rawCerts[0])
+		for _, pin := range pins {
+			if bytes.Equal(pin, sum[:]) {
+				return nil
+			}
+		}
+		return fmt.Errorf("the certificate of the server is not pinned, its SHA-256 is %s", fingerprint(rawCerts[0]))
+	}
+	return config
+}
+
+// withServerName returns config verifying the certificate against host, unless
+// it already names the server.
+func withServerName(config *tls.Config, host string) *tls.Config {
+	if config.ServerName != "" {
+		return config
+	}
+	config = config.Clone()
+	config.ServerName = host
+	return config
+}
+
+// tlsServer and tlsClient complete the TLS handshake on conn, the server being
+// the accepting side, and return the TLS connection.
+func tlsServer(config *tls.Config) func(conn net.Conn) (net.Conn, error) {
+	return func(conn net.Conn) (net.Conn, error) {
+		return handshake(tls.Server(conn, config))
+	}
+}
+
+func tlsClient(conn net.Conn, config *tls.Config) (net.Conn, error) {
+	c, err := handshake(tls.Client(conn, config))
+	if err != nil {
+		conn.Close()
+	}
+	return c, err
+}
+
+func handshake(conn *tls.Conn) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake: %w", err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/jeffque/teecp/teecp"
+	"golang.org/x/net/websocket"
+)
+
+// webPage is the viewer served by --web, streaming the broadcast from /ws.
+//
+//go:embed web/index.html
+var webPage []byte
+
+// webQueue is how many messages may wait for a viewer. A viewer lagging further
+// is disconnected, and reconnects on its own.
+const webQueue = 1024
+
+var errViewerLagging = errors.New("viewer lagging behind")
+
+// webHandler serves the viewer of the broadcast of server, the backlog first. The
+// viewer gets DefaultTopic, or the topics of ?subscribe=a,b as a client
+// subscribing to them would.
+func webHandler(server *teecp.Server, logger *slog.Logger) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(webPage)
+	})
+	mux.Handle("/ws", websocket.Server{
+		Handshake: sameOrigin,
+		Handler: func(ws *websocket.Conn) {
+			remote := ws.Request().RemoteAddr
+			logger.Info("viewer connected", "remote", remote)
+			var topics []string
+			if subscribe := ws.Request().URL.Query().Get("subscribe"); subscribe != "" {
+				topics = strings.Split(subscribe, ",")
+			}
+			err := streamWeb(ws, server, topics)
+			logger.Info("viewer disconnected", "remote", remote, "err", err)
+		},
+	})
+	return mux
+}
+
+// sameOrigin only lets the viewer page itself open the stream, not the pages of
+// other sites the browser visits.
+func sameOrigin(config *websocket.Config, r *http.Request) error {
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	if err != nil || origin.Host != r.Host {
+		return fmt.Errorf("cross-origin request from %q", r.Header.Get("Origin"))
+	}
+	config.Origin = origin
+	return nil
+}
+
+// streamWeb sends the messages of topics to the viewer, one JSON envelope per
+// frame, until it goes away. The messages of the backlog may be sent twice, the viewer skipping
+// those it already has.
+func streamWeb(ws *websocket.Conn, server *teecp.Server, topics []string) error {
+	keep := func(topic string) bool { return teecp.Subscribed(topics, topic) }
+	queue := make(chan teecp.Message, webQueue)
+	lagging := make(chan struct{})
+	h := server.AttachMessages(func(m teecp.Message) error {
+		if !keep(m.Topic) {
+			return nil
+		}
+		m.Data = bytes.Clone(m.Data)
+		select {
+		case queue <- m:
+			return nil
+		default:
+			close(lagging)
+			return errViewerLagging
+		}
+	})
+	defer h.Detach()
+
+	// Every write is a frame of its own.
+	enc := teecp.JSONCodec{}.NewEncoder(ws)
+	for _, m := range server.Replay(0, keep) {
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+	}
+
+	// The viewer is not expected to talk, but reading is how we notice it leaving.
+	gone := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, ws)
+		gone <- err
+	}()
+	for {
+		select {
+		case m := <-queue:
+			if err := enc.Encode(m); err != nil {
+				return err
+			}
+		case <-lagging:
+			return errViewerLagging
+		case err := <-gone:
+			return err
+		}
+	}
+}